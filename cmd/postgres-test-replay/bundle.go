@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/backup"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/bundle"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func newBundleManager(cfg *config.Config, metadata store.Store) *bundle.Manager {
+	checkpointMgr := checkpoint.NewManager(cfg, metadata)
+	if err := checkpointMgr.Load(); err != nil {
+		log.Fatalf("Failed to load checkpoints: %v", err)
+	}
+	sessionMgr := session.NewManager(cfg, metadata)
+	if err := sessionMgr.Load(); err != nil {
+		log.Fatalf("Failed to load sessions: %v", err)
+	}
+	checkpointNav := checkpoint.NewNavigator(wal.NewLogReader(cfg.Storage.WALLogPath), checkpointMgr)
+
+	return bundle.NewManager(cfg, sessionMgr, checkpointMgr, checkpointNav, backup.NewBackupManager(cfg))
+}
+
+func runExport(cfg *config.Config, sessionID, outPath string, opts bundle.ExportOptions) {
+	metadata := openStore(cfg)
+	defer metadata.Close()
+	bundles := newBundleManager(cfg, metadata)
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		log.Fatalf("Failed to create bundle file: %v", err)
+	}
+	defer out.Close()
+
+	manifest, err := bundles.Export(context.Background(), out, sessionID, opts)
+	if err != nil {
+		out.Close()
+		os.Remove(outPath)
+		log.Fatalf("Failed to export session: %v", err)
+	}
+
+	log.Printf("Exported session %s with %d checkpoints and %d log files to %s",
+		manifest.Session.Name, len(manifest.Checkpoints), len(manifest.WAL), outPath)
+	if manifest.Backup != nil {
+		log.Printf("Included backup %s", manifest.Backup.Path)
+	}
+}
+
+func runImport(cfg *config.Config, inPath string) {
+	metadata := openStore(cfg)
+	defer metadata.Close()
+	bundles := newBundleManager(cfg, metadata)
+
+	in, err := os.Open(inPath)
+	if err != nil {
+		log.Fatalf("Failed to open bundle: %v", err)
+	}
+	defer in.Close()
+
+	imported, err := bundles.Import(in)
+	if err != nil {
+		log.Fatalf("Failed to import bundle: %v", err)
+	}
+
+	log.Printf("Imported session %s as %s with %d checkpoints", imported.Session.Name, imported.Session.ID, len(imported.Checkpoints))
+	if imported.Backup != "" {
+		log.Printf("Restored backup %s", imported.Backup)
+	}
+}
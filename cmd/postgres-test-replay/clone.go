@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/clone"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// runClone creates a clone database at a checkpoint and prints its DSN.
+// The clone is dropped by the IPC server's reaper once its TTL runs out,
+// or by the next clone created after that.
+func runClone(cfg *config.Config, opts clone.Options) {
+	log.Printf("Cloning %s at checkpoint %s...", cfg.ReplicaDB.Database, opts.CheckpointID)
+
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
+	checkpointMgr := checkpoint.NewManager(cfg, metadata)
+	if err := checkpointMgr.Load(); err != nil {
+		log.Fatalf("Failed to load checkpoints: %v", err)
+	}
+	if _, err := checkpointMgr.GetCheckpoint(opts.CheckpointID); err != nil {
+		log.Fatalf("Clone failed: %v", err)
+	}
+
+	checkpointNav := checkpoint.NewNavigator(wal.NewLogReader(cfg.Storage.WALLogPath), checkpointMgr)
+	replayer := session.NewReplayer(cfg)
+	cloneMgr := clone.NewManager(cfg, checkpointNav, replayer)
+
+	replayOpts, err := replayer.DefaultOptions()
+	if err != nil {
+		log.Fatalf("Clone failed: %v", err)
+	}
+	created, _, err := cloneMgr.Create(context.Background(), nil, opts, replayOpts)
+	if err != nil {
+		log.Fatalf("Clone failed: %v", err)
+	}
+
+	log.Printf("Replayed %d entries into %s, which expires at %s", created.EntriesApplied, created.Name, created.ExpiresAt.Format("2006-01-02 15:04:05"))
+	fmt.Println(created.DSN)
+}
+
+func runDropClone(cfg *config.Config, name string) {
+	cloneMgr := clone.NewManager(cfg, nil, nil)
+	if err := cloneMgr.Drop(context.Background(), clone.CloneName(name)); err != nil {
+		log.Fatalf("Drop failed: %v", err)
+	}
+	log.Printf("Dropped clone %s", clone.CloneName(name))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func runDiff(cfg *config.Config, fromID, toID, format, outPath string) {
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
+	checkpointMgr := checkpoint.NewManager(cfg, metadata)
+	if err := checkpointMgr.Load(); err != nil {
+		log.Fatalf("Failed to load checkpoints: %v", err)
+	}
+	checkpointNav := checkpoint.NewNavigator(wal.NewLogReader(cfg.Storage.WALLogPath), checkpointMgr)
+
+	changes, err := checkpointNav.Diff(fromID, toID)
+	if err != nil {
+		log.Fatalf("Failed to diff checkpoints: %v", err)
+	}
+
+	out := os.Stdout
+	if outPath != "" && outPath != "-" {
+		out, err = os.Create(outPath)
+		if err != nil {
+			log.Fatalf("Failed to create diff file: %v", err)
+		}
+		defer out.Close()
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(changes)
+	case "text":
+		err = changes.WriteText(out)
+	default:
+		log.Fatalf("Unknown format %q: use text or json", format)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write diff: %v", err)
+	}
+}
@@ -12,11 +12,17 @@ import (
 	"time"
 
 	"github.com/ivikasavnish/postgres-test-replay/pkg/backup"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/bundle"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/clone"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/ipc"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/jobs"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/mask"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/materialize"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/replication"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
 )
 
@@ -24,10 +30,32 @@ func main() {
 	var (
 		envPath    = flag.String("env", ".env", "Path to .env file")
 		configPath = flag.String("config", "", "Path to configuration file (optional, overrides .env)")
-		mode       = flag.String("mode", "listener", "Mode: listener, ipc, backup, restore")
+		mode       = flag.String("mode", "listener", "Mode: listener, ipc, backup, restore, mask, tail, query, materialize, script, diff, verify, clone, export, import, recover, repair")
 		addr       = flag.String("addr", "", "IPC server address (optional, overrides config)")
-		backupName = flag.String("backup", "", "Backup file name for restore mode")
+		backupName = flag.String("backup", "", "Backup file name for restore, materialize and export modes")
+		newBackup  = flag.Bool("new-backup", false, "Take a new backup of the primary to include in export mode")
 		targetDB   = flag.String("target-db", "", "Target database for restore")
+		outPath    = flag.String("out", "", "Output path for mask, script, diff and export modes")
+		inPath     = flag.String("in", "", "Bundle to read in import mode")
+		sessionID  = flag.String("session", "", "Session ID for export mode")
+		storeName  = flag.String("store", "checkpoints", "File to recover in recover mode: sessions or checkpoints")
+		version    = flag.Int("version", 0, "Journal version to restore in recover mode (lists versions when unset)")
+		tables     = flag.String("table", "", "Comma-separated tables to show in tail mode or compare in verify mode")
+		ops        = flag.String("op", "", "Comma-separated operations to show in tail mode")
+		fromStart  = flag.Bool("from-start", false, "Tail from the start of the WAL log instead of the end")
+		queryExpr  = flag.String("q", "", "Filter expression for query mode")
+		limit      = flag.Int("limit", 100, "Maximum number of entries to print in query mode")
+		offset     = flag.Int("offset", 0, "Number of matching entries to skip in query mode")
+		cpID       = flag.String("checkpoint", "", "Checkpoint ID for materialize, script, diff and clone modes")
+		fromCPID   = flag.String("from-checkpoint", "", "Start checkpoint ID for script and diff modes (optional)")
+		kind       = flag.String("kind", "database", "Materialize into, or verify against, a database or schema")
+		name       = flag.String("name", "", "Name of the materialized database, schema or clone (optional; in verify mode, compare against it instead of the primary)")
+		srcSchema  = flag.String("source-schema", "", "Schema restored from the backup in schema mode (default public)")
+		drop       = flag.Bool("drop", false, "Drop the materialized database, schema or clone given by -name")
+		template   = flag.String("template", "", "Baseline database to copy in clone mode (default CLONE_TEMPLATE)")
+		ttl        = flag.String("ttl", "", "How long a clone lives, such as 2h (default CLONE_TTL)")
+		format     = flag.String("format", "text", "Output format for diff mode: text or json")
+		dryRun     = flag.Bool("dry-run", false, "Report what repair mode would fix without changing anything")
 	)
 	flag.Parse()
 
@@ -52,11 +80,94 @@ func main() {
 			log.Fatal("backup and target-db flags are required for restore mode")
 		}
 		runRestore(cfg, *backupName, *targetDB)
+	case "mask":
+		if *outPath == "" {
+			log.Fatal("out flag is required for mask mode")
+		}
+		runMask(cfg, *outPath)
+	case "tail":
+		runTail(cfg, *tables, *ops, *fromStart)
+	case "query":
+		runQuery(cfg, *queryExpr, *offset, *limit)
+	case "materialize":
+		if *drop {
+			if *name == "" {
+				log.Fatal("name flag is required to drop a materialized copy")
+			}
+			runDropMaterialized(cfg, materialize.Kind(*kind), *name)
+			return
+		}
+		if *cpID == "" {
+			log.Fatal("checkpoint flag is required for materialize mode")
+		}
+		runMaterialize(cfg, materialize.Options{
+			CheckpointID: *cpID,
+			BackupFile:   *backupName,
+			Kind:         materialize.Kind(*kind),
+			Name:         *name,
+			SourceSchema: *srcSchema,
+		})
+	case "script":
+		if *cpID == "" {
+			log.Fatal("checkpoint flag is required for script mode")
+		}
+		runScript(cfg, *fromCPID, *cpID, *outPath)
+	case "diff":
+		if *cpID == "" {
+			log.Fatal("checkpoint flag is required for diff mode")
+		}
+		runDiff(cfg, *fromCPID, *cpID, *format, *outPath)
+	case "clone":
+		if *drop {
+			if *name == "" {
+				log.Fatal("name flag is required to drop a clone")
+			}
+			runDropClone(cfg, *name)
+			return
+		}
+		if *cpID == "" {
+			log.Fatal("checkpoint flag is required for clone mode")
+		}
+		runClone(cfg, clone.Options{
+			CheckpointID: *cpID,
+			Template:     *template,
+			Name:         *name,
+			TTL:          *ttl,
+		})
+	case "export":
+		if *sessionID == "" || *outPath == "" {
+			log.Fatal("session and out flags are required for export mode")
+		}
+		runExport(cfg, *sessionID, *outPath, bundle.ExportOptions{
+			Backup:       *backupName,
+			CreateBackup: *newBackup,
+		})
+	case "import":
+		if *inPath == "" {
+			log.Fatal("in flag is required for import mode")
+		}
+		runImport(cfg, *inPath)
+	case "recover":
+		runRecover(cfg, *storeName, *version)
+	case "repair":
+		runRepair(cfg, *dryRun)
+	case "verify":
+		runVerify(cfg, materialize.Kind(*kind), *name, *srcSchema, *tables)
 	default:
 		log.Fatalf("Unknown mode: %s", *mode)
 	}
 }
 
+// openStore returns the metadata store sessions and checkpoints are kept
+// in.
+func openStore(cfg *config.Config) store.Store {
+	metadata, err := store.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to open metadata store: %v", err)
+	}
+	return metadata
+}
+
 func loadConfig(envPath, configPath string) (*config.Config, error) {
 	// Try .env first
 	if envPath != "" {
@@ -100,7 +211,20 @@ func runListener(cfg *config.Config) {
 	}
 	defer walWriter.Close()
 
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
 	listener := replication.NewListener(cfg, walWriter)
+	listener.AddTransformer(session.NewTagger(metadata))
+
+	if cfg.Masking.RulesPath != "" {
+		masker, err := loadMasker(cfg)
+		if err != nil {
+			log.Fatalf("Failed to load masking rules: %v", err)
+		}
+		listener.AddTransformer(masker)
+		log.Printf("Masking captured entries using rules from %s", cfg.Masking.RulesPath)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -135,21 +259,36 @@ func runListener(cfg *config.Config) {
 func runIPC(cfg *config.Config, addr string) {
 	log.Printf("Starting IPC server on %s...", addr)
 
-	checkpointMgr := checkpoint.NewManager(cfg)
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
+	checkpointMgr := checkpoint.NewManager(cfg, metadata)
 	if err := checkpointMgr.Load(); err != nil {
 		log.Fatalf("Failed to load checkpoints: %v", err)
 	}
 
-	sessionMgr := session.NewManager(cfg)
+	sessionMgr := session.NewManager(cfg, metadata)
 	if err := sessionMgr.Load(); err != nil {
 		log.Fatalf("Failed to load sessions: %v", err)
 	}
 
 	walReader := wal.NewLogReader(cfg.Storage.WALLogPath)
 	checkpointNav := checkpoint.NewNavigator(walReader, checkpointMgr)
+	unresolved, err := checkpointNav.Validate()
+	if err != nil {
+		log.Printf("Warning: failed to validate checkpoints: %v", err)
+	}
+	for _, cp := range unresolved {
+		log.Printf("Warning: checkpoint %s (%s) no longer resolves: %s", cp.ID, cp.Name, cp.Problem)
+	}
 	replayer := session.NewReplayer(cfg)
 
-	server := ipc.NewServer(cfg, checkpointMgr, sessionMgr, checkpointNav, replayer)
+	jobMgr := jobs.NewManager(cfg)
+	if err := jobMgr.Load(); err != nil {
+		log.Fatalf("Failed to load jobs: %v", err)
+	}
+
+	server := ipc.NewServer(cfg, checkpointMgr, sessionMgr, checkpointNav, replayer, jobMgr)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -157,6 +296,7 @@ func runIPC(cfg *config.Config, addr string) {
 	go func() {
 		<-sigChan
 		log.Println("Received shutdown signal")
+		jobMgr.Shutdown()
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutdownCancel()
 		if err := server.Shutdown(shutdownCtx); err != nil {
@@ -201,3 +341,63 @@ func runRestore(cfg *config.Config, backupFile, targetDB string) {
 
 	log.Println("Restore completed successfully")
 }
+
+func loadMasker(cfg *config.Config) (*mask.Masker, error) {
+	rules, err := mask.LoadRules(cfg.Masking.RulesPath)
+	if err != nil {
+		return nil, err
+	}
+	return mask.NewMasker(rules, cfg.Masking.Salt)
+}
+
+func runMask(cfg *config.Config, outPath string) {
+	if cfg.Masking.RulesPath == "" {
+		log.Fatal("MASK_RULES_PATH must be set for mask mode")
+	}
+
+	log.Printf("Masking WAL log %s into %s...", cfg.Storage.WALLogPath, outPath)
+
+	masker, err := loadMasker(cfg)
+	if err != nil {
+		log.Fatalf("Failed to load masking rules: %v", err)
+	}
+
+	count, err := mask.RewriteLog(cfg.Storage.WALLogPath, outPath, masker)
+	if err != nil {
+		log.Fatalf("Masking failed: %v", err)
+	}
+
+	log.Printf("Masked %d entries", count)
+}
+
+func runMaterialize(cfg *config.Config, opts materialize.Options) {
+	log.Printf("Materializing checkpoint %s...", opts.CheckpointID)
+
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
+	checkpointMgr := checkpoint.NewManager(cfg, metadata)
+	if err := checkpointMgr.Load(); err != nil {
+		log.Fatalf("Failed to load checkpoints: %v", err)
+	}
+
+	walReader := wal.NewLogReader(cfg.Storage.WALLogPath)
+	checkpointNav := checkpoint.NewNavigator(walReader, checkpointMgr)
+	materializer := materialize.NewMaterializer(cfg, backup.NewBackupManager(cfg), checkpointNav, session.NewReplayer(cfg))
+
+	result, err := materializer.Materialize(context.Background(), opts)
+	if err != nil {
+		log.Fatalf("Materialize failed: %v", err)
+	}
+
+	log.Printf("Materialized %d entries into %s %s", result.EntriesApplied, result.Kind, result.Name)
+	fmt.Println(result.DSN)
+}
+
+func runDropMaterialized(cfg *config.Config, kind materialize.Kind, name string) {
+	materializer := materialize.NewMaterializer(cfg, backup.NewBackupManager(cfg), nil, nil)
+	if err := materializer.Drop(context.Background(), kind, name); err != nil {
+		log.Fatalf("Drop failed: %v", err)
+	}
+	log.Printf("Dropped %s %s", kind, name)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func runQuery(cfg *config.Config, expr string, offset, limit int) {
+	filter, err := wal.ParseFilter(expr)
+	if err != nil {
+		log.Fatalf("Invalid filter: %v", err)
+	}
+
+	reader := wal.NewLogReader(cfg.Storage.WALLogPath)
+	result, err := reader.Search(filter, offset, limit)
+	if err != nil {
+		log.Fatalf("Search failed: %v", err)
+	}
+
+	for _, entry := range result.Entries {
+		fmt.Println(formatEntry(entry))
+	}
+
+	if len(result.Entries) == 0 {
+		fmt.Printf("No matches (%d entries searched)\n", result.Total)
+		return
+	}
+
+	fmt.Printf("Showing %d-%d of %d matches (%d entries searched)\n",
+		result.Offset+1, result.Offset+len(result.Entries), result.Matched, result.Total)
+	if result.NextOffset > 0 {
+		fmt.Printf("Next page: -offset %d\n", result.NextOffset)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+)
+
+// runRecover lists the versions of sessions.json or checkpoints.json kept
+// in the journal, or restores one of them when version is set. It applies
+// to the JSON metadata store only.
+func runRecover(cfg *config.Config, collection string, version int) {
+	if cfg.Metadata.Store != "" && cfg.Metadata.Store != store.KindJSON {
+		log.Fatalf("Recover mode only applies to the json metadata store, not %s", cfg.Metadata.Store)
+	}
+	if collection != store.Sessions && collection != store.Checkpoints {
+		log.Fatalf("Unknown store %q: use sessions or checkpoints", collection)
+	}
+	file, err := store.NewJSONStore(cfg).File(collection)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", collection, err)
+	}
+
+	if version > 0 {
+		if err := file.Restore(version); err != nil {
+			log.Fatalf("Failed to restore version %d: %v", version, err)
+		}
+		log.Printf("Restored version %d of %s", version, file.Path())
+		return
+	}
+
+	versions, err := file.Versions()
+	if err != nil {
+		log.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) == 0 {
+		fmt.Printf("No earlier versions of %s\n", file.Path())
+		return
+	}
+	for _, v := range versions {
+		fmt.Printf("%6d  %s  %d bytes\n", v.Number, v.SavedAt.Format("2006-01-02 15:04:05"), v.Size)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+)
+
+// runRepair reconciles the sessions and checkpoints in the metadata store,
+// or reports what it would change when dryRun is set.
+func runRepair(cfg *config.Config, dryRun bool) {
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
+	repair, err := checkpoint.NewManager(cfg, metadata).Repair(dryRun)
+	if err != nil {
+		log.Fatalf("Failed to repair metadata: %v", err)
+	}
+	if repair.Empty() {
+		fmt.Println("Sessions and checkpoints are consistent")
+		return
+	}
+
+	report := func(done, planned, id string) {
+		if dryRun {
+			done = planned
+		}
+		fmt.Printf(done+"\n", id)
+	}
+	for _, id := range repair.Deleted {
+		report("Deleted orphaned checkpoint %s", "Would delete orphaned checkpoint %s", id)
+	}
+	for _, id := range repair.Attached {
+		report("Added checkpoint %s to its session", "Would add checkpoint %s to its session", id)
+	}
+	for _, id := range repair.Detached {
+		report("Removed missing checkpoint %s from sessions", "Would remove missing checkpoint %s from sessions", id)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func runScript(cfg *config.Config, fromID, toID, outPath string) {
+	metadata := openStore(cfg)
+	defer metadata.Close()
+
+	checkpointMgr := checkpoint.NewManager(cfg, metadata)
+	if err := checkpointMgr.Load(); err != nil {
+		log.Fatalf("Failed to load checkpoints: %v", err)
+	}
+	checkpointNav := checkpoint.NewNavigator(wal.NewLogReader(cfg.Storage.WALLogPath), checkpointMgr)
+
+	var entries []*wal.WALEntry
+	var err error
+	if fromID != "" {
+		entries, err = checkpointNav.GetEntriesAfterCheckpoint(fromID, toID)
+	} else {
+		entries, err = checkpointNav.GetEntriesUpToCheckpoint(toID)
+	}
+	if err != nil {
+		log.Fatalf("Failed to read entries: %v", err)
+	}
+
+	out := os.Stdout
+	if outPath != "" && outPath != "-" {
+		out, err = os.Create(outPath)
+		if err != nil {
+			log.Fatalf("Failed to create script file: %v", err)
+		}
+		defer out.Close()
+	}
+
+	if err := session.WriteScript(out, session.NewReplayer(cfg).ReplicaTarget(), entries); err != nil {
+		log.Fatalf("Failed to write script: %v", err)
+	}
+
+	if out != os.Stdout {
+		log.Printf("Wrote %d entries to %s", len(entries), outPath)
+	}
+}
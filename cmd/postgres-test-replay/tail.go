@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func runTail(cfg *config.Config, tables, ops string, fromStart bool) {
+	reader := wal.NewLogReader(cfg.Storage.WALLogPath)
+
+	var from wal.Position
+	if !fromStart {
+		end, err := reader.End()
+		if err != nil {
+			log.Fatalf("Failed to locate end of WAL log: %v", err)
+		}
+		from = end
+	}
+
+	tableFilter := splitList(tables)
+	opFilter := splitList(strings.ToUpper(ops))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		cancel()
+	}()
+
+	entries, errs := reader.Follow(ctx, from)
+	for entry := range entries {
+		if !matchesTable(tableFilter, entry) || !matchesList(opFilter, string(entry.Operation)) {
+			continue
+		}
+		fmt.Println(formatEntry(entry))
+	}
+
+	if err := <-errs; err != nil {
+		log.Fatalf("Tail failed: %v", err)
+	}
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+func matchesList(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesTable accepts both bare table names and schema-qualified names.
+func matchesTable(tables []string, entry *wal.WALEntry) bool {
+	return matchesList(tables, entry.Table) || matchesList(tables, entry.Schema+"."+entry.Table)
+}
+
+// formatEntry renders an entry on one line: inserts and deletes list the
+// row, updates list only the columns that changed when the old row is known.
+func formatEntry(entry *wal.WALEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-6s %s.%s [%s]",
+		entry.Timestamp.Format("15:04:05.000"), entry.Operation, entry.Schema, entry.Table, entry.LSN)
+
+	switch entry.Operation {
+	case wal.OpInsert:
+		writeColumns(&b, entry.Data)
+	case wal.OpDelete:
+		writeColumns(&b, entry.OldData)
+	case wal.OpUpdate:
+		writeChanges(&b, entry.OldData, entry.Data)
+	default:
+		if entry.SQL != "" {
+			fmt.Fprintf(&b, " %s", entry.SQL)
+		}
+	}
+
+	return b.String()
+}
+
+func writeColumns(b *strings.Builder, row map[string]interface{}) {
+	for _, col := range sortedKeys(row) {
+		fmt.Fprintf(b, " %s=%s", col, formatValue(row[col]))
+	}
+}
+
+func writeChanges(b *strings.Builder, oldRow, newRow map[string]interface{}) {
+	for _, col := range sortedKeys(newRow) {
+		oldValue, known := oldRow[col]
+		switch {
+		case !known:
+			fmt.Fprintf(b, " %s=%s", col, formatValue(newRow[col]))
+		case fmt.Sprint(oldValue) != fmt.Sprint(newRow[col]):
+			fmt.Fprintf(b, " %s: %s → %s", col, formatValue(oldValue), formatValue(newRow[col]))
+		}
+	}
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return fmt.Sprintf("%q", v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -6,6 +6,7 @@ Makes it easier to interact with the IPC service
 
 import sys
 import json
+import time
 import argparse
 import requests
 from datetime import datetime
@@ -48,15 +49,29 @@ def create_checkpoint(name, description, lsn, entry_index, session_id):
     data = {
         "name": name,
         "description": description,
-        "lsn": lsn,
-        "entry_index": entry_index,
         "session_id": session_id
     }
+    if lsn:
+        data["lsn"] = lsn
+    if entry_index is not None:
+        data["entry_index"] = entry_index
     response = requests.post(f"{API_BASE}/checkpoints", json=data)
     response.raise_for_status()
     print("✓ Checkpoint created:")
     print_json(response.json())
 
+def checkpoint_now(name, description, session_id, timeout):
+    """Create a checkpoint at the primary's current position"""
+    data = {"name": name, "description": description}
+    if session_id:
+        data["session_id"] = session_id
+    if timeout:
+        data["timeout"] = timeout
+    response = requests.post(f"{API_BASE}/checkpoints/now", json=data)
+    response.raise_for_status()
+    print("✓ Checkpoint created:")
+    print_json(response.json())
+
 def list_checkpoints(session_id=None):
     """List checkpoints"""
     params = {}
@@ -86,9 +101,21 @@ def replay_session(session_id, checkpoint_id):
     }
     response = requests.post(f"{API_BASE}/replay", json=data)
     response.raise_for_status()
-    result = response.json()
-    print("✓ Replay completed:")
-    print_json(result)
+    job = response.json()
+    print(f"✓ Replay job started: {job['id']}")
+
+    while job["status"] in ("pending", "running"):
+        time.sleep(1)
+        response = requests.get(f"{API_BASE}/jobs/{job['id']}")
+        response.raise_for_status()
+        job = response.json()
+        progress = job["progress"]
+        print(f"  {job['status']}: {progress['done']}/{progress['total']} entries")
+
+    print(f"✓ Replay {job['status']}:")
+    print_json(job.get("result"))
+    if job.get("error"):
+        print(f"✗ {job['error']}")
 
 def health_check():
     """Check API health"""
@@ -116,10 +143,16 @@ def main():
     checkpoint_create = subparsers.add_parser('checkpoint-create', help='Create a checkpoint')
     checkpoint_create.add_argument('name', help='Checkpoint name')
     checkpoint_create.add_argument('--description', default='', help='Checkpoint description')
-    checkpoint_create.add_argument('--lsn', default='0/0', help='LSN position')
-    checkpoint_create.add_argument('--entry-index', type=int, default=0, help='Entry index')
+    checkpoint_create.add_argument('--lsn', default='', help='LSN to anchor at (defaults to the end of the log)')
+    checkpoint_create.add_argument('--entry-index', type=int, default=None, help='Anchor at the entry at this position in the log')
     checkpoint_create.add_argument('--session-id', required=True, help='Session ID')
 
+    checkpoint_now_parser = subparsers.add_parser('checkpoint-now', help="Create a checkpoint at the primary's current position")
+    checkpoint_now_parser.add_argument('name', help='Checkpoint name')
+    checkpoint_now_parser.add_argument('--description', default='', help='Checkpoint description')
+    checkpoint_now_parser.add_argument('--session-id', help='Session ID (defaults to the active session)')
+    checkpoint_now_parser.add_argument('--timeout', default='', help='How long to wait for the listener, such as 10s')
+
     checkpoint_list = subparsers.add_parser('checkpoint-list', help='List checkpoints')
     checkpoint_list.add_argument('--session-id', help='Filter by session ID')
 
@@ -147,6 +180,8 @@ def main():
         elif args.command == 'checkpoint-create':
             create_checkpoint(args.name, args.description, args.lsn, 
                             args.entry_index, args.session_id)
+        elif args.command == 'checkpoint-now':
+            checkpoint_now(args.name, args.description, args.session_id, args.timeout)
         elif args.command == 'checkpoint-list':
             list_checkpoints(args.session_id)
         elif args.command == 'navigate':
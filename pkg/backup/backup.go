@@ -1,16 +1,22 @@
 package backup
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
 )
 
+// timestampLayout is the timestamp CreateBackup puts in backup file names.
+const timestampLayout = "20060102_150405"
+
 type BackupManager struct {
 	config *config.Config
 }
@@ -28,7 +34,7 @@ func (bm *BackupManager) CreateBackup(ctx context.Context, dbName string) (strin
 	}
 
 	// Generate backup filename with timestamp
-	timestamp := time.Now().Format("20060102_150405")
+	timestamp := time.Now().Format(timestampLayout)
 	backupFile := filepath.Join(bm.config.Storage.BackupPath, fmt.Sprintf("%s_%s.sql", dbName, timestamp))
 
 	// Build pg_dump command
@@ -73,6 +79,108 @@ func (bm *BackupManager) RestoreBackup(ctx context.Context, backupFile string, t
 	return nil
 }
 
+// RestoreToNewDatabase restores a backup into an empty database on the
+// replica server. Unlike RestoreBackup it does not drop existing objects
+// first, and it skips ownership so roles need not exist on the replica.
+func (bm *BackupManager) RestoreToNewDatabase(ctx context.Context, backupFile string, targetDB string) error {
+	dbConfig := bm.config.ReplicaDB
+	cmd := exec.CommandContext(ctx, "pg_restore",
+		"-h", dbConfig.Host,
+		"-p", fmt.Sprintf("%d", dbConfig.Port),
+		"-U", dbConfig.User,
+		"-d", targetDB,
+		"--no-owner",
+		"--no-privileges",
+		backupFile,
+	)
+
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", dbConfig.Password))
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pg_restore failed: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// RestoreToSchema restores the objects of sourceSchema from a backup into
+// targetSchema of targetDB on the replica server. The target schema must
+// already exist. pg_restore cannot rename schemas, so the restore script
+// is rewritten on the way to psql.
+func (bm *BackupManager) RestoreToSchema(ctx context.Context, backupFile, sourceSchema, targetSchema, targetDB string) error {
+	dbConfig := bm.config.ReplicaDB
+	env := append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", dbConfig.Password))
+
+	dump := exec.CommandContext(ctx, "pg_restore",
+		"-f", "-",
+		"-n", sourceSchema,
+		"--no-owner",
+		"--no-privileges",
+		backupFile,
+	)
+	dump.Env = env
+
+	script, err := dump.Output()
+	if err != nil {
+		return fmt.Errorf("pg_restore failed: %w", err)
+	}
+
+	load := exec.CommandContext(ctx, "psql",
+		"-h", dbConfig.Host,
+		"-p", fmt.Sprintf("%d", dbConfig.Port),
+		"-U", dbConfig.User,
+		"-d", targetDB,
+		"-v", "ON_ERROR_STOP=1",
+		"-q",
+	)
+	load.Env = env
+	load.Stdin = bytes.NewReader(RewriteSchema(script, sourceSchema, targetSchema))
+
+	output, err := load.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("psql failed: %w, output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// RewriteSchema rewrites references to schema from in a plain SQL restore
+// script so that its objects are created in schema to. Statements that
+// create the source schema itself are dropped, and COPY data lines are
+// left untouched.
+func RewriteSchema(script []byte, from, to string) []byte {
+	qualified := regexp.MustCompile(`(^|[^A-Za-z0-9_$."])"?` + regexp.QuoteMeta(from) + `"?\.`)
+	createSchema := regexp.MustCompile(`^CREATE SCHEMA "?` + regexp.QuoteMeta(from) + `"?;`)
+	replacement := []byte("${1}" + pgQuoteIdent(to) + ".")
+
+	var out bytes.Buffer
+	inCopy := false
+
+	for _, line := range bytes.SplitAfter(script, []byte("\n")) {
+		switch {
+		case inCopy:
+			if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte("\\.")) {
+				inCopy = false
+			}
+		case createSchema.Match(line):
+			continue
+		default:
+			if bytes.HasPrefix(line, []byte("COPY ")) && bytes.Contains(line, []byte("FROM stdin;")) {
+				inCopy = true
+			}
+			line = qualified.ReplaceAll(line, replacement)
+		}
+		out.Write(line)
+	}
+
+	return out.Bytes()
+}
+
+func pgQuoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
 func (bm *BackupManager) ListBackups() ([]string, error) {
 	backupDir := bm.config.Storage.BackupPath
 
@@ -94,3 +202,41 @@ func (bm *BackupManager) ListBackups() ([]string, error) {
 
 	return backups, nil
 }
+
+// BackupTime returns when a backup was started, from the timestamp in its
+// file name. It reports false for names CreateBackup did not generate.
+func BackupTime(name string) (time.Time, bool) {
+	base := strings.TrimSuffix(filepath.Base(name), ".sql")
+	if len(base) < len(timestampLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(timestampLayout, base[len(base)-len(timestampLayout):], time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// TakenBefore reports whether a backup was started before t. Names only
+// carry whole seconds, so a backup started in the same second as t does
+// not count.
+func TakenBefore(name string, t time.Time) bool {
+	started, ok := BackupTime(name)
+	return ok && !started.Add(time.Second).After(t)
+}
+
+// LatestBefore returns the newest of the backups started before t.
+func LatestBefore(backups []string, t time.Time) (string, bool) {
+	latest, found := "", false
+	var latestTime time.Time
+	for _, name := range backups {
+		if !TakenBefore(name, t) {
+			continue
+		}
+		started, _ := BackupTime(name)
+		if !found || started.After(latestTime) {
+			latest, latestTime, found = name, started, true
+		}
+	}
+	return latest, found
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewriteSchema(t *testing.T) {
+	script := strings.Join([]string{
+		`CREATE SCHEMA public;`,
+		`CREATE TABLE public.orders (id integer NOT NULL, note text);`,
+		`ALTER TABLE ONLY "public".orders ADD CONSTRAINT orders_pkey PRIMARY KEY (id);`,
+		`COPY public.orders (id, note) FROM stdin;`,
+		`1	see public.orders`,
+		`\.`,
+		`CREATE INDEX idx ON public.orders USING btree (note);`,
+		`SELECT mypublic.fn();`,
+		``,
+	}, "\n")
+
+	got := string(RewriteSchema([]byte(script), "public", "ptr_cp_1"))
+
+	expected := strings.Join([]string{
+		`CREATE TABLE "ptr_cp_1".orders (id integer NOT NULL, note text);`,
+		`ALTER TABLE ONLY "ptr_cp_1".orders ADD CONSTRAINT orders_pkey PRIMARY KEY (id);`,
+		`COPY "ptr_cp_1".orders (id, note) FROM stdin;`,
+		`1	see public.orders`,
+		`\.`,
+		`CREATE INDEX idx ON "ptr_cp_1".orders USING btree (note);`,
+		`SELECT mypublic.fn();`,
+		``,
+	}, "\n")
+
+	if got != expected {
+		t.Errorf("Unexpected rewrite:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestLatestBefore(t *testing.T) {
+	backups := []string{
+		"testdb_20240105_120000.sql",
+		"testdb_20240105_110000.sql",
+		"testdb_20240105_130000.sql",
+		"notes.sql",
+	}
+	at := func(clock string) time.Time {
+		tm, err := time.ParseInLocation("20060102_150405", clock, time.Local)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", clock, err)
+		}
+		return tm
+	}
+
+	tests := []struct {
+		before   time.Time
+		expected string
+		found    bool
+	}{
+		{at("20240105_125959"), "testdb_20240105_120000.sql", true},
+		{at("20240105_120000"), "testdb_20240105_110000.sql", true},
+		{at("20240105_140000"), "testdb_20240105_130000.sql", true},
+		{at("20240105_100000"), "", false},
+	}
+	for _, tt := range tests {
+		got, found := LatestBefore(backups, tt.before)
+		if got != tt.expected || found != tt.found {
+			t.Errorf("Expected %q, %v before %s, got %q, %v", tt.expected, tt.found, tt.before, got, found)
+		}
+	}
+}
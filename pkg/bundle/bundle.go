@@ -0,0 +1,591 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/backup"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// Version is the version of the bundle format written by Export.
+const Version = 1
+
+// ManifestFile is the name of the manifest, the first file in a bundle.
+const ManifestFile = "manifest.json"
+
+// ErrChecksum is returned when a file in a bundle does not match the
+// checksum in its manifest.
+var ErrChecksum = errors.New("bundle file does not match its checksum")
+
+// File is a file in a bundle.
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes a bundle: the session, its checkpoints and the files
+// holding the WAL entries they reference and the baseline backup. The
+// checkpoints are anchored against the entries in the bundle, not the log
+// they were exported from.
+type Manifest struct {
+	Version     int                      `json:"version"`
+	CreatedAt   time.Time                `json:"created_at"`
+	Session     *session.Session         `json:"session"`
+	Checkpoints []*checkpoint.Checkpoint `json:"checkpoints"`
+	WAL         []File                   `json:"wal"`
+	Backup      *File                    `json:"backup,omitempty"`
+}
+
+type ExportOptions struct {
+	// Backup is the name of a backup in the backup directory to include as
+	// the baseline the session's changes apply to.
+	Backup string `json:"backup,omitempty"`
+	// CreateBackup takes a new backup of the primary to include instead.
+	CreateBackup bool `json:"create_backup,omitempty"`
+}
+
+// Imported is what Import added: the session and checkpoints under their
+// new IDs, the log files written and the backup restored, if any.
+type Imported struct {
+	Session     *session.Session         `json:"session"`
+	Checkpoints []*checkpoint.Checkpoint `json:"checkpoints"`
+	Origin      string                   `json:"origin"`
+	WALFiles    []string                 `json:"wal_files"`
+	Backup      string                   `json:"backup,omitempty"`
+}
+
+// Manager exports sessions to bundles, gzipped tar archives that can be
+// imported on another machine, and imports them.
+type Manager struct {
+	config            *config.Config
+	sessionManager    *session.Manager
+	checkpointManager *checkpoint.Manager
+	navigator         *checkpoint.Navigator
+	backupManager     *backup.BackupManager
+}
+
+func NewManager(cfg *config.Config, sessionMgr *session.Manager, checkpointMgr *checkpoint.Manager, nav *checkpoint.Navigator, backupMgr *backup.BackupManager) *Manager {
+	return &Manager{
+		config:            cfg,
+		sessionManager:    sessionMgr,
+		checkpointManager: checkpointMgr,
+		navigator:         nav,
+		backupManager:     backupMgr,
+	}
+}
+
+// Export writes a bundle of the session to w: its checkpoints and their
+// ancestors, the entries that lead to them, kept in the log files they
+// were read from, and optionally a baseline backup.
+func (m *Manager) Export(ctx context.Context, w io.Writer, sessionID string, opts ExportOptions) (*Manifest, error) {
+	sess, err := m.sessionManager.GetSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints, err := m.exportCheckpoints(sess.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, cp := range checkpoints {
+		entries, err := m.navigator.GetEntriesUpToCheckpoint(cp.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to collect entries of checkpoint %s: %w", cp.ID, err)
+		}
+		for _, entry := range entries {
+			referenced[entry.ID] = true
+		}
+	}
+
+	segments, exported, err := m.exportSegments(referenced)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{
+		Version:     Version,
+		CreatedAt:   time.Now(),
+		Session:     exportSession(sess, checkpoints),
+		Checkpoints: make([]*checkpoint.Checkpoint, len(checkpoints)),
+		WAL:         make([]File, 0, len(segments)),
+	}
+	for i, cp := range checkpoints {
+		copied := *cp
+		if copied.Anchor, err = checkpoint.Reanchor(cp.Anchor, exported); err != nil {
+			return nil, fmt.Errorf("failed to anchor checkpoint %s: %w", cp.ID, err)
+		}
+		manifest.Checkpoints[i] = &copied
+	}
+	for _, segment := range segments {
+		manifest.WAL = append(manifest.WAL, describe(segment.path, segment.data))
+	}
+
+	backupFile, err := m.exportBackup(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if backupFile != "" {
+		described, err := describeFile("backup/"+filepath.Base(backupFile), backupFile)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Backup = &described
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeFile(tw, ManifestFile, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		if err := writeFile(tw, segment.path, bytes.NewReader(segment.data), int64(len(segment.data))); err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Backup != nil {
+		file, err := os.Open(backupFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open backup: %w", err)
+		}
+		err = writeFile(tw, manifest.Backup.Path, file, manifest.Backup.Size)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bundle: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish bundle: %w", err)
+	}
+	return manifest, nil
+}
+
+// exportCheckpoints returns the checkpoints of a session with the
+// checkpoints on their paths from another session, parents first.
+func (m *Manager) exportCheckpoints(sessionID string) ([]*checkpoint.Checkpoint, error) {
+	own, err := m.checkpointManager.ListCheckpoints(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints := make([]*checkpoint.Checkpoint, 0, len(own))
+	seen := make(map[string]bool)
+	for _, cp := range own {
+		path, err := m.checkpointManager.Path(cp.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, step := range path {
+			if !seen[step.ID] {
+				seen[step.ID] = true
+				checkpoints = append(checkpoints, step)
+			}
+		}
+	}
+	return checkpoints, nil
+}
+
+type segment struct {
+	path string
+	data []byte
+}
+
+// exportSegments returns the referenced entries of each log file, encoded
+// in the log format, and all of them in log order.
+func (m *Manager) exportSegments(referenced map[string]bool) ([]segment, []*wal.WALEntry, error) {
+	reader := wal.NewLogReader(m.config.Storage.WALLogPath)
+	files, err := reader.Files()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	segments := make([]segment, 0)
+	exported := make([]*wal.WALEntry, 0, len(referenced))
+	for _, file := range files {
+		entries, err := reader.ReadFile(file)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+
+		var buf bytes.Buffer
+		for _, entry := range entries {
+			if !referenced[entry.ID] {
+				continue
+			}
+			data, err := entry.ToJSON()
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to marshal entry: %w", err)
+			}
+			buf.Write(data)
+			buf.WriteByte('\n')
+			exported = append(exported, entry)
+		}
+		if buf.Len() > 0 {
+			segments = append(segments, segment{path: "wal/" + filepath.Base(file), data: buf.Bytes()})
+		}
+	}
+	return segments, exported, nil
+}
+
+// exportBackup returns the path of the backup to include, taking a new one
+// when asked to.
+func (m *Manager) exportBackup(ctx context.Context, opts ExportOptions) (string, error) {
+	switch {
+	case opts.CreateBackup:
+		file, err := m.backupManager.CreateBackup(ctx, m.config.PrimaryDB.Database)
+		if err != nil {
+			return "", fmt.Errorf("failed to create backup: %w", err)
+		}
+		return file, nil
+	case opts.Backup != "":
+		file := filepath.Join(m.config.Storage.BackupPath, filepath.Base(opts.Backup))
+		if _, err := os.Stat(file); err != nil {
+			return "", fmt.Errorf("backup %s not found: %w", opts.Backup, err)
+		}
+		return file, nil
+	}
+	return "", nil
+}
+
+// exportSession returns a copy of the session listing the exported
+// checkpoints, without the state that only applies to this machine.
+func exportSession(sess *session.Session, checkpoints []*checkpoint.Checkpoint) *session.Session {
+	copied := *sess
+	copied.Checkpoints = make([]string, 0, len(checkpoints))
+	for _, cp := range checkpoints {
+		copied.Checkpoints = append(copied.Checkpoints, cp.ID)
+	}
+	copied.Active = false
+	copied.ReplayCheckpoint, copied.ReplayLSN = "", ""
+	copied.Head, copied.HeadLSN, copied.HeadSeq = "", "", 0
+	return &copied
+}
+
+func describe(name string, data []byte) File {
+	sum := sha256.Sum256(data)
+	return File{Path: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+func describeFile(name, filename string) (File, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to open %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return File{}, fmt.Errorf("failed to read %s: %w", filename, err)
+	}
+	return File{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func writeFile(tw *tar.Writer, name string, r io.Reader, size int64) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s to bundle: %w", name, err)
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("failed to write %s to bundle: %w", name, err)
+	}
+	return nil
+}
+
+// Import reads a bundle from r and adds its session and checkpoints under
+// new IDs. Its entries are written to new log files with a new origin, so
+// that they never mix with the entries captured here, and its backup, if
+// any, is copied to the backup directory. Every file is checked against
+// the manifest before anything is added.
+func (m *Manager) Import(r io.Reader) (*Imported, error) {
+	logPath := m.config.Storage.WALLogPath
+	if err := os.MkdirAll(logPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL log directory: %w", err)
+	}
+	staging, err := os.MkdirTemp(logPath, ".import-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := extract(r, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	imported := &Imported{Origin: uuid.New().String(), WALFiles: make([]string, 0)}
+	origins := map[string]string{"": imported.Origin}
+	originFor := func(origin string) string {
+		if _, ok := origins[origin]; !ok {
+			origins[origin] = uuid.New().String()
+		}
+		return origins[origin]
+	}
+
+	checkpointIDs := make(map[string]string, len(manifest.Checkpoints))
+	for _, cp := range manifest.Checkpoints {
+		checkpointIDs[cp.ID] = uuid.New().String()
+	}
+
+	entryIDs := make(map[string]string)
+	written := make([]string, 0)
+	cleanup := func() {
+		for _, file := range written {
+			os.Remove(file)
+		}
+	}
+
+	sessionID := uuid.New().String()
+	reader := wal.NewLogReader(staging)
+	prefix := "wal_import_" + imported.Origin[:8]
+	for i, file := range manifest.WAL {
+		entries, err := reader.ReadFile(stagedPath(staging, file.Path))
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to read %s: %w", file.Path, err)
+		}
+		for _, entry := range entries {
+			newID := uuid.New().String()
+			entryIDs[entry.ID] = newID
+			entry.ID = newID
+			entry.Origin = originFor(entry.Origin)
+			entry.CheckpointID = checkpointIDs[entry.CheckpointID]
+			// Entries recorded by other sessions on the exporting
+			// machine belong to none here.
+			if entry.SessionID == manifest.Session.ID {
+				entry.SessionID = sessionID
+			} else {
+				entry.SessionID = ""
+			}
+		}
+
+		name := fmt.Sprintf("%s_%03d.log", prefix, i+1)
+		tmp := filepath.Join(staging, name)
+		if err := wal.WriteFile(tmp, entries); err != nil {
+			cleanup()
+			return nil, err
+		}
+		target := filepath.Join(logPath, name)
+		if err := os.Rename(tmp, target); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to move log file: %w", err)
+		}
+		written = append(written, target)
+		imported.WALFiles = append(imported.WALFiles, target)
+	}
+
+	if manifest.Backup != nil {
+		target, err := m.importBackup(stagedPath(staging, manifest.Backup.Path), imported.Origin)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		written = append(written, target)
+		imported.Backup = filepath.Base(target)
+	}
+
+	sess := *manifest.Session
+	sess.ID = sessionID
+	sess.Checkpoints = make([]string, 0, len(manifest.Checkpoints))
+	sess.Active = false
+	sess.ReplayCheckpoint, sess.ReplayLSN = "", ""
+	sess.Head, sess.HeadLSN, sess.HeadSeq = "", "", 0
+	// The recordings were windows of the other machine's change stream.
+	sess.Recordings = nil
+	sess.ForkedFrom = ""
+	sess.ForkedAt = checkpointIDs[sess.ForkedAt]
+	sess.UpdatedAt = time.Now()
+
+	imported.Checkpoints = make([]*checkpoint.Checkpoint, 0, len(manifest.Checkpoints))
+	for _, cp := range manifest.Checkpoints {
+		copied := *cp
+		copied.ID = checkpointIDs[cp.ID]
+		copied.SessionID = sess.ID
+		// Entries of the sessions the bundle's checkpoints were recorded
+		// by are untagged or belong to the imported session.
+		copied.RecordedBy = ""
+		copied.Origin = originFor(cp.Origin)
+		copied.EntryID = entryIDs[cp.EntryID]
+		if cp.ParentID != "" {
+			if copied.ParentID = checkpointIDs[cp.ParentID]; copied.ParentID == "" {
+				cleanup()
+				return nil, fmt.Errorf("parent checkpoint %s of %s is not in the bundle", cp.ParentID, cp.ID)
+			}
+		}
+		imported.Checkpoints = append(imported.Checkpoints, &copied)
+		sess.Checkpoints = append(sess.Checkpoints, copied.ID)
+	}
+
+	if err := m.checkpointManager.AddSession(&sess, imported.Checkpoints); err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to add session: %w", err)
+	}
+	imported.Session = &sess
+
+	return imported, nil
+}
+
+// importBackup moves a staged backup to the backup directory, renaming it
+// if a backup of the same name exists, and returns its path.
+func (m *Manager) importBackup(staged, origin string) (string, error) {
+	backupPath := m.config.Storage.BackupPath
+	if err := os.MkdirAll(backupPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	name := filepath.Base(staged)
+	target := filepath.Join(backupPath, name)
+	if _, err := os.Stat(target); err == nil {
+		ext := filepath.Ext(name)
+		target = filepath.Join(backupPath, fmt.Sprintf("%s_import_%s%s", strings.TrimSuffix(name, ext), origin[:8], ext))
+	}
+
+	if err := os.Rename(staged, target); err == nil {
+		return target, nil
+	}
+
+	// The backup directory may be on another file system.
+	src, err := os.Open(staged)
+	if err != nil {
+		return "", fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer src.Close()
+	dst, err := os.Create(target)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup file: %w", err)
+	}
+	defer dst.Close()
+	if _, err := io.Copy(dst, src); err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to copy backup: %w", err)
+	}
+	if err := dst.Sync(); err != nil {
+		os.Remove(target)
+		return "", fmt.Errorf("failed to sync backup file: %w", err)
+	}
+	return target, nil
+}
+
+// extract reads a bundle into dir, checking each file against the
+// manifest, and returns the manifest.
+func extract(r io.Reader, dir string) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	if header.Name != ManifestFile {
+		return nil, fmt.Errorf("bundle starts with %s instead of %s", header.Name, ManifestFile)
+	}
+	manifest := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.Version != Version {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+	if manifest.Session == nil {
+		return nil, fmt.Errorf("bundle manifest has no session")
+	}
+
+	expected := make(map[string]File, len(manifest.WAL)+1)
+	for _, file := range manifest.WAL {
+		expected[file.Path] = file
+	}
+	if manifest.Backup != nil {
+		expected[manifest.Backup.Path] = *manifest.Backup
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle: %w", err)
+		}
+
+		file, ok := expected[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("bundle holds %s, which is not in its manifest", header.Name)
+		}
+		delete(expected, header.Name)
+		if err := extractFile(tr, stagedPath(dir, file.Path), file); err != nil {
+			return nil, err
+		}
+	}
+
+	for name := range expected {
+		return nil, fmt.Errorf("bundle is missing %s", name)
+	}
+	return manifest, nil
+}
+
+func extractFile(r io.Reader, filename string, expected File) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", expected.Path, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); size != expected.Size || sum != expected.SHA256 {
+		return fmt.Errorf("%w: %s", ErrChecksum, expected.Path)
+	}
+	return nil
+}
+
+// stagedPath returns where a file of a bundle is extracted to in dir. The
+// name is cleaned as if rooted at dir so that a bundle cannot write
+// outside it.
+func stagedPath(dir, name string) string {
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
+}
@@ -0,0 +1,202 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/backup"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+type testEnv struct {
+	config      *config.Config
+	sessions    *session.Manager
+	checkpoints *checkpoint.Manager
+	navigator   *checkpoint.Navigator
+	bundles     *Manager
+}
+
+func newTestEnv(t *testing.T, entries []*wal.WALEntry) *testEnv {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.CheckpointPath = filepath.Join(tmpDir, "checkpoints")
+	cfg.Storage.SessionPath = filepath.Join(tmpDir, "sessions")
+	cfg.Storage.WALLogPath = filepath.Join(tmpDir, "wal")
+	cfg.Storage.BackupPath = filepath.Join(tmpDir, "backups")
+
+	if err := os.MkdirAll(cfg.Storage.WALLogPath, 0755); err != nil {
+		t.Fatalf("Failed to create log directory: %v", err)
+	}
+	if len(entries) > 0 {
+		if err := wal.WriteFile(filepath.Join(cfg.Storage.WALLogPath, "wal_20240101_000000.log"), entries); err != nil {
+			t.Fatalf("Failed to write log: %v", err)
+		}
+	}
+
+	metadata := store.NewJSONStore(cfg)
+	env := &testEnv{
+		config:      cfg,
+		sessions:    session.NewManager(cfg, metadata),
+		checkpoints: checkpoint.NewManager(cfg, metadata),
+	}
+	env.navigator = checkpoint.NewNavigator(wal.NewLogReader(cfg.Storage.WALLogPath), env.checkpoints)
+	env.bundles = NewManager(cfg, env.sessions, env.checkpoints, env.navigator, backup.NewBackupManager(cfg))
+	return env
+}
+
+func (env *testEnv) checkpoint(t *testing.T, sessionID string, entryIndex int, branch checkpoint.Branch) *checkpoint.Checkpoint {
+	t.Helper()
+	anchor, err := env.navigator.AnchorAt("", &entryIndex)
+	if err != nil {
+		t.Fatalf("Failed to anchor checkpoint: %v", err)
+	}
+	cp, err := env.checkpoints.CreateCheckpoint("cp", "", anchor, branch, sessionID)
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	return cp
+}
+
+func testEntries() []*wal.WALEntry {
+	return []*wal.WALEntry{
+		{ID: "e1", LSN: "0/10", Operation: wal.OpInsert, Table: "orders", Data: map[string]interface{}{"id": "1"}},
+		{ID: "other", LSN: "0/18", Operation: wal.OpInsert, Table: "audit", Data: map[string]interface{}{"id": "9"}},
+		{ID: "e2", LSN: "0/20", Operation: wal.OpUpdate, Table: "orders", Data: map[string]interface{}{"id": "1"}},
+		{ID: "e3", LSN: "0/30", Operation: wal.OpDelete, Table: "orders", Data: map[string]interface{}{"id": "1"}},
+	}
+}
+
+func exportTestBundle(t *testing.T) (*bytes.Buffer, *Manifest) {
+	t.Helper()
+	src := newTestEnv(t, testEntries())
+	sess, _ := src.sessions.CreateSession("bug", "", "testdb")
+	root := src.checkpoint(t, sess.ID, 0, checkpoint.Branch{})
+	// The child starts after the entry of another session at 0/18.
+	src.checkpoint(t, sess.ID, 3, checkpoint.BranchFrom(root.ID, checkpoint.Anchor{LSN: "0/18"}))
+
+	if err := os.MkdirAll(src.config.Storage.BackupPath, 0755); err != nil {
+		t.Fatalf("Failed to create backup directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src.config.Storage.BackupPath, "testdb_1.sql"), []byte("dump"), 0644); err != nil {
+		t.Fatalf("Failed to write backup: %v", err)
+	}
+
+	var buf bytes.Buffer
+	manifest, err := src.bundles.Export(context.Background(), &buf, sess.ID, ExportOptions{Backup: "testdb_1.sql"})
+	if err != nil {
+		t.Fatalf("Failed to export session: %v", err)
+	}
+	return &buf, manifest
+}
+
+func TestManager_ExportImport(t *testing.T) {
+	buf, manifest := exportTestBundle(t)
+
+	if len(manifest.Checkpoints) != 2 || len(manifest.WAL) != 1 || manifest.Backup == nil {
+		t.Fatalf("Expected 2 checkpoints, 1 log file and a backup, got %+v", manifest)
+	}
+	if child := manifest.Checkpoints[1]; child.EntryCount != 3 || child.EntryID != "e3" {
+		t.Errorf("Expected the child to cover the 3 exported entries, got %+v", child.Anchor)
+	}
+
+	// The target already has entries at the same LSNs.
+	dst := newTestEnv(t, []*wal.WALEntry{
+		{ID: "local", LSN: "0/10", Operation: wal.OpInsert, Table: "users"},
+	})
+	other, _ := dst.sessions.CreateSession("local", "", "testdb")
+	local := dst.checkpoint(t, other.ID, 0, checkpoint.Branch{})
+
+	imported, err := dst.bundles.Import(buf)
+	if err != nil {
+		t.Fatalf("Failed to import bundle: %v", err)
+	}
+	if imported.Session.ID == manifest.Session.ID || len(imported.Session.Checkpoints) != 2 {
+		t.Errorf("Expected a new session with 2 checkpoints, got %+v", imported.Session)
+	}
+
+	child := imported.Checkpoints[1]
+	if child.ID == manifest.Checkpoints[1].ID || child.ParentID != imported.Checkpoints[0].ID {
+		t.Errorf("Expected remapped IDs, got %+v", child)
+	}
+
+	entries, err := dst.navigator.GetEntriesUpToCheckpoint(child.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Origin != imported.Origin || entry.ID == "e1" || entry.ID == "local" {
+			t.Errorf("Expected an imported entry with a new ID, got %+v", entry)
+		}
+	}
+
+	if entries, err := dst.navigator.GetEntriesUpToCheckpoint(local.ID); err != nil || len(entries) != 1 {
+		t.Errorf("Expected the local checkpoint to still cover 1 entry, got %d, %v", len(entries), err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dst.config.Storage.BackupPath, imported.Backup))
+	if err != nil || string(data) != "dump" {
+		t.Errorf("Expected the backup to be imported, got %q, %v", data, err)
+	}
+}
+
+func TestManager_ImportRejectsCorruptBundle(t *testing.T) {
+	buf, _ := exportTestBundle(t)
+
+	// Rewrite the bundle with the backup changed.
+	var corrupt bytes.Buffer
+	gz, _ := gzip.NewReader(buf)
+	tr := tar.NewReader(gz)
+	gw := gzip.NewWriter(&corrupt)
+	tw := tar.NewWriter(gw)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read bundle: %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		if header.Name == "backup/testdb_1.sql" {
+			data = []byte("dumb")
+		}
+		if err := writeFile(tw, header.Name, bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatalf("Failed to write bundle: %v", err)
+		}
+	}
+	tw.Close()
+	gw.Close()
+
+	dst := newTestEnv(t, nil)
+	if _, err := dst.bundles.Import(&corrupt); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected ErrChecksum, got %v", err)
+	}
+
+	files, _ := wal.NewLogReader(dst.config.Storage.WALLogPath).Files()
+	sessions, _ := dst.sessions.ListSessions()
+	if len(files) != 0 || len(sessions) != 0 {
+		t.Errorf("Expected nothing to be imported, got %v and %d sessions", files, len(sessions))
+	}
+}
+
+func TestStagedPath(t *testing.T) {
+	if got := stagedPath("/tmp/stage", "../../etc/passwd"); got != "/tmp/stage/etc/passwd" {
+		t.Errorf("Expected the path to stay in the staging directory, got %s", got)
+	}
+}
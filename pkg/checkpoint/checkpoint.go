@@ -2,83 +2,258 @@ package checkpoint
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"math"
 	"sort"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
 )
 
+// ErrUnresolved is returned for a checkpoint whose range the WAL log no
+// longer holds.
+var ErrUnresolved = errors.New("checkpoint does not resolve against the WAL log")
+
+// ErrBeforeBranch is returned for a checkpoint anchored before the start of
+// the branch it would be on.
+var ErrBeforeBranch = errors.New("checkpoint is before the start of its branch")
+
+// ErrNotFound is returned for a checkpoint that does not exist.
+var ErrNotFound = errors.New("checkpoint not found")
+
+// Anchor ties a checkpoint to the change stream. The checkpoint covers
+// every entry whose anchor is at or before LSN and Seq; a Seq of 0 covers
+// the whole transaction committed at LSN. EntryID and EntryCount are the
+// last entry covered and the number of entries covered when the checkpoint
+// was made, so that a log that has lost entries since can be detected.
+// Origin is the origin of the entries covered: LSNs of entries imported
+// from a bundle come from another server, so an anchor only covers entries
+// of its own origin.
+type Anchor struct {
+	LSN        string `json:"lsn"`
+	Seq        int    `json:"seq,omitempty"`
+	EntryID    string `json:"entry_id,omitempty"`
+	EntryCount int    `json:"entry_count"`
+	Origin     string `json:"origin,omitempty"`
+}
+
+// position returns the anchor as a wal.Anchor.
+func (a Anchor) position() (wal.Anchor, error) {
+	lsn, err := wal.ParseLSN(a.LSN)
+	if err != nil {
+		return wal.Anchor{}, err
+	}
+	return wal.Anchor{LSN: lsn, Seq: a.Seq}, nil
+}
+
+// covers reports whether an entry at pos is at or before bound.
+func covers(pos, bound wal.Anchor) bool {
+	if bound.Seq == 0 {
+		return pos.LSN <= bound.LSN
+	}
+	return pos.Compare(bound) <= 0
+}
+
 type Checkpoint struct {
 	ID          string    `json:"id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
 	Timestamp   time.Time `json:"timestamp"`
-	LSN         string    `json:"lsn"`
-	EntryIndex  int       `json:"entry_index"`
-	SessionID   string    `json:"session_id"`
+	Anchor
+	Branch
+	// EntryIndex is the position in the log that checkpoints written by
+	// earlier versions were anchored to. Navigator.Validate converts it.
+	EntryIndex *int   `json:"entry_index,omitempty"`
+	SessionID  string `json:"session_id"`
+	// RecordedBy is the session whose changes the checkpoint covers when
+	// it differs from SessionID, after a deleted session handed the
+	// checkpoint over to a fork.
+	RecordedBy string `json:"recorded_by,omitempty"`
+	// Unresolved marks a checkpoint whose range the log no longer holds;
+	// Problem says why.
+	Unresolved bool   `json:"unresolved,omitempty"`
+	Problem    string `json:"problem,omitempty"`
 }
 
+// Manager keeps checkpoints in a metadata store.
 type Manager struct {
-	config      *config.Config
-	checkpoints map[string]*Checkpoint
-	mutex       sync.RWMutex
+	config *config.Config
+	store  store.Store
 }
 
-func NewManager(cfg *config.Config) *Manager {
+func NewManager(cfg *config.Config, st store.Store) *Manager {
 	return &Manager{
-		config:      cfg,
-		checkpoints: make(map[string]*Checkpoint),
+		config: cfg,
+		store:  st,
+	}
+}
+
+func getCheckpoint(r store.Reader, id string) (*Checkpoint, error) {
+	doc, err := r.Get(store.Checkpoints, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(doc, checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint %s: %w", id, err)
+	}
+	return checkpoint, nil
 }
 
-func (m *Manager) CreateCheckpoint(name, description, lsn string, entryIndex int, sessionID string) (*Checkpoint, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+func listCheckpoints(r store.Reader) (map[string]*Checkpoint, error) {
+	docs, err := r.List(store.Checkpoints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoints: %w", err)
+	}
 
+	checkpoints := make(map[string]*Checkpoint, len(docs))
+	for id, doc := range docs {
+		checkpoint := &Checkpoint{}
+		if err := json.Unmarshal(doc, checkpoint); err != nil {
+			return nil, fmt.Errorf("failed to decode checkpoint %s: %w", id, err)
+		}
+		checkpoints[id] = checkpoint
+	}
+	return checkpoints, nil
+}
+
+func putCheckpoint(tx store.Tx, checkpoint *Checkpoint) error {
+	doc, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to encode checkpoint: %w", err)
+	}
+	return tx.Put(store.Checkpoints, checkpoint.ID, doc)
+}
+
+// CreateCheckpoint records a checkpoint at anchor, placed in the tree by
+// branch, and adds it to its session. Use Navigator.AnchorAt to anchor it
+// to the current log. It returns session.ErrNotFound for a missing session
+// and ErrNotFound for a missing parent.
+func (m *Manager) CreateCheckpoint(name, description string, anchor Anchor, branch Branch, sessionID string) (*Checkpoint, error) {
 	checkpoint := &Checkpoint{
 		ID:          uuid.New().String(),
 		Name:        name,
 		Description: description,
 		Timestamp:   time.Now(),
-		LSN:         lsn,
-		EntryIndex:  entryIndex,
+		Anchor:      anchor,
+		Branch:      branch,
 		SessionID:   sessionID,
 	}
 
-	m.checkpoints[checkpoint.ID] = checkpoint
-
-	if err := m.save(); err != nil {
+	err := m.store.Update(func(tx store.Tx) error {
+		if branch.ParentID != "" {
+			if _, err := getCheckpoint(tx, branch.ParentID); err != nil {
+				return fmt.Errorf("parent of the new checkpoint: %w", err)
+			}
+			if compareAnchors(anchor, branch.base()) < 0 {
+				return fmt.Errorf("%w: %s is before %s", ErrBeforeBranch, anchor.LSN, branch.BaseLSN)
+			}
+		}
+		if err := session.AttachCheckpoints(tx, sessionID, checkpoint.ID); err != nil {
+			return err
+		}
+		return putCheckpoint(tx, checkpoint)
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	return checkpoint, nil
 }
 
-func (m *Manager) GetCheckpoint(id string) (*Checkpoint, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+// AddCheckpoints records checkpoints made elsewhere, such as those imported
+// from a bundle, and adds them to their sessions, which must exist. Each
+// parent must either exist already or be among the checkpoints added.
+func (m *Manager) AddCheckpoints(checkpoints []*Checkpoint) error {
+	return m.store.Update(func(tx store.Tx) error {
+		return addCheckpoints(tx, checkpoints)
+	})
+}
+
+// AddSession records a session made elsewhere along with its checkpoints,
+// as AddCheckpoints, in one transaction: when either cannot be added,
+// neither is.
+func (m *Manager) AddSession(sess *session.Session, checkpoints []*Checkpoint) error {
+	return m.store.Update(func(tx store.Tx) error {
+		if _, err := tx.Get(store.Sessions, sess.ID); err == nil {
+			return fmt.Errorf("session %s already exists", sess.ID)
+		}
+		if err := session.Put(tx, sess); err != nil {
+			return err
+		}
+		return addCheckpoints(tx, checkpoints)
+	})
+}
 
-	checkpoint, exists := m.checkpoints[id]
-	if !exists {
-		return nil, fmt.Errorf("checkpoint %s not found", id)
+func addCheckpoints(tx store.Tx, checkpoints []*Checkpoint) error {
+	existing, err := listCheckpoints(tx)
+	if err != nil {
+		return err
 	}
 
-	return checkpoint, nil
+	added := make(map[string]bool, len(checkpoints))
+	for _, cp := range checkpoints {
+		if _, exists := existing[cp.ID]; exists || added[cp.ID] {
+			return fmt.Errorf("checkpoint %s already exists", cp.ID)
+		}
+		added[cp.ID] = true
+	}
+	for _, cp := range checkpoints {
+		if _, exists := existing[cp.ParentID]; cp.ParentID != "" && !exists && !added[cp.ParentID] {
+			return fmt.Errorf("%w: parent %s of %s", ErrNotFound, cp.ParentID, cp.ID)
+		}
+	}
+
+	for _, cp := range checkpoints {
+		if err := session.AttachCheckpoints(tx, cp.SessionID, cp.ID); err != nil {
+			return err
+		}
+		if err := putCheckpoint(tx, cp); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+func (m *Manager) GetCheckpoint(id string) (*Checkpoint, error) {
+	return getCheckpoint(m.store, id)
+}
+
+// ListCheckpoints returns the checkpoints of a session, or every checkpoint
+// when sessionID is empty. A session's checkpoints include those it shares
+// with the session it was forked from.
 func (m *Manager) ListCheckpoints(sessionID string) ([]*Checkpoint, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+	all, err := listCheckpoints(m.store)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := make(map[string]bool)
+	if sessionID != "" {
+		sess, err := session.Get(m.store, sessionID)
+		if err != nil && !errors.Is(err, session.ErrNotFound) {
+			return nil, err
+		}
+		if sess != nil {
+			for _, id := range sess.Checkpoints {
+				shared[id] = true
+			}
+		}
+	}
 
 	checkpoints := make([]*Checkpoint, 0)
-	for _, cp := range m.checkpoints {
-		if sessionID == "" || cp.SessionID == sessionID {
+	for _, cp := range all {
+		if sessionID == "" || cp.SessionID == sessionID || shared[cp.ID] {
 			checkpoints = append(checkpoints, cp)
 		}
 	}
@@ -90,130 +265,416 @@ func (m *Manager) ListCheckpoints(sessionID string) ([]*Checkpoint, error) {
 	return checkpoints, nil
 }
 
-func (m *Manager) DeleteCheckpoint(id string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// updateCheckpoint replaces a checkpoint with an updated copy.
+func (m *Manager) updateCheckpoint(checkpoint *Checkpoint) error {
+	return m.store.Update(func(tx store.Tx) error {
+		if _, err := getCheckpoint(tx, checkpoint.ID); err != nil {
+			return err
+		}
+		return putCheckpoint(tx, checkpoint)
+	})
+}
 
-	if _, exists := m.checkpoints[id]; !exists {
-		return fmt.Errorf("checkpoint %s not found", id)
+// DeleteCheckpoint deletes a checkpoint with the checkpoints that follow
+// it, whose changes start from it, and removes them from their sessions.
+// It returns the IDs of the checkpoints deleted.
+func (m *Manager) DeleteCheckpoint(id string) ([]string, error) {
+	var deleted []string
+	err := m.store.Update(func(tx store.Tx) error {
+		if _, err := getCheckpoint(tx, id); err != nil {
+			return err
+		}
+		checkpoints, err := listCheckpoints(tx)
+		if err != nil {
+			return err
+		}
+		deleted, err = deleteCheckpoints(tx, descendants(checkpoints, map[string]bool{id: true}))
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	return deleted, nil
+}
 
-	delete(m.checkpoints, id)
+// Load checks that the checkpoints can be read from the store.
+func (m *Manager) Load() error {
+	if _, err := listCheckpoints(m.store); err != nil {
+		return fmt.Errorf("failed to load checkpoints: %w", err)
+	}
+	return nil
+}
 
-	return m.save()
+type Navigator struct {
+	walReader *wal.LogReader
+	manager   *Manager
 }
 
-func (m *Manager) Load() error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+func NewNavigator(walReader *wal.LogReader, manager *Manager) *Navigator {
+	return &Navigator{
+		walReader: walReader,
+		manager:   manager,
+	}
+}
 
-	checkpointPath := m.config.Storage.CheckpointPath
-	if err := os.MkdirAll(checkpointPath, 0755); err != nil {
-		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+// AnchorAt anchors a new checkpoint to the current log: at the entry at
+// entryIndex when it is set, otherwise at lsn when it is set, otherwise at
+// the last entry captured here.
+func (n *Navigator) AnchorAt(lsn string, entryIndex *int) (Anchor, error) {
+	allEntries, err := n.walReader.ReadAll()
+	if err != nil {
+		return Anchor{}, fmt.Errorf("failed to read WAL entries: %w", err)
 	}
 
-	filename := filepath.Join(checkpointPath, "checkpoints.json")
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return nil
+	var anchor Anchor
+	switch {
+	case entryIndex != nil:
+		if *entryIndex < 0 || *entryIndex >= len(allEntries) {
+			return Anchor{}, fmt.Errorf("entry index %d is outside the log of %d entries", *entryIndex, len(allEntries))
+		}
+		if anchor, err = entryAnchor(allEntries[*entryIndex]); err != nil {
+			return Anchor{}, err
+		}
+	case lsn != "":
+		parsed, err := wal.ParseLSN(lsn)
+		if err != nil {
+			return Anchor{}, err
+		}
+		anchor.LSN = wal.FormatLSN(parsed)
+	default:
+		anchor.LSN = wal.FormatLSN(0)
+		for i := len(allEntries) - 1; i >= 0; i-- {
+			if allEntries[i].Origin == "" {
+				if anchor, err = entryAnchor(allEntries[i]); err != nil {
+					return Anchor{}, err
+				}
+				break
+			}
+		}
 	}
 
-	file, err := os.Open(filename)
+	return Reanchor(anchor, allEntries)
+}
+
+func entryAnchor(entry *wal.WALEntry) (Anchor, error) {
+	pos, err := entry.Anchor()
 	if err != nil {
-		return fmt.Errorf("failed to open checkpoint file: %w", err)
+		return Anchor{}, err
 	}
-	defer file.Close()
+	return Anchor{LSN: wal.FormatLSN(pos.LSN), Seq: pos.Seq, Origin: entry.Origin}, nil
+}
 
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&m.checkpoints); err != nil {
-		return fmt.Errorf("failed to decode checkpoints: %w", err)
+// coveredBy returns the entries of the anchor's origin at or before it, in
+// log order.
+func coveredBy(anchor Anchor, allEntries []*wal.WALEntry) ([]*wal.WALEntry, error) {
+	bound, err := anchor.position()
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	covered := make([]*wal.WALEntry, 0)
+	for _, entry := range allEntries {
+		if entry.Origin != anchor.Origin {
+			continue
+		}
+		pos, err := entry.Anchor()
+		if err != nil {
+			return nil, err
+		}
+		if covers(pos, bound) {
+			covered = append(covered, entry)
+		}
+	}
+	return covered, nil
 }
 
-func (m *Manager) save() error {
-	checkpointPath := m.config.Storage.CheckpointPath
-	if err := os.MkdirAll(checkpointPath, 0755); err != nil {
-		return fmt.Errorf("failed to create checkpoint directory: %w", err)
+// Reanchor returns anchor with the entry it ends on and the number of
+// entries it covers counted in entries instead of the log it was made
+// against, for a checkpoint moved to a log holding only some of the
+// entries.
+func Reanchor(anchor Anchor, entries []*wal.WALEntry) (Anchor, error) {
+	covered, err := coveredBy(anchor, entries)
+	if err != nil {
+		return Anchor{}, err
 	}
+	anchor.EntryCount = len(covered)
+	anchor.EntryID = ""
+	if len(covered) > 0 {
+		anchor.EntryID = covered[len(covered)-1].ID
+	}
+	return anchor, nil
+}
 
-	filename := filepath.Join(checkpointPath, "checkpoints.json")
-	file, err := os.Create(filename)
-	if err != nil {
-		return fmt.Errorf("failed to create checkpoint file: %w", err)
+// resolve returns the entries a checkpoint covers, checking them against
+// what was recorded when it was made.
+func resolve(cp *Checkpoint, allEntries []*wal.WALEntry) ([]*wal.WALEntry, error) {
+	if cp.Unresolved {
+		return nil, fmt.Errorf("%w: checkpoint %s: %s", ErrUnresolved, cp.ID, cp.Problem)
+	}
+	if cp.EntryIndex != nil {
+		return nil, fmt.Errorf("%w: checkpoint %s is anchored to an entry index", ErrUnresolved, cp.ID)
 	}
-	defer file.Close()
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(m.checkpoints); err != nil {
-		return fmt.Errorf("failed to encode checkpoints: %w", err)
+	covered, err := coveredBy(cp.Anchor, allEntries)
+	if err != nil {
+		return nil, fmt.Errorf("%w: checkpoint %s: %v", ErrUnresolved, cp.ID, err)
 	}
 
-	// Sync to disk to ensure data is persisted
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync checkpoint file: %w", err)
+	if cp.EntryID != "" {
+		found := false
+		for _, entry := range covered {
+			if entry.ID == cp.EntryID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: checkpoint %s: entry %s at %s is no longer in the log", ErrUnresolved, cp.ID, cp.EntryID, cp.LSN)
+		}
+	}
+	if len(covered) != cp.EntryCount {
+		return nil, fmt.Errorf("%w: checkpoint %s: the log holds %d entries up to %s, but it covered %d",
+			ErrUnresolved, cp.ID, len(covered), cp.LSN, cp.EntryCount)
 	}
 
-	return nil
+	return covered, nil
 }
 
-type Navigator struct {
-	walReader *wal.LogReader
-	manager   *Manager
+// convertIndex returns a copy of a checkpoint anchored by entry index,
+// anchored to the LSN of that entry instead.
+func convertIndex(cp *Checkpoint, allEntries []*wal.WALEntry) *Checkpoint {
+	converted := *cp
+	converted.EntryIndex = nil
+
+	index := *cp.EntryIndex
+	if index < 0 || index >= len(allEntries) {
+		converted.Unresolved = true
+		converted.Problem = fmt.Sprintf("entry index %d is outside the log of %d entries", index, len(allEntries))
+		return &converted
+	}
+
+	anchor, err := entryAnchor(allEntries[index])
+	if err == nil {
+		var covered []*wal.WALEntry
+		if covered, err = coveredBy(anchor, allEntries); err == nil {
+			anchor.EntryID = allEntries[index].ID
+			anchor.EntryCount = len(covered)
+		}
+	}
+	if err != nil {
+		converted.Unresolved = true
+		converted.Problem = err.Error()
+		return &converted
+	}
+
+	converted.Anchor = anchor
+	return &converted
 }
 
-func NewNavigator(walReader *wal.LogReader, manager *Manager) *Navigator {
-	return &Navigator{
-		walReader: walReader,
-		manager:   manager,
+// Validate checks every checkpoint against the log, converting checkpoints
+// anchored by entry index to LSN anchors, and flags those that no longer
+// resolve. Checkpoints that resolve again, for example after missing log
+// files were restored, are cleared. It returns the unresolved checkpoints.
+func (n *Navigator) Validate() ([]*Checkpoint, error) {
+	allEntries, err := n.walReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL entries: %w", err)
 	}
+
+	checkpoints, err := n.manager.ListCheckpoints("")
+	if err != nil {
+		return nil, err
+	}
+
+	unresolved := make([]*Checkpoint, 0)
+	for _, cp := range checkpoints {
+		checked := *cp
+		converted := cp.EntryIndex != nil
+		if converted {
+			checked = *convertIndex(cp, allEntries)
+		}
+		if !converted || !checked.Unresolved {
+			checked.Unresolved = false
+			checked.Problem = ""
+			if _, err := resolve(&checked, allEntries); err != nil {
+				checked.Unresolved = true
+				checked.Problem = strings.TrimPrefix(err.Error(), ErrUnresolved.Error()+": ")
+			} else if _, err := n.manager.Path(checked.ID); err != nil {
+				checked.Unresolved = true
+				checked.Problem = err.Error()
+			}
+		}
+
+		if checked != *cp {
+			if err := n.manager.updateCheckpoint(&checked); err != nil {
+				return nil, err
+			}
+		}
+		if checked.Unresolved {
+			unresolved = append(unresolved, &checked)
+		}
+	}
+
+	return unresolved, nil
 }
 
-func (n *Navigator) GetEntriesUpToCheckpoint(checkpointID string) ([]*wal.WALEntry, error) {
-	checkpoint, err := n.manager.GetCheckpoint(checkpointID)
+// checkpoint returns a checkpoint, converting it first if it is still
+// anchored by entry index.
+func (n *Navigator) checkpoint(id string, allEntries []*wal.WALEntry) (*Checkpoint, error) {
+	cp, err := n.manager.GetCheckpoint(id)
 	if err != nil {
 		return nil, err
 	}
+	if cp.EntryIndex != nil {
+		cp = convertIndex(cp, allEntries)
+		if err := n.manager.updateCheckpoint(cp); err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
+}
+
+// readWithCheckpoints reads the log and the checkpoints with the given IDs.
+func (n *Navigator) readWithCheckpoints(ids ...string) ([]*wal.WALEntry, []*Checkpoint, error) {
+	for _, id := range ids {
+		if _, err := n.manager.GetCheckpoint(id); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	allEntries, err := n.walReader.ReadAll()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read WAL entries: %w", err)
+		return nil, nil, fmt.Errorf("failed to read WAL entries: %w", err)
 	}
 
-	if checkpoint.EntryIndex >= len(allEntries) {
-		return allEntries, nil
+	checkpoints := make([]*Checkpoint, len(ids))
+	for i, id := range ids {
+		if checkpoints[i], err = n.checkpoint(id, allEntries); err != nil {
+			return nil, nil, err
+		}
 	}
+	return allEntries, checkpoints, nil
+}
 
-	return allEntries[:checkpoint.EntryIndex+1], nil
+// GetEntriesUpToCheckpoint returns the entries that lead to the checkpoint:
+// those of each checkpoint on its path from the root of its tree. It fails
+// with ErrUnresolved when the log no longer holds them.
+func (n *Navigator) GetEntriesUpToCheckpoint(checkpointID string) ([]*wal.WALEntry, error) {
+	allEntries, checkpoints, err := n.readWithCheckpoints(checkpointID)
+	if err != nil {
+		return nil, err
+	}
+	return n.entriesOf(checkpoints[0], allEntries)
 }
 
+// GetEntriesBetweenCheckpoints returns the entries from the last entry of
+// the earlier checkpoint up to and including the last entry of the later
+// one. The checkpoints must be on the same branch.
 func (n *Navigator) GetEntriesBetweenCheckpoints(startID, endID string) ([]*wal.WALEntry, error) {
-	startCP, err := n.manager.GetCheckpoint(startID)
+	allEntries, checkpoints, err := n.readWithCheckpoints(startID, endID)
 	if err != nil {
 		return nil, err
 	}
+	startCP, endCP := checkpoints[0], checkpoints[1]
 
-	endCP, err := n.manager.GetCheckpoint(endID)
+	before, err := n.entriesOf(startCP, allEntries)
+	if err != nil {
+		return nil, err
+	}
+	upTo, err := n.entriesOf(endCP, allEntries)
 	if err != nil {
 		return nil, err
 	}
 
-	allEntries, err := n.walReader.ReadAll()
+	if !contains(upTo, before) {
+		if !contains(before, upTo) {
+			return nil, fmt.Errorf("checkpoints %s and %s are on different branches", startID, endID)
+		}
+		startCP = endCP
+		before, upTo = upTo, before
+	}
+
+	return after(upTo, before, startCP.EntryID), nil
+}
+
+// GetEntriesAfterCheckpoint returns the entries after fromID up to and
+// including toID: the changes that take a database from the state at fromID
+// to the state at toID. Unlike GetEntriesBetweenCheckpoints it excludes the
+// entry fromID itself ends on, and it fails unless fromID leads to toID.
+func (n *Navigator) GetEntriesAfterCheckpoint(fromID, toID string) ([]*wal.WALEntry, error) {
+	allEntries, checkpoints, err := n.readWithCheckpoints(fromID, toID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read WAL entries: %w", err)
+		return nil, err
 	}
+	fromCP, toCP := checkpoints[0], checkpoints[1]
 
-	startIdx := startCP.EntryIndex
-	endIdx := endCP.EntryIndex
+	before, err := n.entriesOf(fromCP, allEntries)
+	if err != nil {
+		return nil, err
+	}
+	upTo, err := n.entriesOf(toCP, allEntries)
+	if err != nil {
+		return nil, err
+	}
 
-	if startIdx > endIdx {
-		startIdx, endIdx = endIdx, startIdx
+	if !contains(upTo, before) {
+		return nil, fmt.Errorf("checkpoint %s does not lead to checkpoint %s", fromID, toID)
 	}
 
-	if endIdx >= len(allEntries) {
-		endIdx = len(allEntries) - 1
+	return after(upTo, before, ""), nil
+}
+
+// contains reports whether every entry of subset is in entries.
+func contains(entries, subset []*wal.WALEntry) bool {
+	seen := make(map[*wal.WALEntry]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry] = true
+	}
+	for _, entry := range subset {
+		if !seen[entry] {
+			return false
+		}
+	}
+	return true
+}
+
+// after returns the entries of upTo that are not in before, keeping the
+// entry with ID keep.
+func after(upTo, before []*wal.WALEntry, keep string) []*wal.WALEntry {
+	seen := make(map[*wal.WALEntry]bool, len(before))
+	for _, entry := range before {
+		seen[entry] = true
 	}
 
-	return allEntries[startIdx : endIdx+1], nil
+	entries := make([]*wal.WALEntry, 0, len(upTo)-len(before)+1)
+	for _, entry := range upTo {
+		if !seen[entry] || (keep != "" && entry.ID == keep) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// compareAnchors orders checkpoints by their anchors. A Seq of 0 sorts
+// after every sequence number at the same LSN, since it covers the whole
+// transaction. Anchors that do not parse sort first.
+func compareAnchors(a, b Anchor) int {
+	posA, errA := a.position()
+	posB, errB := b.position()
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+
+	if posA.Seq == 0 {
+		posA.Seq = math.MaxInt
+	}
+	if posB.Seq == 0 {
+		posB.Seq = math.MaxInt
+	}
+	return posA.Compare(posB)
 }
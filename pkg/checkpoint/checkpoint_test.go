@@ -0,0 +1,207 @@
+package checkpoint
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func anchoredEntries() []*wal.WALEntry {
+	return []*wal.WALEntry{
+		{ID: "a1", LSN: "0/8", CommitLSN: "0/10", Seq: 1, Operation: wal.OpInsert, Table: "orders"},
+		{ID: "a2", LSN: "0/9", CommitLSN: "0/10", Seq: 2, Operation: wal.OpInsert, Table: "orders"},
+		{ID: "b1", LSN: "0/18", CommitLSN: "0/20", Seq: 1, Operation: wal.OpUpdate, Table: "orders"},
+		{ID: "c1", LSN: "0/28", CommitLSN: "0/30", Seq: 1, Operation: wal.OpDelete, Table: "orders"},
+	}
+}
+
+func entryIDs(entries []*wal.WALEntry) []string {
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID
+	}
+	return ids
+}
+
+func TestNavigator_AnchorWithinTransaction(t *testing.T) {
+	nav, manager := newTestNavigator(t, anchoredEntries())
+	cp := createTestCheckpoint(t, nav, manager, "mid transaction", 0)
+
+	if cp.LSN != "0/10" || cp.Seq != 1 || cp.EntryID != "a1" || cp.EntryCount != 1 {
+		t.Errorf("Expected anchor 0/10#1 on a1, got %+v", cp.Anchor)
+	}
+
+	got, err := nav.GetEntriesUpToCheckpoint(cp.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 1 || ids[0] != "a1" {
+		t.Errorf("Expected a1, got %v", ids)
+	}
+}
+
+func TestNavigator_AnchorAtLSN(t *testing.T) {
+	nav, manager := newTestNavigator(t, anchoredEntries())
+
+	anchor, err := nav.AnchorAt("0/25", nil)
+	if err != nil {
+		t.Fatalf("Failed to anchor checkpoint: %v", err)
+	}
+	if anchor.LSN != "0/25" || anchor.Seq != 0 || anchor.EntryID != "b1" || anchor.EntryCount != 3 {
+		t.Errorf("Expected 3 entries up to b1, got %+v", anchor)
+	}
+
+	cp, _ := manager.CreateCheckpoint("at lsn", "", anchor, Branch{}, "s1")
+	got, err := nav.GetEntriesUpToCheckpoint(cp.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if len(got) != 3 {
+		t.Errorf("Expected 3 entries, got %v", entryIDs(got))
+	}
+
+	if _, err := nav.AnchorAt("", intPtr(4)); err == nil {
+		t.Error("Expected error for an entry index beyond the log")
+	}
+}
+
+func TestNavigator_ResolveIgnoresLogOrder(t *testing.T) {
+	entries := anchoredEntries()
+	nav, manager := newTestNavigator(t, entries)
+	cp := createTestCheckpoint(t, nav, manager, "second commit", 2)
+
+	// The same entries in a different file order, as after files were
+	// rotated and merged.
+	reordered := []*wal.WALEntry{entries[3], entries[2], entries[0], entries[1]}
+	nav = NewNavigator(writeTestLog(t, filepath.Join(t.TempDir(), "wal"), reordered), manager)
+
+	got, err := nav.GetEntriesUpToCheckpoint(cp.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 3 || ids[0] != "b1" {
+		t.Errorf("Expected b1, a1 and a2, got %v", ids)
+	}
+}
+
+func TestNavigator_UnresolvedCheckpoint(t *testing.T) {
+	entries := anchoredEntries()
+	nav, manager := newTestNavigator(t, entries)
+	cp := createTestCheckpoint(t, nav, manager, "second commit", 2)
+	last := createTestCheckpoint(t, nav, manager, "end", 3)
+
+	// The first transaction was lost, for example with a deleted file.
+	nav = NewNavigator(writeTestLog(t, filepath.Join(t.TempDir(), "wal"), entries[2:]), manager)
+
+	if _, err := nav.GetEntriesUpToCheckpoint(cp.ID); !errors.Is(err, ErrUnresolved) {
+		t.Errorf("Expected ErrUnresolved, got %v", err)
+	}
+	if _, err := nav.GetEntriesAfterCheckpoint(cp.ID, last.ID); !errors.Is(err, ErrUnresolved) {
+		t.Errorf("Expected ErrUnresolved, got %v", err)
+	}
+
+	unresolved, err := nav.Validate()
+	if err != nil {
+		t.Fatalf("Failed to validate checkpoints: %v", err)
+	}
+	if len(unresolved) != 2 {
+		t.Fatalf("Expected 2 unresolved checkpoints, got %d", len(unresolved))
+	}
+	flagged, _ := manager.GetCheckpoint(cp.ID)
+	if !flagged.Unresolved || flagged.Problem == "" {
+		t.Errorf("Expected checkpoint to be flagged, got %+v", flagged)
+	}
+}
+
+func TestNavigator_ValidateConvertsEntryIndex(t *testing.T) {
+	nav, manager := newTestNavigator(t, anchoredEntries())
+
+	legacy, _ := manager.CreateCheckpoint("legacy", "", Anchor{}, Branch{}, "s1")
+	converted := *legacy
+	converted.EntryIndex = intPtr(2)
+	if err := manager.updateCheckpoint(&converted); err != nil {
+		t.Fatalf("Failed to update checkpoint: %v", err)
+	}
+
+	lost, _ := manager.CreateCheckpoint("lost", "", Anchor{}, Branch{}, "s1")
+	outOfRange := *lost
+	outOfRange.EntryIndex = intPtr(10)
+	if err := manager.updateCheckpoint(&outOfRange); err != nil {
+		t.Fatalf("Failed to update checkpoint: %v", err)
+	}
+
+	unresolved, err := nav.Validate()
+	if err != nil {
+		t.Fatalf("Failed to validate checkpoints: %v", err)
+	}
+	if len(unresolved) != 1 || unresolved[0].ID != lost.ID {
+		t.Errorf("Expected only the out of range checkpoint to be unresolved, got %v", unresolved)
+	}
+
+	cp, _ := manager.GetCheckpoint(legacy.ID)
+	if cp.EntryIndex != nil || cp.LSN != "0/20" || cp.Seq != 1 || cp.EntryID != "b1" || cp.EntryCount != 3 {
+		t.Errorf("Expected checkpoint anchored at 0/20#1 on b1, got %+v", cp)
+	}
+
+	if _, err := nav.GetEntriesUpToCheckpoint(lost.ID); !errors.Is(err, ErrUnresolved) {
+		t.Errorf("Expected ErrUnresolved for the out of range checkpoint, got %v", err)
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestNavigator_AnchorIgnoresImportedEntries(t *testing.T) {
+	entries := anchoredEntries()
+	entries = append(entries, &wal.WALEntry{ID: "i1", LSN: "0/18", Operation: wal.OpInsert, Table: "orders", Origin: "bundle"})
+	nav, _ := newTestNavigator(t, entries)
+
+	anchor, err := nav.AnchorAt("", nil)
+	if err != nil {
+		t.Fatalf("Failed to anchor checkpoint: %v", err)
+	}
+	if anchor.LSN != "0/30" || anchor.Origin != "" || anchor.EntryID != "c1" || anchor.EntryCount != 4 {
+		t.Errorf("Expected the last local entry c1 covering 4 entries, got %+v", anchor)
+	}
+
+	imported, err := nav.AnchorAt("", intPtr(4))
+	if err != nil {
+		t.Fatalf("Failed to anchor checkpoint: %v", err)
+	}
+	if imported.Origin != "bundle" || imported.EntryCount != 1 {
+		t.Errorf("Expected an anchor covering only the imported entry, got %+v", imported)
+	}
+}
+
+func TestManager_KeepsChangesOfOtherProcesses(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Storage.CheckpointPath = t.TempDir()
+	cfg.Storage.SessionPath = t.TempDir()
+
+	// Two managers with their own stores on the same file, as in the
+	// listener and the IPC server.
+	first := NewManager(cfg, newTestStore(t, cfg))
+	second := NewManager(cfg, store.NewJSONStore(cfg))
+
+	a, err := first.CreateCheckpoint("a", "", Anchor{LSN: "0/10"}, Branch{}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	b, err := second.CreateCheckpoint("b", "", Anchor{LSN: "0/20"}, Branch{}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+
+	for _, manager := range []*Manager{first, second, NewManager(cfg, store.NewJSONStore(cfg))} {
+		for _, id := range []string{a.ID, b.ID} {
+			if _, err := manager.GetCheckpoint(id); err != nil {
+				t.Errorf("Expected checkpoint %s to be kept, got %v", id, err)
+			}
+		}
+	}
+}
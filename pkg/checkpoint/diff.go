@@ -0,0 +1,406 @@
+package checkpoint
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// RowChange is the net change of one row between two checkpoints.
+type RowChange struct {
+	// Key identifies the row at the first checkpoint, or at the second for
+	// inserted rows. NewKey is set when an update changed the key.
+	Key    map[string]string `json:"key"`
+	NewKey map[string]string `json:"new_key,omitempty"`
+	// Row is the inserted row, the deleted row as far as the log knows it,
+	// or the updated row at the second checkpoint.
+	Row     map[string]interface{} `json:"row,omitempty"`
+	Changes []ColumnChange         `json:"changes,omitempty"`
+	// Unknown lists the columns an update wrote whose earlier value is not
+	// in the log, so whether they changed cannot be told. This happens for
+	// rows that predate the log in tables without REPLICA IDENTITY FULL.
+	Unknown []string `json:"unknown,omitempty"`
+}
+
+// TableChanges is the net change of one table.
+type TableChanges struct {
+	Schema   string      `json:"schema"`
+	Table    string      `json:"table"`
+	Inserted []RowChange `json:"inserted"`
+	Updated  []RowChange `json:"updated"`
+	Deleted  []RowChange `json:"deleted"`
+	// Untracked counts the changes whose row could not be identified,
+	// because the table has no key and the old row was not captured.
+	Untracked int `json:"untracked,omitempty"`
+}
+
+// ChangeSet is the net effect of the entries between two checkpoints:
+// what a database at the first checkpoint must change to match the second,
+// with changes that cancel out or are overwritten removed.
+type ChangeSet struct {
+	FromCheckpointID string          `json:"from_checkpoint_id,omitempty"`
+	ToCheckpointID   string          `json:"to_checkpoint_id"`
+	Entries          int             `json:"entries"`
+	Inserted         int             `json:"inserted"`
+	Updated          int             `json:"updated"`
+	Deleted          int             `json:"deleted"`
+	Tables           []*TableChanges `json:"tables"`
+	DDL              []string        `json:"ddl,omitempty"`
+}
+
+// rowState follows one row through the entries of a diff.
+type rowState struct {
+	table   string
+	key     map[string]string
+	existed bool
+	before  map[string]interface{}
+	after   map[string]interface{}
+	written map[string]bool
+}
+
+// Diff returns the net change from the state at fromID to the state at
+// toID. An empty fromID diffs from the start of the log. fromID must lead
+// to toID, as for GetEntriesAfterCheckpoint.
+func (n *Navigator) Diff(fromID, toID string) (*ChangeSet, error) {
+	ids := []string{toID}
+	if fromID != "" {
+		ids = append(ids, fromID)
+	}
+	allEntries, checkpoints, err := n.readWithCheckpoints(ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	upTo, err := n.entriesOf(checkpoints[0], allEntries)
+	if err != nil {
+		return nil, err
+	}
+	before := make([]*wal.WALEntry, 0)
+	if fromID != "" {
+		if before, err = n.entriesOf(checkpoints[1], allEntries); err != nil {
+			return nil, err
+		}
+		if !contains(upTo, before) {
+			return nil, fmt.Errorf("checkpoint %s does not lead to checkpoint %s", fromID, toID)
+		}
+	}
+
+	changes := diffEntries(before, after(upTo, before, ""))
+	changes.FromCheckpointID = fromID
+	changes.ToCheckpointID = toID
+	return changes, nil
+}
+
+// diffEntries returns the net change of entries, applied to the state that
+// before leads to.
+func diffEntries(before, entries []*wal.WALEntry) *ChangeSet {
+	start := snapshot(before)
+
+	changes := &ChangeSet{Entries: len(entries), Tables: make([]*TableChanges, 0)}
+	tables := make(map[string]*TableChanges)
+	tableFor := func(entry *wal.WALEntry) *TableChanges {
+		name := entry.Schema + "." + entry.Table
+		if t, ok := tables[name]; ok {
+			return t
+		}
+		t := &TableChanges{
+			Schema:   entry.Schema,
+			Table:    entry.Table,
+			Inserted: make([]RowChange, 0),
+			Updated:  make([]RowChange, 0),
+			Deleted:  make([]RowChange, 0),
+		}
+		tables[name] = t
+		changes.Tables = append(changes.Tables, t)
+		return t
+	}
+
+	// states holds every row touched, in order of first change; current
+	// maps the identity of each row that exists now to its state.
+	// gone maps the identity of rows deleted in the range to their state, so
+	// that a row inserted again nets to an update.
+	states := make([]*rowState, 0)
+	current := make(map[string]*rowState)
+	gone := make(map[string]*rowState)
+
+	for _, entry := range entries {
+		if entry.Operation == wal.OpDDL {
+			changes.DDL = append(changes.DDL, entry.SQL)
+			continue
+		}
+		if entry.Table == "" {
+			continue
+		}
+		name := entry.Schema + "." + entry.Table
+
+		switch entry.Operation {
+		case wal.OpInsert:
+			id, ok := rowID(entry, entry.Data)
+			if !ok {
+				tableFor(entry).Untracked++
+				continue
+			}
+			st, reinserted := gone[name+id]
+			if reinserted {
+				delete(gone, name+id)
+				for col := range entry.Data {
+					st.written[col] = true
+				}
+			} else {
+				st = &rowState{table: name, written: make(map[string]bool)}
+				states = append(states, st)
+			}
+			current[name+id] = st
+			st.after = wal.MergeRows(nil, entry.Data)
+
+		case wal.OpUpdate, wal.OpDelete:
+			oldImage := entry.OldData
+			if len(entry.KeyColumns) > 0 {
+				oldImage = entry.OldKey()
+			}
+			id, ok := rowID(entry, oldImage)
+			if !ok {
+				tableFor(entry).Untracked++
+				continue
+			}
+
+			st, exists := current[name+id]
+			if !exists {
+				st = &rowState{
+					table:   name,
+					key:     identity(entry, oldImage),
+					existed: true,
+					before:  wal.MergeRows(wal.MergeRows(start[name+id], oldImage), entry.OldData),
+					written: make(map[string]bool),
+				}
+				st.after = st.before
+				states = append(states, st)
+			}
+			delete(current, name+id)
+
+			if entry.Operation == wal.OpDelete {
+				st.after = nil
+				if st.existed {
+					gone[name+id] = st
+				}
+				continue
+			}
+			st.after = wal.MergeRows(st.after, entry.Data)
+			for col := range entry.Data {
+				st.written[col] = true
+			}
+			if newID, ok := rowID(entry, st.after); ok {
+				current[name+newID] = st
+			}
+		}
+	}
+
+	byName := make(map[string]*wal.WALEntry)
+	for _, entry := range entries {
+		if entry.Table != "" {
+			byName[entry.Schema+"."+entry.Table] = entry
+		}
+	}
+
+	for _, st := range states {
+		table := tableFor(byName[st.table])
+		switch {
+		case !st.existed && st.after == nil:
+			// Inserted and deleted again.
+		case !st.existed:
+			table.Inserted = append(table.Inserted, RowChange{Key: identity(byName[st.table], st.after), Row: st.after})
+			changes.Inserted++
+		case st.after == nil:
+			table.Deleted = append(table.Deleted, RowChange{Key: st.key, Row: st.before})
+			changes.Deleted++
+		default:
+			change := updateChange(st, byName[st.table])
+			if len(change.Changes) == 0 && len(change.Unknown) == 0 {
+				continue
+			}
+			table.Updated = append(table.Updated, change)
+			changes.Updated++
+		}
+	}
+
+	filtered := changes.Tables[:0]
+	for _, t := range changes.Tables {
+		if len(t.Inserted)+len(t.Updated)+len(t.Deleted) > 0 || t.Untracked > 0 {
+			filtered = append(filtered, t)
+		}
+	}
+	changes.Tables = filtered
+	sort.SliceStable(changes.Tables, func(i, j int) bool {
+		a, b := changes.Tables[i], changes.Tables[j]
+		return a.Schema+"."+a.Table < b.Schema+"."+b.Table
+	})
+
+	return changes
+}
+
+// updateChange returns the net change of a row that existed before and
+// after.
+func updateChange(st *rowState, entry *wal.WALEntry) RowChange {
+	change := RowChange{Key: st.key, Row: st.after, Changes: make([]ColumnChange, 0)}
+
+	for _, c := range diffRows(st.before, st.after) {
+		if _, known := st.before[c.Column]; known {
+			change.Changes = append(change.Changes, c)
+		} else if st.written[c.Column] {
+			change.Unknown = append(change.Unknown, c.Column)
+		}
+	}
+
+	if newKey := identity(entry, st.after); len(entry.KeyColumns) > 0 && !sameKey(newKey, st.key) {
+		change.NewKey = newKey
+	}
+	return change
+}
+
+// snapshot replays entries into the row images they lead to, by table
+// and row identity.
+func snapshot(entries []*wal.WALEntry) map[string]map[string]interface{} {
+	rows := make(map[string]map[string]interface{})
+	for _, entry := range entries {
+		if entry.Table == "" {
+			continue
+		}
+		name := entry.Schema + "." + entry.Table
+
+		var row map[string]interface{}
+		if entry.Operation != wal.OpInsert {
+			oldImage := entry.OldData
+			if len(entry.KeyColumns) > 0 {
+				oldImage = entry.OldKey()
+			}
+			id, ok := rowID(entry, oldImage)
+			if !ok {
+				continue
+			}
+			row = wal.MergeRows(rows[name+id], entry.OldData)
+			delete(rows, name+id)
+		}
+
+		switch entry.Operation {
+		case wal.OpInsert, wal.OpUpdate:
+			row = wal.MergeRows(row, entry.Data)
+			if id, ok := rowID(entry, row); ok {
+				rows[name+id] = row
+			}
+		}
+	}
+	return rows
+}
+
+// identity returns the values that identify a row: its key columns, or
+// every column for tables without a key.
+func identity(entry *wal.WALEntry, row map[string]interface{}) map[string]string {
+	if row == nil {
+		return nil
+	}
+	if len(entry.KeyColumns) == 0 {
+		return stringKey(row)
+	}
+	key := make(map[string]string, len(entry.KeyColumns))
+	for _, col := range entry.KeyColumns {
+		if v, ok := row[col]; ok {
+			key[col] = fmt.Sprint(v)
+		}
+	}
+	return key
+}
+
+// rowID returns a string naming the row by its identity. It reports false
+// when row does not carry the identity.
+func rowID(entry *wal.WALEntry, row map[string]interface{}) (string, bool) {
+	key := identity(entry, row)
+	if len(key) == 0 || (len(entry.KeyColumns) > 0 && len(key) != len(entry.KeyColumns)) {
+		return "", false
+	}
+	return "\x00" + formatKey(key), true
+}
+
+func sameKey(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for col, v := range a {
+		if b[col] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// formatKey formats a key as col=value pairs sorted by column.
+func formatKey(key map[string]string) string {
+	pairs := make([]string, 0, len(key))
+	for col, v := range key {
+		pairs = append(pairs, col+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// WriteText writes the change set as a report for people to read.
+func (c *ChangeSet) WriteText(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	from := c.FromCheckpointID
+	if from == "" {
+		from = "start of log"
+	}
+	fmt.Fprintf(bw, "Diff %s -> %s: %d entries, %d inserted, %d updated, %d deleted\n",
+		from, c.ToCheckpointID, c.Entries, c.Inserted, c.Updated, c.Deleted)
+
+	for _, t := range c.Tables {
+		fmt.Fprintf(bw, "\n%s.%s\n", t.Schema, t.Table)
+		for _, row := range t.Inserted {
+			fmt.Fprintf(bw, "  + %s %s\n", formatKey(row.Key), formatValue(row.Row))
+		}
+		for _, row := range t.Updated {
+			key := formatKey(row.Key)
+			if row.NewKey != nil {
+				key += " -> " + formatKey(row.NewKey)
+			}
+			fmt.Fprintf(bw, "  ~ %s\n", key)
+			for _, change := range row.Changes {
+				fmt.Fprintf(bw, "      %s: %s -> %s\n", change.Column, formatValue(change.Old), formatValue(change.New))
+			}
+			for _, col := range row.Unknown {
+				fmt.Fprintf(bw, "      %s: ? -> %s\n", col, formatValue(row.Row[col]))
+			}
+		}
+		for _, row := range t.Deleted {
+			fmt.Fprintf(bw, "  - %s\n", formatKey(row.Key))
+		}
+		if t.Untracked > 0 {
+			fmt.Fprintf(bw, "  ! %d changes to rows that could not be identified\n", t.Untracked)
+		}
+	}
+
+	if len(c.DDL) > 0 {
+		fmt.Fprintf(bw, "\nDDL\n")
+		for _, stmt := range c.DDL {
+			fmt.Fprintf(bw, "  %s\n", stmt)
+		}
+	}
+
+	return bw.Flush()
+}
+
+func formatValue(v interface{}) string {
+	if v == nil {
+		return "NULL"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
@@ -0,0 +1,101 @@
+package checkpoint
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestNavigator_Diff(t *testing.T) {
+	keys := []string{"id"}
+	row := func(op wal.OperationType, data, old map[string]interface{}) *wal.WALEntry {
+		return &wal.WALEntry{Operation: op, Schema: "public", Table: "orders", KeyColumns: keys, Data: data, OldData: old}
+	}
+	entries := []*wal.WALEntry{
+		row(wal.OpInsert, map[string]interface{}{"id": "1", "status": "new", "total": "10"}, nil),
+		row(wal.OpInsert, map[string]interface{}{"id": "2", "status": "new", "total": "20"}, nil),
+		row(wal.OpInsert, map[string]interface{}{"id": "9", "status": "new", "total": "90"}, nil),
+		// From here on the changes diffed.
+		row(wal.OpUpdate, map[string]interface{}{"id": "1", "status": "paid", "total": "10"}, nil),
+		row(wal.OpUpdate, map[string]interface{}{"id": "1", "status": "paid", "total": "12"}, nil),
+		row(wal.OpInsert, map[string]interface{}{"id": "3", "status": "new", "total": "30"}, nil),
+		row(wal.OpDelete, nil, map[string]interface{}{"id": "3"}),
+		row(wal.OpDelete, nil, map[string]interface{}{"id": "2"}),
+		row(wal.OpInsert, map[string]interface{}{"id": "4", "status": "new", "total": "40"}, nil),
+		row(wal.OpUpdate, map[string]interface{}{"id": "9", "status": "new", "total": "90"}, nil),
+		row(wal.OpDelete, nil, map[string]interface{}{"id": "5"}),
+		row(wal.OpUpdate, map[string]interface{}{"id": "6", "status": "paid"}, nil),
+	}
+	for i, entry := range entries {
+		entry.ID = fmt.Sprintf("e%d", i)
+		entry.LSN = fmt.Sprintf("0/%X", (i+1)*16)
+	}
+
+	nav, manager := newTestNavigator(t, entries)
+	from := createTestCheckpoint(t, nav, manager, "from", 2)
+	to := createTestCheckpoint(t, nav, manager, "to", len(entries)-1)
+
+	changes, err := nav.Diff(from.ID, to.ID)
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	if changes.Entries != 9 || len(changes.Tables) != 1 {
+		t.Fatalf("Expected 9 entries in one table, got %d in %d", changes.Entries, len(changes.Tables))
+	}
+	table := changes.Tables[0]
+
+	if len(table.Inserted) != 1 || table.Inserted[0].Key["id"] != "4" {
+		t.Errorf("Expected row 4 inserted, got %+v", table.Inserted)
+	}
+	if len(table.Deleted) != 2 || table.Deleted[0].Key["id"] != "2" || table.Deleted[1].Key["id"] != "5" {
+		t.Errorf("Expected rows 2 and 5 deleted, got %+v", table.Deleted)
+	}
+	if len(table.Updated) != 2 {
+		t.Fatalf("Expected 2 updated rows, got %+v", table.Updated)
+	}
+
+	paid := table.Updated[0]
+	if paid.Key["id"] != "1" || len(paid.Changes) != 2 ||
+		paid.Changes[0].Column != "status" || paid.Changes[0].Old != "new" || paid.Changes[0].New != "paid" ||
+		paid.Changes[1].Column != "total" || paid.Changes[1].Old != "10" || paid.Changes[1].New != "12" {
+		t.Errorf("Expected status new -> paid and total 10 -> 12, got %+v", paid.Changes)
+	}
+
+	unknown := table.Updated[1]
+	if unknown.Key["id"] != "6" || len(unknown.Changes) != 0 || len(unknown.Unknown) != 1 || unknown.Unknown[0] != "status" {
+		t.Errorf("Expected unknown status change of row 6, got %+v", unknown)
+	}
+
+	var report bytes.Buffer
+	if err := changes.WriteText(&report); err != nil {
+		t.Fatalf("Failed to write report: %v", err)
+	}
+	for _, want := range []string{"  + id=4 ", "  ~ id=1\n", `status: "new" -> "paid"`, "  - id=2\n", `status: ? -> "paid"`} {
+		if !strings.Contains(report.String(), want) {
+			t.Errorf("Expected report to contain %q, got:\n%s", want, report.String())
+		}
+	}
+}
+
+func TestDiffEntries_ReinsertIsUpdate(t *testing.T) {
+	keys := []string{"id"}
+	before := []*wal.WALEntry{
+		{Operation: wal.OpInsert, Schema: "public", Table: "orders", KeyColumns: keys, Data: map[string]interface{}{"id": "1", "status": "new"}},
+	}
+	entries := []*wal.WALEntry{
+		{Operation: wal.OpDelete, Schema: "public", Table: "orders", KeyColumns: keys, OldData: map[string]interface{}{"id": "1"}},
+		{Operation: wal.OpInsert, Schema: "public", Table: "orders", KeyColumns: keys, Data: map[string]interface{}{"id": "1", "status": "paid"}},
+	}
+
+	changes := diffEntries(before, entries)
+	if changes.Inserted != 0 || changes.Deleted != 0 || changes.Updated != 1 {
+		t.Fatalf("Expected one update, got %+v", changes)
+	}
+	change := changes.Tables[0].Updated[0]
+	if len(change.Changes) != 1 || change.Changes[0].Column != "status" {
+		t.Errorf("Expected status change, got %+v", change.Changes)
+	}
+}
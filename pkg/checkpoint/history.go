@@ -0,0 +1,218 @@
+package checkpoint
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// ColumnChange is the change of a single column between two versions of a
+// row. Old is nil for inserted rows and New is nil for deleted rows.
+type ColumnChange struct {
+	Column string      `json:"column"`
+	Old    interface{} `json:"old"`
+	New    interface{} `json:"new"`
+}
+
+// RowVersion is one change in the history of a row.
+type RowVersion struct {
+	EntryID        string                 `json:"entry_id"`
+	LSN            string                 `json:"lsn"`
+	TxID           uint32                 `json:"xid,omitempty"`
+	Timestamp      time.Time              `json:"timestamp"`
+	Operation      wal.OperationType      `json:"operation"`
+	Data           map[string]interface{} `json:"data"`
+	Changes        []ColumnChange         `json:"changes"`
+	CheckpointID   string                 `json:"checkpoint_id,omitempty"`
+	CheckpointName string                 `json:"checkpoint_name,omitempty"`
+}
+
+// RowHistory is the ordered list of changes made to a single row.
+type RowHistory struct {
+	Schema   string            `json:"schema"`
+	Table    string            `json:"table"`
+	Key      map[string]string `json:"key"`
+	Versions []RowVersion      `json:"versions"`
+}
+
+// RowHistory walks the WAL log and returns every INSERT, UPDATE and DELETE
+// of the row identified by key in schema.table, oldest first. An empty
+// schema matches any schema. A key with an empty column name matches the
+// value of a single-column primary key. When an update changes the key,
+// the history follows the row to its new key.
+//
+// Each version links to the earliest checkpoint whose replay range
+// includes the change.
+func (n *Navigator) RowHistory(schema, table string, key map[string]string) (*RowHistory, error) {
+	if table == "" || len(key) == 0 {
+		return nil, fmt.Errorf("table and key are required")
+	}
+
+	allEntries, err := n.walReader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL entries: %w", err)
+	}
+
+	checkpoints, err := n.manager.ListCheckpoints("")
+	if err != nil {
+		return nil, err
+	}
+	anchored := make([]*Checkpoint, 0, len(checkpoints))
+	for _, cp := range checkpoints {
+		if cp.EntryIndex != nil {
+			cp = convertIndex(cp, allEntries)
+		}
+		if !cp.Unresolved {
+			anchored = append(anchored, cp)
+		}
+	}
+	checkpoints = anchored
+	sort.SliceStable(checkpoints, func(i, j int) bool {
+		return compareAnchors(checkpoints[i].Anchor, checkpoints[j].Anchor) < 0
+	})
+
+	history := &RowHistory{
+		Schema:   schema,
+		Table:    table,
+		Key:      key,
+		Versions: make([]RowVersion, 0),
+	}
+
+	tracked := key
+	var current map[string]interface{}
+
+	for _, entry := range allEntries {
+		if entry.Table != table || (schema != "" && entry.Schema != schema) {
+			continue
+		}
+		if !keyMatches(entry.OldKey(), tracked) {
+			continue
+		}
+
+		version := RowVersion{
+			EntryID:   entry.ID,
+			LSN:       entry.LSN,
+			TxID:      entry.TxID,
+			Timestamp: entry.Timestamp,
+			Operation: entry.Operation,
+		}
+
+		previous := current
+		if previous == nil {
+			previous = entry.OldData
+		}
+
+		switch entry.Operation {
+		case wal.OpInsert:
+			version.Data = entry.Data
+			version.Changes = diffRows(nil, entry.Data)
+		case wal.OpUpdate:
+			version.Data = wal.MergeRows(previous, entry.Data)
+			version.Changes = diffRows(previous, entry.Data)
+		case wal.OpDelete:
+			version.Changes = diffRows(wal.MergeRows(previous, entry.OldData), nil)
+		default:
+			continue
+		}
+
+		if cp := checkpointFor(checkpoints, entry); cp != nil {
+			version.CheckpointID = cp.ID
+			version.CheckpointName = cp.Name
+		}
+
+		history.Versions = append(history.Versions, version)
+		current = version.Data
+
+		if newKey := entry.NewKey(); newKey != nil {
+			tracked = stringKey(newKey)
+		}
+	}
+
+	return history, nil
+}
+
+// keyMatches reports whether the entry's key values equal the wanted key.
+func keyMatches(entryKey map[string]interface{}, want map[string]string) bool {
+	if entryKey == nil {
+		return false
+	}
+
+	for col, value := range want {
+		if col == "" {
+			if len(entryKey) != 1 {
+				return false
+			}
+			for _, v := range entryKey {
+				if fmt.Sprint(v) != value {
+					return false
+				}
+			}
+			continue
+		}
+
+		v, ok := entryKey[col]
+		if !ok || fmt.Sprint(v) != value {
+			return false
+		}
+	}
+
+	return true
+}
+
+func stringKey(key map[string]interface{}) map[string]string {
+	result := make(map[string]string, len(key))
+	for col, v := range key {
+		result[col] = fmt.Sprint(v)
+	}
+	return result
+}
+
+// diffRows returns the columns whose values differ between the two
+// versions, sorted by column name.
+func diffRows(before, after map[string]interface{}) []ColumnChange {
+	columns := make(map[string]struct{}, len(before)+len(after))
+	for col := range before {
+		columns[col] = struct{}{}
+	}
+	for col := range after {
+		columns[col] = struct{}{}
+	}
+
+	changes := make([]ColumnChange, 0)
+	for col := range columns {
+		oldValue, hadOld := before[col]
+		newValue, hasNew := after[col]
+		if after != nil && !hasNew {
+			// Not captured in the new row, so it did not change.
+			continue
+		}
+		if hadOld && hasNew && reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		changes = append(changes, ColumnChange{Column: col, Old: oldValue, New: newValue})
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Column < changes[j].Column
+	})
+
+	return changes
+}
+
+// checkpointFor returns the earliest checkpoint whose own entries include
+// entry. checkpoints must be sorted by anchor.
+func checkpointFor(checkpoints []*Checkpoint, entry *wal.WALEntry) *Checkpoint {
+	pos, err := entry.Anchor()
+	if err != nil {
+		return nil
+	}
+	for _, cp := range checkpoints {
+		if cp.Origin == entry.Origin && cp.ownsEntry(entry, pos) {
+			return cp
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package checkpoint
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func newTestNavigator(t *testing.T, entries []*wal.WALEntry) (*Navigator, *Manager) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.CheckpointPath = filepath.Join(tmpDir, "checkpoints")
+	cfg.Storage.SessionPath = filepath.Join(tmpDir, "sessions")
+	cfg.Storage.WALLogPath = filepath.Join(tmpDir, "wal")
+
+	manager := NewManager(cfg, newTestStore(t, cfg))
+	return NewNavigator(writeTestLog(t, cfg.Storage.WALLogPath, entries), manager), manager
+}
+
+// newTestStore returns a store holding session s1, which test checkpoints
+// belong to.
+func newTestStore(t *testing.T, cfg *config.Config) store.Store {
+	t.Helper()
+	st := store.NewJSONStore(cfg)
+	if err := session.NewManager(cfg, st).AddSession(&session.Session{ID: "s1", Checkpoints: []string{}}); err != nil {
+		t.Fatalf("Failed to add session: %v", err)
+	}
+	return st
+}
+
+func writeTestLog(t *testing.T, dir string, entries []*wal.WALEntry) *wal.LogReader {
+	t.Helper()
+	writer, err := wal.NewLogWriter(dir)
+	if err != nil {
+		t.Fatalf("Failed to create log writer: %v", err)
+	}
+	for _, entry := range entries {
+		if err := writer.WriteEntry(entry); err != nil {
+			t.Fatalf("Failed to write entry: %v", err)
+		}
+	}
+	writer.Close()
+	return wal.NewLogReader(dir)
+}
+
+func createTestCheckpoint(t *testing.T, nav *Navigator, manager *Manager, name string, entryIndex int) *Checkpoint {
+	t.Helper()
+	anchor, err := nav.AnchorAt("", &entryIndex)
+	if err != nil {
+		t.Fatalf("Failed to anchor checkpoint: %v", err)
+	}
+	cp, err := manager.CreateCheckpoint(name, "", anchor, Branch{}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	return cp
+}
+
+func TestNavigator_RowHistory(t *testing.T) {
+	keys := []string{"id"}
+	now := time.Now()
+	entries := []*wal.WALEntry{
+		{ID: "e1", Timestamp: now, LSN: "0/10", Operation: wal.OpInsert, Schema: "public", Table: "orders", KeyColumns: keys,
+			Data: map[string]interface{}{"id": "42", "status": "new"}},
+		{ID: "e2", Timestamp: now, LSN: "0/20", Operation: wal.OpInsert, Schema: "public", Table: "orders", KeyColumns: keys,
+			Data: map[string]interface{}{"id": "43", "status": "new"}},
+		{ID: "e3", Timestamp: now, LSN: "0/30", Operation: wal.OpUpdate, Schema: "public", Table: "orders", KeyColumns: keys,
+			Data: map[string]interface{}{"id": "42", "status": "paid"}},
+		{ID: "e4", Timestamp: now, LSN: "0/40", Operation: wal.OpUpdate, Schema: "public", Table: "orders", KeyColumns: keys,
+			Data: map[string]interface{}{"id": "420", "status": "paid"}, OldData: map[string]interface{}{"id": "42"}},
+		{ID: "e5", Timestamp: now, LSN: "0/50", Operation: wal.OpDelete, Schema: "public", Table: "orders", KeyColumns: keys,
+			OldData: map[string]interface{}{"id": "420"}},
+	}
+
+	nav, manager := newTestNavigator(t, entries)
+	first := createTestCheckpoint(t, nav, manager, "after insert", 0)
+	second := createTestCheckpoint(t, nav, manager, "end", 4)
+
+	history, err := nav.RowHistory("public", "orders", map[string]string{"": "42"})
+	if err != nil {
+		t.Fatalf("Failed to build row history: %v", err)
+	}
+
+	if len(history.Versions) != 4 {
+		t.Fatalf("Expected 4 versions, got %d", len(history.Versions))
+	}
+
+	insert := history.Versions[0]
+	if insert.Operation != wal.OpInsert || insert.CheckpointID != first.ID {
+		t.Errorf("Expected insert under first checkpoint, got %+v", insert)
+	}
+
+	update := history.Versions[1]
+	if len(update.Changes) != 1 || update.Changes[0].Column != "status" ||
+		update.Changes[0].Old != "new" || update.Changes[0].New != "paid" {
+		t.Errorf("Expected status change new → paid, got %+v", update.Changes)
+	}
+	if update.CheckpointID != second.ID {
+		t.Errorf("Expected update under second checkpoint, got %s", update.CheckpointID)
+	}
+
+	rekey := history.Versions[2]
+	if len(rekey.Changes) != 1 || rekey.Changes[0].Column != "id" || rekey.Changes[0].New != "420" {
+		t.Errorf("Expected key change to 420, got %+v", rekey.Changes)
+	}
+
+	deleted := history.Versions[3]
+	if deleted.Operation != wal.OpDelete || deleted.Data != nil || len(deleted.Changes) != 2 {
+		t.Errorf("Expected delete of the followed row, got %+v", deleted)
+	}
+}
+
+func TestNavigator_GetEntriesAfterCheckpoint(t *testing.T) {
+	entries := make([]*wal.WALEntry, 5)
+	for i := range entries {
+		entries[i] = &wal.WALEntry{ID: fmt.Sprintf("e%d", i), LSN: fmt.Sprintf("0/%X", (i+1)*16), Operation: wal.OpInsert, Table: "orders"}
+	}
+
+	nav, manager := newTestNavigator(t, entries)
+	from := createTestCheckpoint(t, nav, manager, "from", 1)
+	to := createTestCheckpoint(t, nav, manager, "to", 3)
+
+	got, err := nav.GetEntriesAfterCheckpoint(from.ID, to.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "e2" || got[1].ID != "e3" {
+		t.Errorf("Expected e2 and e3, got %v", got)
+	}
+
+	if _, err := nav.GetEntriesAfterCheckpoint(to.ID, from.ID); err == nil {
+		t.Error("Expected error when the end checkpoint is before the start")
+	}
+}
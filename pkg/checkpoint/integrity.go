@@ -0,0 +1,203 @@
+package checkpoint
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+)
+
+// errDryRun rolls back the transaction of a repair that only reports.
+var errDryRun = errors.New("dry run")
+
+// Repair is what Manager.Repair found wrong with the sessions and
+// checkpoints, and fixed unless it was a dry run.
+type Repair struct {
+	// Deleted lists the checkpoints whose session or parent does not
+	// exist, with the checkpoints that follow them.
+	Deleted []string `json:"deleted"`
+	// Attached lists the checkpoints their session did not list.
+	Attached []string `json:"attached"`
+	// Detached lists the missing checkpoints that sessions referred to.
+	Detached []string `json:"detached"`
+}
+
+// Empty reports whether nothing needed repairing.
+func (r *Repair) Empty() bool {
+	return len(r.Deleted) == 0 && len(r.Attached) == 0 && len(r.Detached) == 0
+}
+
+// descendants returns the given checkpoints with every checkpoint that
+// follows one of them.
+func descendants(checkpoints map[string]*Checkpoint, ids map[string]bool) map[string]bool {
+	found := make(map[string]bool, len(ids))
+	for id := range ids {
+		found[id] = true
+	}
+	for grown := true; grown; {
+		grown = false
+		for id, cp := range checkpoints {
+			if !found[id] && cp.ParentID != "" && found[cp.ParentID] {
+				found[id] = true
+				grown = true
+			}
+		}
+	}
+	return found
+}
+
+// deleteCheckpoints deletes checkpoints within a transaction and removes
+// them from their sessions. It returns their IDs in order.
+func deleteCheckpoints(tx store.Tx, ids map[string]bool) ([]string, error) {
+	deleted := make([]string, 0, len(ids))
+	for id := range ids {
+		if err := tx.Delete(store.Checkpoints, id); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, id)
+	}
+	if err := session.DetachCheckpoints(tx, ids); err != nil {
+		return nil, err
+	}
+	sort.Strings(deleted)
+	return deleted, nil
+}
+
+// DeleteSession deletes a session with its checkpoints, and the checkpoints
+// of other sessions that follow them. Checkpoints shared with a session
+// forked from it are kept and handed over to that session instead. It
+// returns the IDs of the checkpoints deleted.
+func (m *Manager) DeleteSession(sessionID string) ([]string, error) {
+	var deleted []string
+	err := m.store.Update(func(tx store.Tx) error {
+		if _, err := session.Get(tx, sessionID); err != nil {
+			return err
+		}
+		if err := tx.Delete(store.Sessions, sessionID); err != nil {
+			return err
+		}
+		checkpoints, err := listCheckpoints(tx)
+		if err != nil {
+			return err
+		}
+		sessions, err := session.List(tx)
+		if err != nil {
+			return err
+		}
+		// The oldest session sharing a checkpoint inherits it.
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+		})
+		sharedWith := make(map[string]string)
+		for _, sess := range sessions {
+			for _, id := range sess.Checkpoints {
+				if _, taken := sharedWith[id]; !taken {
+					sharedWith[id] = sess.ID
+				}
+			}
+		}
+
+		owned := make(map[string]bool)
+		for id, cp := range checkpoints {
+			if cp.SessionID != sessionID {
+				continue
+			}
+			if heir, ok := sharedWith[id]; ok {
+				// The checkpoint still covers the changes this session
+				// recorded.
+				cp.RecordedBy = cp.recordedBy()
+				cp.SessionID = heir
+				if err := putCheckpoint(tx, cp); err != nil {
+					return err
+				}
+				continue
+			}
+			owned[id] = true
+		}
+		deleted, err = deleteCheckpoints(tx, descendants(checkpoints, owned))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Repair reconciles sessions and checkpoints left inconsistent by earlier
+// versions or by a file restored from the journal. Checkpoints whose
+// session or parent is missing are deleted with the checkpoints that follow
+// them, checkpoints missing from their session's list are added to it, and
+// references to missing checkpoints are removed from sessions. With dryRun
+// it only reports what it would do.
+func (m *Manager) Repair(dryRun bool) (*Repair, error) {
+	repair := &Repair{}
+	err := m.store.Update(func(tx store.Tx) error {
+		*repair = Repair{Deleted: []string{}, Attached: []string{}, Detached: []string{}}
+
+		sessions, err := session.List(tx)
+		if err != nil {
+			return err
+		}
+		checkpoints, err := listCheckpoints(tx)
+		if err != nil {
+			return err
+		}
+		bySession := make(map[string]*session.Session, len(sessions))
+		for _, sess := range sessions {
+			bySession[sess.ID] = sess
+		}
+
+		orphans := make(map[string]bool)
+		for id, cp := range checkpoints {
+			_, hasSession := bySession[cp.SessionID]
+			_, hasParent := checkpoints[cp.ParentID]
+			if !hasSession || (cp.ParentID != "" && !hasParent) {
+				orphans[id] = true
+			}
+		}
+		orphans = descendants(checkpoints, orphans)
+
+		missing := make(map[string]bool)
+		for _, sess := range sessions {
+			listed := make(map[string]bool, len(sess.Checkpoints))
+			for _, id := range sess.Checkpoints {
+				listed[id] = true
+			}
+			for _, id := range append([]string{sess.Head, sess.ReplayCheckpoint}, sess.Checkpoints...) {
+				if _, exists := checkpoints[id]; id != "" && (!exists || orphans[id]) && !missing[id] {
+					missing[id] = true
+					if !orphans[id] {
+						repair.Detached = append(repair.Detached, id)
+					}
+				}
+			}
+			for id, cp := range checkpoints {
+				if cp.SessionID == sess.ID && !orphans[id] && !listed[id] {
+					if err := session.AttachCheckpoints(tx, sess.ID, id); err != nil {
+						return err
+					}
+					repair.Attached = append(repair.Attached, id)
+				}
+			}
+		}
+
+		if repair.Deleted, err = deleteCheckpoints(tx, orphans); err != nil {
+			return err
+		}
+		if err := session.DetachCheckpoints(tx, missing); err != nil {
+			return err
+		}
+		sort.Strings(repair.Attached)
+		sort.Strings(repair.Detached)
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return repair, nil
+}
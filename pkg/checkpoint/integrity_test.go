@@ -0,0 +1,234 @@
+package checkpoint
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+)
+
+func newIntegrityTest(t *testing.T) (*Manager, *session.Manager, store.Store) {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.CheckpointPath = filepath.Join(tmpDir, "checkpoints")
+	cfg.Storage.SessionPath = filepath.Join(tmpDir, "sessions")
+
+	st := newTestStore(t, cfg)
+	return NewManager(cfg, st), session.NewManager(cfg, st), st
+}
+
+func TestManager_CreateCheckpointRequiresSession(t *testing.T) {
+	manager, sessions, _ := newIntegrityTest(t)
+
+	if _, err := manager.CreateCheckpoint("stray", "", Anchor{LSN: "0/10"}, Branch{}, "missing"); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("Expected session.ErrNotFound, got %v", err)
+	}
+	if all, _ := manager.ListCheckpoints(""); len(all) != 0 {
+		t.Errorf("Expected no checkpoint to be created, got %d", len(all))
+	}
+
+	cp, err := manager.CreateCheckpoint("cp", "", Anchor{LSN: "0/10"}, Branch{}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	sess, _ := sessions.GetSession("s1")
+	if len(sess.Checkpoints) != 1 || sess.Checkpoints[0] != cp.ID {
+		t.Errorf("Expected the session to list %s, got %v", cp.ID, sess.Checkpoints)
+	}
+
+	if _, err := manager.GetCheckpoint("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestManager_DeleteCascades(t *testing.T) {
+	manager, sessions, _ := newIntegrityTest(t)
+	other, _ := sessions.CreateSession("other", "", "testdb")
+
+	root, _ := manager.CreateCheckpoint("root", "", Anchor{LSN: "0/10"}, Branch{}, "s1")
+	child, _ := manager.CreateCheckpoint("child", "", Anchor{LSN: "0/20"}, BranchFrom(root.ID, root.Anchor), "s1")
+	fork, _ := manager.CreateCheckpoint("fork", "", Anchor{LSN: "0/30"}, BranchFrom(child.ID, child.Anchor), other.ID)
+	manager.CreateCheckpoint("second", "", Anchor{LSN: "0/40"}, Branch{}, "s1")
+	if err := sessions.SetHead("s1", child.ID, child.LSN, child.Seq); err != nil {
+		t.Fatalf("Failed to set head: %v", err)
+	}
+
+	deleted, err := manager.DeleteCheckpoint(child.ID)
+	if err != nil {
+		t.Fatalf("Failed to delete checkpoint: %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("Expected the checkpoint and its fork to be deleted, got %v", deleted)
+	}
+	if _, err := manager.GetCheckpoint(fork.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the fork to be deleted, got %v", err)
+	}
+	sess, _ := sessions.GetSession("s1")
+	if len(sess.Checkpoints) != 2 || sess.Head != "" {
+		t.Errorf("Expected root and second without a head, got %v, head %q", sess.Checkpoints, sess.Head)
+	}
+	if sess, _ := sessions.GetSession(other.ID); len(sess.Checkpoints) != 0 {
+		t.Errorf("Expected the fork to be removed from its session, got %v", sess.Checkpoints)
+	}
+
+	if _, err := manager.DeleteCheckpoint(child.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	deleted, err = manager.DeleteSession("s1")
+	if err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("Expected root and second to be deleted, got %v", deleted)
+	}
+	if all, _ := manager.ListCheckpoints(""); len(all) != 0 {
+		t.Errorf("Expected no checkpoints left, got %d", len(all))
+	}
+	if _, err := manager.DeleteSession("s1"); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("Expected session.ErrNotFound, got %v", err)
+	}
+}
+
+func TestManager_Repair(t *testing.T) {
+	manager, sessions, st := newIntegrityTest(t)
+
+	kept, _ := manager.CreateCheckpoint("kept", "", Anchor{LSN: "0/10"}, Branch{}, "s1")
+	orphan := &Checkpoint{ID: "orphan", SessionID: "gone"}
+	child := &Checkpoint{ID: "child", SessionID: "s1", Branch: Branch{ParentID: "orphan"}}
+	unlisted := &Checkpoint{ID: "unlisted", SessionID: "s1"}
+	err := st.Update(func(tx store.Tx) error {
+		for _, cp := range []*Checkpoint{orphan, child, unlisted} {
+			if err := putCheckpoint(tx, cp); err != nil {
+				return err
+			}
+		}
+		sess, err := session.Get(tx, "s1")
+		if err != nil {
+			return err
+		}
+		sess.Checkpoints = append(sess.Checkpoints, "child", "dangling")
+		sess.Head = "dangling"
+		return session.Put(tx, sess)
+	})
+	if err != nil {
+		t.Fatalf("Failed to damage store: %v", err)
+	}
+
+	report, err := manager.Repair(true)
+	if err != nil {
+		t.Fatalf("Failed to check store: %v", err)
+	}
+	if len(report.Deleted) != 2 || len(report.Attached) != 1 || len(report.Detached) != 1 {
+		t.Errorf("Expected 2 deleted, 1 attached and 1 detached, got %+v", report)
+	}
+	if _, err := manager.GetCheckpoint("orphan"); err != nil {
+		t.Errorf("Expected a dry run to change nothing, got %v", err)
+	}
+
+	if _, err := manager.Repair(false); err != nil {
+		t.Fatalf("Failed to repair store: %v", err)
+	}
+	sess, _ := sessions.GetSession("s1")
+	if len(sess.Checkpoints) != 2 || sess.Checkpoints[0] != kept.ID || sess.Checkpoints[1] != "unlisted" || sess.Head != "" {
+		t.Errorf("Expected kept and unlisted without a head, got %v, head %q", sess.Checkpoints, sess.Head)
+	}
+	if _, err := manager.GetCheckpoint("child"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the orphan's child to be deleted, got %v", err)
+	}
+
+	if report, err := manager.Repair(false); err != nil || !report.Empty() {
+		t.Errorf("Expected nothing left to repair, got %+v, %v", report, err)
+	}
+}
+
+func TestManager_ForkSession(t *testing.T) {
+	manager, sessions, _ := newIntegrityTest(t)
+
+	root, _ := manager.CreateCheckpoint("root", "", Anchor{LSN: "0/10"}, Branch{}, "s1")
+	setup, _ := manager.CreateCheckpoint("setup", "", Anchor{LSN: "0/20"}, BranchFrom(root.ID, root.Anchor), "s1")
+	variant, _ := manager.CreateCheckpoint("variant", "", Anchor{LSN: "0/30"}, BranchFrom(setup.ID, setup.Anchor), "s1")
+
+	if _, err := sessions.ForkSession("s1", "missing", "fork"); !errors.Is(err, session.ErrNotInSession) {
+		t.Errorf("Expected session.ErrNotInSession, got %v", err)
+	}
+	if _, err := sessions.ForkSession("s1", "", "fork"); !errors.Is(err, session.ErrNotInSession) {
+		t.Errorf("Expected session.ErrNotInSession for a session without a head, got %v", err)
+	}
+
+	fork, err := sessions.ForkSession("s1", setup.ID, "")
+	if err != nil {
+		t.Fatalf("Failed to fork session: %v", err)
+	}
+	if fork.Head != setup.ID || fork.HeadLSN != "0/20" || fork.ForkedFrom != "s1" {
+		t.Errorf("Expected a fork of s1 headed at setup, got %+v", fork)
+	}
+
+	own, err := manager.CreateCheckpoint("own", "", Anchor{LSN: "0/40"}, BranchFrom(setup.ID, Anchor{LSN: "0/30"}), fork.ID)
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	listed, _ := manager.ListCheckpoints(fork.ID)
+	if ids := checkpointIDs(listed); len(ids) != 3 || ids[0] != root.ID || ids[1] != setup.ID || ids[2] != own.ID {
+		t.Errorf("Expected root, setup and own, got %v", ids)
+	}
+	if listed, _ := manager.ListCheckpoints("s1"); len(listed) != 3 {
+		t.Errorf("Expected the source to keep its 3 checkpoints, got %d", len(listed))
+	}
+
+	// Deleting the source keeps the shared history of the fork.
+	deleted, err := manager.DeleteSession("s1")
+	if err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != variant.ID {
+		t.Errorf("Expected only variant to be deleted, got %v", deleted)
+	}
+	inherited, _ := manager.GetCheckpoint(setup.ID)
+	if inherited == nil || inherited.SessionID != fork.ID {
+		t.Errorf("Expected the fork to inherit setup, got %+v", inherited)
+	}
+	if _, err := manager.Path(own.ID); err != nil {
+		t.Errorf("Expected the fork's path to survive, got %v", err)
+	}
+}
+
+func TestManager_AddSession(t *testing.T) {
+	manager, sessions, _ := newIntegrityTest(t)
+
+	// A checkpoint whose parent is missing adds neither.
+	sess := &session.Session{ID: "imported", Checkpoints: []string{"child"}}
+	orphan := &Checkpoint{ID: "child", Anchor: Anchor{LSN: "0/20"}, Branch: Branch{ParentID: "missing"}, SessionID: sess.ID}
+	if err := manager.AddSession(sess, []*Checkpoint{orphan}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := sessions.GetSession(sess.ID); !errors.Is(err, session.ErrNotFound) {
+		t.Errorf("Expected the session not to be added, got %v", err)
+	}
+
+	root := &Checkpoint{ID: "root", Anchor: Anchor{LSN: "0/10"}, SessionID: sess.ID}
+	orphan.ParentID = root.ID
+	sess.Checkpoints = []string{root.ID, orphan.ID}
+	if err := manager.AddSession(sess, []*Checkpoint{root, orphan}); err != nil {
+		t.Fatalf("Failed to add session: %v", err)
+	}
+	if listed, _ := manager.ListCheckpoints(sess.ID); len(listed) != 2 {
+		t.Errorf("Expected 2 checkpoints in the session, got %d", len(listed))
+	}
+	if err := manager.AddSession(sess, nil); err == nil {
+		t.Error("Expected error adding an existing session")
+	}
+}
+
+func checkpointIDs(checkpoints []*Checkpoint) []string {
+	ids := make([]string, 0, len(checkpoints))
+	for _, cp := range checkpoints {
+		ids = append(ids, cp.ID)
+	}
+	return ids
+}
@@ -0,0 +1,204 @@
+package checkpoint
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// Branch places a checkpoint in the checkpoint tree. The checkpoint follows
+// ParentID, and its own entries are those after BaseLSN and BaseSeq up to
+// its anchor: the changes recorded on its branch since the parent. Entries
+// between the parent and the base belong to other branches. A checkpoint
+// without a parent is a root, whose entries start at the beginning of the
+// log.
+type Branch struct {
+	ParentID string `json:"parent_id,omitempty"`
+	BaseLSN  string `json:"base_lsn,omitempty"`
+	BaseSeq  int    `json:"base_seq,omitempty"`
+}
+
+// BranchFrom returns the branch of a checkpoint that follows parent and
+// records the changes after base.
+func BranchFrom(parentID string, base Anchor) Branch {
+	return Branch{ParentID: parentID, BaseLSN: base.LSN, BaseSeq: base.Seq}
+}
+
+func (b Branch) base() Anchor {
+	return Anchor{LSN: b.BaseLSN, Seq: b.BaseSeq}
+}
+
+// TreeNode is a checkpoint with the checkpoints that follow it.
+type TreeNode struct {
+	*Checkpoint
+	Children []*TreeNode `json:"children"`
+}
+
+// Path returns the checkpoints from the root of the checkpoint's tree down
+// to the checkpoint itself.
+func (n *Navigator) Path(checkpointID string) ([]*Checkpoint, error) {
+	return n.manager.Path(checkpointID)
+}
+
+// Tree returns the checkpoint trees of a session, or of every session when
+// sessionID is empty. Roots and children are ordered by creation time.
+func (n *Navigator) Tree(sessionID string) ([]*TreeNode, error) {
+	return n.manager.Tree(sessionID)
+}
+
+// Path returns the checkpoints from the root of the checkpoint's tree down
+// to the checkpoint itself.
+func (m *Manager) Path(checkpointID string) ([]*Checkpoint, error) {
+	checkpoints, err := listCheckpoints(m.store)
+	if err != nil {
+		return nil, err
+	}
+
+	path := make([]*Checkpoint, 0)
+	seen := make(map[string]bool)
+	for id := checkpointID; id != ""; {
+		cp, exists := checkpoints[id]
+		if !exists {
+			if id == checkpointID {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+			}
+			return nil, fmt.Errorf("%w: parent %s of %s", ErrNotFound, id, path[len(path)-1].ID)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("checkpoint %s is its own ancestor", id)
+		}
+		seen[id] = true
+		path = append(path, cp)
+		id = cp.ParentID
+	}
+
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path, nil
+}
+
+// Tree returns the checkpoint trees of a session, or of every session when
+// sessionID is empty. Roots and children are ordered by creation time. A
+// checkpoint whose parent is missing is listed as a root.
+func (m *Manager) Tree(sessionID string) ([]*TreeNode, error) {
+	checkpoints, err := m.ListCheckpoints(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*TreeNode, len(checkpoints))
+	for _, cp := range checkpoints {
+		nodes[cp.ID] = &TreeNode{Checkpoint: cp, Children: make([]*TreeNode, 0)}
+	}
+
+	roots := make([]*TreeNode, 0)
+	for _, cp := range checkpoints {
+		node := nodes[cp.ID]
+		if parent, ok := nodes[cp.ParentID]; ok && cp.ParentID != cp.ID {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+
+	sort.SliceStable(roots, func(i, j int) bool {
+		return roots[i].Timestamp.Before(roots[j].Timestamp)
+	})
+	return roots, nil
+}
+
+// entriesOf returns the entries that lead to cp: the entries of each
+// checkpoint on its path from the root, in order.
+func (n *Navigator) entriesOf(cp *Checkpoint, allEntries []*wal.WALEntry) ([]*wal.WALEntry, error) {
+	path, err := n.manager.Path(cp.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*wal.WALEntry, 0)
+	for _, step := range path {
+		if step.ID == cp.ID {
+			step = cp
+		} else if step, err = n.checkpoint(step.ID, allEntries); err != nil {
+			return nil, err
+		}
+
+		covered, err := resolve(step, allEntries)
+		if err != nil {
+			return nil, err
+		}
+		own, err := step.own(covered)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, own...)
+	}
+	return entries, nil
+}
+
+// recordedBy returns the session whose changes the checkpoint covers.
+func (cp *Checkpoint) recordedBy() string {
+	if cp.RecordedBy != "" {
+		return cp.RecordedBy
+	}
+	return cp.SessionID
+}
+
+// recorded reports whether entry was recorded by the checkpoint's session.
+// Entries captured while no session was recording, or before entries were
+// tagged, belong to every session.
+func (cp *Checkpoint) recorded(entry *wal.WALEntry) bool {
+	return entry.SessionID == "" || entry.SessionID == cp.recordedBy()
+}
+
+// own returns the entries of covered that were recorded on the
+// checkpoint's branch, after its base, by the checkpoint's session. Other
+// sessions recording into the same stream, such as the source of a fork
+// and the fork, do not see each other's changes.
+func (cp *Checkpoint) own(covered []*wal.WALEntry) ([]*wal.WALEntry, error) {
+	var base wal.Anchor
+	if cp.ParentID != "" {
+		var err error
+		if base, err = cp.base().position(); err != nil {
+			return nil, fmt.Errorf("checkpoint %s has an invalid base: %w", cp.ID, err)
+		}
+	}
+
+	entries := make([]*wal.WALEntry, 0)
+	for _, entry := range covered {
+		if !cp.recorded(entry) {
+			continue
+		}
+		if cp.ParentID == "" {
+			entries = append(entries, entry)
+			continue
+		}
+		pos, err := entry.Anchor()
+		if err != nil {
+			return nil, err
+		}
+		if !covers(pos, base) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// ownsEntry reports whether entry, at pos, was recorded on the
+// checkpoint's branch up to the checkpoint by its session.
+func (cp *Checkpoint) ownsEntry(entry *wal.WALEntry, pos wal.Anchor) bool {
+	if !cp.recorded(entry) {
+		return false
+	}
+	bound, err := cp.position()
+	if err != nil || !covers(pos, bound) {
+		return false
+	}
+	if cp.ParentID == "" {
+		return true
+	}
+	base, err := cp.base().position()
+	return err == nil && !covers(pos, base)
+}
@@ -0,0 +1,172 @@
+package checkpoint
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestNavigator_Branches(t *testing.T) {
+	entries := []*wal.WALEntry{
+		{ID: "r1", LSN: "0/10", Operation: wal.OpInsert, Table: "orders"},
+		{ID: "x1", LSN: "0/20", Operation: wal.OpUpdate, Table: "orders"},
+		{ID: "y1", LSN: "0/30", Operation: wal.OpDelete, Table: "orders"},
+	}
+	nav, manager := newTestNavigator(t, entries)
+
+	root := createTestCheckpoint(t, nav, manager, "root", 0)
+
+	// The first branch records x1 after the root.
+	xAnchor, _ := nav.AnchorAt("", intPtr(1))
+	first, err := manager.CreateCheckpoint("first", "", xAnchor, BranchFrom(root.ID, root.Anchor), "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+
+	// The second branch starts from the root again once x1 was recorded.
+	yAnchor, _ := nav.AnchorAt("", intPtr(2))
+	second, err := manager.CreateCheckpoint("second", "", yAnchor, BranchFrom(root.ID, xAnchor), "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+
+	got, err := nav.GetEntriesUpToCheckpoint(first.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 2 || ids[0] != "r1" || ids[1] != "x1" {
+		t.Errorf("Expected r1 and x1, got %v", ids)
+	}
+
+	got, err = nav.GetEntriesUpToCheckpoint(second.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 2 || ids[0] != "r1" || ids[1] != "y1" {
+		t.Errorf("Expected r1 and y1, got %v", ids)
+	}
+
+	got, err = nav.GetEntriesAfterCheckpoint(root.ID, second.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 1 || ids[0] != "y1" {
+		t.Errorf("Expected y1, got %v", ids)
+	}
+
+	if _, err := nav.GetEntriesAfterCheckpoint(first.ID, second.ID); err == nil {
+		t.Error("Expected error for checkpoints on different branches")
+	}
+	if _, err := nav.GetEntriesBetweenCheckpoints(first.ID, second.ID); err == nil {
+		t.Error("Expected error for checkpoints on different branches")
+	}
+
+	path, err := nav.Path(second.ID)
+	if err != nil {
+		t.Fatalf("Failed to get path: %v", err)
+	}
+	if len(path) != 2 || path[0].ID != root.ID || path[1].ID != second.ID {
+		t.Errorf("Expected path root → second, got %v", path)
+	}
+
+	tree, err := nav.Tree("s1")
+	if err != nil {
+		t.Fatalf("Failed to get tree: %v", err)
+	}
+	if len(tree) != 1 || tree[0].ID != root.ID || len(tree[0].Children) != 2 {
+		t.Errorf("Expected one root with two children, got %+v", tree)
+	}
+}
+
+func TestManager_CreateCheckpointBeforeBranch(t *testing.T) {
+	entries := []*wal.WALEntry{
+		{ID: "r1", LSN: "0/10", Operation: wal.OpInsert, Table: "orders"},
+		{ID: "x1", LSN: "0/20", Operation: wal.OpUpdate, Table: "orders"},
+	}
+	nav, manager := newTestNavigator(t, entries)
+	root := createTestCheckpoint(t, nav, manager, "root", 0)
+
+	base, _ := nav.AnchorAt("", intPtr(1))
+	if _, err := manager.CreateCheckpoint("early", "", root.Anchor, BranchFrom(root.ID, base), "s1"); !errors.Is(err, ErrBeforeBranch) {
+		t.Errorf("Expected ErrBeforeBranch, got %v", err)
+	}
+
+	if _, err := manager.CreateCheckpoint("orphan", "", base, BranchFrom("missing", base), "s1"); err == nil {
+		t.Error("Expected error for a missing parent")
+	}
+}
+
+func TestNavigator_InterleavedFork(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := config.DefaultConfig()
+	cfg.Storage.CheckpointPath = filepath.Join(tmpDir, "checkpoints")
+	cfg.Storage.SessionPath = filepath.Join(tmpDir, "sessions")
+	cfg.Storage.WALLogPath = filepath.Join(tmpDir, "wal")
+
+	st := newTestStore(t, cfg)
+	manager := NewManager(cfg, st)
+	sessions := session.NewManager(cfg, st)
+
+	root, err := manager.CreateCheckpoint("root", "", Anchor{LSN: "0/10", EntryCount: 1}, Branch{}, "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	fork, err := sessions.ForkSession("s1", root.ID, "")
+	if err != nil {
+		t.Fatalf("Failed to fork session: %v", err)
+	}
+
+	// The source and the fork record into the same stream after the root.
+	entries := []*wal.WALEntry{
+		{ID: "r1", LSN: "0/10", Operation: wal.OpInsert, Table: "orders", SessionID: "s1"},
+		{ID: "a1", LSN: "0/20", Operation: wal.OpInsert, Table: "orders", SessionID: "s1"},
+		{ID: "f1", LSN: "0/30", Operation: wal.OpInsert, Table: "orders", SessionID: fork.ID},
+		{ID: "a2", LSN: "0/40", Operation: wal.OpUpdate, Table: "orders", SessionID: "s1"},
+		{ID: "f2", LSN: "0/50", Operation: wal.OpDelete, Table: "orders", SessionID: fork.ID},
+		{ID: "u1", LSN: "0/60", Operation: wal.OpInsert, Table: "audit"},
+	}
+	nav := NewNavigator(writeTestLog(t, cfg.Storage.WALLogPath, entries), manager)
+
+	anchor, _ := nav.AnchorAt("", intPtr(5))
+	source, err := manager.CreateCheckpoint("source", "", anchor, BranchFrom(root.ID, root.Anchor), "s1")
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+	own, err := manager.CreateCheckpoint("own", "", anchor, BranchFrom(root.ID, root.Anchor), fork.ID)
+	if err != nil {
+		t.Fatalf("Failed to create checkpoint: %v", err)
+	}
+
+	got, err := nav.GetEntriesUpToCheckpoint(source.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 4 || ids[0] != "r1" || ids[1] != "a1" || ids[2] != "a2" || ids[3] != "u1" {
+		t.Errorf("Expected r1, a1, a2 and u1 for the source, got %v", ids)
+	}
+
+	got, err = nav.GetEntriesUpToCheckpoint(own.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 4 || ids[0] != "r1" || ids[1] != "f1" || ids[2] != "f2" || ids[3] != "u1" {
+		t.Errorf("Expected r1, f1, f2 and u1 for the fork, got %v", ids)
+	}
+
+	// The fork inherits the root from the deleted source, which still
+	// covers the source's changes.
+	if _, err := manager.DeleteSession("s1"); err != nil {
+		t.Fatalf("Failed to delete session: %v", err)
+	}
+	got, err = nav.GetEntriesUpToCheckpoint(own.ID)
+	if err != nil {
+		t.Fatalf("Failed to get entries: %v", err)
+	}
+	if ids := entryIDs(got); len(ids) != 4 || ids[0] != "r1" || ids[1] != "f1" {
+		t.Errorf("Expected r1, f1, f2 and u1 after deleting the source, got %v", ids)
+	}
+}
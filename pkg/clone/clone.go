@@ -0,0 +1,352 @@
+package clone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+)
+
+// NamePrefix is prepended to clone names so that clones can be listed and
+// reaped without touching other databases.
+const NamePrefix = "ptr_clone_"
+
+// DefaultTTL is how long a clone lives when neither the request nor
+// CLONE_TTL sets it.
+const DefaultTTL = time.Hour
+
+// ReapInterval is how often the reaper looks for expired clones.
+const ReapInterval = time.Minute
+
+// maintenanceDatabase is connected to for creating and dropping clones,
+// since no session may be connected to the template while it is copied.
+const maintenanceDatabase = "postgres"
+
+// ErrNoTemplate is returned when a clone has no baseline database to be
+// copied from.
+var ErrNoTemplate = errors.New("no clone template: set CLONE_TEMPLATE or template to a baseline database")
+
+var validName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+type Options struct {
+	CheckpointID string `json:"checkpoint_id"`
+	// Template is the database on the replica server to copy. Defaults to
+	// CLONE_TEMPLATE.
+	Template string `json:"template,omitempty"`
+	// Name of the clone, prefixed with NamePrefix unless it already is.
+	// Generated when empty.
+	Name string `json:"name,omitempty"`
+	// TTL is how long the clone lives, as a duration such as "2h".
+	TTL string `json:"ttl,omitempty"`
+}
+
+// Clone is a database copied from a template, with a session replayed into
+// it. Its metadata is kept in the database comment so that clones survive
+// restarts of the server.
+type Clone struct {
+	Name           string    `json:"name"`
+	DSN            string    `json:"dsn"`
+	Template       string    `json:"template"`
+	SessionID      string    `json:"session_id,omitempty"`
+	CheckpointID   string    `json:"checkpoint_id,omitempty"`
+	EntriesApplied int       `json:"entries_applied"`
+	CreatedAt      time.Time `json:"created_at"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// Expired reports whether the clone's TTL has run out at now.
+func (c *Clone) Expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+// Manager creates, lists and drops clones on the replica server.
+type Manager struct {
+	config    *config.Config
+	navigator *checkpoint.Navigator
+	replayer  *session.Replayer
+}
+
+func NewManager(cfg *config.Config, nav *checkpoint.Navigator, replayer *session.Replayer) *Manager {
+	return &Manager{
+		config:    cfg,
+		navigator: nav,
+		replayer:  replayer,
+	}
+}
+
+// CloneName returns name with NamePrefix, or a generated name when name
+// is empty.
+func CloneName(name string) string {
+	if name == "" {
+		return NamePrefix + strings.ReplaceAll(uuid.New().String(), "-", "")[:12]
+	}
+	if strings.HasPrefix(name, NamePrefix) {
+		return name
+	}
+	return NamePrefix + name
+}
+
+// Create copies the template into a new database and replays the session
+// up to the checkpoint into it. The clone is dropped again if the replay
+// fails.
+func (m *Manager) Create(ctx context.Context, sess *session.Session, opts Options, replayOpts session.Options) (*Clone, *session.Result, error) {
+	if opts.CheckpointID == "" {
+		return nil, nil, fmt.Errorf("checkpoint_id is required")
+	}
+
+	ttl, err := m.ttl(opts.TTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template, err := m.Template(opts.Template)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := CloneName(opts.Name)
+	if !validName.MatchString(name) {
+		return nil, nil, fmt.Errorf("invalid name %q: use lowercase letters, digits and underscores", name)
+	}
+
+	entries, err := m.navigator.GetEntriesUpToCheckpoint(opts.CheckpointID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := m.Reap(ctx); err != nil {
+		log.Printf("Failed to reap expired clones: %v", err)
+	}
+
+	now := time.Now()
+	clone := &Clone{
+		Name:         name,
+		DSN:          m.DSN(name),
+		Template:     template,
+		CheckpointID: opts.CheckpointID,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(ttl),
+	}
+	if sess != nil {
+		clone.SessionID = sess.ID
+	}
+
+	stmt := fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s", pgx.Identifier{name}.Sanitize(), pgx.Identifier{template}.Sanitize())
+	if err := m.exec(ctx, stmt); err != nil {
+		return nil, nil, fmt.Errorf("failed to create clone of %s: %w", template, err)
+	}
+	// Recorded before the replay so that the clone expires even if the
+	// server stops while replaying.
+	if err := m.describe(ctx, clone); err != nil {
+		m.Drop(context.Background(), name)
+		return nil, nil, err
+	}
+
+	result, err := m.replayer.ReplayInto(ctx, session.Target{DSN: clone.DSN}, entries, replayOpts)
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		m.Drop(context.Background(), name)
+		return nil, result, fmt.Errorf("failed to replay into clone: %w", err)
+	}
+	clone.EntriesApplied = result.Applied
+
+	if err := m.describe(ctx, clone); err != nil {
+		m.Drop(context.Background(), name)
+		return nil, result, err
+	}
+
+	return clone, result, nil
+}
+
+// Template returns the database to copy for a clone: name, or
+// CLONE_TEMPLATE when name is empty. The replica database is refused,
+// since it already holds replayed changes and the replay connections keep
+// it open.
+func (m *Manager) Template(name string) (string, error) {
+	if name == "" {
+		name = m.config.Clone.Template
+	}
+	if name == "" {
+		return "", ErrNoTemplate
+	}
+	if name == m.config.ReplicaDB.Database {
+		return "", fmt.Errorf("%w: %s is the replica database, which already holds replayed changes", ErrNoTemplate, name)
+	}
+	return name, nil
+}
+
+func (m *Manager) ttl(value string) (time.Duration, error) {
+	if value == "" {
+		value = m.config.Clone.TTL
+	}
+	if value == "" {
+		return DefaultTTL, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q: expected a positive duration such as 2h", value)
+	}
+	return ttl, nil
+}
+
+// describe stores the clone's metadata as the comment of its database,
+// leaving out the DSN and the password in it.
+func (m *Manager) describe(ctx context.Context, clone *Clone) error {
+	meta := *clone
+	meta.DSN = ""
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode clone: %w", err)
+	}
+
+	stmt := fmt.Sprintf("COMMENT ON DATABASE %s IS '%s'", pgx.Identifier{clone.Name}.Sanitize(), strings.ReplaceAll(string(data), "'", "''"))
+	if err := m.exec(ctx, stmt); err != nil {
+		return fmt.Errorf("failed to record clone metadata: %w", err)
+	}
+	return nil
+}
+
+// List returns the clones on the replica server, oldest first. Clones
+// whose metadata cannot be read are listed with their name only and are
+// never reaped.
+func (m *Manager) List(ctx context.Context) ([]*Clone, error) {
+	conn, err := pgx.Connect(ctx, m.adminDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to replica: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, `
+		SELECT datname, coalesce(shobj_description(oid, 'pg_database'), '')
+		FROM pg_database WHERE datname LIKE $1 ORDER BY oid`,
+		NamePrefix+"%")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clones: %w", err)
+	}
+	defer rows.Close()
+
+	clones := make([]*Clone, 0)
+	for rows.Next() {
+		var name, comment string
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, err
+		}
+		clones = append(clones, parseClone(name, comment, m.DSN(name)))
+	}
+
+	return clones, rows.Err()
+}
+
+func parseClone(name, comment, dsn string) *Clone {
+	clone := &Clone{}
+	if comment == "" || json.Unmarshal([]byte(comment), clone) != nil {
+		clone = &Clone{}
+	}
+	clone.Name = name
+	clone.DSN = dsn
+	return clone
+}
+
+// Get returns the clone called name.
+func (m *Manager) Get(ctx context.Context, name string) (*Clone, error) {
+	clones, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, clone := range clones {
+		if clone.Name == name {
+			return clone, nil
+		}
+	}
+	return nil, fmt.Errorf("clone %s not found", name)
+}
+
+// Drop removes a clone, disconnecting its sessions.
+func (m *Manager) Drop(ctx context.Context, name string) error {
+	if !validName.MatchString(name) || !strings.HasPrefix(name, NamePrefix) {
+		return fmt.Errorf("invalid clone name %q", name)
+	}
+	if err := m.exec(ctx, "DROP DATABASE IF EXISTS "+pgx.Identifier{name}.Sanitize()+" WITH (FORCE)"); err != nil {
+		return fmt.Errorf("failed to drop clone %s: %w", name, err)
+	}
+	return nil
+}
+
+// Reap drops the clones whose TTL has run out and returns their names.
+func (m *Manager) Reap(ctx context.Context) ([]string, error) {
+	clones, err := m.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	dropped := make([]string, 0)
+	for _, clone := range clones {
+		if !clone.Expired(now) {
+			continue
+		}
+		if err := m.Drop(ctx, clone.Name); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, clone.Name)
+	}
+	return dropped, nil
+}
+
+// RunReaper reaps expired clones every ReapInterval until ctx is
+// cancelled.
+func (m *Manager) RunReaper(ctx context.Context) {
+	ticker := time.NewTicker(ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			dropped, err := m.Reap(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Failed to reap expired clones: %v", err)
+			}
+			for _, name := range dropped {
+				log.Printf("Dropped expired clone %s", name)
+			}
+		}
+	}
+}
+
+// DSN returns the connection string for a clone.
+func (m *Manager) DSN(name string) string {
+	dbConfig := m.config.ReplicaDB
+	dbConfig.Database = name
+	return dbConfig.ToDSN()
+}
+
+func (m *Manager) adminDSN() string {
+	return m.DSN(maintenanceDatabase)
+}
+
+func (m *Manager) exec(ctx context.Context, stmt string) error {
+	conn, err := pgx.Connect(ctx, m.adminDSN())
+	if err != nil {
+		return fmt.Errorf("failed to connect to replica: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, stmt)
+	return err
+}
@@ -0,0 +1,98 @@
+package clone
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+)
+
+func TestCloneName(t *testing.T) {
+	if got := CloneName("ci_42"); got != "ptr_clone_ci_42" {
+		t.Errorf("Expected prefixed name, got %s", got)
+	}
+	if got := CloneName("ptr_clone_ci_42"); got != "ptr_clone_ci_42" {
+		t.Errorf("Expected prefixed name to be kept, got %s", got)
+	}
+
+	generated := CloneName("")
+	if !strings.HasPrefix(generated, NamePrefix) || !validName.MatchString(generated) {
+		t.Errorf("Expected a valid generated name, got %s", generated)
+	}
+	if CloneName("") == generated {
+		t.Error("Expected generated names to differ")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+	c := &Clone{ExpiresAt: now}
+
+	if c.Expired(now.Add(-time.Second)) {
+		t.Error("Expected clone not to expire before its TTL")
+	}
+	if !c.Expired(now) {
+		t.Error("Expected clone to expire at its TTL")
+	}
+	if (&Clone{}).Expired(now) {
+		t.Error("Expected clone without metadata never to expire")
+	}
+}
+
+func TestParseClone(t *testing.T) {
+	c := parseClone("ptr_clone_a", `{"template":"testdb","checkpoint_id":"cp1","expires_at":"2024-01-05T13:00:00Z"}`, "dsn")
+	if c.Name != "ptr_clone_a" || c.Template != "testdb" || c.CheckpointID != "cp1" || c.DSN != "dsn" {
+		t.Errorf("Expected metadata from the comment, got %+v", c)
+	}
+	if c.ExpiresAt.IsZero() {
+		t.Error("Expected expiry from the comment")
+	}
+
+	c = parseClone("ptr_clone_b", "not json", "dsn")
+	if c.Name != "ptr_clone_b" || !c.ExpiresAt.IsZero() {
+		t.Errorf("Expected name only for an unreadable comment, got %+v", c)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Clone.TTL = "30m"
+	m := NewManager(cfg, nil, nil)
+
+	if ttl, err := m.ttl(""); err != nil || ttl != 30*time.Minute {
+		t.Errorf("Expected configured TTL of 30m, got %v (%v)", ttl, err)
+	}
+	if ttl, err := m.ttl("2h"); err != nil || ttl != 2*time.Hour {
+		t.Errorf("Expected requested TTL of 2h, got %v (%v)", ttl, err)
+	}
+	if _, err := m.ttl("-1h"); err == nil {
+		t.Error("Expected error for a negative TTL")
+	}
+
+	cfg.Clone.TTL = ""
+	if ttl, _ := m.ttl(""); ttl != DefaultTTL {
+		t.Errorf("Expected default TTL, got %v", ttl)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	cfg := config.DefaultConfig()
+	m := NewManager(cfg, nil, nil)
+
+	if _, err := m.Template(""); !errors.Is(err, ErrNoTemplate) {
+		t.Errorf("Expected ErrNoTemplate without a template, got %v", err)
+	}
+	if _, err := m.Template(cfg.ReplicaDB.Database); !errors.Is(err, ErrNoTemplate) {
+		t.Errorf("Expected ErrNoTemplate for the replica database, got %v", err)
+	}
+
+	cfg.Clone.Template = "testdb_baseline"
+	if template, err := m.Template(""); err != nil || template != "testdb_baseline" {
+		t.Errorf("Expected configured template testdb_baseline, got %q (%v)", template, err)
+	}
+	if template, err := m.Template("other_baseline"); err != nil || template != "other_baseline" {
+		t.Errorf("Expected requested template other_baseline, got %q (%v)", template, err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -16,6 +18,10 @@ type Config struct {
 	Storage     StorageConfig     `json:"storage"`
 	Replication ReplicationConfig `json:"replication"`
 	Server      ServerConfig      `json:"server"`
+	Masking     MaskingConfig     `json:"masking"`
+	Replay      ReplayConfig      `json:"replay"`
+	Clone       CloneConfig       `json:"clone"`
+	Metadata    MetadataConfig    `json:"metadata"`
 }
 
 type DatabaseConfig struct {
@@ -32,6 +38,14 @@ type StorageConfig struct {
 	BackupPath     string `json:"backup_path"`
 	SessionPath    string `json:"session_path"`
 	CheckpointPath string `json:"checkpoint_path"`
+	JobPath        string `json:"job_path"`
+	// JobHistory is how many finished jobs are kept in the job history.
+	// Configuration files written before it existed have 0, which keeps
+	// the default of 100.
+	JobHistory int `json:"job_history"`
+	// JournalSize is how many earlier versions of sessions.json and
+	// checkpoints.json are kept for recovery. 0 keeps none.
+	JournalSize int `json:"journal_size"`
 }
 
 type ReplicationConfig struct {
@@ -44,6 +58,50 @@ type ServerConfig struct {
 	UIPath string `json:"ui_path"`
 }
 
+// MaskingConfig configures the column masking stage. Masking is disabled
+// when RulesPath is empty.
+type MaskingConfig struct {
+	RulesPath string `json:"rules_path"`
+	Salt      string `json:"salt"`
+}
+
+// ReplayConfig configures how WAL entries are applied to the replica.
+// OnError is one of abort, skip or stop and decides what happens when a
+// source transaction fails to apply. Conflicts maps schema.table, table or
+// "*" to the policy for rows that drifted in the replica: error, skip,
+// upsert, insert_if_missing or verify_old.
+//
+// Speed divides the original gaps between transactions (zero replays as
+// fast as possible), MaxGap caps each gap as a duration such as "5s", and
+// Connections fans independent transactions out over several
+// connections.
+type ReplayConfig struct {
+	OnError     string            `json:"on_error"`
+	Conflicts   map[string]string `json:"conflicts,omitempty"`
+	Speed       float64           `json:"speed"`
+	MaxGap      string            `json:"max_gap,omitempty"`
+	Connections int               `json:"connections"`
+}
+
+// CloneConfig configures ephemeral clone databases. Template is the
+// baseline database on the replica server that clones are copied from,
+// and TTL how long a clone lives, such as "1h".
+type CloneConfig struct {
+	Template string `json:"template,omitempty"`
+	TTL      string `json:"ttl"`
+}
+
+// MetadataConfig selects where sessions and checkpoints are kept. Store is
+// "json" for the files in the session and checkpoint paths, "bolt" for an
+// embedded database at Path, or "postgres" for tables in Schema of the
+// database at DSN, the primary when empty.
+type MetadataConfig struct {
+	Store  string `json:"store"`
+	Path   string `json:"path,omitempty"`
+	DSN    string `json:"dsn,omitempty"`
+	Schema string `json:"schema,omitempty"`
+}
+
 // ToDSN converts DatabaseConfig to DSN string
 func (d *DatabaseConfig) ToDSN() string {
 	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=%s",
@@ -135,6 +193,23 @@ func LoadFromEnv(envPath string) (*Config, error) {
 		BackupPath:     getEnvOrDefault("BACKUP_PATH", "./backups"),
 		SessionPath:    getEnvOrDefault("SESSION_PATH", "./sessions"),
 		CheckpointPath: getEnvOrDefault("CHECKPOINT_PATH", "./checkpoints"),
+		JobPath:        getEnvOrDefault("JOB_PATH", "./jobs"),
+		JobHistory:     100,
+		JournalSize:    5,
+	}
+	if historyStr := os.Getenv("JOB_HISTORY"); historyStr != "" {
+		history, err := strconv.Atoi(historyStr)
+		if err != nil || history < 1 {
+			return nil, fmt.Errorf("invalid JOB_HISTORY: %s", historyStr)
+		}
+		cfg.Storage.JobHistory = history
+	}
+	if sizeStr := os.Getenv("JOURNAL_SIZE"); sizeStr != "" {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid JOURNAL_SIZE: %s", sizeStr)
+		}
+		cfg.Storage.JournalSize = size
 	}
 
 	// Replication configuration
@@ -143,9 +218,107 @@ func LoadFromEnv(envPath string) (*Config, error) {
 		PublicationName: getEnvOrDefault("PUBLICATION_NAME", "test_publication"),
 	}
 
+	// Masking configuration
+	cfg.Masking = MaskingConfig{
+		RulesPath: os.Getenv("MASK_RULES_PATH"),
+		Salt:      os.Getenv("MASK_SALT"),
+	}
+
+	// Replay configuration
+	cfg.Replay = ReplayConfig{
+		OnError: getEnvOrDefault("REPLAY_ON_ERROR", "abort"),
+	}
+	switch cfg.Replay.OnError {
+	case "abort", "skip", "stop":
+	default:
+		return nil, fmt.Errorf("invalid REPLAY_ON_ERROR: %s", cfg.Replay.OnError)
+	}
+	if conflicts := os.Getenv("REPLAY_CONFLICTS"); conflicts != "" {
+		policies, err := parsePolicyList(conflicts)
+		if err == nil {
+			err = validateConflicts(policies)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid REPLAY_CONFLICTS: %w", err)
+		}
+		cfg.Replay.Conflicts = policies
+	}
+	if speed := os.Getenv("REPLAY_SPEED"); speed != "" {
+		v, err := strconv.ParseFloat(speed, 64)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("invalid REPLAY_SPEED: %s", speed)
+		}
+		cfg.Replay.Speed = v
+	}
+	if maxGap := os.Getenv("REPLAY_MAX_GAP"); maxGap != "" {
+		if _, err := time.ParseDuration(maxGap); err != nil {
+			return nil, fmt.Errorf("invalid REPLAY_MAX_GAP: %s", maxGap)
+		}
+		cfg.Replay.MaxGap = maxGap
+	}
+	cfg.Replay.Connections = 1
+	if conns := os.Getenv("REPLAY_CONNECTIONS"); conns != "" {
+		n, err := strconv.Atoi(conns)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid REPLAY_CONNECTIONS: %s", conns)
+		}
+		cfg.Replay.Connections = n
+	}
+
+	// Clone configuration
+	cfg.Clone = CloneConfig{
+		Template: os.Getenv("CLONE_TEMPLATE"),
+		TTL:      getEnvOrDefault("CLONE_TTL", "1h"),
+	}
+	if ttl, err := time.ParseDuration(cfg.Clone.TTL); err != nil || ttl <= 0 {
+		return nil, fmt.Errorf("invalid CLONE_TTL: %s", cfg.Clone.TTL)
+	}
+
+	// Metadata configuration
+	cfg.Metadata = MetadataConfig{
+		Store:  getEnvOrDefault("METADATA_STORE", "json"),
+		Path:   getEnvOrDefault("METADATA_PATH", "./metadata.db"),
+		DSN:    os.Getenv("METADATA_DSN"),
+		Schema: getEnvOrDefault("METADATA_SCHEMA", "postgres_test_replay"),
+	}
+	switch cfg.Metadata.Store {
+	case "json", "bolt", "postgres":
+	default:
+		return nil, fmt.Errorf("invalid METADATA_STORE: %s", cfg.Metadata.Store)
+	}
+
 	return cfg, nil
 }
 
+// parsePolicyList parses a comma-separated list of table=policy pairs.
+func parsePolicyList(list string) (map[string]string, error) {
+	policies := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		table, policy, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(table) == "" {
+			return nil, fmt.Errorf("expected table=policy, got %q", pair)
+		}
+		policies[strings.TrimSpace(table)] = strings.TrimSpace(policy)
+	}
+	return policies, nil
+}
+
+// validateConflicts checks the policy names of a conflict policy map.
+func validateConflicts(policies map[string]string) error {
+	for table, policy := range policies {
+		switch policy {
+		case "", "error", "skip", "upsert", "insert_if_missing", "verify_old":
+		default:
+			return fmt.Errorf("table %s: unknown conflict policy %q", table, policy)
+		}
+	}
+	return nil
+}
+
 func getEnvOrDefault(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -165,6 +338,9 @@ func LoadConfig(path string) (*Config, error) {
 	if err := decoder.Decode(config); err != nil {
 		return nil, err
 	}
+	if err := validateConflicts(config.Replay.Conflicts); err != nil {
+		return nil, fmt.Errorf("invalid replay conflicts: %w", err)
+	}
 
 	return config, nil
 }
@@ -192,6 +368,9 @@ func DefaultConfig() *Config {
 			BackupPath:     "./backups",
 			SessionPath:    "./sessions",
 			CheckpointPath: "./checkpoints",
+			JobPath:        "./jobs",
+			JobHistory:     100,
+			JournalSize:    5,
 		},
 		Replication: ReplicationConfig{
 			SlotName:        "test_slot",
@@ -201,6 +380,18 @@ func DefaultConfig() *Config {
 			Port:   8080,
 			UIPath: "./ui",
 		},
+		Replay: ReplayConfig{
+			OnError:     "abort",
+			Connections: 1,
+		},
+		Clone: CloneConfig{
+			TTL: "1h",
+		},
+		Metadata: MetadataConfig{
+			Store:  "json",
+			Path:   "./metadata.db",
+			Schema: "postgres_test_replay",
+		},
 	}
 }
 
@@ -58,6 +58,20 @@ func TestLoadNonExistentConfig(t *testing.T) {
 	}
 }
 
+func TestLoadConfigRejectsUnknownConflictPolicy(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+
+	cfg := DefaultConfig()
+	cfg.Replay.Conflicts = map[string]string{"users": "upsert", "orders": "upsret"}
+	if err := cfg.Save(configPath); err != nil {
+		t.Fatalf("Failed to save config: %v", err)
+	}
+
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Error("Expected error loading config with an unknown conflict policy")
+	}
+}
+
 func TestConfigValidation(t *testing.T) {
 	cfg := DefaultConfig()
 
@@ -1,17 +1,28 @@
 package ipc
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ivikasavnish/postgres-test-replay/pkg/backup"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/bundle"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/clone"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/jobs"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/materialize"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/replication"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/verify"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
 )
 
@@ -21,16 +32,27 @@ type Server struct {
 	sessionManager    *session.Manager
 	checkpointNav     *checkpoint.Navigator
 	replayer          *session.Replayer
+	jobManager        *jobs.Manager
+	materializer      *materialize.Materializer
+	verifier          *verify.Verifier
+	clones            *clone.Manager
+	bundles           *bundle.Manager
+	stopReaper        context.CancelFunc
 	server            *http.Server
 }
 
-func NewServer(cfg *config.Config, cpMgr *checkpoint.Manager, sessMgr *session.Manager, cpNav *checkpoint.Navigator, replayer *session.Replayer) *Server {
+func NewServer(cfg *config.Config, cpMgr *checkpoint.Manager, sessMgr *session.Manager, cpNav *checkpoint.Navigator, replayer *session.Replayer, jobMgr *jobs.Manager) *Server {
 	return &Server{
 		config:            cfg,
 		checkpointManager: cpMgr,
 		sessionManager:    sessMgr,
 		checkpointNav:     cpNav,
 		replayer:          replayer,
+		jobManager:        jobMgr,
+		materializer:      materialize.NewMaterializer(cfg, backup.NewBackupManager(cfg), cpNav, replayer),
+		verifier:          verify.NewVerifier(cfg),
+		clones:            clone.NewManager(cfg, cpNav, replayer),
+		bundles:           bundle.NewManager(cfg, sessMgr, cpMgr, cpNav, backup.NewBackupManager(cfg)),
 	}
 }
 
@@ -41,12 +63,25 @@ func (s *Server) Start(addr string) error {
 	mux.HandleFunc("/api/sessions", s.handleSessions)
 	mux.HandleFunc("/api/sessions/", s.handleSession)
 	mux.HandleFunc("/api/sessions/switch", s.handleSwitchSession)
+	mux.HandleFunc("/api/sessions/import", s.handleImportSession)
 	mux.HandleFunc("/api/checkpoints", s.handleCheckpoints)
 	mux.HandleFunc("/api/checkpoints/", s.handleCheckpoint)
+	mux.HandleFunc("/api/checkpoints/now", s.handleCheckpointNow)
+	mux.HandleFunc("/api/checkpoints/tree", s.handleCheckpointTree)
 	mux.HandleFunc("/api/replay", s.handleReplay)
+	mux.HandleFunc("/api/rewind", s.handleRewind)
 	mux.HandleFunc("/api/navigate", s.handleNavigate)
 	mux.HandleFunc("/api/config", s.handleConfig)
 	mux.HandleFunc("/api/wal-logs", s.handleWALLogs)
+	mux.HandleFunc("/api/row-history", s.handleRowHistory)
+	mux.HandleFunc("/api/diff", s.handleDiff)
+	mux.HandleFunc("/api/materialize", s.handleMaterialize)
+	mux.HandleFunc("/api/materialize/", s.handleMaterialized)
+	mux.HandleFunc("/api/verify", s.handleVerify)
+	mux.HandleFunc("/api/clones", s.handleClones)
+	mux.HandleFunc("/api/clones/", s.handleClone)
+	mux.HandleFunc("/api/jobs", s.handleJobs)
+	mux.HandleFunc("/api/jobs/", s.handleJob)
 	mux.HandleFunc("/health", s.handleHealth)
 
 	// Serve UI files
@@ -65,6 +100,10 @@ func (s *Server) Start(addr string) error {
 		return fmt.Errorf("failed to create listener: %w", err)
 	}
 
+	reaperCtx, stopReaper := context.WithCancel(context.Background())
+	s.stopReaper = stopReaper
+	go s.clones.RunReaper(reaperCtx)
+
 	fmt.Printf("IPC Server listening on %s\n", addr)
 	if s.config.Server.UIPath != "" {
 		fmt.Printf("UI available at http://localhost%s\n", addr)
@@ -73,6 +112,9 @@ func (s *Server) Start(addr string) error {
 }
 
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stopReaper != nil {
+		s.stopReaper()
+	}
 	if s.server != nil {
 		return s.server.Shutdown(ctx)
 	}
@@ -120,11 +162,23 @@ func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
-	// Extract session ID from path
-	sessionID := r.URL.Path[len("/api/sessions/"):]
+	// Extract session ID and action from path
+	sessionID, action, _ := strings.Cut(r.URL.Path[len("/api/sessions/"):], "/")
 
-	switch r.Method {
-	case http.MethodGet:
+	switch {
+	case action == "export" && r.Method == http.MethodGet:
+		s.handleExportSession(w, r, sessionID)
+
+	case (action == "start" || action == "stop") && r.Method == http.MethodPost:
+		s.handleRecording(w, r, sessionID, action == "start")
+
+	case action == "fork" && r.Method == http.MethodPost:
+		s.handleForkSession(w, r, sessionID)
+
+	case action != "":
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodGet:
 		sess, err := s.sessionManager.GetSession(sessionID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -132,18 +186,71 @@ func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
 		}
 		json.NewEncoder(w).Encode(sess)
 
-	case http.MethodDelete:
-		if err := s.sessionManager.DeleteSession(sessionID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	case r.Method == http.MethodDelete:
+		deleted, err := s.checkpointManager.DeleteSession(sessionID)
+		if err != nil {
+			http.Error(w, err.Error(), notFoundStatus(err, http.StatusInternalServerError))
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted_checkpoints": deleted})
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// handleExportSession sends a bundle of the session. The bundle is written
+// to a temporary file first, so that a failure is still reported as an
+// error rather than a truncated download.
+func (s *Server) handleExportSession(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if _, err := s.sessionManager.GetSession(sessionID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	opts := bundle.ExportOptions{
+		Backup:       r.URL.Query().Get("backup"),
+		CreateBackup: r.URL.Query().Get("create_backup") == "true",
+	}
+
+	file, err := os.CreateTemp("", "bundle-*.tar.gz")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if _, err := s.bundles.Export(r.Context(), file, sessionID, opts); err != nil {
+		http.Error(w, err.Error(), entriesStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "session_"+sessionID+".tar.gz"))
+	http.ServeContent(w, r, "", time.Now(), file)
+}
+
+func (s *Server) handleImportSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	imported, err := s.bundles.Import(r.Body)
+	if errors.Is(err, bundle.ErrChecksum) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(imported)
+}
+
 func (s *Server) handleSwitchSession(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -158,12 +265,76 @@ func (s *Server) handleSwitchSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.sessionManager.SwitchSession(req.SessionID); err != nil {
+	s.handleRecording(w, r, req.SessionID, true)
+}
+
+// handleForkSession creates a session sharing the history of another up to
+// one of its checkpoints, with the checkpoint checked out so that the
+// fork's changes start from now.
+func (s *Server) handleForkSession(w http.ResponseWriter, r *http.Request, sourceID string) {
+	var req struct {
+		// CheckpointID defaults to the source session's head.
+		CheckpointID string `json:"checkpoint_id"`
+		Name         string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fork, err := s.sessionManager.ForkSession(sourceID, req.CheckpointID, req.Name)
+	if errors.Is(err, session.ErrNotInSession) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), notFoundStatus(err, http.StatusInternalServerError))
+		return
+	}
+	if err := s.checkout(fork.ID, fork.Head); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	fork, _ = s.sessionManager.GetSession(fork.ID)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(fork)
+}
+
+// handleRecording starts or stops the recording of a session at the
+// primary's current position.
+func (s *Server) handleRecording(w http.ResponseWriter, r *http.Request, sessionID string, start bool) {
+	if _, err := s.sessionManager.GetSession(sessionID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	label := "stop " + sessionID
+	if start {
+		label = "start " + sessionID
+	}
+	position, err := replication.CurrentPosition(r.Context(), s.config, label)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if start {
+		err = s.sessionManager.StartRecording(sessionID, wal.FormatLSN(position))
+	} else {
+		err = s.sessionManager.StopRecording(sessionID, wal.FormatLSN(position))
+	}
+	if errors.Is(err, session.ErrNotRecording) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), notFoundStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	sess, _ := s.sessionManager.GetSession(sessionID)
+	json.NewEncoder(w).Encode(sess)
 }
 
 func (s *Server) handleCheckpoints(w http.ResponseWriter, r *http.Request) {
@@ -182,7 +353,7 @@ func (s *Server) handleCheckpoints(w http.ResponseWriter, r *http.Request) {
 			Name        string `json:"name"`
 			Description string `json:"description"`
 			LSN         string `json:"lsn"`
-			EntryIndex  int    `json:"entry_index"`
+			EntryIndex  *int   `json:"entry_index"`
 			SessionID   string `json:"session_id"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -190,14 +361,15 @@ func (s *Server) handleCheckpoints(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		cp, err := s.checkpointManager.CreateCheckpoint(req.Name, req.Description, req.LSN, req.EntryIndex, req.SessionID)
+		anchor, err := s.checkpointNav.AnchorAt(req.LSN, req.EntryIndex)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if err := s.sessionManager.AddCheckpoint(req.SessionID, cp.ID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		cp, status, err := s.createCheckpoint(req.Name, req.Description, anchor, req.SessionID)
+		if err != nil {
+			http.Error(w, err.Error(), status)
 			return
 		}
 
@@ -209,11 +381,121 @@ func (s *Server) handleCheckpoints(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleCheckpointNow creates a checkpoint at the primary's current
+// position, once the listener has captured every transaction before it.
+func (s *Server) handleCheckpointNow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		// SessionID defaults to the active session.
+		SessionID string `json:"session_id"`
+		// Timeout is how long to wait for the listener, such as "10s".
+		Timeout string `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var timeout time.Duration
+	if req.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(req.Timeout); err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("invalid timeout %q: expected a positive duration such as 10s", req.Timeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.SessionID == "" {
+		sess, err := s.sessionManager.GetActiveSession()
+		if err != nil {
+			http.Error(w, "session_id is required when no session is active", http.StatusBadRequest)
+			return
+		}
+		req.SessionID = sess.ID
+	} else if _, err := s.sessionManager.GetSession(req.SessionID); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	position, err := replication.CurrentPosition(r.Context(), s.config, req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if err := replication.WaitForCapture(r.Context(), s.config.Storage.WALLogPath, position, timeout); err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	anchor, err := s.checkpointNav.AnchorAt(wal.FormatLSN(position), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cp, status, err := s.createCheckpoint(req.Name, req.Description, anchor, req.SessionID)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cp)
+}
+
+// createCheckpoint records a checkpoint in a session, following the
+// session's head, and moves the head to it. It returns the HTTP status for
+// the error when it fails.
+func (s *Server) createCheckpoint(name, description string, anchor checkpoint.Anchor, sessionID string) (*checkpoint.Checkpoint, int, error) {
+	sess, err := s.sessionManager.GetSession(sessionID)
+	if err != nil {
+		return nil, http.StatusNotFound, err
+	}
+
+	var branch checkpoint.Branch
+	if _, err := s.checkpointManager.GetCheckpoint(sess.Head); err == nil {
+		branch = checkpoint.BranchFrom(sess.Head, checkpoint.Anchor{LSN: sess.HeadLSN, Seq: sess.HeadSeq})
+	}
+
+	cp, err := s.checkpointManager.CreateCheckpoint(name, description, anchor, branch, sess.ID)
+	if errors.Is(err, checkpoint.ErrBeforeBranch) {
+		return nil, http.StatusBadRequest, err
+	}
+	if err != nil {
+		return nil, notFoundStatus(err, http.StatusInternalServerError), err
+	}
+
+	if err := s.sessionManager.SetHead(sess.ID, cp.ID, cp.LSN, cp.Seq); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	return cp, http.StatusCreated, nil
+}
+
+// checkout makes a checkpoint the head of a session, so that the changes
+// recorded from now on start a branch from it.
+func (s *Server) checkout(sessionID, checkpointID string) error {
+	if _, err := s.checkpointManager.GetCheckpoint(checkpointID); err != nil {
+		return err
+	}
+	base, err := s.checkpointNav.AnchorAt("", nil)
+	if err != nil {
+		return err
+	}
+	return s.sessionManager.SetHead(sessionID, checkpointID, base.LSN, base.Seq)
+}
+
 func (s *Server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
-	checkpointID := r.URL.Path[len("/api/checkpoints/"):]
+	checkpointID, action, _ := strings.Cut(r.URL.Path[len("/api/checkpoints/"):], "/")
 
-	switch r.Method {
-	case http.MethodGet:
+	switch {
+	case action == "" && r.Method == http.MethodGet:
 		cp, err := s.checkpointManager.GetCheckpoint(checkpointID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusNotFound)
@@ -221,16 +503,71 @@ func (s *Server) handleCheckpoint(w http.ResponseWriter, r *http.Request) {
 		}
 		json.NewEncoder(w).Encode(cp)
 
-	case http.MethodDelete:
-		if err := s.checkpointManager.DeleteCheckpoint(checkpointID); err != nil {
+	case action == "" && r.Method == http.MethodDelete:
+		deleted, err := s.checkpointManager.DeleteCheckpoint(checkpointID)
+		if err != nil {
+			http.Error(w, err.Error(), notFoundStatus(err, http.StatusInternalServerError))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"deleted_checkpoints": deleted})
+
+	case action == "path" && r.Method == http.MethodGet:
+		if _, err := s.checkpointManager.GetCheckpoint(checkpointID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		path, err := s.checkpointNav.Path(checkpointID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		json.NewEncoder(w).Encode(path)
+
+	case action == "checkout" && r.Method == http.MethodPost:
+		var req struct {
+			SessionID string `json:"session_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := s.sessionManager.GetSession(req.SessionID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if _, err := s.checkpointManager.GetCheckpoint(checkpointID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := s.checkout(req.SessionID, checkpointID); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+		sess, _ := s.sessionManager.GetSession(req.SessionID)
+		json.NewEncoder(w).Encode(sess)
+
+	case action == "" || action == "path" || action == "checkout":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 
 	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleCheckpointTree returns the checkpoint trees of a session, or of
+// every session.
+func (s *Server) handleCheckpointTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tree, err := s.checkpointNav.Tree(r.URL.Query().Get("session_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	json.NewEncoder(w).Encode(tree)
 }
 
 func (s *Server) handleNavigate(w http.ResponseWriter, r *http.Request) {
@@ -262,7 +599,7 @@ func (s *Server) handleNavigate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), entriesStatus(err, http.StatusInternalServerError))
 		return
 	}
 
@@ -272,59 +609,557 @@ func (s *Server) handleNavigate(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type replayRequest struct {
+	SessionID        string            `json:"session_id"`
+	CheckpointID     string            `json:"checkpoint_id"`
+	FromCheckpointID string            `json:"from_checkpoint_id,omitempty"`
+	OnError          string            `json:"on_error,omitempty"`
+	Conflicts        map[string]string `json:"conflicts,omitempty"`
+	Speed            *float64          `json:"speed,omitempty"`
+	MaxGap           string            `json:"max_gap,omitempty"`
+	Connections      int               `json:"connections,omitempty"`
+	// Verify compares the replica against a source once the replay has
+	// finished without errors.
+	Verify *verifyRequest `json:"verify,omitempty"`
+}
+
+// handleReplay starts a replay job and returns it without waiting for the
+// replay to finish. With ?dry_run=true it returns the replay as a SQL
+// script instead.
 func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		SessionID    string `json:"session_id"`
-		CheckpointID string `json:"checkpoint_id"`
-	}
+	var req replayRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	opts, err := s.replayer.DefaultOptions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.OnError != "" {
+		policy, err := session.ParseFailurePolicy(req.OnError)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.OnError = policy
+	}
+	if req.Conflicts != nil {
+		conflicts, err := session.ParseConflictPolicies(req.Conflicts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Conflicts = conflicts
+	}
+	if req.Speed != nil {
+		if *req.Speed < 0 {
+			http.Error(w, "speed must not be negative", http.StatusBadRequest)
+			return
+		}
+		opts.Speed = *req.Speed
+	}
+	if req.MaxGap != "" {
+		maxGap, err := time.ParseDuration(req.MaxGap)
+		if err != nil {
+			http.Error(w, "invalid max_gap: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.MaxGap = maxGap
+	}
+	if req.Connections > 0 {
+		opts.Connections = req.Connections
+	}
+
+	var entries []*wal.WALEntry
+	if req.FromCheckpointID != "" {
+		entries, err = s.checkpointNav.GetEntriesAfterCheckpoint(req.FromCheckpointID, req.CheckpointID)
+	} else {
+		entries, err = s.checkpointNav.GetEntriesUpToCheckpoint(req.CheckpointID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), entriesStatus(err, http.StatusInternalServerError))
+		return
+	}
+
+	if r.URL.Query().Get("dry_run") == "true" {
+		var script bytes.Buffer
+		if err := session.WriteScript(&script, s.replayer.ReplicaTarget(), entries); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sql")
+		w.Write(script.Bytes())
+		return
+	}
+
 	sess, err := s.sessionManager.GetSession(req.SessionID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	entries, err := s.checkpointNav.GetEntriesUpToCheckpoint(req.CheckpointID)
+	var source verify.Side
+	if req.Verify != nil {
+		if source, err = s.verifySource(*req.Verify); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	job, err := s.jobManager.Start("replay", req, func(ctx context.Context, progress func(jobs.Progress)) (interface{}, error) {
+		progress(jobs.Progress{Total: len(entries)})
+		opts.Progress = func(done, total int, lsn string) {
+			progress(jobs.Progress{Total: total, Done: done, CurrentLSN: lsn})
+		}
+
+		result, err := s.replayer.ReplaySession(ctx, sess, entries, opts)
+		summary, err := s.finishReplay(sess.ID, req.CheckpointID, opts, result, err)
+		if err != nil || req.Verify == nil {
+			return summary, err
+		}
+
+		report, err := s.verifier.Compare(ctx, source, s.verifier.Replica(), req.Verify.options())
+		if err != nil {
+			return summary, fmt.Errorf("replay succeeded but verification failed: %w", err)
+		}
+		summary.(map[string]interface{})["verification"] = report
+		return summary, report.Err()
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
 
-	if err := s.replayer.ReplaySession(ctx, sess, entries); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// finishReplay turns the outcome of a replay or rewind job into its
+// result, and records where the session's replica now is. A replica left
+// partway is given no position, since it matches no checkpoint.
+func (s *Server) finishReplay(sessionID, checkpointID string, opts session.Options, result *session.Result, err error) (interface{}, error) {
+	if err == nil {
+		err = result.Err()
+	}
+	if err != nil {
+		s.sessionManager.SetReplayPosition(sessionID, "", "")
+		if result == nil {
+			return nil, err
+		}
+		return replaySummary(opts, result), err
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status":          "success",
-		"entries_applied": len(entries),
-	})
+	cp, err := s.checkpointManager.GetCheckpoint(checkpointID)
+	if err != nil {
+		return replaySummary(opts, result), err
+	}
+	if err := s.sessionManager.SetReplayPosition(sessionID, cp.ID, cp.LSN); err != nil {
+		return replaySummary(opts, result), err
+	}
+	// Changes recorded after the replay branch off the checkpoint.
+	return replaySummary(opts, result), s.checkout(sessionID, cp.ID)
 }
 
-func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+// handleRewind starts a job that undoes entries on the replica, taking it
+// back from the session's current position, or from_checkpoint_id, to an
+// earlier checkpoint.
+func (s *Server) handleRewind(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	response := map[string]interface{}{
-		"input_dsn":  s.config.PrimaryDB.ToDSN(),
-		"output_dsn": s.config.ReplicaDB.ToDSN(),
-		"server": map[string]interface{}{
-			"port":    s.config.Server.Port,
-			"ui_path": s.config.Server.UIPath,
+	var req struct {
+		SessionID        string `json:"session_id"`
+		CheckpointID     string `json:"checkpoint_id"`
+		FromCheckpointID string `json:"from_checkpoint_id,omitempty"`
+		OnError          string `json:"on_error,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess, err := s.sessionManager.GetSession(req.SessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if req.FromCheckpointID == "" {
+		req.FromCheckpointID = sess.ReplayCheckpoint
+	}
+	if req.FromCheckpointID == "" {
+		http.Error(w, "session has no replay position; set from_checkpoint_id", http.StatusBadRequest)
+		return
+	}
+
+	opts, err := s.replayer.DefaultOptions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.OnError != "" {
+		policy, err := session.ParseFailurePolicy(req.OnError)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.OnError = policy
+	}
+
+	entries, err := s.checkpointNav.GetEntriesAfterCheckpoint(req.CheckpointID, req.FromCheckpointID)
+	if err != nil {
+		http.Error(w, err.Error(), entriesStatus(err, http.StatusBadRequest))
+		return
+	}
+	if _, err := session.Invert(entries); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	job, err := s.jobManager.Start("rewind", req, func(ctx context.Context, progress func(jobs.Progress)) (interface{}, error) {
+		progress(jobs.Progress{Total: len(entries)})
+		opts.Progress = func(done, total int, lsn string) {
+			progress(jobs.Progress{Total: total, Done: done, CurrentLSN: lsn})
+		}
+
+		result, err := s.replayer.RewindSession(ctx, sess, entries, opts)
+		return s.finishReplay(sess.ID, req.CheckpointID, opts, result, err)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// replaySummary is the result stored on a finished replay job.
+func replaySummary(opts session.Options, result *session.Result) map[string]interface{} {
+	status := "success"
+	switch {
+	case result.Stopped:
+		status = "stopped"
+	case len(result.Errors) > 0:
+		status = "partial"
+	}
+
+	summary := map[string]interface{}{
+		"status":                  status,
+		"on_error":                opts.OnError,
+		"entries_applied":         result.Applied,
+		"entries_skipped":         result.Skipped,
+		"entries_rolled_back":     result.RolledBack,
+		"transactions_applied":    result.Transactions,
+		"transactions_failed":     len(result.Errors),
+		"transactions_serialized": result.Serialized,
+		"errors":                  result.Errors,
+		"conflicts":               result.Conflicts,
+	}
+	if result.SerialReason != "" {
+		summary["serial_reason"] = result.SerialReason
+	}
+	return summary
+}
+
+type verifyRequest struct {
+	// Source is primary, the default, or materialized.
+	Source string `json:"source,omitempty"`
+	// Name, Kind and SourceSchema select the materialized copy.
+	Name         string           `json:"name,omitempty"`
+	Kind         materialize.Kind `json:"kind,omitempty"`
+	SourceSchema string           `json:"source_schema,omitempty"`
+	Tables       []string         `json:"tables,omitempty"`
+	MaxRows      int              `json:"max_rows,omitempty"`
+}
+
+func (req verifyRequest) options() verify.Options {
+	return verify.Options{Tables: req.Tables, MaxRows: req.MaxRows}
+}
+
+// verifySource returns the database the replica is compared against.
+func (s *Server) verifySource(req verifyRequest) (verify.Side, error) {
+	switch req.Source {
+	case "", "primary":
+		return s.verifier.Primary(), nil
+	case "materialized":
+		if req.Name == "" {
+			return verify.Side{}, fmt.Errorf("name is required for a materialized source")
+		}
+		kind := req.Kind
+		if kind == "" {
+			kind = materialize.KindDatabase
+		}
+		if kind != materialize.KindDatabase && kind != materialize.KindSchema {
+			return verify.Side{}, fmt.Errorf("unknown kind %q", kind)
+		}
+		return s.verifier.Materialized(s.materializer, kind, req.Name, req.SourceSchema), nil
+	default:
+		return verify.Side{}, fmt.Errorf("unknown source %q: must be primary or materialized", req.Source)
+	}
+}
+
+// handleVerify starts a job that compares the replica against the primary
+// or a materialized checkpoint, table by table.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req verifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source, err := s.verifySource(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.jobManager.Start("verify", req, func(ctx context.Context, progress func(jobs.Progress)) (interface{}, error) {
+		report, err := s.verifier.Compare(ctx, source, s.verifier.Replica(), req.options())
+		if err != nil {
+			return nil, err
+		}
+		return report, report.Err()
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+type cloneRequest struct {
+	SessionID string `json:"session_id"`
+	clone.Options
+	OnError string `json:"on_error,omitempty"`
+}
+
+// handleClones lists clone databases, or starts a job that creates one at
+// a checkpoint. The finished job's result holds the clone and its DSN.
+func (s *Server) handleClones(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		clones, err := s.clones.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(clones)
+
+	case http.MethodPost:
+		var req cloneRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		sess, err := s.sessionManager.GetSession(req.SessionID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if _, err := s.checkpointManager.GetCheckpoint(req.CheckpointID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		opts, err := s.replayer.DefaultOptions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.OnError != "" {
+			policy, err := session.ParseFailurePolicy(req.OnError)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			opts.OnError = policy
+		}
+		if req.TTL != "" {
+			if ttl, err := time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				http.Error(w, "invalid ttl: expected a positive duration such as 2h", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Template, err = s.clones.Template(req.Template); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Fixed now so that the job's params name the clone it creates.
+		req.Name = clone.CloneName(req.Name)
+
+		job, err := s.jobManager.Start("clone", req, func(ctx context.Context, progress func(jobs.Progress)) (interface{}, error) {
+			opts.Progress = func(done, total int, lsn string) {
+				progress(jobs.Progress{Total: total, Done: done, CurrentLSN: lsn})
+			}
+
+			created, result, err := s.clones.Create(ctx, sess, req.Options, opts)
+			if err != nil {
+				if result != nil {
+					return map[string]interface{}{"replay": replaySummary(opts, result)}, err
+				}
+				return nil, err
+			}
+			return map[string]interface{}{"clone": created, "replay": replaySummary(opts, result)}, nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleClone serves /api/clones/{name}: GET returns the clone, DELETE
+// drops it before its TTL runs out.
+func (s *Server) handleClone(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/api/clones/"):]
+
+	switch r.Method {
+	case http.MethodGet:
+		c, err := s.clones.Get(r.Context(), name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(c)
+
+	case http.MethodDelete:
+		if err := s.clones.Drop(r.Context(), name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	list, err := s.jobManager.ListJobs(r.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+// handleJob serves /api/jobs/{id}, /api/jobs/{id}/cancel and
+// /api/jobs/{id}/stream.
+func (s *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(r.URL.Path[len("/api/jobs/"):], "/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		job, err := s.jobManager.GetJob(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(job)
+
+	case action == "cancel" && r.Method == http.MethodPost:
+		if _, err := s.jobManager.GetJob(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := s.jobManager.CancelJob(id); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]string{"status": "cancelling"})
+
+	case action == "stream" && r.Method == http.MethodGet:
+		s.streamJob(w, r, id)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamJob sends the job's state as server-sent events until it finishes
+// or the client goes away.
+func (s *Server) streamJob(w http.ResponseWriter, r *http.Request, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	updates, stop, err := s.jobManager.Watch(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case job, ok := <-updates:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(job)
+			if err != nil {
+				return
+			}
+			event := "progress"
+			if job.Status.Done() {
+				event = "done"
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := map[string]interface{}{
+		"input_dsn":  s.config.PrimaryDB.ToDSN(),
+		"output_dsn": s.config.ReplicaDB.ToDSN(),
+		"server": map[string]interface{}{
+			"port":    s.config.Server.Port,
+			"ui_path": s.config.Server.UIPath,
 		},
 		"storage": map[string]interface{}{
 			"wal_log_path":    s.config.Storage.WALLogPath,
@@ -343,7 +1178,8 @@ func (s *Server) handleWALLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limitStr := r.URL.Query().Get("limit")
+	query := r.URL.Query()
+	limitStr := query.Get("limit")
 	limit := 100
 	if limitStr != "" {
 		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
@@ -352,6 +1188,38 @@ func (s *Server) handleWALLogs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	walReader := wal.NewLogReader(s.config.Storage.WALLogPath)
+
+	// A filter expression or an explicit offset switches to paginated
+	// search, oldest entries first.
+	if query.Has("q") || query.Has("offset") {
+		filter, err := wal.ParseFilter(query.Get("q"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		offset := 0
+		if o, err := strconv.Atoi(query.Get("offset")); err == nil && o > 0 {
+			offset = o
+		}
+
+		result, err := walReader.Search(filter, offset, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries":     result.Entries,
+			"total_count": result.Total,
+			"matched":     result.Matched,
+			"returned":    len(result.Entries),
+			"offset":      result.Offset,
+			"next_offset": result.NextOffset,
+		})
+		return
+	}
+
 	entries, err := walReader.ReadAll()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -370,3 +1238,161 @@ func (s *Server) handleWALLogs(w http.ResponseWriter, r *http.Request) {
 		"returned":    len(entries[start:]),
 	})
 }
+
+func (s *Server) handleRowHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	table := query.Get("table")
+	key := parseRowKey(query.Get("key"))
+	if table == "" || len(key) == 0 {
+		http.Error(w, "Invalid request: provide table and key", http.StatusBadRequest)
+		return
+	}
+
+	history, err := s.checkpointNav.RowHistory(query.Get("schema"), table, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(history)
+}
+
+// handleDiff returns the net change between two checkpoints, as JSON or,
+// with format=text, as a report.
+func (s *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	toID := query.Get("to")
+	if toID == "" {
+		http.Error(w, "Invalid request: provide to and optionally from", http.StatusBadRequest)
+		return
+	}
+
+	changes, err := s.checkpointNav.Diff(query.Get("from"), toID)
+	if err != nil {
+		http.Error(w, err.Error(), entriesStatus(err, http.StatusBadRequest))
+		return
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		json.NewEncoder(w).Encode(changes)
+	case "text":
+		var report bytes.Buffer
+		if err := changes.WriteText(&report); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(report.Bytes())
+	default:
+		http.Error(w, "Invalid format: use json or text", http.StatusBadRequest)
+	}
+}
+
+// parseRowKey parses "col:value,col:value" into a key map. A bare value
+// without a column name is matched against a single-column primary key.
+func parseRowKey(raw string) map[string]string {
+	key := make(map[string]string)
+	if raw == "" {
+		return key
+	}
+
+	if !strings.Contains(raw, ":") {
+		key[""] = raw
+		return key
+	}
+
+	for _, part := range strings.Split(raw, ",") {
+		col, value, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+		key[strings.TrimSpace(col)] = strings.TrimSpace(value)
+	}
+	return key
+}
+
+func (s *Server) handleMaterialize(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		results, err := s.materializer.List(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(results)
+
+	case http.MethodPost:
+		var opts materialize.Options
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := s.checkpointManager.GetCheckpoint(opts.CheckpointID); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		result, err := s.materializer.Materialize(r.Context(), opts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(result)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleMaterialized(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/api/materialize/"):]
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	kind := materialize.Kind(r.URL.Query().Get("kind"))
+	if kind == "" {
+		kind = materialize.KindDatabase
+	}
+
+	if err := s.materializer.Drop(r.Context(), kind, name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notFoundStatus returns 404 for an error about a missing session or
+// checkpoint, or status for other errors.
+func notFoundStatus(err error, status int) int {
+	if errors.Is(err, session.ErrNotFound) || errors.Is(err, checkpoint.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return status
+}
+
+// entriesStatus returns the status for an error resolving checkpoint ranges,
+// or status for errors other than a checkpoint the log no longer holds or
+// one that does not exist.
+func entriesStatus(err error, status int) int {
+	if errors.Is(err, checkpoint.ErrUnresolved) {
+		return http.StatusConflict
+	}
+	return notFoundStatus(err, status)
+}
@@ -0,0 +1,385 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/persist"
+)
+
+// DefaultHistory is how many finished jobs are kept when neither the
+// config file nor JOB_HISTORY sets it.
+const DefaultHistory = 100
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+// Done reports whether the job has finished.
+func (s Status) Done() bool {
+	return s == StatusSucceeded || s == StatusFailed || s == StatusCancelled
+}
+
+// Progress is how far a running job has got. ETASeconds is estimated from
+// the rate so far and is omitted until there is one.
+type Progress struct {
+	Total      int     `json:"total"`
+	Done       int     `json:"done"`
+	CurrentLSN string  `json:"current_lsn,omitempty"`
+	ETASeconds float64 `json:"eta_seconds,omitempty"`
+}
+
+type Job struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Status     Status      `json:"status"`
+	Params     interface{} `json:"params,omitempty"`
+	Progress   Progress    `json:"progress"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	CreatedAt  time.Time   `json:"created_at"`
+	StartedAt  *time.Time  `json:"started_at,omitempty"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+// RunFunc does the work of a job. It reports progress through progress,
+// and should return promptly once ctx is cancelled. A result returned with
+// an error is kept on the job.
+type RunFunc func(ctx context.Context, progress func(Progress)) (interface{}, error)
+
+// Manager runs jobs in the background and keeps their history in the job
+// directory.
+type Manager struct {
+	config   *config.Config
+	jobs     map[string]*Job
+	cancels  map[string]context.CancelFunc
+	watchers map[string][]chan Job
+	mutex    sync.RWMutex
+}
+
+func NewManager(cfg *config.Config) *Manager {
+	return &Manager{
+		config:   cfg,
+		jobs:     make(map[string]*Job),
+		cancels:  make(map[string]context.CancelFunc),
+		watchers: make(map[string][]chan Job),
+	}
+}
+
+// Start creates a job and runs it in the background.
+func (m *Manager) Start(jobType string, params interface{}, run RunFunc) (*Job, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job := &Job{
+		ID:        uuid.New().String(),
+		Type:      jobType,
+		Status:    StatusPending,
+		Params:    params,
+		CreatedAt: time.Now(),
+	}
+	m.jobs[job.ID] = job
+
+	if err := m.save(); err != nil {
+		delete(m.jobs, job.ID)
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancels[job.ID] = cancel
+
+	go m.run(ctx, job.ID, run)
+
+	clone := *job
+	return &clone, nil
+}
+
+func (m *Manager) run(ctx context.Context, id string, run RunFunc) {
+	m.update(id, func(job *Job) {
+		now := time.Now()
+		job.Status = StatusRunning
+		job.StartedAt = &now
+	}, true)
+
+	result, err := run(ctx, func(p Progress) {
+		m.update(id, func(job *Job) {
+			p.ETASeconds = estimateETA(p, time.Since(*job.StartedAt)).Seconds()
+			job.Progress = p
+		}, false)
+	})
+
+	m.update(id, func(job *Job) {
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Result = result
+		job.Progress.ETASeconds = 0
+
+		switch {
+		case err == nil:
+			job.Status = StatusSucceeded
+		case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+			job.Status = StatusCancelled
+			job.Error = "cancelled"
+		default:
+			job.Status = StatusFailed
+			job.Error = err.Error()
+		}
+	}, true)
+
+	m.mutex.Lock()
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.mutex.Unlock()
+}
+
+// update applies fn to the job, notifies watchers and, with persist set,
+// saves the job list.
+func (m *Manager) update(id string, fn func(*Job), persist bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return
+	}
+	fn(job)
+
+	if job.Status.Done() {
+		m.prune()
+	}
+	if persist {
+		if err := m.save(); err != nil {
+			log.Printf("Warning: failed to save job %s: %v", id, err)
+		}
+	}
+
+	for _, ch := range m.watchers[id] {
+		notify(ch, *job)
+	}
+	if job.Status.Done() {
+		for _, ch := range m.watchers[id] {
+			close(ch)
+		}
+		delete(m.watchers, id)
+	}
+}
+
+// prune drops the oldest finished jobs beyond the history limit. Jobs
+// still running are always kept. The caller must hold the mutex.
+func (m *Manager) prune() {
+	finished := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		if job.Status.Done() {
+			finished = append(finished, job)
+		}
+	}
+	if len(finished) <= m.history() {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.After(finished[j].CreatedAt)
+	})
+	for _, job := range finished[m.history():] {
+		delete(m.jobs, job.ID)
+	}
+}
+
+// notify sends the latest state without blocking, replacing a state the
+// watcher has not read yet.
+func notify(ch chan Job, job Job) {
+	select {
+	case <-ch:
+	default:
+	}
+	ch <- job
+}
+
+// estimateETA extrapolates the time left from the rate so far.
+func estimateETA(p Progress, elapsed time.Duration) time.Duration {
+	if p.Done <= 0 || p.Total <= p.Done {
+		return 0
+	}
+	perItem := elapsed / time.Duration(p.Done)
+	return perItem * time.Duration(p.Total-p.Done)
+}
+
+func (m *Manager) GetJob(id string) (*Job, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+
+	clone := *job
+	return &clone, nil
+}
+
+// ListJobs returns jobs newest first, optionally only those of jobType.
+func (m *Manager) ListJobs(jobType string) ([]*Job, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		if jobType != "" && job.Type != jobType {
+			continue
+		}
+		clone := *job
+		jobs = append(jobs, &clone)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].CreatedAt.After(jobs[j].CreatedAt)
+	})
+
+	return jobs, nil
+}
+
+// CancelJob asks a running job to stop. The job is marked cancelled once
+// it has stopped.
+func (m *Manager) CancelJob(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if job.Status.Done() {
+		return fmt.Errorf("job %s already %s", id, job.Status)
+	}
+
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+	}
+	return nil
+}
+
+// Watch returns a channel that receives the job's state whenever it
+// changes, starting with the current state. The channel is closed when the
+// job finishes; call stop to unsubscribe earlier.
+func (m *Manager) Watch(id string) (<-chan Job, func(), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	job, exists := m.jobs[id]
+	if !exists {
+		return nil, nil, fmt.Errorf("job %s not found", id)
+	}
+
+	ch := make(chan Job, 1)
+	ch <- *job
+	if job.Status.Done() {
+		close(ch)
+		return ch, func() {}, nil
+	}
+	m.watchers[id] = append(m.watchers[id], ch)
+
+	stop := func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		watchers := m.watchers[id]
+		for i, w := range watchers {
+			if w == ch {
+				m.watchers[id] = append(watchers[:i], watchers[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	return ch, stop, nil
+}
+
+// Shutdown cancels every running job.
+func (m *Manager) Shutdown() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+}
+
+// Load reads the job history. Jobs that were still running when the
+// process stopped are marked failed.
+func (m *Manager) Load() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := os.MkdirAll(m.jobPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create job directory: %w", err)
+	}
+
+	var jobs map[string]*Job
+	found, err := m.file().Load(&jobs)
+	if err != nil {
+		return fmt.Errorf("failed to load jobs: %w", err)
+	}
+	if !found {
+		return nil
+	}
+
+	for _, job := range jobs {
+		if !job.Status.Done() {
+			job.Status = StatusFailed
+			job.Error = "interrupted: the server stopped while the job was running"
+		}
+	}
+	m.jobs = jobs
+	m.prune()
+
+	return nil
+}
+
+// save replaces the job file atomically, so that a crash while saving
+// cannot lose the job history. Only the IPC server writes it, so it takes
+// no lock and keeps no journal.
+func (m *Manager) save() error {
+	if err := m.file().Save(m.jobs); err != nil {
+		return fmt.Errorf("failed to save jobs: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) file() *persist.File {
+	return persist.NewFile(filepath.Join(m.jobPath(), "jobs.json"), 0)
+}
+
+// history returns how many finished jobs are kept, defaulting to
+// DefaultHistory for configuration files written before it existed.
+func (m *Manager) history() int {
+	if m.config.Storage.JobHistory <= 0 {
+		return DefaultHistory
+	}
+	return m.config.Storage.JobHistory
+}
+
+// jobPath returns the job directory, defaulting to ./jobs for
+// configuration files written before it existed.
+func (m *Manager) jobPath() string {
+	if m.config.Storage.JobPath == "" {
+		return "./jobs"
+	}
+	return m.config.Storage.JobPath
+}
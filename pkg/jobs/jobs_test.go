@@ -0,0 +1,170 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+)
+
+func newTestManager(t *testing.T) (*Manager, *config.Config) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Storage.JobPath = filepath.Join(t.TempDir(), "jobs")
+	return NewManager(cfg), cfg
+}
+
+func waitDone(t *testing.T, m *Manager, id string) *Job {
+	t.Helper()
+	updates, stop, err := m.Watch(id)
+	if err != nil {
+		t.Fatalf("Failed to watch job: %v", err)
+	}
+	defer stop()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case job, ok := <-updates:
+			if !ok {
+				final, _ := m.GetJob(id)
+				return final
+			}
+			if job.Status.Done() {
+				return &job
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for job")
+		}
+	}
+}
+
+func TestManager_RunAndPersist(t *testing.T) {
+	m, cfg := newTestManager(t)
+
+	job, err := m.Start("replay", map[string]string{"checkpoint_id": "cp1"}, func(ctx context.Context, progress func(Progress)) (interface{}, error) {
+		progress(Progress{Total: 2, Done: 1, CurrentLSN: "0/10"})
+		progress(Progress{Total: 2, Done: 2, CurrentLSN: "0/20"})
+		return map[string]int{"entries_applied": 2}, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to start job: %v", err)
+	}
+
+	final := waitDone(t, m, job.ID)
+	if final.Status != StatusSucceeded {
+		t.Fatalf("Expected job to succeed, got %s (%s)", final.Status, final.Error)
+	}
+	if final.Progress.Done != 2 || final.Progress.CurrentLSN != "0/20" {
+		t.Errorf("Expected final progress 2 at 0/20, got %+v", final.Progress)
+	}
+
+	reloaded := NewManager(cfg)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load jobs: %v", err)
+	}
+	loaded, err := reloaded.GetJob(job.ID)
+	if err != nil {
+		t.Fatalf("Expected job to be persisted: %v", err)
+	}
+	if loaded.Status != StatusSucceeded || loaded.Result == nil {
+		t.Errorf("Expected persisted result, got %+v", loaded)
+	}
+}
+
+func TestManager_Failure(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	job, _ := m.Start("replay", nil, func(ctx context.Context, progress func(Progress)) (interface{}, error) {
+		return "partial", errors.New("1 transactions failed")
+	})
+
+	final := waitDone(t, m, job.ID)
+	if final.Status != StatusFailed || final.Error != "1 transactions failed" || final.Result != "partial" {
+		t.Errorf("Expected failed job with result kept, got %+v", final)
+	}
+}
+
+func TestManager_Cancel(t *testing.T) {
+	m, _ := newTestManager(t)
+	started := make(chan struct{})
+
+	job, _ := m.Start("replay", nil, func(ctx context.Context, progress func(Progress)) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	<-started
+	if err := m.CancelJob(job.ID); err != nil {
+		t.Fatalf("Failed to cancel job: %v", err)
+	}
+
+	if final := waitDone(t, m, job.ID); final.Status != StatusCancelled {
+		t.Errorf("Expected cancelled job, got %s", final.Status)
+	}
+	if err := m.CancelJob(job.ID); err == nil {
+		t.Error("Expected error cancelling a finished job")
+	}
+}
+
+func TestManager_LoadMarksInterrupted(t *testing.T) {
+	m, cfg := newTestManager(t)
+	m.jobs["j1"] = &Job{ID: "j1", Type: "replay", Status: StatusRunning, CreatedAt: time.Now()}
+	if err := m.save(); err != nil {
+		t.Fatalf("Failed to save jobs: %v", err)
+	}
+
+	reloaded := NewManager(cfg)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load jobs: %v", err)
+	}
+	job, _ := reloaded.GetJob("j1")
+	if job.Status != StatusFailed || job.Error == "" {
+		t.Errorf("Expected interrupted job to be marked failed, got %+v", job)
+	}
+}
+
+func TestManager_PrunesHistory(t *testing.T) {
+	m, cfg := newTestManager(t)
+	cfg.Storage.JobHistory = 2
+
+	ids := make([]string, 0, 3)
+	for i := 0; i < 3; i++ {
+		job, err := m.Start("replay", nil, func(ctx context.Context, progress func(Progress)) (interface{}, error) {
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to start job: %v", err)
+		}
+		waitDone(t, m, job.ID)
+		ids = append(ids, job.ID)
+	}
+
+	if _, err := m.GetJob(ids[0]); err == nil {
+		t.Error("Expected the oldest finished job to be dropped")
+	}
+	if jobs, _ := m.ListJobs(""); len(jobs) != 2 {
+		t.Errorf("Expected 2 jobs to be kept, got %d", len(jobs))
+	}
+
+	reloaded := NewManager(cfg)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Failed to load jobs: %v", err)
+	}
+	if jobs, _ := reloaded.ListJobs(""); len(jobs) != 2 {
+		t.Errorf("Expected 2 jobs to be saved, got %d", len(jobs))
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	if eta := estimateETA(Progress{Total: 100, Done: 25}, 10*time.Second); eta != 30*time.Second {
+		t.Errorf("Expected 30s, got %v", eta)
+	}
+	if eta := estimateETA(Progress{Total: 100}, 10*time.Second); eta != 0 {
+		t.Errorf("Expected no estimate before progress, got %v", eta)
+	}
+}
@@ -0,0 +1,373 @@
+package mask
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+type Strategy string
+
+const (
+	// StrategyHash replaces the value with a keyed SHA-256 hex digest.
+	StrategyHash Strategy = "hash"
+	// StrategyFakeEmail replaces the value with a plausible fake address.
+	StrategyFakeEmail Strategy = "fake_email"
+	// StrategyFakeName replaces the value with a plausible fake full name.
+	StrategyFakeName Strategy = "fake_name"
+	// StrategyNull replaces the value with NULL.
+	StrategyNull Strategy = "null"
+	// StrategyScramble keeps the format of the value (digits stay digits,
+	// letters keep their case, punctuation is preserved) but replaces
+	// every letter and digit.
+	StrategyScramble Strategy = "scramble"
+	// StrategyMap replaces the value with a stable token. Numbers map to
+	// numbers of the same sign and shape, and UUIDs to UUIDs, so that keys
+	// keep their type, which keeps foreign keys matching when both columns
+	// use this strategy. UUIDs and numbers of up to maxPermutedDigits
+	// digits are permuted, so distinct keys never collide. Other text maps
+	// to a token.
+	StrategyMap Strategy = "map"
+)
+
+// Rule masks a single column. Column is either "table.column" or
+// "schema.table.column".
+type Rule struct {
+	Column   string   `json:"column"`
+	Strategy Strategy `json:"strategy"`
+}
+
+type RuleSet struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Masker applies masking rules to WAL entries. Every strategy is
+// deterministic: the same input value and salt always produce the same
+// output, regardless of the column it appears in.
+type Masker struct {
+	rules map[string]Strategy
+	salt  []byte
+}
+
+func NewMasker(rules []Rule, salt string) (*Masker, error) {
+	m := &Masker{
+		rules: make(map[string]Strategy, len(rules)),
+		salt:  []byte(salt),
+	}
+
+	for _, rule := range rules {
+		parts := strings.Split(rule.Column, ".")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid column %q: expected table.column or schema.table.column", rule.Column)
+		}
+
+		switch rule.Strategy {
+		case StrategyHash, StrategyFakeEmail, StrategyFakeName, StrategyNull, StrategyScramble, StrategyMap:
+		default:
+			return nil, fmt.Errorf("unknown masking strategy %q for column %s", rule.Strategy, rule.Column)
+		}
+
+		m.rules[rule.Column] = rule.Strategy
+	}
+
+	return m, nil
+}
+
+// LoadRules reads a rule set from a JSON file.
+func LoadRules(path string) ([]Rule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file: %w", err)
+	}
+	defer file.Close()
+
+	var set RuleSet
+	if err := json.NewDecoder(file).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode rules file: %w", err)
+	}
+
+	return set.Rules, nil
+}
+
+// Apply masks the Data and OldData columns of entry in place.
+func (m *Masker) Apply(entry *wal.WALEntry) {
+	m.applyMap(entry.Schema, entry.Table, entry.Data)
+	m.applyMap(entry.Schema, entry.Table, entry.OldData)
+}
+
+func (m *Masker) applyMap(schema, table string, row map[string]interface{}) {
+	for column, value := range row {
+		strategy, ok := m.strategyFor(schema, table, column)
+		if !ok || value == nil {
+			continue
+		}
+		row[column] = m.maskValue(strategy, value)
+	}
+}
+
+func (m *Masker) strategyFor(schema, table, column string) (Strategy, bool) {
+	if s, ok := m.rules[schema+"."+table+"."+column]; ok {
+		return s, true
+	}
+	s, ok := m.rules[table+"."+column]
+	return s, ok
+}
+
+func (m *Masker) maskValue(strategy Strategy, value interface{}) interface{} {
+	text, ok := value.(string)
+	if !ok {
+		text = fmt.Sprint(value)
+	}
+
+	switch strategy {
+	case StrategyNull:
+		return nil
+	case StrategyHash:
+		return hex.EncodeToString(m.digest(text, 0))
+	case StrategyFakeEmail:
+		return m.fakeEmail(text)
+	case StrategyFakeName:
+		return m.fakeName(text)
+	case StrategyScramble:
+		return m.scramble(text)
+	case StrategyMap:
+		return m.mapValue(text)
+	}
+
+	return value
+}
+
+// digest returns the keyed hash of value for the given round. Rounds let
+// strategies draw more pseudo-random bytes than a single digest provides.
+func (m *Masker) digest(value string, round uint32) []byte {
+	mac := hmac.New(sha256.New, m.salt)
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], round)
+	mac.Write(buf[:])
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// stream returns n pseudo-random bytes derived from value.
+func (m *Masker) stream(value string, n int) []byte {
+	out := make([]byte, 0, n)
+	for round := uint32(0); len(out) < n; round++ {
+		out = append(out, m.digest(value, round)...)
+	}
+	return out[:n]
+}
+
+var firstNames = []string{
+	"Alex", "Blair", "Casey", "Dana", "Eli", "Frankie", "Gale", "Harper",
+	"Indy", "Jordan", "Kai", "Logan", "Morgan", "Noel", "Parker", "Quinn",
+	"Reese", "Sam", "Taylor", "Val",
+}
+
+var lastNames = []string{
+	"Adams", "Brooks", "Carter", "Diaz", "Evans", "Foster", "Garcia", "Hayes",
+	"Ibarra", "Jensen", "Kim", "Lopez", "Mills", "Nguyen", "Owens", "Patel",
+	"Reyes", "Silva", "Turner", "Walsh",
+}
+
+func (m *Masker) fakeName(value string) string {
+	d := m.digest(value, 0)
+	first := firstNames[int(binary.BigEndian.Uint16(d[0:2]))%len(firstNames)]
+	last := lastNames[int(binary.BigEndian.Uint16(d[2:4]))%len(lastNames)]
+	return first + " " + last
+}
+
+func (m *Masker) fakeEmail(value string) string {
+	d := m.digest(value, 0)
+	first := firstNames[int(binary.BigEndian.Uint16(d[0:2]))%len(firstNames)]
+	last := lastNames[int(binary.BigEndian.Uint16(d[2:4]))%len(lastNames)]
+	// The suffix keeps distinct inputs from colliding on the same address,
+	// which matters for columns with unique constraints.
+	suffix := hex.EncodeToString(d[4:8])
+	return strings.ToLower(first+"."+last) + "." + suffix + "@example.com"
+}
+
+func (m *Masker) scramble(value string) string {
+	runes := []rune(value)
+	random := m.stream(value, len(runes))
+
+	for i, r := range runes {
+		b := int(random[i])
+		switch {
+		case unicode.IsDigit(r):
+			runes[i] = rune('0' + b%10)
+		case unicode.IsUpper(r):
+			runes[i] = rune('A' + b%26)
+		case unicode.IsLower(r):
+			runes[i] = rune('a' + b%26)
+		}
+	}
+
+	return string(runes)
+}
+
+// maxPermutedDigits is the longest number mapValue permutes. Longer numbers
+// are mapped digit by digit, where collisions are too unlikely to matter.
+const maxPermutedDigits = 18
+
+func (m *Masker) mapValue(value string) string {
+	if len(value) == 36 {
+		if id, err := uuid.Parse(value); err == nil {
+			return m.permuteUUID(id).String()
+		}
+	}
+
+	sign, digits := "", value
+	if strings.HasPrefix(value, "-") {
+		sign, digits = "-", value[1:]
+	}
+	whole, fraction, decimal := strings.Cut(digits, ".")
+	if whole != "" && isDigits(whole) && (!decimal || fraction != "" && isDigits(fraction)) {
+		// The digits are mapped together and the point put back, so that
+		// decimals keep their scale.
+		mapped := m.mapDigits(whole + fraction)
+		if decimal {
+			mapped = mapped[:len(whole)] + "." + mapped[len(whole):]
+		}
+		return sign + mapped
+	}
+
+	return "tok_" + hex.EncodeToString(m.digest(value, 0)[:8])
+}
+
+// mapDigits maps a string of digits to another of the same length.
+func (m *Masker) mapDigits(value string) string {
+	if len(value) <= maxPermutedDigits {
+		return m.permuteDigits(value)
+	}
+
+	random := m.stream(value, len(value))
+	out := make([]byte, len(value))
+	for i := range out {
+		out[i] = '0' + random[i]%10
+	}
+	// Keep the value free of a leading zero so it still parses to a
+	// number of the same magnitude.
+	if value[0] != '0' && out[0] == '0' {
+		out[0] = '1' + random[0]%9
+	}
+	return string(out)
+}
+
+// permuteUUID maps a UUID to another through a keyed permutation of its
+// 128 bits: a Feistel network over its two halves.
+func (m *Masker) permuteUUID(id uuid.UUID) uuid.UUID {
+	left, right := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	for round := uint32(0); round < 8; round++ {
+		f := binary.BigEndian.Uint64(m.digest(fmt.Sprintf("uuid:%d", right), round)[:8])
+		left, right = right, left^f
+	}
+
+	var out uuid.UUID
+	binary.BigEndian.PutUint64(out[:8], left)
+	binary.BigEndian.PutUint64(out[8:], right)
+	return out
+}
+
+// permuteDigits maps a number to another of the same length through a
+// keyed permutation, so that distinct numbers stay distinct. Numbers
+// without a leading zero are permuted among themselves, as are those with
+// one, which keeps the magnitude of plain integers.
+func (m *Masker) permuteDigits(value string) string {
+	n := len(value)
+	var x uint64
+	for i := 0; i < n; i++ {
+		x = x*10 + uint64(value[i]-'0')
+	}
+
+	// The domain is [offset, offset+size).
+	var offset, size uint64 = 0, 1
+	for i := 1; i < n; i++ {
+		size *= 10
+	}
+	if n == 1 {
+		size = 10
+	} else if value[0] != '0' {
+		offset, size = size, 9*size
+	}
+
+	x = offset + m.permute(x-offset, size, n)
+	return fmt.Sprintf("%0*d", n, x)
+}
+
+// permute applies a keyed bijection of [0, size) to x: a Feistel network
+// over the smallest even number of bits that covers size, repeated until
+// the result falls inside the domain again.
+func (m *Masker) permute(x, size uint64, domain int) uint64 {
+	bits := 2
+	for size > uint64(1)<<bits {
+		bits += 2
+	}
+	half := bits / 2
+	mask := uint64(1)<<half - 1
+
+	for {
+		left, right := x>>half, x&mask
+		for round := uint32(0); round < 8; round++ {
+			f := binary.BigEndian.Uint64(m.digest(fmt.Sprintf("permute:%d:%d", domain, right), round)[:8])
+			left, right = right, (left^f)&mask
+		}
+		x = left<<half | right
+		if x < size {
+			return x
+		}
+	}
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// RewriteLog applies the masker to every entry of the WAL log in srcDir
+// and writes the masked files, under the same names, to dstDir. It returns
+// the number of entries rewritten.
+func RewriteLog(srcDir, dstDir string, m *Masker) (int, error) {
+	if err := os.MkdirAll(dstDir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	reader := wal.NewLogReader(srcDir)
+	files, err := reader.Files()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, file := range files {
+		entries, err := reader.ReadFile(file)
+		if err != nil {
+			return count, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+
+		for _, entry := range entries {
+			m.Apply(entry)
+		}
+
+		if err := wal.WriteFile(filepath.Join(dstDir, filepath.Base(file)), entries); err != nil {
+			return count, err
+		}
+		count += len(entries)
+	}
+
+	return count, nil
+}
@@ -0,0 +1,228 @@
+package mask
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestMasker_Apply(t *testing.T) {
+	masker, err := NewMasker([]Rule{
+		{Column: "users.email", Strategy: StrategyFakeEmail},
+		{Column: "public.users.phone", Strategy: StrategyScramble},
+		{Column: "users.ssn", Strategy: StrategyNull},
+	}, "salt")
+	if err != nil {
+		t.Fatalf("Failed to create masker: %v", err)
+	}
+
+	entry := &wal.WALEntry{
+		Schema:    "public",
+		Table:     "users",
+		Operation: wal.OpUpdate,
+		Data: map[string]interface{}{
+			"id":    "1",
+			"email": "jane@corp.com",
+			"phone": "+1 (555) 010-9999",
+			"ssn":   "123-45-6789",
+		},
+		OldData: map[string]interface{}{
+			"email": "jane@corp.com",
+		},
+	}
+
+	masker.Apply(entry)
+
+	if entry.Data["id"] != "1" {
+		t.Errorf("Expected unmasked id to be unchanged, got %v", entry.Data["id"])
+	}
+
+	email := entry.Data["email"].(string)
+	if email == "jane@corp.com" || !strings.HasSuffix(email, "@example.com") {
+		t.Errorf("Expected fake email, got %s", email)
+	}
+
+	if entry.OldData["email"] != email {
+		t.Errorf("Expected old and new email to mask identically, got %v and %s", entry.OldData["email"], email)
+	}
+
+	phone := entry.Data["phone"].(string)
+	if len(phone) != len("+1 (555) 010-9999") || phone[0] != '+' || phone[3] != '(' {
+		t.Errorf("Expected scrambled phone to keep its format, got %s", phone)
+	}
+
+	if entry.Data["ssn"] != nil {
+		t.Errorf("Expected ssn to be nulled, got %v", entry.Data["ssn"])
+	}
+}
+
+func TestMasker_MapKeepsForeignKeysMatching(t *testing.T) {
+	masker, err := NewMasker([]Rule{
+		{Column: "users.id", Strategy: StrategyMap},
+		{Column: "orders.user_id", Strategy: StrategyMap},
+	}, "salt")
+	if err != nil {
+		t.Fatalf("Failed to create masker: %v", err)
+	}
+
+	user := &wal.WALEntry{Table: "users", Data: map[string]interface{}{"id": "4242"}}
+	order := &wal.WALEntry{Table: "orders", Data: map[string]interface{}{"user_id": "4242"}}
+
+	masker.Apply(user)
+	masker.Apply(order)
+
+	if user.Data["id"] != order.Data["user_id"] {
+		t.Errorf("Expected mapped keys to match, got %v and %v", user.Data["id"], order.Data["user_id"])
+	}
+
+	mapped := user.Data["id"].(string)
+	if len(mapped) != 4 || !isDigits(mapped) || mapped[0] == '0' {
+		t.Errorf("Expected a 4 digit number, got %s", mapped)
+	}
+}
+
+func TestMasker_MapIsCollisionFree(t *testing.T) {
+	masker, err := NewMasker([]Rule{{Column: "users.id", Strategy: StrategyMap}}, "salt")
+	if err != nil {
+		t.Fatalf("Failed to create masker: %v", err)
+	}
+
+	// Every 4 digit number must map to a different one.
+	seen := make(map[string]string)
+	for i := 1000; i <= 9999; i++ {
+		value := strconv.Itoa(i)
+		mapped := masker.mapValue(value)
+		if len(mapped) != 4 || mapped[0] == '0' {
+			t.Fatalf("Expected %s to map to a 4 digit number, got %s", value, mapped)
+		}
+		if other, ok := seen[mapped]; ok {
+			t.Fatalf("Expected distinct values, got %s for both %s and %s", mapped, other, value)
+		}
+		seen[mapped] = value
+	}
+
+	if mapped := masker.mapValue("0042"); len(mapped) != 4 || mapped[0] != '0' {
+		t.Errorf("Expected a value with a leading zero to keep it, got %s", mapped)
+	}
+	if mapped := masker.mapValue("7"); len(mapped) != 1 || !isDigits(mapped) {
+		t.Errorf("Expected a single digit, got %s", mapped)
+	}
+}
+
+func TestMasker_MapKeepsType(t *testing.T) {
+	masker, err := NewMasker([]Rule{{Column: "users.id", Strategy: StrategyMap}}, "salt")
+	if err != nil {
+		t.Fatalf("Failed to create masker: %v", err)
+	}
+
+	// UUIDs map to distinct UUIDs, whatever their case.
+	ids := []string{
+		"550e8400-e29b-41d4-a716-446655440000",
+		"550e8400-e29b-41d4-a716-446655440001",
+		"00000000-0000-0000-0000-000000000000",
+	}
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		mapped := masker.mapValue(id)
+		if _, err := uuid.Parse(mapped); err != nil || len(mapped) != 36 || mapped == id {
+			t.Errorf("Expected %s to map to another UUID, got %s", id, mapped)
+		}
+		if seen[mapped] {
+			t.Errorf("Expected distinct UUIDs, got %s twice", mapped)
+		}
+		seen[mapped] = true
+	}
+	if upper := masker.mapValue(strings.ToUpper(ids[0])); upper != masker.mapValue(ids[0]) {
+		t.Errorf("Expected an upper case UUID to map as the same UUID, got %s", upper)
+	}
+
+	// Negative numbers keep their sign, and decimals their scale.
+	for _, value := range []string{"-42", "-7", "-1000"} {
+		mapped := masker.mapValue(value)
+		if len(mapped) != len(value) || mapped[0] != '-' || !isDigits(mapped[1:]) || (len(mapped) > 2 && mapped[1] == '0') {
+			t.Errorf("Expected %s to map to a negative number of the same length, got %s", value, mapped)
+		}
+	}
+	if mapped := masker.mapValue("-12.50"); len(mapped) != 6 || mapped[0] != '-' || mapped[3] != '.' || mapped[1] == '0' {
+		t.Errorf("Expected a negative decimal with 2 digits on each side, got %s", mapped)
+	}
+	if mapped := masker.mapValue("0.5"); len(mapped) != 3 || mapped[:2] != "0." {
+		t.Errorf("Expected a decimal below 1, got %s", mapped)
+	}
+
+	// Only text becomes a token.
+	for _, value := range []string{"abc", "-", "1.", "12-34"} {
+		if mapped := masker.mapValue(value); !strings.HasPrefix(mapped, "tok_") {
+			t.Errorf("Expected %q to map to a token, got %s", value, mapped)
+		}
+	}
+}
+
+func TestMasker_SaltChangesOutput(t *testing.T) {
+	rules := []Rule{{Column: "users.name", Strategy: StrategyHash}}
+	a, _ := NewMasker(rules, "one")
+	b, _ := NewMasker(rules, "two")
+
+	ea := &wal.WALEntry{Table: "users", Data: map[string]interface{}{"name": "Jane"}}
+	eb := &wal.WALEntry{Table: "users", Data: map[string]interface{}{"name": "Jane"}}
+	a.Apply(ea)
+	b.Apply(eb)
+
+	if ea.Data["name"] == eb.Data["name"] {
+		t.Error("Expected different salts to produce different hashes")
+	}
+}
+
+func TestNewMasker_InvalidRules(t *testing.T) {
+	tests := []Rule{
+		{Column: "email", Strategy: StrategyHash},
+		{Column: "users.email", Strategy: "rot13"},
+	}
+
+	for _, rule := range tests {
+		if _, err := NewMasker([]Rule{rule}, ""); err == nil {
+			t.Errorf("Expected error for rule %+v", rule)
+		}
+	}
+}
+
+func TestRewriteLog(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	writer, err := wal.NewLogWriter(srcDir)
+	if err != nil {
+		t.Fatalf("Failed to create log writer: %v", err)
+	}
+	writer.WriteEntry(&wal.WALEntry{
+		ID:        "test-1",
+		Timestamp: time.Now(),
+		Operation: wal.OpInsert,
+		Schema:    "public",
+		Table:     "users",
+		Data:      map[string]interface{}{"email": "jane@corp.com"},
+	})
+	writer.Close()
+
+	masker, _ := NewMasker([]Rule{{Column: "users.email", Strategy: StrategyHash}}, "salt")
+	count, err := RewriteLog(srcDir, dstDir, masker)
+	if err != nil {
+		t.Fatalf("Failed to rewrite log: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 entry rewritten, got %d", count)
+	}
+
+	entries, err := wal.NewLogReader(dstDir).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read rewritten log: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Data["email"] == "jane@corp.com" {
+		t.Errorf("Expected masked entry in rewritten log, got %+v", entries)
+	}
+}
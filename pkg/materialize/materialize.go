@@ -0,0 +1,311 @@
+package materialize
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/backup"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/checkpoint"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/session"
+)
+
+// NamePrefix is prepended to generated names so that materialized
+// databases and schemas can be listed and told apart from user objects.
+const NamePrefix = "ptr_cp_"
+
+type Kind string
+
+const (
+	// KindDatabase materializes into a new database on the replica server.
+	KindDatabase Kind = "database"
+	// KindSchema materializes into a new schema of the replica database.
+	KindSchema Kind = "schema"
+)
+
+type Options struct {
+	CheckpointID string `json:"checkpoint_id"`
+	// BackupFile is a file name in the backup directory or a path. The
+	// newest backup taken before the first captured entry is used when it
+	// is empty.
+	BackupFile string `json:"backup"`
+	Kind       Kind   `json:"kind"`
+	// Name of the database or schema to create. Generated from the
+	// checkpoint ID when empty.
+	Name string `json:"name"`
+	// SourceSchema is the schema restored from the backup in schema mode.
+	// Defaults to public.
+	SourceSchema string `json:"source_schema"`
+}
+
+type Result struct {
+	Name           string    `json:"name"`
+	Kind           Kind      `json:"kind"`
+	DSN            string    `json:"dsn"`
+	CheckpointID   string    `json:"checkpoint_id,omitempty"`
+	BackupFile     string    `json:"backup,omitempty"`
+	EntriesApplied int       `json:"entries_applied"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Materializer builds read-only copies of the database as it was at a
+// checkpoint: a base backup restored into a fresh database or schema on
+// the replica server, with the WAL entries up to the checkpoint replayed
+// on top.
+type Materializer struct {
+	config    *config.Config
+	backups   *backup.BackupManager
+	navigator *checkpoint.Navigator
+	replayer  *session.Replayer
+}
+
+func NewMaterializer(cfg *config.Config, backups *backup.BackupManager, nav *checkpoint.Navigator, replayer *session.Replayer) *Materializer {
+	return &Materializer{
+		config:    cfg,
+		backups:   backups,
+		navigator: nav,
+		replayer:  replayer,
+	}
+}
+
+var validName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+// DefaultName returns the generated name for a checkpoint's copy.
+func DefaultName(checkpointID string) string {
+	id := strings.ToLower(strings.ReplaceAll(checkpointID, "-", ""))
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return NamePrefix + id
+}
+
+func (m *Materializer) Materialize(ctx context.Context, opts Options) (*Result, error) {
+	if opts.CheckpointID == "" {
+		return nil, fmt.Errorf("checkpoint_id is required")
+	}
+	if opts.Kind == "" {
+		opts.Kind = KindDatabase
+	}
+	if opts.Kind != KindDatabase && opts.Kind != KindSchema {
+		return nil, fmt.Errorf("unknown kind %q: expected database or schema", opts.Kind)
+	}
+	if opts.SourceSchema == "" {
+		opts.SourceSchema = "public"
+	}
+	if opts.Name == "" {
+		opts.Name = DefaultName(opts.CheckpointID)
+	}
+	if !validName.MatchString(opts.Name) {
+		return nil, fmt.Errorf("invalid name %q: use lowercase letters, digits and underscores", opts.Name)
+	}
+
+	entries, err := m.navigator.GetEntriesUpToCheckpoint(opts.CheckpointID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries run from the start of the log, so the backup must not
+	// already hold any of them.
+	var firstEntry time.Time
+	if len(entries) > 0 {
+		firstEntry = entries[0].Timestamp
+	}
+	backupFile, err := m.resolveBackup(opts.BackupFile, firstEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Name:         opts.Name,
+		Kind:         opts.Kind,
+		CheckpointID: opts.CheckpointID,
+		BackupFile:   backupFile,
+		CreatedAt:    time.Now(),
+	}
+
+	target := session.Target{}
+	switch opts.Kind {
+	case KindDatabase:
+		if err := m.createDatabase(ctx, opts.Name); err != nil {
+			return nil, err
+		}
+		if err := m.backups.RestoreToNewDatabase(ctx, backupFile, opts.Name); err != nil {
+			m.Drop(context.Background(), KindDatabase, opts.Name)
+			return nil, err
+		}
+		target.DSN = m.databaseDSN(opts.Name)
+
+	case KindSchema:
+		for _, entry := range entries {
+			if entry.Schema != "" && entry.Schema != opts.SourceSchema {
+				return nil, fmt.Errorf("schema mode materializes a single schema, but entry %s is in schema %s", entry.ID, entry.Schema)
+			}
+		}
+		if err := m.exec(ctx, m.config.ReplicaDB.ToDSN(), "CREATE SCHEMA "+pgx.Identifier{opts.Name}.Sanitize()); err != nil {
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+		if err := m.backups.RestoreToSchema(ctx, backupFile, opts.SourceSchema, opts.Name, m.config.ReplicaDB.Database); err != nil {
+			m.Drop(context.Background(), KindSchema, opts.Name)
+			return nil, err
+		}
+		target.DSN = m.config.ReplicaDB.ToDSN()
+		target.Schemas = map[string]string{opts.SourceSchema: opts.Name}
+	}
+
+	replayed, err := m.replayer.ReplayInto(ctx, target, entries, session.Options{OnError: session.FailAbort})
+	if err == nil {
+		err = replayed.Err()
+	}
+	if err != nil {
+		m.Drop(context.Background(), opts.Kind, opts.Name)
+		return nil, fmt.Errorf("failed to replay entries: %w", err)
+	}
+	result.EntriesApplied = replayed.Applied
+
+	if err := m.makeReadOnly(ctx, opts.Kind, opts.Name); err != nil {
+		return nil, err
+	}
+	result.DSN = m.DSN(opts.Kind, opts.Name)
+
+	return result, nil
+}
+
+// List returns the materialized databases and schemas on the replica
+// server, identified by NamePrefix.
+func (m *Materializer) List(ctx context.Context) ([]*Result, error) {
+	conn, err := pgx.Connect(ctx, m.config.ReplicaDB.ToDSN())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to replica: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	results := make([]*Result, 0)
+	rows, err := conn.Query(ctx, `
+		SELECT 'database', datname FROM pg_database WHERE datname LIKE $1
+		UNION ALL
+		SELECT 'schema', nspname FROM pg_namespace WHERE nspname LIKE $1`,
+		NamePrefix+"%")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list materialized copies: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, name string
+		if err := rows.Scan(&kind, &name); err != nil {
+			return nil, err
+		}
+		results = append(results, &Result{Name: name, Kind: Kind(kind), DSN: m.DSN(Kind(kind), name)})
+	}
+
+	return results, rows.Err()
+}
+
+// Drop removes a materialized database or schema.
+func (m *Materializer) Drop(ctx context.Context, kind Kind, name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid name %q", name)
+	}
+
+	switch kind {
+	case KindDatabase:
+		return m.exec(ctx, m.config.ReplicaDB.ToDSN(), "DROP DATABASE IF EXISTS "+pgx.Identifier{name}.Sanitize()+" WITH (FORCE)")
+	case KindSchema:
+		return m.exec(ctx, m.config.ReplicaDB.ToDSN(), "DROP SCHEMA IF EXISTS "+pgx.Identifier{name}.Sanitize()+" CASCADE")
+	}
+	return fmt.Errorf("unknown kind %q", kind)
+}
+
+func (m *Materializer) createDatabase(ctx context.Context, name string) error {
+	if err := m.exec(ctx, m.config.ReplicaDB.ToDSN(), "CREATE DATABASE "+pgx.Identifier{name}.Sanitize()); err != nil {
+		return fmt.Errorf("failed to create database: %w", err)
+	}
+	return nil
+}
+
+// makeReadOnly turns the copy read-only for new sessions. For schemas the
+// read-only setting is carried in the DSN instead, since the rest of the
+// replica database must stay writable.
+func (m *Materializer) makeReadOnly(ctx context.Context, kind Kind, name string) error {
+	if kind != KindDatabase {
+		return nil
+	}
+	stmt := "ALTER DATABASE " + pgx.Identifier{name}.Sanitize() + " SET default_transaction_read_only = on"
+	if err := m.exec(ctx, m.config.ReplicaDB.ToDSN(), stmt); err != nil {
+		return fmt.Errorf("failed to make database read-only: %w", err)
+	}
+	return nil
+}
+
+func (m *Materializer) databaseDSN(name string) string {
+	dbConfig := m.config.ReplicaDB
+	dbConfig.Database = name
+	return dbConfig.ToDSN()
+}
+
+// DSN returns the connection string for a materialized copy. For a schema
+// it sets the search path to that schema and makes the session read-only.
+func (m *Materializer) DSN(kind Kind, name string) string {
+	if kind == KindDatabase {
+		return m.databaseDSN(name)
+	}
+	options := fmt.Sprintf("-c search_path=%s -c default_transaction_read_only=on", name)
+	return m.config.ReplicaDB.ToDSN() + "&options=" + url.QueryEscape(options)
+}
+
+func (m *Materializer) exec(ctx context.Context, dsn, stmt string) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return fmt.Errorf("failed to connect to replica: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	_, err = conn.Exec(ctx, stmt)
+	return err
+}
+
+// resolveBackup turns a backup name into a path, defaulting to the newest
+// backup in the backup directory started before the first entry to replay.
+// A zero before accepts any backup. Named backups whose file name dates
+// them are checked against before as well.
+func (m *Materializer) resolveBackup(name string, before time.Time) (string, error) {
+	if name == "" {
+		backups, err := m.backups.ListBackups()
+		if err != nil {
+			return "", err
+		}
+		if len(backups) == 0 {
+			return "", fmt.Errorf("no backups found in %s", m.config.Storage.BackupPath)
+		}
+		if before.IsZero() {
+			sort.Strings(backups)
+			name = backups[len(backups)-1]
+		} else {
+			var ok bool
+			if name, ok = backup.LatestBefore(backups, before); !ok {
+				return "", fmt.Errorf("no backup in %s was taken before the first captured entry at %s", m.config.Storage.BackupPath, before.Format(time.RFC3339))
+			}
+		}
+	} else if _, dated := backup.BackupTime(name); dated && !before.IsZero() && !backup.TakenBefore(name, before) {
+		return "", fmt.Errorf("backup %s was taken after the first captured entry at %s, so replaying would apply changes twice", name, before.Format(time.RFC3339))
+	}
+
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+
+	path := filepath.Join(m.config.Storage.BackupPath, name)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("backup %s not found", name)
+	}
+	return path, nil
+}
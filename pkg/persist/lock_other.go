@@ -0,0 +1,16 @@
+//go:build !unix
+
+package persist
+
+import "os"
+
+// Advisory locks are only taken on unix. Elsewhere writes are still
+// atomic, but concurrent writers in different processes may lose updates.
+
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
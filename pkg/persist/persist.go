@@ -0,0 +1,345 @@
+package persist
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultJournalSize is how many earlier versions of a file are kept when
+// neither the config file nor JOURNAL_SIZE sets it.
+const DefaultJournalSize = 5
+
+// File is a JSON file shared by several processes, such as the listener
+// and the IPC server.
+//
+// Every write replaces the file atomically with a rename, so a crash never
+// leaves it half written and readers need no lock. Writers hold an
+// advisory lock on a separate lock file, and reload the file before
+// changing it, so that one process does not overwrite the changes of
+// another. The versions a write replaces are kept in a journal directory
+// next to the file, so that recent versions can be recovered.
+type File struct {
+	path        string
+	journalSize int
+	mutex       sync.Mutex
+	// loaded is the file as last loaded or saved, to tell when another
+	// process has replaced it.
+	loaded os.FileInfo
+}
+
+// Version is an earlier version of a file kept in its journal.
+type Version struct {
+	Number  int       `json:"number"`
+	SavedAt time.Time `json:"saved_at"`
+	Size    int64     `json:"size"`
+}
+
+// NewFile returns the file at path, keeping up to journalSize earlier
+// versions. A journalSize of 0 keeps none.
+func NewFile(path string, journalSize int) *File {
+	return &File{
+		path:        path,
+		journalSize: journalSize,
+	}
+}
+
+// Path returns the path of the file.
+func (f *File) Path() string {
+	return f.path
+}
+
+// Changed reports whether the file was replaced since it was last loaded
+// or saved.
+func (f *File) Changed() (bool, error) {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", f.path, err)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return !sameVersion(f.loaded, info), nil
+}
+
+// Version returns a value that changes whenever the file is replaced, or
+// an empty string when it does not exist.
+func (f *File) Version() (string, error) {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to stat %s: %w", f.path, err)
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// Load decodes the file into v, which should be a new value since the
+// decoder merges into maps. It returns false without touching v when the
+// file does not exist.
+func (f *File) Load(v interface{}) (bool, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open %s: %w", f.path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %w", f.path, err)
+	}
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to decode %s: %w", f.path, err)
+	}
+
+	f.mutex.Lock()
+	f.loaded = info
+	f.mutex.Unlock()
+	return true, nil
+}
+
+// Lock takes the advisory lock shared by every process writing the file,
+// waiting for it if needed. Call the returned function to release it.
+func (f *File) Lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	lock, err := os.OpenFile(f.path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", f.path, err)
+	}
+	return func() {
+		unlockFile(lock)
+		lock.Close()
+	}, nil
+}
+
+// Save encodes v and replaces the file with it, keeping the version it
+// replaces in the journal. Callers should hold the lock.
+func (f *File) Save(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", filepath.Base(f.path), err)
+	}
+	return f.write(append(data, '\n'))
+}
+
+func (f *File) write(data []byte) error {
+	dir := filepath.Dir(f.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	if err := f.journal(); err != nil {
+		return err
+	}
+
+	tmp, err := writeTemp(dir, filepath.Base(f.path), data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace %s: %w", f.path, err)
+	}
+	syncDir(dir)
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", f.path, err)
+	}
+	f.mutex.Lock()
+	f.loaded = info
+	f.mutex.Unlock()
+	return nil
+}
+
+// Remove deletes the file. Callers should hold the lock.
+func (f *File) Remove() error {
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", f.path, err)
+	}
+	syncDir(filepath.Dir(f.path))
+
+	f.mutex.Lock()
+	f.loaded = nil
+	f.mutex.Unlock()
+	return nil
+}
+
+// journal copies the current version of the file into the journal and
+// drops the oldest versions beyond the journal size.
+func (f *File) journal() error {
+	if f.journalSize <= 0 {
+		return nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", f.path, err)
+	}
+
+	dir := f.journalDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	numbers, err := f.versionNumbers()
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+	tmp, err := writeTemp(dir, "version", data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f.versionPath(next)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	numbers = append(numbers, next)
+	for len(numbers) > f.journalSize {
+		os.Remove(f.versionPath(numbers[0]))
+		numbers = numbers[1:]
+	}
+	return nil
+}
+
+// Versions returns the versions kept in the journal, newest first.
+func (f *File) Versions() ([]Version, error) {
+	numbers, err := f.versionNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]Version, 0, len(numbers))
+	for i := len(numbers) - 1; i >= 0; i-- {
+		info, err := os.Stat(f.versionPath(numbers[i]))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, Version{Number: numbers[i], SavedAt: info.ModTime(), Size: info.Size()})
+	}
+	return versions, nil
+}
+
+// Restore makes a version from the journal current again. The version it
+// replaces is kept in the journal in turn, so a restore can be undone.
+func (f *File) Restore(number int) error {
+	data, err := os.ReadFile(f.versionPath(number))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("version %d of %s not found", number, filepath.Base(f.path))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read version %d: %w", number, err)
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("version %d of %s is not valid JSON", number, filepath.Base(f.path))
+	}
+
+	unlock, err := f.Lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return f.write(data)
+}
+
+func (f *File) journalDir() string {
+	return f.path + ".journal"
+}
+
+func (f *File) versionPath(number int) string {
+	return filepath.Join(f.journalDir(), fmt.Sprintf("%06d.json", number))
+}
+
+// versionNumbers returns the numbers of the versions in the journal, in
+// ascending order.
+func (f *File) versionNumbers() ([]int, error) {
+	entries, err := os.ReadDir(f.journalDir())
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	numbers := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if number, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// writeTemp writes data to a new temporary file in dir and syncs it,
+// returning its path.
+func writeTemp(dir, prefix string, data []byte) (string, error) {
+	file, err := os.CreateTemp(dir, "."+prefix+".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	// Sync to disk to ensure data is persisted before the rename
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// syncDir syncs a directory so that a rename in it is persisted. Not every
+// platform supports it, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// sameVersion reports whether two stats of the file are of the same
+// version. Every save renames a new file into place, so a replaced file is
+// a different file even when its size and time match.
+func sameVersion(a, b os.FileInfo) bool {
+	return a != nil && b != nil && os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
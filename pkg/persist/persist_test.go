@@ -0,0 +1,134 @@
+package persist
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type counter struct {
+	Value int `json:"value"`
+}
+
+func TestFile_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "data.json")
+	f := NewFile(path, 0)
+
+	var missing counter
+	if loaded, err := f.Load(&missing); err != nil || loaded {
+		t.Fatalf("Expected nothing to load, got %v, %v", loaded, err)
+	}
+
+	if err := f.Save(counter{Value: 1}); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	if changed, _ := f.Changed(); changed {
+		t.Error("Expected the file not to have changed after its own save")
+	}
+
+	other := NewFile(path, 0)
+	if err := other.Save(counter{Value: 2}); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+	if changed, _ := f.Changed(); !changed {
+		t.Error("Expected the file to have changed after another save")
+	}
+
+	var got counter
+	if loaded, err := f.Load(&got); err != nil || !loaded || got.Value != 2 {
+		t.Errorf("Expected value 2, got %d, %v, %v", got.Value, loaded, err)
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*tmp*"))
+	if len(leftovers) != 0 {
+		t.Errorf("Expected no temporary files, got %v", leftovers)
+	}
+}
+
+func TestFile_Journal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	f := NewFile(path, 2)
+
+	for i := 1; i <= 4; i++ {
+		if err := f.Save(counter{Value: i}); err != nil {
+			t.Fatalf("Failed to save: %v", err)
+		}
+	}
+
+	versions, err := f.Versions()
+	if err != nil {
+		t.Fatalf("Failed to list versions: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Number != 3 || versions[1].Number != 2 {
+		t.Fatalf("Expected versions 3 and 2, got %+v", versions)
+	}
+
+	if err := f.Restore(2); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	var got counter
+	f.Load(&got)
+	if got.Value != 2 {
+		t.Errorf("Expected value 2 after restore, got %d", got.Value)
+	}
+
+	// The restored-over version is kept, so the restore can be undone.
+	versions, _ = f.Versions()
+	if err := f.Restore(versions[0].Number); err != nil {
+		t.Fatalf("Failed to undo restore: %v", err)
+	}
+	f.Load(&got)
+	if got.Value != 4 {
+		t.Errorf("Expected value 4 after undoing the restore, got %d", got.Value)
+	}
+
+	if err := f.Restore(99); err == nil {
+		t.Error("Expected error for a missing version")
+	}
+}
+
+func TestFile_LockSerializesWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.json")
+	if err := NewFile(path, 0).Save(counter{}); err != nil {
+		t.Fatalf("Failed to save: %v", err)
+	}
+
+	const writers, increments = 4, 10
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each writer has its own File, as separate processes would.
+			f := NewFile(path, 0)
+			for j := 0; j < increments; j++ {
+				unlock, err := f.Lock()
+				if err != nil {
+					t.Errorf("Failed to lock: %v", err)
+					return
+				}
+				var c counter
+				if _, err := f.Load(&c); err != nil {
+					t.Errorf("Failed to load: %v", err)
+				}
+				c.Value++
+				if err := f.Save(c); err != nil {
+					t.Errorf("Failed to save: %v", err)
+				}
+				unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var got counter
+	NewFile(path, 0).Load(&got)
+	if got.Value != writers*increments {
+		t.Errorf("Expected %d, got %d", writers*increments, got.Value)
+	}
+
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Errorf("Expected a lock file, got %v", err)
+	}
+}
@@ -3,34 +3,73 @@ package replication
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pglogrepl"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
 
 	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
 )
 
+// Transformer rewrites an entry after it has been decoded and before it is
+// written to the WAL log.
+type Transformer interface {
+	Apply(entry *wal.WALEntry)
+}
+
 type Listener struct {
 	config      *config.Config
 	conn        *pgconn.PgConn
 	walWriter   *wal.LogWriter
 	slotName    string
 	publication string
+	catalog     *pgconn.PgConn
+	relations   map[uint32]*pglogrepl.RelationMessage
+	info        map[uint32]*relationInfo
+	typeMap     *pgtype.Map
+	transforms  []Transformer
+	currentXid  uint32
+	commitLSN   pglogrepl.LSN
+	commitTime  time.Time
+	seq         int
+	inTx        bool
+	// flushed is the position up to which every transaction has been
+	// written to the log; see advance.
+	flushed pglogrepl.LSN
+	// recorded is the position last written to the status file, at
+	// recordedAt; see recordStatus.
+	recorded   pglogrepl.LSN
+	recordedAt time.Time
 }
 
+// statusInterval is the least time between two writes of the status file
+// for commits and keepalives. Marker messages are recorded at once.
+const statusInterval = 100 * time.Millisecond
+
 func NewListener(cfg *config.Config, walWriter *wal.LogWriter) *Listener {
 	return &Listener{
 		config:      cfg,
 		walWriter:   walWriter,
 		slotName:    cfg.Replication.SlotName,
 		publication: cfg.Replication.PublicationName,
+		relations:   make(map[uint32]*pglogrepl.RelationMessage),
+		info:        make(map[uint32]*relationInfo),
+		typeMap:     pgtype.NewMap(),
 	}
 }
 
+// AddTransformer registers a transform stage that is applied, in order of
+// registration, to every captured entry before it is written.
+func (l *Listener) AddTransformer(t Transformer) {
+	l.transforms = append(l.transforms, t)
+}
+
 func (l *Listener) Connect(ctx context.Context) error {
 	dbConfig := l.config.PrimaryDB
 	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?replication=database",
@@ -42,6 +81,15 @@ func (l *Listener) Connect(ctx context.Context) error {
 	}
 
 	l.conn = conn
+
+	// A regular connection is kept alongside the replication connection to
+	// look up table metadata while the stream is running.
+	catalog, err := pgconn.Connect(ctx, dbConfig.ToDSN())
+	if err != nil {
+		return fmt.Errorf("failed to connect for catalog lookups: %w", err)
+	}
+
+	l.catalog = catalog
 	return nil
 }
 
@@ -59,6 +107,11 @@ func (l *Listener) Start(ctx context.Context) error {
 		"proto_version '1'",
 		fmt.Sprintf("publication_names '%s'", l.publication),
 	}
+	// Marker messages let a checkpoint know promptly when the listener has
+	// captured everything before it. pgoutput sends them from PostgreSQL 14.
+	if serverMajorVersion(l.conn) >= 14 {
+		pluginArguments = append(pluginArguments, "messages 'true'")
+	}
 
 	err := pglogrepl.StartReplication(ctx, l.conn, l.slotName, 0, pglogrepl.StartReplicationOptions{
 		PluginArgs: pluginArguments,
@@ -82,6 +135,10 @@ func (l *Listener) receiveMessages(ctx context.Context) error {
 		default:
 		}
 
+		if err := l.recordStatus(false); err != nil {
+			return err
+		}
+
 		if time.Now().After(nextStandbyMessageDeadline) {
 			err := pglogrepl.SendStandbyStatusUpdate(ctx, l.conn, pglogrepl.StandbyStatusUpdate{
 				WALWritePosition: clientXLogPos,
@@ -92,7 +149,12 @@ func (l *Listener) receiveMessages(ctx context.Context) error {
 			nextStandbyMessageDeadline = time.Now().Add(standbyMessageTimeout)
 		}
 
-		ctx2, cancel := context.WithTimeout(ctx, standbyMessageTimeout)
+		// Wake up in time to record a position held back by recordStatus.
+		receiveTimeout := standbyMessageTimeout
+		if l.recorded < l.flushed {
+			receiveTimeout = statusInterval
+		}
+		ctx2, cancel := context.WithTimeout(ctx, receiveTimeout)
 		rawMsg, err := l.conn.ReceiveMessage(ctx2)
 		cancel()
 
@@ -123,13 +185,21 @@ func (l *Listener) receiveMessages(ctx context.Context) error {
 				nextStandbyMessageDeadline = time.Time{}
 			}
 
+			// Keepalives report how far the server has decoded, so every
+			// transaction committed before that has been received.
+			if !l.inTx {
+				if err := l.advance(pkm.ServerWALEnd); err != nil {
+					return err
+				}
+			}
+
 		case pglogrepl.XLogDataByteID:
 			xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
 			if err != nil {
 				return fmt.Errorf("parse xlog data failed: %w", err)
 			}
 
-			if err := l.processWALData(xld); err != nil {
+			if err := l.processWALData(ctx, xld); err != nil {
 				return fmt.Errorf("process WAL data failed: %w", err)
 			}
 
@@ -138,7 +208,7 @@ func (l *Listener) receiveMessages(ctx context.Context) error {
 	}
 }
 
-func (l *Listener) processWALData(xld pglogrepl.XLogData) error {
+func (l *Listener) processWALData(ctx context.Context, xld pglogrepl.XLogData) error {
 	logicalMsg, err := pglogrepl.Parse(xld.WALData)
 	if err != nil {
 		return fmt.Errorf("parse logical message failed: %w", err)
@@ -146,7 +216,25 @@ func (l *Listener) processWALData(xld pglogrepl.XLogData) error {
 
 	switch msg := logicalMsg.(type) {
 	case *pglogrepl.RelationMessage:
-		// Handle relation messages
+		l.relations[msg.RelationID] = msg
+		l.info[msg.RelationID] = l.lookupRelation(ctx, msg)
+	case *pglogrepl.BeginMessage:
+		l.currentXid = msg.Xid
+		l.commitLSN = msg.FinalLSN
+		l.commitTime = msg.CommitTime
+		l.seq = 0
+		l.inTx = true
+	case *pglogrepl.CommitMessage:
+		l.inTx = false
+		return l.advance(msg.TransactionEndLSN)
+	case *pglogrepl.LogicalDecodingMessage:
+		if !msg.Transactional && msg.Prefix == MarkerPrefix {
+			if err := l.advance(msg.LSN); err != nil {
+				return err
+			}
+			// A checkpoint is waiting for this marker.
+			return l.recordStatus(true)
+		}
 	case *pglogrepl.InsertMessage:
 		return l.handleInsert(msg, xld.WALStart)
 	case *pglogrepl.UpdateMessage:
@@ -159,53 +247,169 @@ func (l *Listener) processWALData(xld pglogrepl.XLogData) error {
 }
 
 func (l *Listener) handleInsert(msg *pglogrepl.InsertMessage, lsn pglogrepl.LSN) error {
+	rel := l.relations[msg.RelationID]
 	entry := &wal.WALEntry{
 		ID:        uuid.New().String(),
 		Timestamp: time.Now(),
 		LSN:       lsn.String(),
 		Operation: wal.OpInsert,
-		Data:      l.tupleToMap(msg.Tuple),
+		Data:      l.tupleToMap(rel, msg.Tuple),
 	}
+	l.describeRelation(entry, rel)
 
-	return l.walWriter.WriteEntry(entry)
+	return l.writeEntry(entry)
 }
 
 func (l *Listener) handleUpdate(msg *pglogrepl.UpdateMessage, lsn pglogrepl.LSN) error {
+	rel := l.relations[msg.RelationID]
 	entry := &wal.WALEntry{
 		ID:        uuid.New().String(),
 		Timestamp: time.Now(),
 		LSN:       lsn.String(),
 		Operation: wal.OpUpdate,
-		Data:      l.tupleToMap(msg.NewTuple),
+		Data:      l.tupleToMap(rel, msg.NewTuple),
 	}
+	l.describeRelation(entry, rel)
 
 	if msg.OldTuple != nil {
-		entry.OldData = l.tupleToMap(msg.OldTuple)
+		entry.OldData = l.tupleToMap(rel, msg.OldTuple)
 	}
 
-	return l.walWriter.WriteEntry(entry)
+	return l.writeEntry(entry)
 }
 
 func (l *Listener) handleDelete(msg *pglogrepl.DeleteMessage, lsn pglogrepl.LSN) error {
+	rel := l.relations[msg.RelationID]
 	entry := &wal.WALEntry{
 		ID:        uuid.New().String(),
 		Timestamp: time.Now(),
 		LSN:       lsn.String(),
 		Operation: wal.OpDelete,
-		OldData:   l.tupleToMap(msg.OldTuple),
+		OldData:   l.tupleToMap(rel, msg.OldTuple),
 	}
+	l.describeRelation(entry, rel)
+
+	return l.writeEntry(entry)
+}
+
+// relationInfo is the catalog metadata kept for each relation.
+type relationInfo struct {
+	keyColumns  []string
+	columnTypes map[string]string
+}
+
+// describeRelation fills in the schema, table, key columns and column
+// types of an entry from the cached relation metadata.
+func (l *Listener) describeRelation(entry *wal.WALEntry, rel *pglogrepl.RelationMessage) {
+	if rel == nil {
+		return
+	}
+	entry.Schema = rel.Namespace
+	entry.Table = rel.RelationName
+
+	if info := l.info[rel.RelationID]; info != nil {
+		entry.KeyColumns = info.keyColumns
+		entry.ColumnTypes = info.columnTypes
+	}
+}
+
+const primaryKeyQuery = `SELECT a.attname
+FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::oid AND i.indisprimary
+ORDER BY array_position(i.indkey, a.attnum)`
+
+// columnTypesQuery leaves out generated columns, which pgoutput does not
+// send and replay cannot write.
+const columnTypesQuery = `SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+FROM pg_attribute a
+WHERE a.attrelid = $1::oid AND a.attnum > 0 AND NOT a.attisdropped AND a.attgenerated = ''`
+
+// lookupRelation collects the primary key columns and column types of a
+// relation from the catalog.
+//
+// Tables without a primary key fall back to the replica identity columns
+// that pgoutput flags in the relation message. The flags alone are not
+// used for every table because REPLICA IDENTITY FULL flags every column.
+func (l *Listener) lookupRelation(ctx context.Context, rel *pglogrepl.RelationMessage) *relationInfo {
+	info := &relationInfo{}
+	relID := [][]byte{[]byte(fmt.Sprint(rel.RelationID))}
+	catalogTypes := make(map[string]string)
+
+	if l.catalog != nil {
+		result := l.catalog.ExecParams(ctx, primaryKeyQuery, relID, nil, nil, nil).Read()
+		if result.Err == nil {
+			for _, row := range result.Rows {
+				info.keyColumns = append(info.keyColumns, string(row[0]))
+			}
+		}
 
+		result = l.catalog.ExecParams(ctx, columnTypesQuery, relID, nil, nil, nil).Read()
+		if result.Err == nil {
+			for _, row := range result.Rows {
+				catalogTypes[string(row[0])] = string(row[1])
+			}
+		}
+	}
+
+	if len(info.keyColumns) == 0 {
+		for _, col := range rel.Columns {
+			if col.Flags&1 != 0 {
+				info.keyColumns = append(info.keyColumns, col.Name)
+			}
+		}
+	}
+	info.columnTypes = l.columnTypes(rel, catalogTypes)
+	return info
+}
+
+// columnTypes returns the types of the columns the relation message lists,
+// which are the columns of the captured rows: a full old row holds every
+// one of them. Types come from the catalog, falling back to the built-in
+// type names for the OIDs in the relation message, which lack type
+// modifiers and custom types.
+func (l *Listener) columnTypes(rel *pglogrepl.RelationMessage, catalogTypes map[string]string) map[string]string {
+	types := make(map[string]string, len(rel.Columns))
+	for _, col := range rel.Columns {
+		if typ, ok := catalogTypes[col.Name]; ok {
+			types[col.Name] = typ
+		} else if t, ok := l.typeMap.TypeForOID(col.DataType); ok {
+			types[col.Name] = t.Name
+		}
+	}
+	return types
+}
+
+// writeEntry stamps the entry with the current transaction and its
+// position in it, runs the registered transform stages and writes the
+// entry.
+func (l *Listener) writeEntry(entry *wal.WALEntry) error {
+	l.seq++
+	entry.TxID = l.currentXid
+	entry.CommitLSN = l.commitLSN.String()
+	commitTime := l.commitTime
+	entry.CommitTime = &commitTime
+	entry.Seq = l.seq
+	for _, t := range l.transforms {
+		t.Apply(entry)
+	}
 	return l.walWriter.WriteEntry(entry)
 }
 
-func (l *Listener) tupleToMap(tuple *pglogrepl.TupleData) map[string]interface{} {
+func (l *Listener) tupleToMap(rel *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) map[string]interface{} {
 	result := make(map[string]interface{})
+	if tuple == nil {
+		return result
+	}
 
-	// Note: Using generic column names here as relation metadata is not readily available
-	// in the current message context. For production use, consider maintaining a cache
-	// of relation ID -> column metadata mapping from RelationMessage events.
+	// Column names come from the RelationMessage that pgoutput sends before
+	// the first change to each table. Fall back to positional names if the
+	// relation has not been seen.
 	for i, col := range tuple.Columns {
 		key := fmt.Sprintf("col_%d", i)
+		if rel != nil && i < len(rel.Columns) {
+			key = rel.Columns[i].Name
+		}
 
 		switch col.DataType {
 		case 'n':
@@ -219,8 +423,54 @@ func (l *Listener) tupleToMap(tuple *pglogrepl.TupleData) map[string]interface{}
 }
 
 func (l *Listener) Close() error {
+	if l.catalog != nil {
+		l.catalog.Close(context.Background())
+	}
 	if l.conn != nil {
 		return l.conn.Close(context.Background())
 	}
 	return nil
 }
+
+// advance records that every transaction before lsn has been written to
+// the log, in the status file that checkpoints wait on.
+func (l *Listener) advance(lsn pglogrepl.LSN) error {
+	if lsn <= l.flushed {
+		return nil
+	}
+	l.flushed = lsn
+	return l.recordStatus(false)
+}
+
+// recordStatus writes the flushed position to the status file. Unless
+// force is set, it writes at most once per statusInterval, so that a busy
+// primary does not cost a file sync per transaction; the receive loop
+// writes a position held back once the interval has passed.
+func (l *Listener) recordStatus(force bool) error {
+	if l.recorded >= l.flushed {
+		return nil
+	}
+	now := time.Now()
+	if !force && now.Sub(l.recordedAt) < statusInterval {
+		return nil
+	}
+
+	status := &wal.Status{FlushedLSN: wal.FormatLSN(uint64(l.flushed)), UpdatedAt: now}
+	if err := wal.WriteStatus(l.config.Storage.WALLogPath, status); err != nil {
+		return fmt.Errorf("failed to record listener position: %w", err)
+	}
+	l.recorded = l.flushed
+	l.recordedAt = now
+	return nil
+}
+
+// serverMajorVersion returns the major version of the server conn is
+// connected to, or 0 when it cannot be told.
+func serverMajorVersion(conn *pgconn.PgConn) int {
+	version := conn.ParameterStatus("server_version")
+	if i := strings.IndexAny(version, ". "); i >= 0 {
+		version = version[:i]
+	}
+	major, _ := strconv.Atoi(version)
+	return major
+}
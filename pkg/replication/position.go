@@ -0,0 +1,102 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// MarkerPrefix is the prefix of the logical decoding messages emitted on
+// the primary to mark a position in the change stream.
+const MarkerPrefix = "postgres_test_replay"
+
+// DefaultCaptureTimeout is how long WaitForCapture waits when no timeout
+// is given.
+const DefaultCaptureTimeout = 30 * time.Second
+
+// captureInterval is how often WaitForCapture polls the listener status.
+const captureInterval = 100 * time.Millisecond
+
+// CurrentPosition returns the position of the primary's change stream now:
+// every transaction committed before the call has a commit LSN at or
+// before it, and every transaction committed after has one after it.
+//
+// It emits a marker message, which the listener receives as soon as it has
+// captured everything before it. Where the message cannot be emitted, it
+// falls back to the WAL insert position.
+func CurrentPosition(ctx context.Context, cfg *config.Config, label string) (uint64, error) {
+	conn, err := pgx.Connect(ctx, cfg.PrimaryDB.ToDSN())
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to primary: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	var lsn string
+	err = conn.QueryRow(ctx, "SELECT pg_logical_emit_message(false, $1, $2)::text", MarkerPrefix, label).Scan(&lsn)
+	if err == nil {
+		return wal.ParseLSN(lsn)
+	}
+
+	if err := conn.QueryRow(ctx, "SELECT pg_current_wal_insert_lsn()::text").Scan(&lsn); err != nil {
+		return 0, fmt.Errorf("failed to read current WAL position: %w", err)
+	}
+	position, err := wal.ParseLSN(lsn)
+	if err != nil {
+		return 0, err
+	}
+	// The next record may start at the insert position, so only the byte
+	// before it is known to be in the past.
+	if position > 0 {
+		position--
+	}
+	return position, nil
+}
+
+// WaitForCapture waits until the listener writing to the log at logPath
+// has flushed every transaction up to position.
+func WaitForCapture(ctx context.Context, logPath string, position uint64, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultCaptureTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(captureInterval)
+	defer ticker.Stop()
+
+	var flushed uint64
+	var lastErr error
+	for {
+		status, err := wal.ReadStatus(logPath)
+		switch {
+		case os.IsNotExist(err):
+			lastErr = fmt.Errorf("no listener status in %s; is the listener running?", logPath)
+		case err != nil:
+			lastErr = err
+		default:
+			if flushed, err = status.Flushed(); err != nil {
+				lastErr = err
+			} else if flushed >= position {
+				return nil
+			} else {
+				lastErr = nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("timed out waiting for the listener to reach %s: %w", wal.FormatLSN(position), lastErr)
+			}
+			return fmt.Errorf("timed out waiting for the listener to reach %s: it has flushed up to %s",
+				wal.FormatLSN(position), wal.FormatLSN(flushed))
+		case <-ticker.C:
+		}
+	}
+}
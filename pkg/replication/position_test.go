@@ -0,0 +1,90 @@
+package replication
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestWaitForCapture(t *testing.T) {
+	tmpDir := t.TempDir()
+	ctx := context.Background()
+
+	if err := WaitForCapture(ctx, tmpDir, 0x100, 150*time.Millisecond); err == nil {
+		t.Error("Expected error without a listener status")
+	}
+
+	if err := wal.WriteStatus(tmpDir, &wal.Status{FlushedLSN: "0/80", UpdatedAt: time.Now()}); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+	if err := WaitForCapture(ctx, tmpDir, 0x100, 150*time.Millisecond); err == nil {
+		t.Error("Expected error while the listener is behind")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		wal.WriteStatus(tmpDir, &wal.Status{FlushedLSN: "0/100", UpdatedAt: time.Now()})
+	}()
+	if err := WaitForCapture(ctx, tmpDir, 0x100, 5*time.Second); err != nil {
+		t.Errorf("Expected the listener to catch up, got %v", err)
+	}
+}
+
+func TestListener_RecordStatusThrottles(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Storage.WALLogPath = t.TempDir()
+	l := NewListener(cfg, nil)
+
+	flushed := func() string {
+		status, err := wal.ReadStatus(cfg.Storage.WALLogPath)
+		if err != nil {
+			return ""
+		}
+		return status.FlushedLSN
+	}
+
+	l.advance(0x100)
+	l.advance(0x200)
+	if got := flushed(); got != "0/100" {
+		t.Errorf("Expected the second commit to be held back, got %q", got)
+	}
+
+	if err := l.recordStatus(true); err != nil {
+		t.Fatalf("Failed to record status: %v", err)
+	}
+	if got := flushed(); got != "0/200" {
+		t.Errorf("Expected a forced write to record 0/200, got %q", got)
+	}
+
+	l.advance(0x300)
+	l.recordedAt = time.Now().Add(-statusInterval)
+	if err := l.recordStatus(false); err != nil {
+		t.Fatalf("Failed to record status: %v", err)
+	}
+	if got := flushed(); got != "0/300" {
+		t.Errorf("Expected the held back position once the interval passed, got %q", got)
+	}
+}
+
+func TestListener_ColumnTypes(t *testing.T) {
+	l := NewListener(config.DefaultConfig(), nil)
+	rel := &pglogrepl.RelationMessage{
+		RelationName: "orders",
+		Columns: []*pglogrepl.RelationMessageColumn{
+			{Name: "id", DataType: pgtype.Int4OID},
+			{Name: "total", DataType: pgtype.NumericOID},
+		},
+	}
+
+	// A generated column is in the catalog but not in the captured rows.
+	types := l.columnTypes(rel, map[string]string{"total": "numeric(10,2)", "doubled": "numeric"})
+	if len(types) != 2 || types["id"] != "int4" || types["total"] != "numeric(10,2)" {
+		t.Errorf("Expected the types of id and total only, got %v", types)
+	}
+}
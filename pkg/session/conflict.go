@@ -0,0 +1,268 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// ErrOldValuesMismatch is reported in verify_old mode when the target row
+// exists but no longer holds the values captured before the change.
+var ErrOldValuesMismatch = errors.New("row does not match the entry's old values")
+
+// ConflictPolicy decides how a replay handles rows in the target that have
+// drifted from the source.
+type ConflictPolicy string
+
+const (
+	// ConflictError fails the entry on a duplicate key or a missing row.
+	ConflictError ConflictPolicy = "error"
+	// ConflictSkip leaves the target row alone and skips the entry.
+	ConflictSkip ConflictPolicy = "skip"
+	// ConflictUpsert overwrites existing rows on INSERT, inserts missing
+	// rows on UPDATE and ignores missing rows on DELETE.
+	ConflictUpsert ConflictPolicy = "upsert"
+	// ConflictInsertIfMissing inserts the new row when an UPDATE finds no
+	// row. Other conflicts fail.
+	ConflictInsertIfMissing ConflictPolicy = "insert_if_missing"
+	// ConflictVerifyOld only updates or deletes a row whose current values
+	// match every captured old value, and fails otherwise. It is only
+	// stricter than ConflictError for tables with REPLICA IDENTITY FULL.
+	ConflictVerifyOld ConflictPolicy = "verify_old"
+)
+
+// ParseConflictPolicy validates a policy name. An empty name yields
+// ConflictError.
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch ConflictPolicy(name) {
+	case "":
+		return ConflictError, nil
+	case ConflictError, ConflictSkip, ConflictUpsert, ConflictInsertIfMissing, ConflictVerifyOld:
+		return ConflictPolicy(name), nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q: expected error, skip, upsert, insert_if_missing or verify_old", name)
+}
+
+// ParseConflictPolicies validates a map of table names to policy names.
+// Tables are named as schema.table or table, and "*" sets the policy for
+// every other table.
+func ParseConflictPolicies(policies map[string]string) (map[string]ConflictPolicy, error) {
+	parsed := make(map[string]ConflictPolicy, len(policies))
+	for table, name := range policies {
+		policy, err := ParseConflictPolicy(name)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", table, err)
+		}
+		parsed[table] = policy
+	}
+	return parsed, nil
+}
+
+// conflictPolicy returns the policy for the entry's table.
+func (o Options) conflictPolicy(entry *wal.WALEntry) ConflictPolicy {
+	if policy, ok := o.Conflicts[entry.Schema+"."+entry.Table]; ok {
+		return policy
+	}
+	if policy, ok := o.Conflicts[entry.Table]; ok {
+		return policy
+	}
+	if policy, ok := o.Conflicts["*"]; ok {
+		return policy
+	}
+	return ConflictError
+}
+
+type ConflictKind string
+
+const (
+	ConflictDuplicateKey ConflictKind = "duplicate_key"
+	ConflictMissingRow   ConflictKind = "missing_row"
+	ConflictOldMismatch  ConflictKind = "old_values_mismatch"
+)
+
+// Conflict records a target row that did not match what an entry expected,
+// and how the policy resolved it.
+type Conflict struct {
+	EntryID    string            `json:"entry_id"`
+	LSN        string            `json:"lsn"`
+	TxID       uint32            `json:"xid,omitempty"`
+	Operation  wal.OperationType `json:"operation"`
+	Table      string            `json:"table"`
+	Kind       ConflictKind      `json:"kind"`
+	Policy     ConflictPolicy    `json:"policy"`
+	Resolution string            `json:"resolution"`
+}
+
+const (
+	resolutionFailed   = "failed"
+	resolutionSkipped  = "skipped"
+	resolutionUpdated  = "updated"
+	resolutionInserted = "inserted"
+)
+
+func newConflict(entry *wal.WALEntry, kind ConflictKind, policy ConflictPolicy, resolution string) *Conflict {
+	return &Conflict{
+		EntryID:    entry.ID,
+		LSN:        entry.LSN,
+		TxID:       entry.TxID,
+		Operation:  entry.Operation,
+		Table:      qualifiedName(entry),
+		Kind:       kind,
+		Policy:     policy,
+		Resolution: resolution,
+	}
+}
+
+func qualifiedName(entry *wal.WALEntry) string {
+	if entry.Schema == "" {
+		return entry.Table
+	}
+	return entry.Schema + "." + entry.Table
+}
+
+// applyInsert inserts the entry's row, resolving duplicate keys by policy.
+func applyInsert(ctx context.Context, conn *pgconn.PgConn, target Target, entry *wal.WALEntry, policy ConflictPolicy) (bool, *Conflict, error) {
+	params := &paramBinder{}
+	stmt, err := buildInsert(params, target, entry, entry.Data)
+	if err != nil {
+		return false, nil, err
+	}
+
+	switch policy {
+	case ConflictSkip:
+		tag, err := conn.ExecParams(ctx, stmt+" ON CONFLICT DO NOTHING", params.args, nil, nil, nil).Close()
+		if err != nil {
+			return false, nil, err
+		}
+		if tag.RowsAffected() == 0 {
+			return false, newConflict(entry, ConflictDuplicateKey, policy, resolutionSkipped), nil
+		}
+		return true, nil, nil
+
+	case ConflictUpsert:
+		clause, err := onConflictUpdate(entry, entry.Data)
+		if err != nil {
+			return false, nil, err
+		}
+		// xmax is only set on the returned row when it replaced an
+		// existing one. No row is returned when every column is part of
+		// the key and the row already exists, as there is nothing to
+		// update.
+		rr := conn.ExecParams(ctx, stmt+clause+" RETURNING xmax <> 0", params.args, nil, nil, nil)
+		returned, updated := false, false
+		for rr.NextRow() {
+			returned = true
+			updated = string(rr.Values()[0]) == "t"
+		}
+		if _, err := rr.Close(); err != nil {
+			return false, nil, err
+		}
+		if !returned {
+			return false, newConflict(entry, ConflictDuplicateKey, policy, resolutionSkipped), nil
+		}
+		if updated {
+			return true, newConflict(entry, ConflictDuplicateKey, policy, resolutionUpdated), nil
+		}
+		return true, nil, nil
+	}
+
+	if _, err := conn.ExecParams(ctx, stmt, params.args, nil, nil, nil).Close(); err != nil {
+		if isUniqueViolation(err) {
+			return false, newConflict(entry, ConflictDuplicateKey, policy, resolutionFailed), err
+		}
+		return false, nil, err
+	}
+	return true, nil, nil
+}
+
+// applyChange updates or deletes the entry's row, resolving missing or
+// changed rows by policy.
+func applyChange(ctx context.Context, conn *pgconn.PgConn, target Target, entry *wal.WALEntry, policy ConflictPolicy) (bool, *Conflict, error) {
+	params := &paramBinder{}
+	match := rowMatch(entry, policy == ConflictVerifyOld)
+
+	var stmt string
+	var err error
+	if entry.Operation == wal.OpUpdate {
+		stmt, err = buildUpdate(params, target, entry, entry.Data, match)
+	} else {
+		stmt, err = buildDelete(params, target, entry, match)
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	tag, err := conn.ExecParams(ctx, stmt, params.args, nil, nil, nil).Close()
+	if err != nil {
+		return false, nil, err
+	}
+	if tag.RowsAffected() > 0 {
+		return true, nil, nil
+	}
+
+	kind := ConflictMissingRow
+	if policy == ConflictVerifyOld && entry.OldKey() != nil {
+		exists, err := rowExists(ctx, conn, target, entry)
+		if err != nil {
+			return false, nil, err
+		}
+		if exists {
+			kind = ConflictOldMismatch
+		}
+	}
+
+	switch {
+	case policy == ConflictSkip, policy == ConflictUpsert && entry.Operation == wal.OpDelete:
+		return false, newConflict(entry, kind, policy, resolutionSkipped), nil
+
+	case (policy == ConflictUpsert || policy == ConflictInsertIfMissing) && entry.Operation == wal.OpUpdate:
+		row := wal.MergeRows(entry.OldData, entry.Data)
+		params := &paramBinder{}
+		stmt, err := buildInsert(params, target, entry, row)
+		if err != nil {
+			return false, nil, err
+		}
+		if _, err := conn.ExecParams(ctx, stmt, params.args, nil, nil, nil).Close(); err != nil {
+			return false, newConflict(entry, kind, policy, resolutionFailed), err
+		}
+		return true, newConflict(entry, kind, policy, resolutionInserted), nil
+	}
+
+	conflictErr := ErrNoRowMatched
+	if kind == ConflictOldMismatch {
+		conflictErr = ErrOldValuesMismatch
+	}
+	return false, newConflict(entry, kind, policy, resolutionFailed), conflictErr
+}
+
+// rowExists reports whether the target holds a row with the entry's key.
+func rowExists(ctx context.Context, conn *pgconn.PgConn, target Target, entry *wal.WALEntry) (bool, error) {
+	table, err := tableName(target, entry)
+	if err != nil {
+		return false, err
+	}
+	params := &paramBinder{}
+	where, err := whereClause(params, entry, entry.OldKey())
+	if err != nil {
+		return false, err
+	}
+
+	rr := conn.ExecParams(ctx, fmt.Sprintf("SELECT 1 FROM %s WHERE %s LIMIT 1", table, where), params.args, nil, nil, nil)
+	found := false
+	for rr.NextRow() {
+		found = true
+	}
+	if _, err := rr.Close(); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
@@ -0,0 +1,78 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestOptions_ConflictPolicy(t *testing.T) {
+	opts := Options{Conflicts: map[string]ConflictPolicy{
+		"public.orders": ConflictUpsert,
+		"users":         ConflictVerifyOld,
+		"*":             ConflictSkip,
+	}}
+
+	tests := []struct {
+		schema, table string
+		want          ConflictPolicy
+	}{
+		{"public", "orders", ConflictUpsert},
+		{"archive", "orders", ConflictSkip},
+		{"public", "users", ConflictVerifyOld},
+		{"public", "items", ConflictSkip},
+	}
+	for _, tt := range tests {
+		got := opts.conflictPolicy(&wal.WALEntry{Schema: tt.schema, Table: tt.table})
+		if got != tt.want {
+			t.Errorf("Expected %s for %s.%s, got %s", tt.want, tt.schema, tt.table, got)
+		}
+	}
+
+	if got := (Options{}).conflictPolicy(&wal.WALEntry{Table: "orders"}); got != ConflictError {
+		t.Errorf("Expected error policy by default, got %s", got)
+	}
+}
+
+func TestParseConflictPolicies(t *testing.T) {
+	if _, err := ParseConflictPolicies(map[string]string{"orders": "overwrite"}); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+
+	policies, err := ParseConflictPolicies(map[string]string{"orders": "insert_if_missing"})
+	if err != nil {
+		t.Fatalf("Failed to parse policies: %v", err)
+	}
+	if policies["orders"] != ConflictInsertIfMissing {
+		t.Errorf("Expected insert_if_missing, got %s", policies["orders"])
+	}
+}
+
+func TestOnConflictUpdate(t *testing.T) {
+	entry := &wal.WALEntry{Table: "orders", KeyColumns: []string{"id"}}
+
+	clause, err := onConflictUpdate(entry, map[string]interface{}{"id": "1", "status": "paid", "note": nil})
+	if err != nil {
+		t.Fatalf("Failed to build clause: %v", err)
+	}
+	if want := ` ON CONFLICT ("id") DO UPDATE SET "note" = EXCLUDED."note", "status" = EXCLUDED."status"`; clause != want {
+		t.Errorf("Expected %s, got %s", want, clause)
+	}
+
+	if _, err := onConflictUpdate(&wal.WALEntry{Table: "orders"}, entry.Data); err == nil {
+		t.Error("Expected error without key columns")
+	}
+}
+
+func TestRowMatch_Strict(t *testing.T) {
+	entry := &wal.WALEntry{Operation: wal.OpUpdate, KeyColumns: []string{"id"},
+		Data:    map[string]interface{}{"id": "1", "status": "paid"},
+		OldData: map[string]interface{}{"id": "1", "status": "new"}}
+
+	if match := rowMatch(entry, false); len(match) != 1 || match["id"] != "1" {
+		t.Errorf("Expected key-only match, got %v", match)
+	}
+	if match := rowMatch(entry, true); len(match) != 2 || match["status"] != "new" {
+		t.Errorf("Expected old values in strict match, got %v", match)
+	}
+}
@@ -0,0 +1,440 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// ForeignKey is a foreign key in the replay target. Tables are named with
+// their schema as it appears in the WAL log.
+type ForeignKey struct {
+	Name       string   `json:"name"`
+	Table      string   `json:"table"`
+	Columns    []string `json:"columns"`
+	RefTable   string   `json:"ref_table"`
+	RefColumns []string `json:"ref_columns"`
+}
+
+// UniqueKey is a unique index in the replay target other than the primary
+// key. Columns is empty when the index is on expressions or partial, so
+// that the rows it makes conflict cannot be named from their values.
+type UniqueKey struct {
+	Name    string   `json:"name"`
+	Table   string   `json:"table"`
+	Columns []string `json:"columns,omitempty"`
+}
+
+// DependencyGraph holds what a parallel replay must know about the target
+// to order transactions safely: the foreign keys between tables, the
+// unique indexes whose values two rows cannot share at once, and the
+// tables with triggers that fire during a replay (enabled as REPLICA or
+// ALWAYS), whose side effects cannot be predicted.
+type DependencyGraph struct {
+	ForeignKeys []ForeignKey    `json:"foreign_keys"`
+	UniqueKeys  []UniqueKey     `json:"unique_keys"`
+	Triggers    map[string]bool `json:"triggers"`
+}
+
+const foreignKeysQuery = `SELECT c.conname, cn.nspname, cl.relname, pn.nspname, pl.relname,
+  ARRAY(SELECT a.attname::text FROM unnest(c.conkey) WITH ORDINALITY k(attnum, ord)
+        JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = k.attnum ORDER BY k.ord),
+  ARRAY(SELECT a.attname::text FROM unnest(c.confkey) WITH ORDINALITY k(attnum, ord)
+        JOIN pg_attribute a ON a.attrelid = c.confrelid AND a.attnum = k.attnum ORDER BY k.ord)
+FROM pg_constraint c
+JOIN pg_class cl ON cl.oid = c.conrelid
+JOIN pg_namespace cn ON cn.oid = cl.relnamespace
+JOIN pg_class pl ON pl.oid = c.confrelid
+JOIN pg_namespace pn ON pn.oid = pl.relnamespace
+WHERE c.contype = 'f'
+ORDER BY cn.nspname, cl.relname, c.conname`
+
+const uniqueKeysQuery = `SELECT ic.relname, n.nspname, c.relname,
+  i.indexprs IS NULL AND i.indpred IS NULL,
+  ARRAY(SELECT a.attname::text FROM unnest(i.indkey) WITH ORDINALITY k(attnum, ord)
+        JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = k.attnum
+        WHERE k.ord <= i.indnkeyatts ORDER BY k.ord)
+FROM pg_index i
+JOIN pg_class ic ON ic.oid = i.indexrelid
+JOIN pg_class c ON c.oid = i.indrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE i.indisunique AND NOT i.indisprimary
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY n.nspname, c.relname, ic.relname`
+
+const triggersQuery = `SELECT DISTINCT n.nspname, c.relname
+FROM pg_trigger t
+JOIN pg_class c ON c.oid = t.tgrelid
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE NOT t.tgisinternal AND t.tgenabled IN ('R', 'A')`
+
+// LoadDependencyGraph reads the foreign keys, unique indexes and triggers
+// of the target from its catalog.
+func LoadDependencyGraph(ctx context.Context, conn *pgx.Conn, target Target) (*DependencyGraph, error) {
+	logical := make(map[string]string, len(target.Schemas))
+	for name, actual := range target.Schemas {
+		logical[actual] = name
+	}
+	nameOf := func(schema, table string) string {
+		if name, ok := logical[schema]; ok {
+			schema = name
+		}
+		return schema + "." + table
+	}
+
+	graph := &DependencyGraph{
+		ForeignKeys: make([]ForeignKey, 0),
+		UniqueKeys:  make([]UniqueKey, 0),
+		Triggers:    make(map[string]bool),
+	}
+
+	rows, err := conn.Query(ctx, foreignKeysQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query foreign keys: %w", err)
+	}
+	for rows.Next() {
+		var fk ForeignKey
+		var schema, table, refSchema, refTable string
+		if err := rows.Scan(&fk.Name, &schema, &table, &refSchema, &refTable, &fk.Columns, &fk.RefColumns); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan foreign key: %w", err)
+		}
+		fk.Table = nameOf(schema, table)
+		fk.RefTable = nameOf(refSchema, refTable)
+		graph.ForeignKeys = append(graph.ForeignKeys, fk)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query foreign keys: %w", err)
+	}
+
+	rows, err = conn.Query(ctx, uniqueKeysQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query unique indexes: %w", err)
+	}
+	for rows.Next() {
+		var uk UniqueKey
+		var schema, table string
+		var plain bool
+		var columns []string
+		if err := rows.Scan(&uk.Name, &schema, &table, &plain, &columns); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan unique index: %w", err)
+		}
+		uk.Table = nameOf(schema, table)
+		if plain {
+			uk.Columns = columns
+		}
+		graph.UniqueKeys = append(graph.UniqueKeys, uk)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query unique indexes: %w", err)
+	}
+
+	rows, err = conn.Query(ctx, triggersQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query triggers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			return nil, fmt.Errorf("failed to scan trigger: %w", err)
+		}
+		graph.Triggers[nameOf(schema, table)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query triggers: %w", err)
+	}
+
+	return graph, nil
+}
+
+// dependencyPlan decides which resources each transaction of a parallel
+// replay claims. A transaction waits for every earlier transaction that
+// claimed one of its resources.
+//
+// Rows are resources of their own, so that transactions on different rows
+// of a table run concurrently. A row that references another through a
+// foreign key also claims the referenced row, which orders it after the
+// insert and before the delete of that row. Values of unique indexes are
+// claimed like rows, so that a row taking a value waits for the row that
+// gave it up. When the entries lack the values to name a row, its whole
+// table is claimed instead, and a transaction whose effects cannot be
+// predicted at all runs alone.
+type dependencyPlan struct {
+	graph *DependencyGraph
+	// parents holds the foreign keys of each referencing table.
+	parents map[string][]ForeignKey
+	// claimedKeys holds the column sets of each table, besides its key,
+	// whose values are claimed: those other rows reference and those of
+	// unique indexes.
+	claimedKeys map[string][][]string
+	// coarse holds the tables that are ordered as a whole.
+	coarse map[string]bool
+	// serial is set once a transaction changed the schema, which may add
+	// foreign keys the graph does not know about.
+	serial bool
+}
+
+func newDependencyPlan(graph *DependencyGraph, entries []*wal.WALEntry) *dependencyPlan {
+	p := &dependencyPlan{
+		graph:       graph,
+		parents:     make(map[string][]ForeignKey),
+		claimedKeys: make(map[string][][]string),
+		coarse:      make(map[string]bool),
+	}
+	for _, fk := range graph.ForeignKeys {
+		p.parents[fk.Table] = append(p.parents[fk.Table], fk)
+		p.claimedKeys[fk.RefTable] = append(p.claimedKeys[fk.RefTable], fk.RefColumns)
+	}
+	for _, uk := range graph.UniqueKeys {
+		if len(uk.Columns) == 0 {
+			p.coarse[uk.Table] = true
+			continue
+		}
+		p.claimedKeys[uk.Table] = append(p.claimedKeys[uk.Table], uk.Columns)
+	}
+
+	for _, entry := range entries {
+		if entry.Operation == wal.OpDDL || entry.Table == "" {
+			continue
+		}
+		table := qualifiedName(entry)
+
+		if _, _, ok := rowImages(entry, entry.KeyColumns); len(entry.KeyColumns) == 0 || !ok {
+			p.coarse[table] = true
+		}
+		for _, cols := range p.claimedKeys[table] {
+			if _, _, ok := rowImages(entry, cols); !ok {
+				p.coarse[table] = true
+			}
+		}
+		for _, fk := range p.parents[table] {
+			if _, _, ok := rowImages(entry, fk.Columns); !ok {
+				p.coarse[fk.RefTable] = true
+			}
+		}
+	}
+
+	return p
+}
+
+// resources returns what group claims. It reports false when the group
+// must run alone.
+func (p *dependencyPlan) resources(group []*wal.WALEntry) ([]string, bool) {
+	if p.serial {
+		return nil, false
+	}
+
+	seen := make(map[string]bool)
+	claimed := make([]string, 0, len(group))
+	claim := func(resource string) {
+		if !seen[resource] {
+			seen[resource] = true
+			claimed = append(claimed, resource)
+		}
+	}
+
+	for _, entry := range group {
+		if entry.Operation == wal.OpDDL || entry.Table == "" {
+			p.serial = entry.Operation == wal.OpDDL
+			return nil, false
+		}
+		table := qualifiedName(entry)
+		if p.graph.Triggers[table] {
+			return nil, false
+		}
+
+		if p.coarse[table] {
+			claim(table)
+		} else {
+			p.claimRows(claim, table, entry, entry.KeyColumns, entry.KeyColumns)
+			for _, cols := range p.claimedKeys[table] {
+				p.claimRows(claim, table, entry, cols, cols)
+			}
+		}
+
+		for _, fk := range p.parents[table] {
+			if p.coarse[fk.RefTable] {
+				claim(fk.RefTable)
+				continue
+			}
+			p.claimRows(claim, fk.RefTable, entry, fk.Columns, fk.RefColumns)
+		}
+	}
+
+	return claimed, true
+}
+
+// claimRows claims the rows of table named by the values of cols in the
+// old and new row of entry, with the values taken as those of refCols.
+// Rows with a NULL value are not claimed, since they reference nothing.
+func (p *dependencyPlan) claimRows(claim func(string), table string, entry *wal.WALEntry, cols, refCols []string) {
+	oldValues, newValues, _ := rowImages(entry, cols)
+	for _, values := range [][]string{oldValues, newValues} {
+		if values != nil {
+			claim(rowResource(table, refCols, values))
+		}
+	}
+}
+
+// rowImages returns the text values of cols in the row before and after
+// entry; nil for a row that does not exist or has a NULL in cols. It
+// reports false when the entry does not carry the values, as for the old
+// row of an update on a table without REPLICA IDENTITY FULL when cols are
+// not part of the key.
+func rowImages(entry *wal.WALEntry, cols []string) ([]string, []string, bool) {
+	inKey := len(entry.KeyColumns) > 0 && containsAll(entry.KeyColumns, cols)
+
+	var oldRow, newRow map[string]interface{}
+	switch entry.Operation {
+	case wal.OpInsert:
+		newRow = entry.Data
+	case wal.OpUpdate:
+		newRow = entry.Data
+		oldRow = entry.OldData
+		if inKey {
+			oldRow = entry.OldKey()
+		}
+	case wal.OpDelete:
+		oldRow = entry.OldData
+		if inKey {
+			oldRow = entry.OldKey()
+		}
+	}
+
+	oldValues, ok := columnValues(oldRow, cols)
+	if !ok && entry.Operation != wal.OpInsert {
+		return nil, nil, false
+	}
+	newValues, ok := columnValues(newRow, cols)
+	if !ok && entry.Operation != wal.OpDelete {
+		return nil, nil, false
+	}
+	return oldValues, newValues, true
+}
+
+// columnValues returns the text values of cols in row, or nil when one of
+// them is NULL. It reports false when row lacks one of them.
+func columnValues(row map[string]interface{}, cols []string) ([]string, bool) {
+	values := make([]string, len(cols))
+	null := false
+	for i, col := range cols {
+		v, ok := row[col]
+		if !ok {
+			return nil, false
+		}
+		text, isNull := textValue(v)
+		null = null || isNull
+		values[i] = text
+	}
+	if null {
+		return nil, true
+	}
+	return values, true
+}
+
+func containsAll(set, cols []string) bool {
+	for _, col := range cols {
+		found := false
+		for _, s := range set {
+			if s == col {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// rowResource names a row of table by the values of cols. Columns are
+// sorted so that a row has one name whatever the column order of the key
+// or foreign key naming it.
+func rowResource(table string, cols, values []string) string {
+	pairs := make([]string, len(cols))
+	for i, col := range cols {
+		pairs[i] = col + "=" + values[i]
+	}
+	sort.Strings(pairs)
+	return table + "\x00" + strings.Join(pairs, "\x00")
+}
+
+// schedulerPruneInterval is how many transactions are scheduled between
+// sweeps of resources whose last claimant has finished.
+const schedulerPruneInterval = 4096
+
+// scheduler orders transactions that run on several connections. A
+// transaction waits for the last earlier transaction that claimed each of
+// its resources. Transactions that must run alone are barriers that wait
+// for, and are waited on by, every other transaction.
+type scheduler struct {
+	last      map[string]chan struct{}
+	barrier   chan struct{}
+	scheduled int
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{last: make(map[string]chan struct{})}
+}
+
+// schedule registers a transaction claiming resources, or a barrier when
+// alone is set, and returns the channels it must wait on and the channel
+// to close once it has been applied.
+func (s *scheduler) schedule(resources []string, alone bool) ([]chan struct{}, chan struct{}) {
+	s.scheduled++
+	if s.scheduled%schedulerPruneInterval == 0 {
+		s.prune()
+	}
+
+	done := make(chan struct{})
+	seen := make(map[chan struct{}]bool)
+	deps := make([]chan struct{}, 0)
+	wait := func(ch chan struct{}) {
+		if !seen[ch] {
+			seen[ch] = true
+			deps = append(deps, ch)
+		}
+	}
+	if s.barrier != nil {
+		wait(s.barrier)
+	}
+
+	if alone {
+		for _, ch := range s.last {
+			wait(ch)
+		}
+		s.last = make(map[string]chan struct{})
+		s.barrier = done
+		return deps, done
+	}
+
+	for _, resource := range resources {
+		if ch, ok := s.last[resource]; ok {
+			wait(ch)
+		}
+		s.last[resource] = done
+	}
+	return deps, done
+}
+
+// prune forgets resources whose last claimant has finished, so that
+// replaying many rows does not keep a channel per row.
+func (s *scheduler) prune() {
+	for resource, ch := range s.last {
+		select {
+		case <-ch:
+			delete(s.last, resource)
+		default:
+		}
+	}
+}
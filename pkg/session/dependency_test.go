@@ -0,0 +1,197 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestScheduler(t *testing.T) {
+	sched := newScheduler()
+
+	deps, first := sched.schedule([]string{"orders/1"}, false)
+	if len(deps) != 0 {
+		t.Errorf("Expected first transaction to have no dependencies, got %d", len(deps))
+	}
+
+	if deps, _ := sched.schedule([]string{"orders/2"}, false); len(deps) != 0 {
+		t.Errorf("Expected transaction on another resource to be independent, got %d dependencies", len(deps))
+	}
+
+	deps, _ = sched.schedule([]string{"orders/1", "customers/7"}, false)
+	if len(deps) != 1 || deps[0] != first {
+		t.Errorf("Expected transaction to wait for the earlier one on the same resource, got %v", deps)
+	}
+
+	deps, barrier := sched.schedule(nil, true)
+	if len(deps) != 2 {
+		t.Errorf("Expected barrier to wait for every pending transaction once, got %d dependencies", len(deps))
+	}
+
+	deps, _ = sched.schedule([]string{"orders/2"}, false)
+	if len(deps) != 1 || deps[0] != barrier {
+		t.Errorf("Expected transaction after a barrier to wait for it, got %v", deps)
+	}
+}
+
+func TestSchedulerPrune(t *testing.T) {
+	sched := newScheduler()
+	_, done := sched.schedule([]string{"orders/1"}, false)
+	_, pending := sched.schedule([]string{"orders/2"}, false)
+	close(done)
+
+	sched.prune()
+	if _, ok := sched.last["orders/1"]; ok {
+		t.Error("Expected finished resource to be pruned")
+	}
+	if sched.last["orders/2"] != pending {
+		t.Error("Expected pending resource to be kept")
+	}
+}
+
+func fkGraph() *DependencyGraph {
+	return &DependencyGraph{
+		ForeignKeys: []ForeignKey{{
+			Name:       "orders_customer_id_fkey",
+			Table:      "public.orders",
+			Columns:    []string{"customer_id"},
+			RefTable:   "public.customers",
+			RefColumns: []string{"id"},
+		}},
+		Triggers: map[string]bool{"public.audit": true},
+	}
+}
+
+func insertCustomer(id string) *wal.WALEntry {
+	return &wal.WALEntry{Operation: wal.OpInsert, Schema: "public", Table: "customers", KeyColumns: []string{"id"},
+		Data: map[string]interface{}{"id": id, "name": "c" + id}}
+}
+
+func insertOrder(id, customerID string) *wal.WALEntry {
+	return &wal.WALEntry{Operation: wal.OpInsert, Schema: "public", Table: "orders", KeyColumns: []string{"id"},
+		Data: map[string]interface{}{"id": id, "customer_id": customerID}}
+}
+
+func shareResource(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestDependencyPlanRows(t *testing.T) {
+	entries := []*wal.WALEntry{
+		insertCustomer("1"),
+		insertCustomer("2"),
+		insertOrder("10", "1"),
+	}
+	plan := newDependencyPlan(fkGraph(), entries)
+
+	c1, ok1 := plan.resources(entries[:1])
+	c2, ok2 := plan.resources(entries[1:2])
+	o10, ok3 := plan.resources(entries[2:3])
+	if !ok1 || !ok2 || !ok3 {
+		t.Fatal("Expected row changes with keys to run in parallel")
+	}
+
+	if shareResource(c1, c2) {
+		t.Errorf("Expected inserts of different customers to be independent, got %v and %v", c1, c2)
+	}
+	if !shareResource(c1, o10) {
+		t.Errorf("Expected order to depend on the customer it references, got %v and %v", c1, o10)
+	}
+	if shareResource(c2, o10) {
+		t.Errorf("Expected order not to depend on another customer, got %v and %v", c2, o10)
+	}
+}
+
+func TestDependencyPlanUniqueKeys(t *testing.T) {
+	graph := fkGraph()
+	graph.UniqueKeys = []UniqueKey{
+		{Name: "customers_email_key", Table: "public.customers", Columns: []string{"email"}},
+		{Name: "orders_lower_ref_idx", Table: "public.orders"},
+	}
+	gone := &wal.WALEntry{Operation: wal.OpDelete, Schema: "public", Table: "customers", KeyColumns: []string{"id"},
+		OldData: map[string]interface{}{"id": "1", "name": "c1", "email": "x@example.com"}}
+	taken := insertCustomer("2")
+	taken.Data["email"] = "x@example.com"
+	other := insertCustomer("3")
+	other.Data["email"] = "y@example.com"
+	entries := []*wal.WALEntry{gone, taken, other}
+	plan := newDependencyPlan(graph, entries)
+
+	deleted, _ := plan.resources(entries[:1])
+	inserted, _ := plan.resources(entries[1:2])
+	unrelated, _ := plan.resources(entries[2:])
+	if !shareResource(deleted, inserted) {
+		t.Errorf("Expected the insert to wait for the delete freeing its email, got %v and %v", deleted, inserted)
+	}
+	if shareResource(inserted, unrelated) {
+		t.Errorf("Expected customers with different emails to be independent, got %v and %v", inserted, unrelated)
+	}
+	if !plan.coarse["public.orders"] {
+		t.Error("Expected a table with an expression index to be ordered as a whole")
+	}
+}
+
+func TestDependencyPlanNullReference(t *testing.T) {
+	order := insertOrder("11", "")
+	order.Data["customer_id"] = nil
+	entries := []*wal.WALEntry{insertCustomer("1"), order}
+	plan := newDependencyPlan(fkGraph(), entries)
+
+	customer, _ := plan.resources(entries[:1])
+	resources, ok := plan.resources(entries[1:])
+	if !ok || len(resources) != 1 || shareResource(customer, resources) {
+		t.Errorf("Expected an order without customer to claim only its own row, got %v", resources)
+	}
+}
+
+func TestDependencyPlanCoarse(t *testing.T) {
+	// The old row of the update lacks customer_id, so which customer the
+	// order referenced before is unknown and customers are ordered as a
+	// whole.
+	update := &wal.WALEntry{Operation: wal.OpUpdate, Schema: "public", Table: "orders", KeyColumns: []string{"id"},
+		Data: map[string]interface{}{"id": "10", "customer_id": "2"}}
+	entries := []*wal.WALEntry{insertCustomer("1"), update}
+	plan := newDependencyPlan(fkGraph(), entries)
+
+	if !plan.coarse["public.customers"] {
+		t.Fatal("Expected customers to be ordered as a whole")
+	}
+	customer, _ := plan.resources(entries[:1])
+	order, ok := plan.resources(entries[1:])
+	if !ok || !shareResource(customer, order) {
+		t.Errorf("Expected update to wait for every customer change, got %v and %v", customer, order)
+	}
+}
+
+func TestDependencyPlanSerial(t *testing.T) {
+	audit := &wal.WALEntry{Operation: wal.OpInsert, Schema: "public", Table: "audit", KeyColumns: []string{"id"},
+		Data: map[string]interface{}{"id": "1"}}
+	ddl := &wal.WALEntry{Operation: wal.OpDDL, SQL: "ALTER TABLE orders ADD COLUMN note text"}
+	entries := []*wal.WALEntry{audit, ddl, insertCustomer("1")}
+	plan := newDependencyPlan(fkGraph(), entries)
+
+	if _, ok := plan.resources(entries[:1]); ok {
+		t.Error("Expected a table with triggers to run alone")
+	}
+	if _, ok := plan.resources(entries[1:2]); ok {
+		t.Error("Expected DDL to run alone")
+	}
+	if _, ok := plan.resources(entries[2:]); ok {
+		t.Error("Expected transactions after DDL to run alone")
+	}
+}
+
+func TestRowResourceColumnOrder(t *testing.T) {
+	a := rowResource("public.lines", []string{"order_id", "sku"}, []string{"1", "x"})
+	b := rowResource("public.lines", []string{"sku", "order_id"}, []string{"x", "1"})
+	if a != b {
+		t.Errorf("Expected row names to ignore column order, got %q and %q", a, b)
+	}
+}
@@ -0,0 +1,120 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+)
+
+// ErrNotInSession is returned for forking a session at a checkpoint it
+// does not have.
+var ErrNotInSession = errors.New("checkpoint is not in the session")
+
+// checkpointRef is what forking needs of a checkpoint document: its place
+// in the checkpoint tree and its anchor.
+type checkpointRef struct {
+	ID       string `json:"id"`
+	ParentID string `json:"parent_id"`
+	LSN      string `json:"lsn"`
+	Seq      int    `json:"seq"`
+}
+
+func getCheckpointRef(r store.Reader, id string) (*checkpointRef, error) {
+	doc, err := r.Get(store.Checkpoints, id)
+	if err != nil {
+		return nil, err
+	}
+	ref := &checkpointRef{}
+	if err := json.Unmarshal(doc, ref); err != nil {
+		return nil, fmt.Errorf("failed to decode checkpoint %s: %w", id, err)
+	}
+	return ref, nil
+}
+
+// ForkSession creates a session that shares the history of the source
+// session up to one of its checkpoints and records its own changes from
+// there. The checkpoint and those before it in the checkpoint tree are
+// listed in both sessions, and the fork's head is the checkpoint, so that
+// its first checkpoint starts a branch from it. An empty atCheckpointID
+// forks at the source's head, cloning the session's current state.
+//
+// The head's position is the checkpoint's anchor; check the checkpoint out
+// in the fork, or replay to it, before recording. The changes the source
+// records afterwards are tagged with its ID, and the fork's checkpoints
+// leave them out.
+func (m *Manager) ForkSession(sourceID, atCheckpointID, name string) (*Session, error) {
+	var fork *Session
+	err := m.store.Update(func(tx store.Tx) error {
+		source, err := Get(tx, sourceID)
+		if err != nil {
+			return err
+		}
+		if atCheckpointID == "" {
+			if source.Head == "" {
+				return fmt.Errorf("%w: %s has no head to fork at", ErrNotInSession, sourceID)
+			}
+			atCheckpointID = source.Head
+		}
+
+		listed := false
+		for _, id := range source.Checkpoints {
+			if id == atCheckpointID {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			return fmt.Errorf("%w: %s is not in %s", ErrNotInSession, atCheckpointID, sourceID)
+		}
+
+		at, err := getCheckpointRef(tx, atCheckpointID)
+		if err != nil {
+			return err
+		}
+		path := []string{at.ID}
+		seen := map[string]bool{at.ID: true}
+		for parentID := at.ParentID; parentID != ""; {
+			if seen[parentID] {
+				return fmt.Errorf("checkpoint %s is its own ancestor", parentID)
+			}
+			seen[parentID] = true
+			parent, err := getCheckpointRef(tx, parentID)
+			if err != nil {
+				return err
+			}
+			path = append([]string{parent.ID}, path...)
+			parentID = parent.ParentID
+		}
+
+		if name == "" {
+			name = source.Name + " (fork)"
+		}
+		now := time.Now()
+		fork = &Session{
+			ID:          uuid.New().String(),
+			Name:        name,
+			Description: source.Description,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+			Database:    source.Database,
+			Checkpoints: path,
+			Head:        at.ID,
+			HeadLSN:     at.LSN,
+			HeadSeq:     at.Seq,
+			// The replica is where the source left it.
+			ReplayCheckpoint: source.ReplayCheckpoint,
+			ReplayLSN:        source.ReplayLSN,
+			ForkedFrom:       source.ID,
+			ForkedAt:         at.ID,
+		}
+		return Put(tx, fork)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fork, nil
+}
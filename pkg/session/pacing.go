@@ -0,0 +1,63 @@
+package session
+
+import (
+	"context"
+	"time"
+)
+
+// pacer delays transactions so that they start with the same gaps as
+// their commits on the source, divided by speed. A speed of zero or less disables pacing.
+type pacer struct {
+	speed  float64
+	maxGap time.Duration
+	start  time.Time
+	offset time.Duration
+	prev   time.Time
+}
+
+func newPacer(speed float64, maxGap time.Duration) *pacer {
+	return &pacer{speed: speed, maxGap: maxGap}
+}
+
+// wait blocks until the transaction committed at ts is due.
+func (p *pacer) wait(ctx context.Context, ts time.Time) error {
+	if p.speed <= 0 {
+		return nil
+	}
+
+	if p.start.IsZero() {
+		p.start = time.Now()
+	} else {
+		p.offset += scaledGap(p.prev, ts, p.speed, p.maxGap)
+	}
+	p.prev = ts
+
+	delay := time.Until(p.start.Add(p.offset))
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// scaledGap returns the delay between two transactions committed at prev
+// and next when replayed at speed, capped at maxGap when it is positive.
+// Out-of-order timestamps yield no delay.
+func scaledGap(prev, next time.Time, speed float64, maxGap time.Duration) time.Duration {
+	gap := next.Sub(prev)
+	if gap <= 0 || prev.IsZero() {
+		return 0
+	}
+	gap = time.Duration(float64(gap) / speed)
+	if maxGap > 0 && gap > maxGap {
+		gap = maxGap
+	}
+	return gap
+}
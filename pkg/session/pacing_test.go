@@ -0,0 +1,32 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaledGap(t *testing.T) {
+	base := time.Date(2024, 1, 5, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		next   time.Time
+		speed  float64
+		maxGap time.Duration
+		want   time.Duration
+	}{
+		{"real time", base.Add(2 * time.Second), 1, 0, 2 * time.Second},
+		{"faster", base.Add(2 * time.Second), 10, 0, 200 * time.Millisecond},
+		{"slower", base.Add(2 * time.Second), 0.5, 0, 4 * time.Second},
+		{"capped", base.Add(time.Hour), 1, 5 * time.Second, 5 * time.Second},
+		{"out of order", base.Add(-time.Second), 1, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scaledGap(base, tt.next, tt.speed, tt.maxGap); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// ErrNotRecording is returned when stopping a session that is not active.
+var ErrNotRecording = errors.New("session is not recording")
+
+// Recording is a window of the change stream owned by a session: the
+// transactions committed after StartLSN and up to EndLSN. EndLSN is empty
+// while the session is still recording.
+type Recording struct {
+	StartLSN string `json:"start_lsn"`
+	EndLSN   string `json:"end_lsn,omitempty"`
+}
+
+// Covers reports whether a transaction committed at lsn is in the window.
+func (r Recording) Covers(lsn uint64) bool {
+	start, err := wal.ParseLSN(r.StartLSN)
+	if err != nil || lsn <= start {
+		return false
+	}
+	if r.EndLSN == "" {
+		return true
+	}
+	end, err := wal.ParseLSN(r.EndLSN)
+	return err == nil && lsn <= end
+}
+
+// Recording returns whether the session records changes committed at lsn.
+func (s *Session) Recording(lsn uint64) bool {
+	for _, r := range s.Recordings {
+		if r.Covers(lsn) {
+			return true
+		}
+	}
+	return false
+}
+
+// open reports whether the session's last recording is still open.
+func (s *Session) open() bool {
+	n := len(s.Recordings)
+	return n > 0 && s.Recordings[n-1].EndLSN == ""
+}
+
+// stop closes the session's open recording at lsn.
+func (s *Session) stop(lsn string) {
+	if s.open() {
+		s.Recordings[len(s.Recordings)-1].EndLSN = lsn
+	}
+	s.Active = false
+}
+
+// StartRecording makes a session the active one from lsn, the primary's
+// position when it was started, so that it owns the changes committed
+// after it. The session active until then stops recording at lsn.
+// Starting the active session again changes nothing, unless it was made
+// active before sessions had recordings, in which case it opens one.
+func (m *Manager) StartRecording(id, lsn string) error {
+	if _, err := wal.ParseLSN(lsn); err != nil {
+		return err
+	}
+	return m.store.Update(func(tx store.Tx) error {
+		session, err := Get(tx, id)
+		if err != nil {
+			return err
+		}
+		if session.Active && session.open() {
+			return nil
+		}
+
+		sessions, err := List(tx)
+		if err != nil {
+			return err
+		}
+		for _, other := range sessions {
+			if other.Active && other.ID != id {
+				other.stop(lsn)
+				if err := Put(tx, other); err != nil {
+					return err
+				}
+			}
+		}
+
+		session.Recordings = append(session.Recordings, Recording{StartLSN: lsn})
+		session.Active = true
+		return Put(tx, session)
+	})
+}
+
+// StopRecording stops the active session at lsn, the primary's position
+// when it was stopped. Changes committed after it belong to no session.
+func (m *Manager) StopRecording(id, lsn string) error {
+	if _, err := wal.ParseLSN(lsn); err != nil {
+		return err
+	}
+	return m.store.Update(func(tx store.Tx) error {
+		session, err := Get(tx, id)
+		if err != nil {
+			return err
+		}
+		if !session.Active {
+			return fmt.Errorf("%w: %s", ErrNotRecording, id)
+		}
+		session.stop(lsn)
+		return Put(tx, session)
+	})
+}
+
+// Tagger is a transform stage of the listener that stamps each captured
+// entry with the session recording it and the session's head, the
+// checkpoint the change was made after. Sessions are read again at the
+// start of every transaction, so a session started or stopped before a
+// transaction commits is taken into account; with a store.Versioned store,
+// only when they changed.
+type Tagger struct {
+	store     store.Reader
+	sessions  []*Session
+	version   string
+	commitLSN string
+}
+
+func NewTagger(st store.Reader) *Tagger {
+	return &Tagger{store: st}
+}
+
+// refresh reads the sessions unless the store tells they are unchanged
+// since they were read last.
+func (t *Tagger) refresh() error {
+	version := ""
+	if versioned, ok := t.store.(store.Versioned); ok {
+		var err error
+		if version, err = versioned.Version(store.Sessions); err != nil {
+			return err
+		}
+		if t.sessions != nil && version != "" && version == t.version {
+			return nil
+		}
+	}
+
+	sessions, err := List(t.store)
+	if err != nil {
+		return err
+	}
+	t.sessions = sessions
+	t.version = version
+	return nil
+}
+
+func (t *Tagger) Apply(entry *wal.WALEntry) {
+	if entry.CommitLSN != t.commitLSN {
+		t.commitLSN = entry.CommitLSN
+		if err := t.refresh(); err != nil {
+			// Keep tagging with the sessions read last.
+			log.Printf("Failed to read sessions for tagging: %v", err)
+		}
+	}
+
+	lsn, err := wal.ParseLSN(entry.CommitLSN)
+	if err != nil {
+		return
+	}
+	for _, session := range t.sessions {
+		if session.Recording(lsn) {
+			entry.SessionID = session.ID
+			entry.CheckpointID = session.Head
+			return
+		}
+	}
+}
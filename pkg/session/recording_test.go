@@ -0,0 +1,176 @@
+package session
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func newTestManager(t *testing.T) (*Manager, store.Store) {
+	t.Helper()
+	cfg := config.DefaultConfig()
+	cfg.Storage.SessionPath = t.TempDir()
+	cfg.Storage.CheckpointPath = t.TempDir()
+
+	st := store.NewJSONStore(cfg)
+	return NewManager(cfg, st), st
+}
+
+func TestRecording_Covers(t *testing.T) {
+	open := Recording{StartLSN: "0/100"}
+	closed := Recording{StartLSN: "0/100", EndLSN: "0/200"}
+
+	tests := []struct {
+		recording Recording
+		lsn       uint64
+		expected  bool
+	}{
+		{open, 0x100, false},
+		{open, 0x101, true},
+		{open, 0x10000, true},
+		{closed, 0x200, true},
+		{closed, 0x201, false},
+	}
+	for _, tt := range tests {
+		if got := tt.recording.Covers(tt.lsn); got != tt.expected {
+			t.Errorf("Expected %+v covering %X to be %v, got %v", tt.recording, tt.lsn, tt.expected, got)
+		}
+	}
+}
+
+func TestManager_Recording(t *testing.T) {
+	manager, _ := newTestManager(t)
+	first, _ := manager.CreateSession("first", "", "testdb")
+	second, _ := manager.CreateSession("second", "", "testdb")
+
+	if err := manager.StartRecording(first.ID, "0/100"); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	if err := manager.StartRecording(second.ID, "0/200"); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+
+	active, err := manager.GetActiveSession()
+	if err != nil || active.ID != second.ID {
+		t.Fatalf("Expected the second session to be active, got %v, %v", active, err)
+	}
+	first, _ = manager.GetSession(first.ID)
+	if len(first.Recordings) != 1 || first.Recordings[0].EndLSN != "0/200" {
+		t.Errorf("Expected the first session to stop at 0/200, got %+v", first.Recordings)
+	}
+
+	if err := manager.StopRecording(second.ID, "0/300"); err != nil {
+		t.Fatalf("Failed to stop recording: %v", err)
+	}
+	if err := manager.StopRecording(second.ID, "0/400"); !errors.Is(err, ErrNotRecording) {
+		t.Errorf("Expected ErrNotRecording, got %v", err)
+	}
+	if _, err := manager.GetActiveSession(); err == nil {
+		t.Error("Expected no active session")
+	}
+
+	if err := manager.StartRecording("missing", "0/500"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestManager_StartRecordingActiveWithoutWindow(t *testing.T) {
+	manager, st := newTestManager(t)
+	legacy, _ := manager.CreateSession("legacy", "", "testdb")
+	// A session made active before sessions had recordings.
+	err := st.Update(func(tx store.Tx) error {
+		legacy.Active = true
+		return Put(tx, legacy)
+	})
+	if err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+
+	if err := manager.StartRecording(legacy.ID, "0/100"); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	legacy, _ = manager.GetSession(legacy.ID)
+	if len(legacy.Recordings) != 1 || !legacy.Active || !legacy.Recording(0x101) {
+		t.Errorf("Expected an open recording from 0/100, got %+v", legacy.Recordings)
+	}
+
+	if err := manager.StartRecording(legacy.ID, "0/200"); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	if legacy, _ = manager.GetSession(legacy.ID); len(legacy.Recordings) != 1 {
+		t.Errorf("Expected starting a recording session to change nothing, got %+v", legacy.Recordings)
+	}
+}
+
+func TestTagger(t *testing.T) {
+	manager, st := newTestManager(t)
+	sess, _ := manager.CreateSession("tagged", "", "testdb")
+	tagger := NewTagger(st)
+
+	before := &wal.WALEntry{CommitLSN: "0/100"}
+	tagger.Apply(before)
+
+	if err := manager.StartRecording(sess.ID, "0/100"); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	if err := manager.SetHead(sess.ID, "c1", "0/100", 0); err != nil {
+		t.Fatalf("Failed to set head: %v", err)
+	}
+
+	// A transaction committed before the start but captured after it.
+	late := &wal.WALEntry{CommitLSN: "0/F0"}
+	tagger.Apply(late)
+	during := &wal.WALEntry{CommitLSN: "0/110"}
+	tagger.Apply(during)
+
+	if err := manager.StopRecording(sess.ID, "0/120"); err != nil {
+		t.Fatalf("Failed to stop recording: %v", err)
+	}
+	after := &wal.WALEntry{CommitLSN: "0/130"}
+	tagger.Apply(after)
+
+	if during.SessionID != sess.ID || during.CheckpointID != "c1" {
+		t.Errorf("Expected the entry to be tagged with %s and c1, got %q and %q", sess.ID, during.SessionID, during.CheckpointID)
+	}
+	for _, entry := range []*wal.WALEntry{before, late, after} {
+		if entry.SessionID != "" || entry.CheckpointID != "" {
+			t.Errorf("Expected the entry at %s to be untagged, got %q", entry.CommitLSN, entry.SessionID)
+		}
+	}
+}
+
+// countingStore counts the times sessions are listed.
+type countingStore struct {
+	*store.JSONStore
+	lists int
+}
+
+func (s *countingStore) List(collection string) (map[string][]byte, error) {
+	s.lists++
+	return s.JSONStore.List(collection)
+}
+
+func TestTagger_ReadsChangedSessions(t *testing.T) {
+	manager, st := newTestManager(t)
+	sess, _ := manager.CreateSession("tagged", "", "testdb")
+	counting := &countingStore{JSONStore: st.(*store.JSONStore)}
+	tagger := NewTagger(counting)
+
+	tagger.Apply(&wal.WALEntry{CommitLSN: "0/100"})
+	tagger.Apply(&wal.WALEntry{CommitLSN: "0/110"})
+	if counting.lists != 1 {
+		t.Errorf("Expected unchanged sessions to be read once, got %d reads", counting.lists)
+	}
+
+	if err := manager.StartRecording(sess.ID, "0/110"); err != nil {
+		t.Fatalf("Failed to start recording: %v", err)
+	}
+	entry := &wal.WALEntry{CommitLSN: "0/120"}
+	tagger.Apply(entry)
+	if counting.lists != 2 || entry.SessionID != sess.ID {
+		t.Errorf("Expected the started session to be read and tag the entry, got %d reads and %q", counting.lists, entry.SessionID)
+	}
+}
@@ -0,0 +1,485 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// ErrNoRowMatched is reported when an UPDATE or DELETE finds no row with
+// the entry's key in the target.
+var ErrNoRowMatched = errors.New("no row matched the entry's key")
+
+// Target is the database a replay writes to.
+type Target struct {
+	DSN string `json:"dsn"`
+	// Schemas maps schema names in the WAL log to schema names in the
+	// target. Schemas without a mapping are written unchanged.
+	Schemas map[string]string `json:"schemas,omitempty"`
+}
+
+// schemaFor returns the target schema for a schema in the WAL log.
+func (t Target) schemaFor(schema string) string {
+	if mapped, ok := t.Schemas[schema]; ok {
+		return mapped
+	}
+	return schema
+}
+
+// FailurePolicy decides what a replay does when a source transaction
+// fails to apply.
+type FailurePolicy string
+
+const (
+	// FailAbort rolls back the failing transaction and ends the replay.
+	FailAbort FailurePolicy = "abort"
+	// FailSkip rolls back the failing transaction and continues with the
+	// next one.
+	FailSkip FailurePolicy = "skip"
+	// FailStop commits the failing transaction up to, but not including,
+	// the failing entry and ends the replay.
+	FailStop FailurePolicy = "stop"
+)
+
+// ParseFailurePolicy validates a policy name. An empty name yields
+// FailAbort.
+func ParseFailurePolicy(name string) (FailurePolicy, error) {
+	switch FailurePolicy(name) {
+	case "":
+		return FailAbort, nil
+	case FailAbort, FailSkip, FailStop:
+		return FailurePolicy(name), nil
+	}
+	return "", fmt.Errorf("unknown failure policy %q: expected abort, skip or stop", name)
+}
+
+// Options controls a single replay.
+type Options struct {
+	OnError FailurePolicy `json:"on_error"`
+	// Conflicts maps schema.table, table or "*" to the conflict policy
+	// for that table. Tables without a policy use ConflictError.
+	Conflicts map[string]ConflictPolicy `json:"conflicts,omitempty"`
+	// Speed replays the original gaps between transactions divided by
+	// this factor: 1 is real time, 10 is ten times faster. Zero replays
+	// as fast as possible.
+	Speed float64 `json:"speed,omitempty"`
+	// MaxGap caps the delay between two transactions when pacing.
+	MaxGap time.Duration `json:"max_gap,omitempty"`
+	// Connections fans transactions out over this many connections.
+	// Transactions on unrelated rows may then commit out of order.
+	Connections int `json:"connections,omitempty"`
+	// Progress, when set, is called after each source transaction with
+	// the number of entries processed so far and the LSN reached.
+	Progress func(done, total int, lsn string) `json:"-"`
+}
+
+func (o Options) reportProgress(done, total int, group []*wal.WALEntry) {
+	if o.Progress != nil {
+		o.Progress(done, total, group[len(group)-1].LSN)
+	}
+}
+
+// EntryError describes a WAL entry that could not be applied, and the
+// source transaction it belongs to.
+type EntryError struct {
+	EntryID   string            `json:"entry_id"`
+	LSN       string            `json:"lsn"`
+	TxID      uint32            `json:"xid,omitempty"`
+	Operation wal.OperationType `json:"operation"`
+	Table     string            `json:"table"`
+	Error     string            `json:"error"`
+}
+
+// Result summarizes a replay. Applied only counts entries whose replica
+// transaction committed. Serialized counts the transactions of a parallel
+// replay that ran alone because their dependencies could not be proven
+// safe, and SerialReason is set when the whole replay ran serially.
+type Result struct {
+	Applied      int          `json:"applied"`
+	Skipped      int          `json:"skipped"`
+	Transactions int          `json:"transactions"`
+	RolledBack   int          `json:"rolled_back"`
+	Stopped      bool         `json:"stopped"`
+	Serialized   int          `json:"serialized"`
+	SerialReason string       `json:"serial_reason,omitempty"`
+	Errors       []EntryError `json:"errors"`
+	Conflicts    []Conflict   `json:"conflicts"`
+}
+
+// Err returns an error when any entry failed to apply.
+func (r *Result) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	first := r.Errors[0]
+	return fmt.Errorf("%d transactions failed to apply, first xid %d at %s (entry %s): %s",
+		len(r.Errors), first.TxID, first.LSN, first.EntryID, first.Error)
+}
+
+func newResult() *Result {
+	return &Result{Errors: make([]EntryError, 0), Conflicts: make([]Conflict, 0)}
+}
+
+func (r *Result) merge(other *Result) {
+	r.Applied += other.Applied
+	r.Skipped += other.Skipped
+	r.Transactions += other.Transactions
+	r.RolledBack += other.RolledBack
+	r.Stopped = r.Stopped || other.Stopped
+	r.Serialized += other.Serialized
+	if r.SerialReason == "" {
+		r.SerialReason = other.SerialReason
+	}
+	r.Errors = append(r.Errors, other.Errors...)
+	r.Conflicts = append(r.Conflicts, other.Conflicts...)
+}
+
+func (r *Result) addError(entry *wal.WALEntry, err error) {
+	r.Errors = append(r.Errors, EntryError{
+		EntryID:   entry.ID,
+		LSN:       entry.LSN,
+		TxID:      entry.TxID,
+		Operation: entry.Operation,
+		Table:     qualifiedName(entry),
+		Error:     err.Error(),
+	})
+}
+
+type Replayer struct {
+	config *config.Config
+}
+
+func NewReplayer(cfg *config.Config) *Replayer {
+	return &Replayer{
+		config: cfg,
+	}
+}
+
+// ReplicaTarget returns the target for the configured replica database.
+func (r *Replayer) ReplicaTarget() Target {
+	return Target{DSN: r.config.ReplicaDB.ToDSN()}
+}
+
+// DefaultOptions returns the replay options from the configuration. It
+// fails when the configuration names an unknown conflict policy.
+func (r *Replayer) DefaultOptions() (Options, error) {
+	policy, err := ParseFailurePolicy(r.config.Replay.OnError)
+	if err != nil {
+		policy = FailAbort
+	}
+	conflicts, err := ParseConflictPolicies(r.config.Replay.Conflicts)
+	if err != nil {
+		return Options{}, fmt.Errorf("invalid replay conflicts: %w", err)
+	}
+	maxGap, _ := time.ParseDuration(r.config.Replay.MaxGap)
+	return Options{
+		OnError:     policy,
+		Conflicts:   conflicts,
+		Speed:       r.config.Replay.Speed,
+		MaxGap:      maxGap,
+		Connections: r.config.Replay.Connections,
+	}, nil
+}
+
+func (r *Replayer) ReplaySession(ctx context.Context, session *Session, entries []*wal.WALEntry, opts Options) (*Result, error) {
+	fmt.Printf("Replaying session %s with %d entries\n", session.ID, len(entries))
+	return r.ReplayInto(ctx, r.ReplicaTarget(), entries, opts)
+}
+
+// ReplayInto applies entries, in order, to the given target. Entries of
+// the same source transaction are applied in one replica transaction, so
+// the target never holds part of a source transaction unless opts.OnError
+// is FailStop. Failures are recorded in the result; the returned error is
+// only set when the replay could not run at all, for example when the
+// target is unreachable or ctx is cancelled.
+func (r *Replayer) ReplayInto(ctx context.Context, target Target, entries []*wal.WALEntry, opts Options) (*Result, error) {
+	if opts.OnError == "" {
+		opts.OnError = FailAbort
+	}
+	if opts.Connections > 1 {
+		return r.replayParallel(ctx, target, entries, opts)
+	}
+
+	conn, err := connectTarget(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	pace := newPacer(opts.Speed, opts.MaxGap)
+	result := newResult()
+	done := 0
+	for _, group := range GroupByTransaction(entries) {
+		if err := pace.wait(ctx, group[0].Committed()); err != nil {
+			return result, err
+		}
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+
+		if err := r.applyTransaction(ctx, conn, target, group, opts, result); err != nil {
+			return result, err
+		}
+		done += len(group)
+		opts.reportProgress(done, len(entries), group)
+		if result.Stopped {
+			break
+		}
+	}
+
+	return result, nil
+}
+
+// connectTarget connects to the replay target as a replication apply
+// worker would: with session_replication_role set to replica, so that
+// ordinary triggers and foreign key actions do not fire. The captured log
+// already holds their effects, such as audit rows and cascaded deletes,
+// which would otherwise be applied twice.
+func connectTarget(ctx context.Context, target Target) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, target.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to replay target: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "SET session_replication_role = replica"); err != nil {
+		conn.Close(context.Background())
+		return nil, fmt.Errorf("failed to set session_replication_role on replay target (the replay user must be a superuser): %w", err)
+	}
+	return conn, nil
+}
+
+// replayParallel applies transactions over opts.Connections connections.
+// Transactions keep their order relative to earlier ones touching the same
+// rows or rows they reference, as planned from the target's foreign keys
+// (see dependencyPlan). When the failure policy ends the replay,
+// transactions already running still finish.
+func (r *Replayer) replayParallel(ctx context.Context, target Target, entries []*wal.WALEntry, opts Options) (*Result, error) {
+	pool := make(chan *pgx.Conn, opts.Connections)
+	defer func() {
+		close(pool)
+		for conn := range pool {
+			conn.Close(context.Background())
+		}
+	}()
+	for i := 0; i < opts.Connections; i++ {
+		conn, err := connectTarget(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		pool <- conn
+	}
+
+	conn := <-pool
+	graph, err := LoadDependencyGraph(ctx, conn, target)
+	pool <- conn
+	result := newResult()
+	plan := &dependencyPlan{serial: true}
+	if err != nil {
+		result.SerialReason = err.Error()
+	} else {
+		plan = newDependencyPlan(graph, entries)
+	}
+
+	var (
+		processed int
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		firstErr  error
+		stopOnce  sync.Once
+	)
+	stop := make(chan struct{})
+	halt := func() { stopOnce.Do(func() { close(stop) }) }
+	// Bounds the number of transactions waiting for a connection.
+	inflight := make(chan struct{}, 16*opts.Connections)
+
+	sched := newScheduler()
+	pace := newPacer(opts.Speed, opts.MaxGap)
+
+dispatch:
+	for _, group := range GroupByTransaction(entries) {
+		if err := pace.wait(ctx, group[0].Committed()); err != nil {
+			break
+		}
+		select {
+		case inflight <- struct{}{}:
+		case <-stop:
+			break dispatch
+		case <-ctx.Done():
+			break dispatch
+		}
+
+		resources, ok := plan.resources(group)
+		if !ok {
+			mu.Lock()
+			result.Serialized++
+			mu.Unlock()
+		}
+		deps, done := sched.schedule(resources, !ok)
+		wg.Add(1)
+		go func(group []*wal.WALEntry) {
+			defer wg.Done()
+			defer func() { <-inflight }()
+			defer close(done)
+
+			for _, dep := range deps {
+				select {
+				case <-dep:
+				case <-stop:
+					return
+				}
+			}
+
+			var conn *pgx.Conn
+			select {
+			case conn = <-pool:
+			case <-stop:
+				return
+			}
+			defer func() { pool <- conn }()
+
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			local := newResult()
+			err := r.applyTransaction(ctx, conn, target, group, opts, local)
+
+			mu.Lock()
+			result.merge(local)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			processed += len(group)
+			opts.reportProgress(processed, len(entries), group)
+			mu.Unlock()
+
+			if err != nil || local.Stopped {
+				halt()
+			}
+		}(group)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return result, firstErr
+	}
+	return result, ctx.Err()
+}
+
+// GroupByTransaction splits entries into runs of consecutive entries with
+// the same source transaction ID. Entries without a transaction ID, from
+// logs written before it was captured, each form their own group.
+func GroupByTransaction(entries []*wal.WALEntry) [][]*wal.WALEntry {
+	groups := make([][]*wal.WALEntry, 0)
+	for i, entry := range entries {
+		if i > 0 && entry.TxID != 0 && entry.TxID == entries[i-1].TxID {
+			groups[len(groups)-1] = append(groups[len(groups)-1], entry)
+			continue
+		}
+		groups = append(groups, []*wal.WALEntry{entry})
+	}
+	return groups
+}
+
+// applyTransaction applies one source transaction in a replica transaction
+// and records the outcome in result. It returns an error only when the
+// replica transaction itself could not be started.
+func (r *Replayer) applyTransaction(ctx context.Context, conn *pgx.Conn, target Target, group []*wal.WALEntry, opts Options, result *Result) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	applied, skipped := 0, 0
+	for i, entry := range group {
+		ok, conflict, err := r.applyInTransaction(ctx, tx, target, entry, opts)
+		if conflict != nil {
+			result.Conflicts = append(result.Conflicts, *conflict)
+		}
+		if err != nil {
+			result.addError(entry, err)
+			if opts.OnError == FailStop {
+				result.Stopped = true
+				result.RolledBack += len(group) - i
+				break
+			}
+
+			result.RolledBack += len(group)
+			result.Stopped = opts.OnError == FailAbort
+			return nil
+		}
+		if ok {
+			applied++
+		} else {
+			skipped++
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		// Deferred constraints are only checked here, so the failure
+		// belongs to the transaction rather than one of its entries.
+		result.addError(group[len(group)-1], fmt.Errorf("commit failed: %w", err))
+		result.RolledBack += applied + skipped
+		result.Stopped = opts.OnError != FailSkip
+		return nil
+	}
+
+	result.Applied += applied
+	result.Skipped += skipped
+	result.Transactions++
+	return nil
+}
+
+// applyInTransaction applies entry inside tx. With the stop policy the
+// entry runs in its own savepoint so that a failure leaves the earlier
+// entries of the transaction intact.
+func (r *Replayer) applyInTransaction(ctx context.Context, tx pgx.Tx, target Target, entry *wal.WALEntry, opts Options) (bool, *Conflict, error) {
+	if opts.OnError != FailStop {
+		return r.applyEntry(ctx, tx.Conn().PgConn(), target, entry, opts)
+	}
+
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	ok, conflict, err := r.applyEntry(ctx, tx.Conn().PgConn(), target, entry, opts)
+	if err != nil {
+		sp.Rollback(ctx)
+		return false, conflict, err
+	}
+	return ok, conflict, sp.Commit(ctx)
+}
+
+// applyEntry executes the statement for entry, resolving conflicts with
+// the table's policy. It reports false for entries that have nothing to
+// apply or were skipped.
+func (r *Replayer) applyEntry(ctx context.Context, conn *pgconn.PgConn, target Target, entry *wal.WALEntry, opts Options) (bool, *Conflict, error) {
+	switch entry.Operation {
+	case wal.OpInsert:
+		return applyInsert(ctx, conn, target, entry, opts.conflictPolicy(entry))
+	case wal.OpUpdate, wal.OpDelete:
+		return applyChange(ctx, conn, target, entry, opts.conflictPolicy(entry))
+	case wal.OpDDL:
+		if entry.SQL == "" {
+			return false, nil, nil
+		}
+		// Captured DDL may hold several statements, which only the simple
+		// protocol accepts.
+		if _, err := conn.Exec(ctx, entry.SQL).ReadAll(); err != nil {
+			return false, nil, err
+		}
+		return true, nil, nil
+	}
+	return false, nil, fmt.Errorf("unsupported operation %s", entry.Operation)
+}
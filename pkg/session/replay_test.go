@@ -0,0 +1,35 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestGroupByTransaction(t *testing.T) {
+	entries := []*wal.WALEntry{
+		{ID: "a", TxID: 10},
+		{ID: "b", TxID: 10},
+		{ID: "c", TxID: 11},
+		{ID: "d"},
+		{ID: "e"},
+		{ID: "f", TxID: 12},
+	}
+
+	groups := GroupByTransaction(entries)
+
+	want := [][]string{{"a", "b"}, {"c"}, {"d"}, {"e"}, {"f"}}
+	if len(groups) != len(want) {
+		t.Fatalf("Expected %d groups, got %d", len(want), len(groups))
+	}
+	for i, group := range groups {
+		if len(group) != len(want[i]) {
+			t.Fatalf("Expected group %d to have %d entries, got %d", i, len(want[i]), len(group))
+		}
+		for j, entry := range group {
+			if entry.ID != want[i][j] {
+				t.Errorf("Expected entry %s in group %d, got %s", want[i][j], i, entry.ID)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// ErrNotReversible is returned when entries lack the old row values needed
+// to undo them.
+var ErrNotReversible = errors.New("entries cannot be reversed")
+
+// Invert returns the operations that undo entries, newest first: inserted
+// rows are deleted, updated rows get their old values back and deleted
+// rows are inserted again. Undoing updates and deletes needs the complete
+// old row, which the listener only captures for tables with REPLICA
+// IDENTITY FULL. Invert checks every entry before returning and fails if
+// any of them cannot be undone.
+func Invert(entries []*wal.WALEntry) ([]*wal.WALEntry, error) {
+	inverted := make([]*wal.WALEntry, 0, len(entries))
+	var first error
+	failed := 0
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		inverse, err := invertEntry(entries[i])
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed++
+			continue
+		}
+		inverted = append(inverted, inverse)
+	}
+
+	if failed > 0 {
+		return nil, fmt.Errorf("%w: %d of %d entries lack the data to undo them, first: %v", ErrNotReversible, failed, len(entries), first)
+	}
+	return inverted, nil
+}
+
+func invertEntry(entry *wal.WALEntry) (*wal.WALEntry, error) {
+	inverse := *entry
+	inverse.SQL = ""
+
+	switch entry.Operation {
+	case wal.OpInsert:
+		if len(entry.Data) == 0 {
+			return nil, fmt.Errorf("INSERT %s at %s has no row data", entry.ID, entry.LSN)
+		}
+		inverse.Operation = wal.OpDelete
+		inverse.OldData = entry.Data
+		inverse.Data = nil
+
+	case wal.OpUpdate:
+		if err := requireFullOldRow(entry); err != nil {
+			return nil, err
+		}
+		inverse.Data = entry.OldData
+		inverse.OldData = wal.MergeRows(entry.OldData, entry.Data)
+
+	case wal.OpDelete:
+		if err := requireFullOldRow(entry); err != nil {
+			return nil, err
+		}
+		inverse.Operation = wal.OpInsert
+		inverse.Data = entry.OldData
+		inverse.OldData = nil
+
+	default:
+		return nil, fmt.Errorf("%s %s at %s cannot be undone", entry.Operation, entry.ID, entry.LSN)
+	}
+
+	return &inverse, nil
+}
+
+// requireFullOldRow checks that an UPDATE or DELETE carries every column
+// of the old row. The columns of the table are known from the captured
+// column types; without them, old data holding more than the key is taken
+// as a full row.
+func requireFullOldRow(entry *wal.WALEntry) error {
+	missing := fmt.Errorf("%s %s at %s on %s has no full old row; set REPLICA IDENTITY FULL on the table",
+		entry.Operation, entry.ID, entry.LSN, qualifiedName(entry))
+
+	if len(entry.OldData) == 0 {
+		return missing
+	}
+
+	if len(entry.ColumnTypes) > 0 {
+		for col := range entry.ColumnTypes {
+			if _, ok := entry.OldData[col]; !ok {
+				return missing
+			}
+		}
+		return nil
+	}
+
+	if len(entry.OldData) <= len(entry.KeyColumns) {
+		return missing
+	}
+	for col := range entry.Data {
+		if _, ok := entry.OldData[col]; !ok {
+			return missing
+		}
+	}
+	return nil
+}
+
+// RewindInto undoes entries on target, newest first, so that it returns
+// to the state before the first of them. It refuses to start when any
+// entry cannot be undone. Pacing does not apply.
+func (r *Replayer) RewindInto(ctx context.Context, target Target, entries []*wal.WALEntry, opts Options) (*Result, error) {
+	inverted, err := Invert(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Speed = 0
+	return r.ReplayInto(ctx, target, inverted, opts)
+}
+
+func (r *Replayer) RewindSession(ctx context.Context, session *Session, entries []*wal.WALEntry, opts Options) (*Result, error) {
+	fmt.Printf("Rewinding session %s by %d entries\n", session.ID, len(entries))
+	return r.RewindInto(ctx, r.ReplicaTarget(), entries, opts)
+}
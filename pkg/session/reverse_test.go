@@ -0,0 +1,66 @@
+package session
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestInvert(t *testing.T) {
+	types := map[string]string{"id": "integer", "status": "text"}
+	keys := []string{"id"}
+	entries := []*wal.WALEntry{
+		{ID: "e1", TxID: 1, Operation: wal.OpInsert, Table: "orders", KeyColumns: keys, ColumnTypes: types,
+			Data: map[string]interface{}{"id": "1", "status": "new"}},
+		{ID: "e2", TxID: 2, Operation: wal.OpUpdate, Table: "orders", KeyColumns: keys, ColumnTypes: types,
+			Data:    map[string]interface{}{"id": "2", "status": "paid"},
+			OldData: map[string]interface{}{"id": "1", "status": "new"}},
+		{ID: "e3", TxID: 3, Operation: wal.OpDelete, Table: "orders", KeyColumns: keys, ColumnTypes: types,
+			OldData: map[string]interface{}{"id": "2", "status": "paid"}},
+	}
+
+	inverted, err := Invert(entries)
+	if err != nil {
+		t.Fatalf("Failed to invert entries: %v", err)
+	}
+	if len(inverted) != 3 {
+		t.Fatalf("Expected 3 inverse entries, got %d", len(inverted))
+	}
+
+	reinsert := inverted[0]
+	if reinsert.ID != "e3" || reinsert.Operation != wal.OpInsert || reinsert.Data["status"] != "paid" {
+		t.Errorf("Expected delete to become an insert of the old row, got %+v", reinsert)
+	}
+
+	restore := inverted[1]
+	if restore.Operation != wal.OpUpdate || restore.Data["id"] != "1" || restore.OldKey()["id"] != "2" {
+		t.Errorf("Expected update to restore id 1 on the row now keyed 2, got %+v", restore)
+	}
+
+	remove := inverted[2]
+	if remove.Operation != wal.OpDelete || remove.OldKey()["id"] != "1" {
+		t.Errorf("Expected insert to become a delete of id 1, got %+v", remove)
+	}
+
+	if entries[1].Operation != wal.OpUpdate || entries[2].Operation != wal.OpDelete {
+		t.Error("Expected the original entries to be left unchanged")
+	}
+}
+
+func TestInvert_RequiresFullOldRow(t *testing.T) {
+	entries := []*wal.WALEntry{
+		{ID: "e1", Operation: wal.OpUpdate, Table: "orders", KeyColumns: []string{"id"},
+			ColumnTypes: map[string]string{"id": "integer", "status": "text"},
+			Data:        map[string]interface{}{"id": "1", "status": "paid"},
+			OldData:     map[string]interface{}{"id": "1"}},
+		{ID: "e2", Operation: wal.OpDelete, Table: "orders", KeyColumns: []string{"id"},
+			OldData: map[string]interface{}{"id": "1"}},
+		{ID: "e3", Operation: wal.OpDDL, SQL: "ALTER TABLE orders ADD COLUMN note text"},
+	}
+
+	_, err := Invert(entries)
+	if !errors.Is(err, ErrNotReversible) {
+		t.Fatalf("Expected ErrNotReversible, got %v", err)
+	}
+}
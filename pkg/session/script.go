@@ -0,0 +1,74 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// literalBinder inlines values as quoted SQL literals.
+type literalBinder struct{}
+
+func (literalBinder) bind(value interface{}, typ string) string {
+	text, isNull := textValue(value)
+	if isNull {
+		return withCast("NULL", typ)
+	}
+	return withCast(quoteLiteral(text), typ)
+}
+
+// quoteLiteral quotes s as a string literal. Scripts set
+// standard_conforming_strings, so backslashes need no escaping.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// WriteScript writes entries to w as a standalone SQL script instead of
+// applying them. Each source transaction becomes a BEGIN/COMMIT block and
+// values are inlined as literals, so the same entries always produce the
+// same script. Conflict policies do not apply; the script holds the
+// statements a replay with the error policy would run.
+func WriteScript(w io.Writer, target Target, entries []*wal.WALEntry) error {
+	out := bufio.NewWriter(w)
+	groups := GroupByTransaction(entries)
+
+	fmt.Fprintln(out, "-- postgres-test-replay script")
+	if len(entries) > 0 {
+		fmt.Fprintf(out, "-- %d entries in %d transactions, LSN %s to %s\n",
+			len(entries), len(groups), entries[0].LSN, entries[len(entries)-1].LSN)
+	}
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "SET standard_conforming_strings = on;")
+	// As in a replay, triggers and foreign key actions already ran on the
+	// source and their effects are part of the script.
+	fmt.Fprintln(out, "SET session_replication_role = replica;")
+
+	for _, group := range groups {
+		fmt.Fprintln(out)
+		if xid := group[0].TxID; xid != 0 {
+			fmt.Fprintf(out, "-- xid %d, LSN %s\n", xid, group[0].LSN)
+		} else {
+			fmt.Fprintf(out, "-- LSN %s\n", group[0].LSN)
+		}
+		fmt.Fprintln(out, "BEGIN;")
+
+		for _, entry := range group {
+			stmt, err := buildStatement(literalBinder{}, target, entry)
+			if err != nil {
+				return fmt.Errorf("failed to script entry %s at %s: %w", entry.ID, entry.LSN, err)
+			}
+			if stmt == "" {
+				fmt.Fprintf(out, "-- %s at %s skipped: no SQL captured\n", entry.Operation, entry.LSN)
+				continue
+			}
+			fmt.Fprintln(out, strings.TrimRight(strings.TrimSpace(stmt), ";")+";")
+		}
+
+		fmt.Fprintln(out, "COMMIT;")
+	}
+
+	return out.Flush()
+}
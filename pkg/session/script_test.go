@@ -0,0 +1,51 @@
+package session
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestWriteScript(t *testing.T) {
+	types := map[string]string{"id": "integer", "note": "text"}
+	entries := []*wal.WALEntry{
+		{ID: "e1", LSN: "0/10", TxID: 7, Operation: wal.OpInsert, Schema: "public", Table: "notes", KeyColumns: []string{"id"}, ColumnTypes: types,
+			Data: map[string]interface{}{"id": "1", "note": `it's a \ test`}},
+		{ID: "e2", LSN: "0/20", TxID: 7, Operation: wal.OpUpdate, Schema: "public", Table: "notes", KeyColumns: []string{"id"}, ColumnTypes: types,
+			Data: map[string]interface{}{"id": "1", "note": nil}},
+		{ID: "e3", LSN: "0/30", Operation: wal.OpDDL},
+	}
+
+	var buf bytes.Buffer
+	if err := WriteScript(&buf, Target{}, entries); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+
+	want := `-- postgres-test-replay script
+-- 3 entries in 2 transactions, LSN 0/10 to 0/30
+
+SET standard_conforming_strings = on;
+SET session_replication_role = replica;
+
+-- xid 7, LSN 0/10
+BEGIN;
+INSERT INTO "public"."notes" ("id", "note") VALUES ('1'::integer, 'it''s a \ test'::text);
+UPDATE "public"."notes" SET "id" = '1'::integer, "note" = NULL::text WHERE "id" = '1'::integer;
+COMMIT;
+
+-- LSN 0/30
+BEGIN;
+-- DDL at 0/30 skipped: no SQL captured
+COMMIT;
+`
+	if buf.String() != want {
+		t.Errorf("Unexpected script:\n%s", buf.String())
+	}
+
+	var again bytes.Buffer
+	WriteScript(&again, Target{}, entries)
+	if again.String() != buf.String() {
+		t.Error("Expected the same entries to produce the same script")
+	}
+}
@@ -1,18 +1,15 @@
 package session
 
 import (
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"sort"
-	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
-	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/store"
 )
 
 type Session struct {
@@ -24,237 +21,254 @@ type Session struct {
 	Database    string    `json:"database"`
 	Checkpoints []string  `json:"checkpoints"`
 	Active      bool      `json:"active"`
+	// ReplayCheckpoint is the checkpoint the replica was last replayed or
+	// rewound to, and ReplayLSN the LSN of its last entry.
+	ReplayCheckpoint string `json:"replay_checkpoint,omitempty"`
+	ReplayLSN        string `json:"replay_lsn,omitempty"`
+	// Head is the checkpoint that the next checkpoint of the session
+	// follows, and HeadLSN and HeadSeq the position in the WAL log after
+	// which the changes recorded since then start.
+	Head    string `json:"head,omitempty"`
+	HeadLSN string `json:"head_lsn,omitempty"`
+	HeadSeq int    `json:"head_seq,omitempty"`
+	// Recordings are the windows of the change stream captured while the
+	// session was active, oldest first. The last one is open while the
+	// session is active.
+	Recordings []Recording `json:"recordings,omitempty"`
+	// ForkedFrom is the session this one was forked from, and ForkedAt the
+	// checkpoint it was forked at.
+	ForkedFrom string `json:"forked_from,omitempty"`
+	ForkedAt   string `json:"forked_at,omitempty"`
 }
 
+// Manager keeps sessions in a metadata store. The active session is the
+// one marked Active, which owns the changes the listener captures.
 type Manager struct {
-	config   *config.Config
-	sessions map[string]*Session
-	active   string
-	mutex    sync.RWMutex
+	config *config.Config
+	store  store.Store
 }
 
-func NewManager(cfg *config.Config) *Manager {
+func NewManager(cfg *config.Config, st store.Store) *Manager {
 	return &Manager{
-		config:   cfg,
-		sessions: make(map[string]*Session),
+		config: cfg,
+		store:  st,
 	}
 }
 
-func (m *Manager) CreateSession(name, description, database string) (*Session, error) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+// ErrNotFound is returned for a session that does not exist.
+var ErrNotFound = errors.New("session not found")
 
-	session := &Session{
-		ID:          uuid.New().String(),
-		Name:        name,
-		Description: description,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
-		Database:    database,
-		Checkpoints: make([]string, 0),
-		Active:      false,
+// Get reads a session from a store or within a transaction.
+func Get(r store.Reader, id string) (*Session, error) {
+	doc, err := r.Get(store.Sessions, id)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
 	}
-
-	m.sessions[session.ID] = session
-
-	if err := m.save(); err != nil {
+	if err != nil {
 		return nil, err
 	}
 
-	return session, nil
-}
-
-func (m *Manager) GetSession(id string) (*Session, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-
-	session, exists := m.sessions[id]
-	if !exists {
-		return nil, fmt.Errorf("session %s not found", id)
+	session := &Session{}
+	if err := json.Unmarshal(doc, session); err != nil {
+		return nil, fmt.Errorf("failed to decode session %s: %w", id, err)
 	}
-
 	return session, nil
 }
 
-func (m *Manager) ListSessions() ([]*Session, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-
-	sessions := make([]*Session, 0, len(m.sessions))
-	for _, s := range m.sessions {
-		sessions = append(sessions, s)
+// List reads every session from a store or within a transaction.
+func List(r store.Reader) ([]*Session, error) {
+	docs, err := r.List(store.Sessions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
 	}
 
-	sort.Slice(sessions, func(i, j int) bool {
-		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
-	})
-
+	sessions := make([]*Session, 0, len(docs))
+	for id, doc := range docs {
+		session := &Session{}
+		if err := json.Unmarshal(doc, session); err != nil {
+			return nil, fmt.Errorf("failed to decode session %s: %w", id, err)
+		}
+		sessions = append(sessions, session)
+	}
 	return sessions, nil
 }
 
-func (m *Manager) SwitchSession(id string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	session, exists := m.sessions[id]
-	if !exists {
-		return fmt.Errorf("session %s not found", id)
-	}
-
-	for _, s := range m.sessions {
-		s.Active = false
+// Put writes a session within a transaction.
+func Put(tx store.Tx, session *Session) error {
+	doc, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
 	}
-
-	session.Active = true
-	m.active = id
-
-	return m.save()
+	return tx.Put(store.Sessions, session.ID, doc)
 }
 
-func (m *Manager) GetActiveSession() (*Session, error) {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
-
-	if m.active == "" {
-		return nil, fmt.Errorf("no active session")
+// AttachCheckpoints adds checkpoints to the list of a session within a
+// transaction, skipping those it lists already. It returns ErrNotFound when
+// the session does not exist.
+func AttachCheckpoints(tx store.Tx, sessionID string, checkpointIDs ...string) error {
+	session, err := Get(tx, sessionID)
+	if err != nil {
+		return err
 	}
 
-	return m.sessions[m.active], nil
-}
-
-func (m *Manager) AddCheckpoint(sessionID, checkpointID string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	session, exists := m.sessions[sessionID]
-	if !exists {
-		return fmt.Errorf("session %s not found", sessionID)
+	listed := make(map[string]bool, len(session.Checkpoints))
+	for _, id := range session.Checkpoints {
+		listed[id] = true
+	}
+	changed := false
+	for _, id := range checkpointIDs {
+		if !listed[id] {
+			session.Checkpoints = append(session.Checkpoints, id)
+			listed[id] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
 	}
-
-	session.Checkpoints = append(session.Checkpoints, checkpointID)
 	session.UpdatedAt = time.Now()
-
-	return m.save()
+	return Put(tx, session)
 }
 
-func (m *Manager) DeleteSession(id string) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	if _, exists := m.sessions[id]; !exists {
-		return fmt.Errorf("session %s not found", id)
+// DetachCheckpoints removes deleted checkpoints from every session within a
+// transaction. A session whose head or replay position was one of them
+// loses it, so that its next checkpoint starts a new tree.
+func DetachCheckpoints(tx store.Tx, deleted map[string]bool) error {
+	sessions, err := List(tx)
+	if err != nil {
+		return err
 	}
 
-	delete(m.sessions, id)
+	for _, session := range sessions {
+		changed := false
+		kept := make([]string, 0, len(session.Checkpoints))
+		for _, id := range session.Checkpoints {
+			if deleted[id] {
+				changed = true
+				continue
+			}
+			kept = append(kept, id)
+		}
+		session.Checkpoints = kept
+		if deleted[session.Head] {
+			session.Head, session.HeadLSN, session.HeadSeq = "", "", 0
+			changed = true
+		}
+		if deleted[session.ReplayCheckpoint] {
+			session.ReplayCheckpoint, session.ReplayLSN = "", ""
+			changed = true
+		}
 
-	if m.active == id {
-		m.active = ""
+		if changed {
+			session.UpdatedAt = time.Now()
+			if err := Put(tx, session); err != nil {
+				return err
+			}
+		}
 	}
-
-	return m.save()
+	return nil
 }
 
-func (m *Manager) Load() error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-
-	sessionPath := m.config.Storage.SessionPath
-	if err := os.MkdirAll(sessionPath, 0755); err != nil {
-		return fmt.Errorf("failed to create session directory: %w", err)
-	}
+// update applies fn to a session and saves it.
+func (m *Manager) update(sessionID string, fn func(session *Session)) error {
+	return m.store.Update(func(tx store.Tx) error {
+		session, err := Get(tx, sessionID)
+		if err != nil {
+			return err
+		}
+		fn(session)
+		session.UpdatedAt = time.Now()
+		return Put(tx, session)
+	})
+}
 
-	filename := filepath.Join(sessionPath, "sessions.json")
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return nil
+func (m *Manager) CreateSession(name, description, database string) (*Session, error) {
+	session := &Session{
+		ID:          uuid.New().String(),
+		Name:        name,
+		Description: description,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+		Database:    database,
+		Checkpoints: make([]string, 0),
+		Active:      false,
 	}
 
-	file, err := os.Open(filename)
+	err := m.store.Update(func(tx store.Tx) error {
+		return Put(tx, session)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to open session file: %w", err)
-	}
-	defer file.Close()
-
-	type SaveData struct {
-		Sessions map[string]*Session `json:"sessions"`
-		Active   string              `json:"active"`
-	}
-
-	var data SaveData
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&data); err != nil {
-		return fmt.Errorf("failed to decode sessions: %w", err)
+		return nil, err
 	}
 
-	m.sessions = data.Sessions
-	m.active = data.Active
+	return session, nil
+}
 
-	return nil
+// AddSession records a session created elsewhere, such as one imported
+// from a bundle.
+func (m *Manager) AddSession(session *Session) error {
+	return m.store.Update(func(tx store.Tx) error {
+		if _, err := tx.Get(store.Sessions, session.ID); err == nil {
+			return fmt.Errorf("session %s already exists", session.ID)
+		}
+		return Put(tx, session)
+	})
 }
 
-func (m *Manager) save() error {
-	sessionPath := m.config.Storage.SessionPath
-	if err := os.MkdirAll(sessionPath, 0755); err != nil {
-		return fmt.Errorf("failed to create session directory: %w", err)
-	}
+func (m *Manager) GetSession(id string) (*Session, error) {
+	return Get(m.store, id)
+}
 
-	filename := filepath.Join(sessionPath, "sessions.json")
-	file, err := os.Create(filename)
+func (m *Manager) ListSessions() ([]*Session, error) {
+	sessions, err := List(m.store)
 	if err != nil {
-		return fmt.Errorf("failed to create session file: %w", err)
+		return nil, err
 	}
-	defer file.Close()
 
-	type SaveData struct {
-		Sessions map[string]*Session `json:"sessions"`
-		Active   string              `json:"active"`
-	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
 
-	data := SaveData{
-		Sessions: m.sessions,
-		Active:   m.active,
-	}
+	return sessions, nil
+}
 
-	encoder := json.NewEncoder(file)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(data); err != nil {
-		return fmt.Errorf("failed to encode sessions: %w", err)
+func (m *Manager) GetActiveSession() (*Session, error) {
+	sessions, err := List(m.store)
+	if err != nil {
+		return nil, err
 	}
 
-	// Sync to disk to ensure data is persisted
-	if err := file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync session file: %w", err)
+	for _, s := range sessions {
+		if s.Active {
+			return s, nil
+		}
 	}
 
-	return nil
+	return nil, fmt.Errorf("no active session")
 }
 
-type Replayer struct {
-	config *config.Config
+// SetReplayPosition records the checkpoint the replica now matches.
+func (m *Manager) SetReplayPosition(sessionID, checkpointID, lsn string) error {
+	return m.update(sessionID, func(session *Session) {
+		session.ReplayCheckpoint = checkpointID
+		session.ReplayLSN = lsn
+	})
 }
 
-func NewReplayer(cfg *config.Config) *Replayer {
-	return &Replayer{
-		config: cfg,
-	}
+// SetHead records the checkpoint the session's next checkpoint follows,
+// and the position in the log after which its changes start.
+func (m *Manager) SetHead(sessionID, checkpointID, lsn string, seq int) error {
+	return m.update(sessionID, func(session *Session) {
+		session.Head = checkpointID
+		session.HeadLSN = lsn
+		session.HeadSeq = seq
+	})
 }
 
-func (r *Replayer) ReplaySession(ctx context.Context, session *Session, entries []*wal.WALEntry) error {
-	// This would connect to the replica database and replay the WAL entries
-	// For now, we'll just log that we would replay
-	fmt.Printf("Replaying session %s with %d entries\n", session.ID, len(entries))
-
-	for _, entry := range entries {
-		if err := r.applyEntry(ctx, entry); err != nil {
-			return fmt.Errorf("failed to apply entry %s: %w", entry.ID, err)
-		}
+// Load checks that the sessions can be read from the store.
+func (m *Manager) Load() error {
+	if _, err := List(m.store); err != nil {
+		return fmt.Errorf("failed to load sessions: %w", err)
 	}
-
-	return nil
-}
-
-func (r *Replayer) applyEntry(ctx context.Context, entry *wal.WALEntry) error {
-	// Apply the WAL entry to the database
-	// This is a placeholder - actual implementation would execute SQL
-	fmt.Printf("Applying %s operation on %s.%s\n", entry.Operation, entry.Schema, entry.Table)
 	return nil
 }
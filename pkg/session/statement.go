@@ -0,0 +1,252 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+// binder turns a value into SQL text for a statement: a parameter
+// placeholder when executing, or a literal when writing a script.
+type binder interface {
+	bind(value interface{}, typ string) string
+}
+
+// paramBinder collects values as text-format parameters.
+type paramBinder struct {
+	args [][]byte
+}
+
+func (b *paramBinder) bind(value interface{}, typ string) string {
+	text, isNull := textValue(value)
+	if isNull {
+		b.args = append(b.args, nil)
+	} else {
+		b.args = append(b.args, []byte(text))
+	}
+	return withCast(fmt.Sprintf("$%d", len(b.args)), typ)
+}
+
+func withCast(expr, typ string) string {
+	if typ == "" {
+		return expr
+	}
+	return expr + "::" + typ
+}
+
+// textValue returns the text representation PostgreSQL expects for a
+// captured value. Values captured by the listener are already text; other
+// types appear when entries were written by hand or rewritten.
+func textValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, false
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), false
+	case bool:
+		return strconv.FormatBool(v), false
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data), false
+	default:
+		return fmt.Sprint(v), false
+	}
+}
+
+// buildStatement generates the SQL that applies entry to target, matching
+// rows by their key. It returns an empty string for entries that have
+// nothing to apply, such as DDL entries without captured SQL.
+func buildStatement(b binder, target Target, entry *wal.WALEntry) (string, error) {
+	switch entry.Operation {
+	case wal.OpInsert:
+		return buildInsert(b, target, entry, entry.Data)
+	case wal.OpUpdate:
+		return buildUpdate(b, target, entry, entry.Data, rowMatch(entry, false))
+	case wal.OpDelete:
+		return buildDelete(b, target, entry, rowMatch(entry, false))
+	case wal.OpDDL:
+		return entry.SQL, nil
+	}
+	return "", fmt.Errorf("unsupported operation %s", entry.Operation)
+}
+
+// rowMatch returns the columns that identify the row an UPDATE or DELETE
+// changes: its key, or without key metadata every column of the old row,
+// which is available when the table uses REPLICA IDENTITY FULL. With
+// strict set, every captured old value is matched as well as the key.
+func rowMatch(entry *wal.WALEntry, strict bool) map[string]interface{} {
+	key := entry.OldKey()
+	if key == nil {
+		return entry.OldData
+	}
+	if !strict {
+		return key
+	}
+
+	match := make(map[string]interface{}, len(entry.OldData)+len(key))
+	for col, v := range entry.OldData {
+		match[col] = v
+	}
+	for col, v := range key {
+		match[col] = v
+	}
+	return match
+}
+
+func tableName(target Target, entry *wal.WALEntry) (string, error) {
+	if entry.Table == "" {
+		return "", fmt.Errorf("entry %s has no table name", entry.ID)
+	}
+	if entry.Schema == "" {
+		return pgx.Identifier{entry.Table}.Sanitize(), nil
+	}
+	return pgx.Identifier{target.schemaFor(entry.Schema), entry.Table}.Sanitize(), nil
+}
+
+func buildInsert(b binder, target Target, entry *wal.WALEntry, row map[string]interface{}) (string, error) {
+	table, err := tableName(target, entry)
+	if err != nil {
+		return "", err
+	}
+	if len(row) == 0 {
+		return "", fmt.Errorf("entry %s has no row data", entry.ID)
+	}
+
+	columns := sortedColumns(row)
+	names := make([]string, len(columns))
+	values := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = pgx.Identifier{col}.Sanitize()
+		values[i] = b.bind(row[col], entry.ColumnTypes[col])
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		table, strings.Join(names, ", "), strings.Join(values, ", ")), nil
+}
+
+func buildUpdate(b binder, target Target, entry *wal.WALEntry, row, match map[string]interface{}) (string, error) {
+	table, err := tableName(target, entry)
+	if err != nil {
+		return "", err
+	}
+	if len(row) == 0 {
+		return "", fmt.Errorf("entry %s has no row data", entry.ID)
+	}
+
+	columns := sortedColumns(row)
+	sets := make([]string, len(columns))
+	for i, col := range columns {
+		sets[i] = pgx.Identifier{col}.Sanitize() + " = " + b.bind(row[col], entry.ColumnTypes[col])
+	}
+
+	where, err := whereClause(b, entry, match)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(sets, ", "), oneRow(table, entry, where)), nil
+}
+
+func buildDelete(b binder, target Target, entry *wal.WALEntry, match map[string]interface{}) (string, error) {
+	table, err := tableName(target, entry)
+	if err != nil {
+		return "", err
+	}
+
+	where, err := whereClause(b, entry, match)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", table, oneRow(table, entry, where)), nil
+}
+
+// oneRow narrows where to a single row for tables without a key, whose
+// rows are matched on every column: a table may hold several copies of
+// the row, and a captured change applies to one of them only.
+func oneRow(table string, entry *wal.WALEntry, where string) string {
+	if entry.OldKey() != nil {
+		return where
+	}
+	return fmt.Sprintf("ctid = (SELECT ctid FROM %s WHERE %s LIMIT 1)", table, where)
+}
+
+// textEquality holds the types without an equality operator, or whose
+// equality is not identity (box compares areas). Values of these types
+// are compared as text.
+var textEquality = map[string]bool{
+	"json": true, "xml": true, "point": true, "line": true, "lseg": true,
+	"box": true, "path": true, "polygon": true, "circle": true,
+}
+
+// whereClause matches a row on the given column values. NULL values are
+// matched with IS NULL, and values of types in textEquality by their text.
+func whereClause(b binder, entry *wal.WALEntry, match map[string]interface{}) (string, error) {
+	if len(match) == 0 {
+		return "", fmt.Errorf("entry %s has no key columns or old row to identify the row", entry.ID)
+	}
+
+	columns := sortedColumns(match)
+	conds := make([]string, len(columns))
+	for i, col := range columns {
+		name := pgx.Identifier{col}.Sanitize()
+		if match[col] == nil {
+			conds[i] = name + " IS NULL"
+			continue
+		}
+		typ := entry.ColumnTypes[col]
+		if textEquality[strings.TrimSuffix(typ, "[]")] {
+			conds[i] = name + "::text = " + b.bind(match[col], "text")
+			continue
+		}
+		conds[i] = name + " = " + b.bind(match[col], typ)
+	}
+
+	return strings.Join(conds, " AND "), nil
+}
+
+func sortedColumns(row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	for col := range row {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// onConflictUpdate returns an ON CONFLICT clause for an INSERT of row that
+// overwrites the other columns of an existing row with the same key.
+func onConflictUpdate(entry *wal.WALEntry, row map[string]interface{}) (string, error) {
+	if len(entry.KeyColumns) == 0 {
+		return "", fmt.Errorf("upsert requires key columns, but none were captured for %s", entry.Table)
+	}
+
+	keys := make([]string, len(entry.KeyColumns))
+	isKey := make(map[string]bool, len(entry.KeyColumns))
+	for i, col := range entry.KeyColumns {
+		keys[i] = pgx.Identifier{col}.Sanitize()
+		isKey[col] = true
+	}
+
+	sets := make([]string, 0, len(row))
+	for _, col := range sortedColumns(row) {
+		if isKey[col] {
+			continue
+		}
+		name := pgx.Identifier{col}.Sanitize()
+		sets = append(sets, name+" = EXCLUDED."+name)
+	}
+
+	if len(sets) == 0 {
+		return fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", ")), nil
+	}
+	return fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(sets, ", ")), nil
+}
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/wal"
+)
+
+func TestBuildStatement(t *testing.T) {
+	types := map[string]string{"id": "integer", "status": "text", "note": "text"}
+
+	tests := []struct {
+		name  string
+		entry *wal.WALEntry
+		sql   string
+		args  []interface{}
+	}{
+		{
+			name: "insert",
+			entry: &wal.WALEntry{Operation: wal.OpInsert, Schema: "public", Table: "orders", KeyColumns: []string{"id"}, ColumnTypes: types,
+				Data: map[string]interface{}{"status": "new", "id": "1", "note": nil}},
+			sql:  `INSERT INTO "public"."orders" ("id", "note", "status") VALUES ($1::integer, $2::text, $3::text)`,
+			args: []interface{}{"1", nil, "new"},
+		},
+		{
+			name: "update by key",
+			entry: &wal.WALEntry{Operation: wal.OpUpdate, Schema: "public", Table: "orders", KeyColumns: []string{"id"}, ColumnTypes: types,
+				Data: map[string]interface{}{"id": "1", "status": "paid"}},
+			sql:  `UPDATE "public"."orders" SET "id" = $1::integer, "status" = $2::text WHERE "id" = $3::integer`,
+			args: []interface{}{"1", "paid", "1"},
+		},
+		{
+			name: "delete by full old row",
+			entry: &wal.WALEntry{Operation: wal.OpDelete, Schema: "public", Table: "orders",
+				OldData: map[string]interface{}{"id": "1", "note": nil}},
+			sql:  `DELETE FROM "public"."orders" WHERE ctid = (SELECT ctid FROM "public"."orders" WHERE "id" = $1 AND "note" IS NULL LIMIT 1)`,
+			args: []interface{}{"1"},
+		},
+		{
+			name: "update by full old row with json",
+			entry: &wal.WALEntry{Operation: wal.OpUpdate, Schema: "public", Table: "events",
+				ColumnTypes: map[string]string{"payload": "json", "at": "point[]"},
+				Data:        map[string]interface{}{"payload": `{"a":2}`},
+				OldData:     map[string]interface{}{"payload": `{"a":1}`, "at": "{}"}},
+			sql:  `UPDATE "public"."events" SET "payload" = $1::json WHERE ctid = (SELECT ctid FROM "public"."events" WHERE "at"::text = $2::text AND "payload"::text = $3::text LIMIT 1)`,
+			args: []interface{}{`{"a":2}`, "{}", `{"a":1}`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &paramBinder{}
+			sql, err := buildStatement(params, Target{}, tt.entry)
+			if err != nil {
+				t.Fatalf("Failed to build statement: %v", err)
+			}
+			if sql != tt.sql {
+				t.Errorf("Expected SQL\n%s\ngot\n%s", tt.sql, sql)
+			}
+			if len(params.args) != len(tt.args) {
+				t.Fatalf("Expected %d args, got %d", len(tt.args), len(params.args))
+			}
+			for i, want := range tt.args {
+				got := params.args[i]
+				if want == nil {
+					if got != nil {
+						t.Errorf("Expected arg %d to be NULL, got %q", i+1, got)
+					}
+					continue
+				}
+				if string(got) != want {
+					t.Errorf("Expected arg %d to be %q, got %q", i+1, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildStatement_SchemaMapping(t *testing.T) {
+	entry := &wal.WALEntry{Operation: wal.OpDelete, Schema: "public", Table: "orders", KeyColumns: []string{"id"},
+		OldData: map[string]interface{}{"id": "1"}}
+	target := Target{Schemas: map[string]string{"public": "ptr_cp_abc"}}
+
+	sql, err := buildStatement(&paramBinder{}, target, entry)
+	if err != nil {
+		t.Fatalf("Failed to build statement: %v", err)
+	}
+	if want := `DELETE FROM "ptr_cp_abc"."orders" WHERE "id" = $1`; sql != want {
+		t.Errorf("Expected %s, got %s", want, sql)
+	}
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltOpenTimeout is how long BoltStore waits for another process to close
+// the database.
+const boltOpenTimeout = 10 * time.Second
+
+// BoltStore keeps the collections as buckets of an embedded bbolt
+// database, whose transactions are atomic across collections. bbolt lets
+// only one process open a database at a time, so the database is opened
+// for each operation and closed after it, letting the listener and the
+// server share it.
+type BoltStore struct {
+	path string
+}
+
+func NewBoltStore(path string) *BoltStore {
+	return &BoltStore{path: path}
+}
+
+func (s *BoltStore) open(readOnly bool) (*bolt.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metadata directory: %w", err)
+	}
+	if readOnly {
+		// A read-only open fails on a database that was never written.
+		if _, err := os.Stat(s.path); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: boltOpenTimeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metadata database %s: %w", s.path, err)
+	}
+	return db, nil
+}
+
+func (s *BoltStore) view(fn func(tx Tx) error) error {
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	if db == nil {
+		return fn(boltTx{})
+	}
+	defer db.Close()
+	return db.View(func(btx *bolt.Tx) error {
+		return fn(boltTx{tx: btx})
+	})
+}
+
+func (s *BoltStore) Get(collection, id string) ([]byte, error) {
+	var doc []byte
+	err := s.view(func(tx Tx) error {
+		var err error
+		doc, err = tx.Get(collection, id)
+		return err
+	})
+	return doc, err
+}
+
+func (s *BoltStore) List(collection string) (map[string][]byte, error) {
+	var docs map[string][]byte
+	err := s.view(func(tx Tx) error {
+		var err error
+		docs, err = tx.List(collection)
+		return err
+	})
+	return docs, err
+}
+
+// Version returns the version of the database file, which changes with
+// every collection.
+func (s *BoltStore) Version(collection string) (string, error) {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to stat metadata database %s: %w", s.path, err)
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(btx *bolt.Tx) error {
+		return fn(boltTx{tx: btx})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return nil
+}
+
+// boltTx is a transaction on the database, or on an empty store when tx
+// is nil.
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) bucket(collection string) *bolt.Bucket {
+	if t.tx == nil {
+		return nil
+	}
+	return t.tx.Bucket([]byte(collection))
+}
+
+func (t boltTx) Get(collection, id string) ([]byte, error) {
+	b := t.bucket(collection)
+	if b == nil {
+		return nil, notFound(collection, id)
+	}
+	doc := b.Get([]byte(id))
+	if doc == nil {
+		return nil, notFound(collection, id)
+	}
+	// Values are only valid for the life of the transaction.
+	return append([]byte(nil), doc...), nil
+}
+
+func (t boltTx) List(collection string) (map[string][]byte, error) {
+	docs := make(map[string][]byte)
+	b := t.bucket(collection)
+	if b == nil {
+		return docs, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		docs[string(k)] = append([]byte(nil), v...)
+		return nil
+	})
+	return docs, err
+}
+
+func (t boltTx) Put(collection, id string, doc []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(collection))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket %s: %w", collection, err)
+	}
+	return b.Put([]byte(id), doc)
+}
+
+func (t boltTx) Delete(collection, id string) error {
+	b := t.tx.Bucket([]byte(collection))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(id))
+}
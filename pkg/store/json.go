@@ -0,0 +1,392 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/persist"
+)
+
+// JSONStore keeps each collection in a JSON file: sessions.json in the
+// session path and checkpoints.json in the checkpoint path, the files
+// earlier versions wrote. Files are replaced atomically under a lock shared
+// with other processes. A transaction that changes both collections first
+// writes them together to pending.json in the checkpoint path, which
+// commits it, then writes each file and removes pending.json. A pending
+// transaction left by a process that stopped in between is rolled forward
+// by the next one to use the store.
+type JSONStore struct {
+	collections map[string]*jsonCollection
+	pending     *persist.File
+	mutex       sync.Mutex
+}
+
+type jsonCollection struct {
+	file *persist.File
+	// field names the object holding the documents in a file that holds
+	// other data too. The documents are the whole file when it is empty.
+	field string
+	docs  map[string]json.RawMessage
+	other map[string]json.RawMessage
+}
+
+func NewJSONStore(cfg *config.Config) *JSONStore {
+	return &JSONStore{
+		collections: map[string]*jsonCollection{
+			Sessions: {
+				file:  persist.NewFile(filepath.Join(cfg.Storage.SessionPath, "sessions.json"), cfg.Storage.JournalSize),
+				field: "sessions",
+			},
+			Checkpoints: {
+				file: persist.NewFile(filepath.Join(cfg.Storage.CheckpointPath, "checkpoints.json"), cfg.Storage.JournalSize),
+			},
+		},
+		pending: persist.NewFile(filepath.Join(cfg.Storage.CheckpointPath, "pending.json"), 0),
+	}
+}
+
+// File returns the file a collection is kept in, for recovering earlier
+// versions from its journal.
+func (s *JSONStore) File(collection string) (*persist.File, error) {
+	c, err := s.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	return c.file, nil
+}
+
+func (s *JSONStore) collection(name string) (*jsonCollection, error) {
+	c, ok := s.collections[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown collection %s", name)
+	}
+	return c, nil
+}
+
+// load reads a collection unless it is unchanged since it was last read.
+// The caller must hold the mutex.
+func (c *jsonCollection) load() error {
+	if c.docs != nil {
+		if changed, err := c.file.Changed(); err != nil || !changed {
+			return err
+		}
+	}
+
+	var top map[string]json.RawMessage
+	loaded, err := c.file.Load(&top)
+	if err != nil {
+		return err
+	}
+
+	c.docs = make(map[string]json.RawMessage)
+	c.other = make(map[string]json.RawMessage)
+	if !loaded || top == nil {
+		return nil
+	}
+	if c.field == "" {
+		c.docs = top
+		return nil
+	}
+
+	if raw, ok := top[c.field]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &c.docs); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", c.field, err)
+		}
+	}
+	delete(top, c.field)
+	c.other = top
+	return nil
+}
+
+// encode returns the content of the collection's file holding docs.
+func (c *jsonCollection) encode(docs map[string]json.RawMessage) (json.RawMessage, error) {
+	if c.field == "" {
+		data, err := json.Marshal(docs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", filepath.Base(c.file.Path()), err)
+		}
+		return data, nil
+	}
+
+	top := make(map[string]json.RawMessage, len(c.other)+1)
+	for key, value := range c.other {
+		top[key] = value
+	}
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", c.field, err)
+	}
+	top[c.field] = data
+	if data, err = json.Marshal(top); err != nil {
+		return nil, fmt.Errorf("failed to encode %s: %w", filepath.Base(c.file.Path()), err)
+	}
+	return data, nil
+}
+
+// lock takes the lock of every file, in a fixed order so that two
+// processes cannot deadlock, and rolls a pending transaction forward. The
+// caller must hold the mutex.
+func (s *JSONStore) lock() ([]string, func(), error) {
+	names := make([]string, 0, len(s.collections))
+	for name := range s.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	unlocks := make([]func(), 0, len(names))
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, name := range names {
+		release, err := s.collections[name].file.Lock()
+		if err != nil {
+			unlock()
+			return nil, nil, err
+		}
+		unlocks = append(unlocks, release)
+	}
+
+	if err := s.rollForward(); err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return names, unlock, nil
+}
+
+// rollForward writes the collections of a pending transaction and removes
+// it. The caller must hold the locks.
+func (s *JSONStore) rollForward() error {
+	var files map[string]json.RawMessage
+	loaded, err := s.pending.Load(&files)
+	if err != nil || !loaded {
+		return err
+	}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, err := s.collection(name)
+		if err != nil {
+			return fmt.Errorf("failed to roll forward pending transaction: %w", err)
+		}
+		// Read the file again next time, whether it was written or not.
+		c.docs = nil
+		if err := c.file.Save(files[name]); err != nil {
+			return fmt.Errorf("failed to roll forward pending transaction: %w", err)
+		}
+	}
+	return s.pending.Remove()
+}
+
+// recover rolls forward a transaction that is still pending, so that
+// readers do not see it half written. The caller must hold the mutex.
+func (s *JSONStore) recover() error {
+	if _, err := os.Stat(s.pending.Path()); os.IsNotExist(err) {
+		return nil
+	}
+	_, unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	unlock()
+	return nil
+}
+
+// Version returns the version of the collection's file.
+func (s *JSONStore) Version(collection string) (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.recover(); err != nil {
+		return "", err
+	}
+	c, err := s.collection(collection)
+	if err != nil {
+		return "", err
+	}
+	return c.file.Version()
+}
+
+func (s *JSONStore) Get(collection, id string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	c, err := s.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	doc, ok := c.docs[id]
+	if !ok {
+		return nil, notFound(collection, id)
+	}
+	return doc, nil
+}
+
+func (s *JSONStore) List(collection string) (map[string][]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	c, err := s.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	docs := make(map[string][]byte, len(c.docs))
+	for id, doc := range c.docs {
+		docs[id] = doc
+	}
+	return docs, nil
+}
+
+// Update locks every file and writes the collections fn changed. Changes
+// to more than one collection go through pending.json.
+func (s *JSONStore) Update(fn func(tx Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names, unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tx := &jsonTx{store: s, docs: make(map[string]map[string]json.RawMessage), dirty: make(map[string]bool)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	files := make(map[string]json.RawMessage)
+	for _, name := range names {
+		if !tx.dirty[name] {
+			continue
+		}
+		data, err := s.collections[name].encode(tx.docs[name])
+		if err != nil {
+			return err
+		}
+		files[name] = data
+	}
+	if len(files) > 1 {
+		if err := s.pending.Save(files); err != nil {
+			return fmt.Errorf("failed to write pending transaction: %w", err)
+		}
+		// The transaction is committed: a failure from here on leaves it
+		// pending for the next process to roll forward.
+		if err := s.rollForward(); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		return nil
+	}
+
+	for name, data := range files {
+		c := s.collections[name]
+		if err := c.file.Save(data); err != nil {
+			// The file was not replaced, so read it again next time.
+			c.docs = nil
+			return err
+		}
+		c.docs = tx.docs[name]
+	}
+	return nil
+}
+
+func (s *JSONStore) Close() error {
+	return nil
+}
+
+// jsonTx works on copies of the collections, which Update writes when the
+// transaction succeeds.
+type jsonTx struct {
+	store *JSONStore
+	docs  map[string]map[string]json.RawMessage
+	dirty map[string]bool
+}
+
+func (tx *jsonTx) collection(name string) (map[string]json.RawMessage, error) {
+	if docs, ok := tx.docs[name]; ok {
+		return docs, nil
+	}
+
+	c, err := tx.store.collection(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	docs := make(map[string]json.RawMessage, len(c.docs))
+	for id, doc := range c.docs {
+		docs[id] = doc
+	}
+	tx.docs[name] = docs
+	return docs, nil
+}
+
+func (tx *jsonTx) Get(collection, id string) ([]byte, error) {
+	docs, err := tx.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := docs[id]
+	if !ok {
+		return nil, notFound(collection, id)
+	}
+	return doc, nil
+}
+
+func (tx *jsonTx) List(collection string) (map[string][]byte, error) {
+	docs, err := tx.collection(collection)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string][]byte, len(docs))
+	for id, doc := range docs {
+		list[id] = doc
+	}
+	return list, nil
+}
+
+func (tx *jsonTx) Put(collection, id string, doc []byte) error {
+	docs, err := tx.collection(collection)
+	if err != nil {
+		return err
+	}
+	if !json.Valid(doc) {
+		return fmt.Errorf("document %s in %s is not valid JSON", id, collection)
+	}
+	docs[id] = append(json.RawMessage(nil), doc...)
+	tx.dirty[collection] = true
+	return nil
+}
+
+func (tx *jsonTx) Delete(collection, id string) error {
+	docs, err := tx.collection(collection)
+	if err != nil {
+		return err
+	}
+	delete(docs, id)
+	tx.dirty[collection] = true
+	return nil
+}
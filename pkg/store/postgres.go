@@ -0,0 +1,204 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore keeps the collections in a table of a Postgres schema, so
+// that developers whose machines point at the same control database share
+// their sessions and checkpoints. Transactions take an advisory lock, so
+// that changes from different machines are applied one at a time.
+type PostgresStore struct {
+	pool   *pgxpool.Pool
+	schema string
+	table  string
+	// ready is set once the schema and table exist.
+	ready bool
+	mutex sync.Mutex
+}
+
+// NewPostgresStore returns a store in schema of the database at dsn. It
+// connects, and creates the schema and table, on first use.
+func NewPostgresStore(dsn, schema string) (*PostgresStore, error) {
+	if schema == "" {
+		schema = "postgres_test_replay"
+	}
+	poolConfig, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata DSN: %w", err)
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata connection pool: %w", err)
+	}
+	return &PostgresStore{
+		pool:   pool,
+		schema: schema,
+		table:  pgx.Identifier{schema, "metadata"}.Sanitize(),
+	}, nil
+}
+
+// init creates the schema and table if they do not exist yet.
+func (s *PostgresStore) init(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.ready {
+		return nil
+	}
+
+	stmts := []string{
+		fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pgx.Identifier{s.schema}.Sanitize()),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			collection text NOT NULL,
+			id text NOT NULL,
+			doc jsonb NOT NULL,
+			updated_at timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY (collection, id)
+		)`, s.table),
+	}
+	for _, stmt := range stmts {
+		if _, err := s.pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create metadata table: %w", err)
+		}
+	}
+	s.ready = true
+	return nil
+}
+
+func (s *PostgresStore) Get(collection, id string) ([]byte, error) {
+	ctx := context.Background()
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	return pgTx{q: s.pool, table: s.table}.Get(collection, id)
+}
+
+func (s *PostgresStore) List(collection string) (map[string][]byte, error) {
+	ctx := context.Background()
+	if err := s.init(ctx); err != nil {
+		return nil, err
+	}
+	return pgTx{q: s.pool, table: s.table}.List(collection)
+}
+
+// Version returns the number of documents in the collection and when the
+// last one was written, which change with every write and delete.
+func (s *PostgresStore) Version(collection string) (string, error) {
+	ctx := context.Background()
+	if err := s.init(ctx); err != nil {
+		return "", err
+	}
+	var version string
+	err := s.pool.QueryRow(ctx,
+		fmt.Sprintf("SELECT count(*) || '-' || coalesce(max(updated_at)::text, '') FROM %s WHERE collection = $1", s.table),
+		collection).Scan(&version)
+	if err != nil {
+		return "", fmt.Errorf("failed to read version of %s: %w", collection, err)
+	}
+	return version, nil
+}
+
+func (s *PostgresStore) Update(fn func(tx Tx) error) error {
+	ctx := context.Background()
+	if err := s.init(ctx); err != nil {
+		return err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", s.table); err != nil {
+		return fmt.Errorf("failed to lock metadata: %w", err)
+	}
+	if err := fn(pgTx{q: tx, table: s.table}); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit metadata: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+// querier is what pgTx needs of a pool or a transaction.
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type pgTx struct {
+	q     querier
+	table string
+}
+
+func (t pgTx) Get(collection, id string) ([]byte, error) {
+	var doc []byte
+	err := t.q.QueryRow(context.Background(),
+		fmt.Sprintf("SELECT doc::text FROM %s WHERE collection = $1 AND id = $2", t.table),
+		collection, id).Scan(&doc)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, notFound(collection, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s %s: %w", collection, id, err)
+	}
+	return doc, nil
+}
+
+func (t pgTx) List(collection string) (map[string][]byte, error) {
+	rows, err := t.q.Query(context.Background(),
+		fmt.Sprintf("SELECT id, doc::text FROM %s WHERE collection = $1", t.table), collection)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", collection, err)
+	}
+	defer rows.Close()
+
+	docs := make(map[string][]byte)
+	for rows.Next() {
+		var id string
+		var doc []byte
+		if err := rows.Scan(&id, &doc); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", collection, err)
+		}
+		docs[id] = doc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", collection, err)
+	}
+	return docs, nil
+}
+
+func (t pgTx) Put(collection, id string, doc []byte) error {
+	_, err := t.q.Exec(context.Background(), fmt.Sprintf(
+		`INSERT INTO %s (collection, id, doc) VALUES ($1, $2, $3::jsonb)
+		ON CONFLICT (collection, id) DO UPDATE SET doc = EXCLUDED.doc, updated_at = now()`, t.table),
+		collection, id, string(doc))
+	if err != nil {
+		return fmt.Errorf("failed to write %s %s: %w", collection, id, err)
+	}
+	return nil
+}
+
+func (t pgTx) Delete(collection, id string) error {
+	_, err := t.q.Exec(context.Background(),
+		fmt.Sprintf("DELETE FROM %s WHERE collection = $1 AND id = $2", t.table), collection, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s %s: %w", collection, id, err)
+	}
+	return nil
+}
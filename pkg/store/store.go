@@ -0,0 +1,81 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+)
+
+// Collections of documents kept in a store.
+const (
+	Sessions    = "sessions"
+	Checkpoints = "checkpoints"
+)
+
+// Kinds of store, set with METADATA_STORE.
+const (
+	KindJSON     = "json"
+	KindBolt     = "bolt"
+	KindPostgres = "postgres"
+)
+
+// ErrNotFound is returned for a document that is not in the store.
+var ErrNotFound = errors.New("not found")
+
+// Store keeps the metadata of sessions and checkpoints as JSON documents,
+// by collection and ID. Every implementation may be shared by several
+// processes, so callers should not cache what they read.
+type Store interface {
+	Reader
+	// Update runs fn in a transaction. Its changes are made all at once
+	// when fn returns nil and not at all when it returns an error, and no
+	// other process changes the store while it runs.
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Reader reads documents from a store or within a transaction.
+type Reader interface {
+	// Get returns the document with the given ID, or ErrNotFound.
+	Get(collection, id string) ([]byte, error)
+	// List returns every document of a collection by ID.
+	List(collection string) (map[string][]byte, error)
+}
+
+// Versioned is implemented by stores that can tell cheaply whether a
+// collection changed, so that a reader polling it need not read every
+// document each time.
+type Versioned interface {
+	// Version returns a value that changes whenever the collection does.
+	Version(collection string) (string, error)
+}
+
+// Tx reads and changes a store within Store.Update.
+type Tx interface {
+	Reader
+	Put(collection, id string, doc []byte) error
+	Delete(collection, id string) error
+}
+
+// New returns the store selected by the configuration. It does not
+// connect yet, so it only fails for an invalid configuration.
+func New(cfg *config.Config) (Store, error) {
+	switch cfg.Metadata.Store {
+	case "", KindJSON:
+		return NewJSONStore(cfg), nil
+	case KindBolt:
+		return NewBoltStore(cfg.Metadata.Path), nil
+	case KindPostgres:
+		dsn := cfg.Metadata.DSN
+		if dsn == "" {
+			dsn = cfg.PrimaryDB.ToDSN()
+		}
+		return NewPostgresStore(dsn, cfg.Metadata.Schema)
+	}
+	return nil, fmt.Errorf("unknown metadata store %q: use json, bolt or postgres", cfg.Metadata.Store)
+}
+
+func notFound(collection, id string) error {
+	return fmt.Errorf("%s %s: %w", collection, id, ErrNotFound)
+}
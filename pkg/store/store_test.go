@@ -0,0 +1,175 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+)
+
+func testConfig(t *testing.T) *config.Config {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	cfg := config.DefaultConfig()
+	cfg.Storage.SessionPath = filepath.Join(tmpDir, "sessions")
+	cfg.Storage.CheckpointPath = filepath.Join(tmpDir, "checkpoints")
+	cfg.Metadata.Path = filepath.Join(tmpDir, "metadata.db")
+	return cfg
+}
+
+// testStore runs the checks every store must pass.
+func testStore(t *testing.T, s Store) {
+	t.Helper()
+
+	if _, err := s.Get(Sessions, "s1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound from an empty store, got %v", err)
+	}
+	if docs, err := s.List(Checkpoints); err != nil || len(docs) != 0 {
+		t.Errorf("Expected no documents, got %v, %v", docs, err)
+	}
+
+	versioned, _ := s.(Versioned)
+	var before string
+	if versioned != nil {
+		before, _ = versioned.Version(Sessions)
+	}
+
+	err := s.Update(func(tx Tx) error {
+		if err := tx.Put(Sessions, "s1", []byte(`{"id":"s1"}`)); err != nil {
+			return err
+		}
+		if err := tx.Put(Checkpoints, "c1", []byte(`{"id":"c1"}`)); err != nil {
+			return err
+		}
+		// Changes are visible within the transaction.
+		if _, err := tx.Get(Checkpoints, "c1"); err != nil {
+			return err
+		}
+		return tx.Put(Checkpoints, "c2", []byte(`{"id":"c2"}`))
+	})
+	if err != nil {
+		t.Fatalf("Failed to update store: %v", err)
+	}
+
+	if versioned != nil {
+		if after, err := versioned.Version(Sessions); err != nil || after == before {
+			t.Errorf("Expected the version of sessions to change, got %q, %v", after, err)
+		}
+	}
+
+	doc, err := s.Get(Sessions, "s1")
+	if err != nil || !strings.Contains(string(doc), `"s1"`) {
+		t.Errorf("Expected session s1, got %s, %v", doc, err)
+	}
+	if docs, err := s.List(Checkpoints); err != nil || len(docs) != 2 {
+		t.Errorf("Expected 2 checkpoints, got %d, %v", len(docs), err)
+	}
+
+	// A failed transaction changes nothing.
+	failure := errors.New("failure")
+	err = s.Update(func(tx Tx) error {
+		if err := tx.Delete(Checkpoints, "c1"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected the transaction's error, got %v", err)
+	}
+	if _, err := s.Get(Checkpoints, "c1"); err != nil {
+		t.Errorf("Expected c1 to survive a failed transaction, got %v", err)
+	}
+
+	if err := s.Update(func(tx Tx) error { return tx.Delete(Checkpoints, "c1") }); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	if _, err := s.Get(Checkpoints, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected c1 to be deleted, got %v", err)
+	}
+}
+
+func TestJSONStore(t *testing.T) {
+	testStore(t, NewJSONStore(testConfig(t)))
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, NewBoltStore(testConfig(t).Metadata.Path))
+}
+
+func TestJSONStore_ReadsEarlierFiles(t *testing.T) {
+	cfg := testConfig(t)
+	if err := os.MkdirAll(cfg.Storage.SessionPath, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	legacy := `{"sessions": {"s1": {"id": "s1", "active": true}}, "active": "s1"}`
+	filename := filepath.Join(cfg.Storage.SessionPath, "sessions.json")
+	if err := os.WriteFile(filename, []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write sessions: %v", err)
+	}
+
+	s := NewJSONStore(cfg)
+	if _, err := s.Get(Sessions, "s1"); err != nil {
+		t.Fatalf("Expected session s1, got %v", err)
+	}
+
+	if err := s.Update(func(tx Tx) error { return tx.Put(Sessions, "s2", []byte(`{"id":"s2"}`)) }); err != nil {
+		t.Fatalf("Failed to update store: %v", err)
+	}
+	data, _ := os.ReadFile(filename)
+	if !strings.Contains(string(data), `"active": "s1"`) || !strings.Contains(string(data), `"s2"`) {
+		t.Errorf("Expected the file layout to be kept, got %s", data)
+	}
+}
+
+func TestJSONStore_RollsForwardPendingTransaction(t *testing.T) {
+	cfg := testConfig(t)
+	s := NewJSONStore(cfg)
+	if err := s.Update(func(tx Tx) error { return tx.Put(Sessions, "s1", []byte(`{"id":"s1"}`)) }); err != nil {
+		t.Fatalf("Failed to update store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Storage.CheckpointPath, "pending.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected no pending transaction after an update, got %v", err)
+	}
+
+	// A process that stopped after committing a transaction to both
+	// collections, before writing the files.
+	pending := `{"checkpoints": {"c1": {"id": "c1"}}, "sessions": {"sessions": {"s1": {"id": "s1", "checkpoints": ["c1"]}}}}`
+	if err := os.MkdirAll(cfg.Storage.CheckpointPath, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Storage.CheckpointPath, "pending.json"), []byte(pending), 0644); err != nil {
+		t.Fatalf("Failed to write pending transaction: %v", err)
+	}
+
+	s = NewJSONStore(cfg)
+	if _, err := s.Get(Checkpoints, "c1"); err != nil {
+		t.Errorf("Expected the pending checkpoint, got %v", err)
+	}
+	doc, err := s.Get(Sessions, "s1")
+	if err != nil || !strings.Contains(string(doc), "c1") {
+		t.Errorf("Expected the pending session, got %s, %v", doc, err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Storage.CheckpointPath, "pending.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected the pending transaction to be removed, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	cfg := testConfig(t)
+
+	cfg.Metadata.Store = KindBolt
+	if s, err := New(cfg); err != nil {
+		t.Errorf("Expected a bolt store, got %v", err)
+	} else if _, ok := s.(*BoltStore); !ok {
+		t.Errorf("Expected a bolt store, got %T", s)
+	}
+
+	cfg.Metadata.Store = "etcd"
+	if _, err := New(cfg); err == nil {
+		t.Error("Expected error for an unknown store")
+	}
+}
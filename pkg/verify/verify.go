@@ -0,0 +1,417 @@
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/ivikasavnish/postgres-test-replay/pkg/config"
+	"github.com/ivikasavnish/postgres-test-replay/pkg/materialize"
+)
+
+// ErrMismatch is returned by Report.Err when the databases differ.
+var ErrMismatch = errors.New("databases differ")
+
+// DefaultMaxRows is how many keys are listed per kind of row difference
+// when Options.MaxRows is not set.
+const DefaultMaxRows = 100
+
+// Side is one of the two databases being compared.
+type Side struct {
+	Label string `json:"label"`
+	DSN   string `json:"-"`
+	// Schemas maps schema names as compared to the schema names on this
+	// side, for example public to the schema of a materialized checkpoint.
+	// When set, only the mapped schemas are compared.
+	Schemas map[string]string `json:"schemas,omitempty"`
+}
+
+func (s Side) schemaFor(schema string) string {
+	if mapped, ok := s.Schemas[schema]; ok {
+		return mapped
+	}
+	return schema
+}
+
+type Options struct {
+	// Tables limits the comparison to these tables, named as schema.table
+	// or table. Every user table of the source is compared when empty.
+	Tables []string `json:"tables,omitempty"`
+	// MaxRows caps the keys listed per kind of difference.
+	MaxRows int `json:"max_rows,omitempty"`
+}
+
+// TableReport compares one table. Row-level differences are only listed
+// for tables with a primary key.
+type TableReport struct {
+	Schema        string              `json:"schema"`
+	Table         string              `json:"table"`
+	Match         bool                `json:"match"`
+	SourceRows    int64               `json:"source_rows"`
+	TargetRows    int64               `json:"target_rows"`
+	SourceHash    string              `json:"source_hash"`
+	TargetHash    string              `json:"target_hash"`
+	KeyColumns    []string            `json:"key_columns,omitempty"`
+	Missing       int                 `json:"missing"`
+	Extra         int                 `json:"extra"`
+	Differing     int                 `json:"differing"`
+	MissingKeys   []map[string]string `json:"missing_keys,omitempty"`
+	ExtraKeys     []map[string]string `json:"extra_keys,omitempty"`
+	DifferingKeys []map[string]string `json:"differing_keys,omitempty"`
+	Error         string              `json:"error,omitempty"`
+}
+
+// Report is the outcome of comparing two databases. Missing rows exist in
+// the source but not the target; extra rows exist only in the target.
+type Report struct {
+	Source    Side          `json:"source"`
+	Target    Side          `json:"target"`
+	Match     bool          `json:"match"`
+	Tables    []TableReport `json:"tables"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+// Mismatched returns the tables that differ.
+func (r *Report) Mismatched() []TableReport {
+	tables := make([]TableReport, 0)
+	for _, t := range r.Tables {
+		if !t.Match {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// Err returns ErrMismatch, naming the first differing table, when the
+// databases differ.
+func (r *Report) Err() error {
+	mismatched := r.Mismatched()
+	if len(mismatched) == 0 {
+		return nil
+	}
+	first := mismatched[0]
+	reason := first.Error
+	if reason == "" {
+		reason = fmt.Sprintf("%d missing, %d extra, %d differing rows", first.Missing, first.Extra, first.Differing)
+	}
+	return fmt.Errorf("%w: %d of %d tables, first %s.%s: %s",
+		ErrMismatch, len(mismatched), len(r.Tables), first.Schema, first.Table, reason)
+}
+
+// Verifier compares the contents of two databases table by table, using
+// row counts and order-independent content hashes computed on the server.
+type Verifier struct {
+	config *config.Config
+}
+
+func NewVerifier(cfg *config.Config) *Verifier {
+	return &Verifier{
+		config: cfg,
+	}
+}
+
+// Primary returns the side for the configured primary database.
+func (v *Verifier) Primary() Side {
+	return Side{Label: "primary", DSN: v.config.PrimaryDB.ToDSN()}
+}
+
+// Replica returns the side for the configured replica database.
+func (v *Verifier) Replica() Side {
+	return Side{Label: "replica", DSN: v.config.ReplicaDB.ToDSN()}
+}
+
+// Materialized returns the side for a copy made by the materializer. A
+// schema copy holds the tables of sourceSchema, public when empty, so
+// only that schema is compared.
+func (v *Verifier) Materialized(m *materialize.Materializer, kind materialize.Kind, name, sourceSchema string) Side {
+	side := Side{Label: string(kind) + " " + name, DSN: m.DSN(kind, name)}
+	if kind == materialize.KindSchema {
+		if sourceSchema == "" {
+			sourceSchema = "public"
+		}
+		side.Schemas = map[string]string{sourceSchema: name}
+	}
+	return side
+}
+
+type tableName struct {
+	schema, table string
+}
+
+// Compare checks every table of source against target.
+func (v *Verifier) Compare(ctx context.Context, source, target Side, opts Options) (*Report, error) {
+	if opts.MaxRows <= 0 {
+		opts.MaxRows = DefaultMaxRows
+	}
+
+	src, err := pgx.Connect(ctx, source.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", source.Label, err)
+	}
+	defer src.Close(context.Background())
+
+	dst, err := pgx.Connect(ctx, target.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", target.Label, err)
+	}
+	defer dst.Close(context.Background())
+
+	tables, err := listTables(ctx, src, source, opts.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Source:    source,
+		Target:    target,
+		Match:     true,
+		Tables:    make([]TableReport, 0, len(tables)),
+		CheckedAt: time.Now(),
+	}
+
+	for _, t := range tables {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		tr := compareTable(ctx, src, dst, source, target, t, opts.MaxRows)
+		if !tr.Match {
+			report.Match = false
+		}
+		report.Tables = append(report.Tables, tr)
+	}
+
+	return report, nil
+}
+
+const tablesQuery = `SELECT n.nspname, c.relname
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p')
+  AND NOT c.relispartition
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg_toast%'
+ORDER BY 1, 2`
+
+// listTables returns the tables of the source side, named by their
+// compared schema.
+func listTables(ctx context.Context, conn *pgx.Conn, side Side, only []string) ([]tableName, error) {
+	compared := make(map[string]string, len(side.Schemas))
+	for name, actual := range side.Schemas {
+		compared[actual] = name
+	}
+
+	rows, err := conn.Query(ctx, tablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables on %s: %w", side.Label, err)
+	}
+	defer rows.Close()
+
+	tables := make([]tableName, 0)
+	for rows.Next() {
+		var t tableName
+		if err := rows.Scan(&t.schema, &t.table); err != nil {
+			return nil, err
+		}
+		if len(side.Schemas) > 0 {
+			name, ok := compared[t.schema]
+			if !ok {
+				continue
+			}
+			t.schema = name
+		}
+		if len(only) > 0 && !selected(only, t) {
+			continue
+		}
+		tables = append(tables, t)
+	}
+
+	return tables, rows.Err()
+}
+
+func selected(only []string, t tableName) bool {
+	for _, name := range only {
+		if name == t.table || name == t.schema+"."+t.table {
+			return true
+		}
+	}
+	return false
+}
+
+func compareTable(ctx context.Context, src, dst *pgx.Conn, source, target Side, t tableName, maxRows int) TableReport {
+	tr := TableReport{Schema: t.schema, Table: t.table}
+	srcTable := pgx.Identifier{source.schemaFor(t.schema), t.table}.Sanitize()
+	dstTable := pgx.Identifier{target.schemaFor(t.schema), t.table}.Sanitize()
+
+	var err error
+	if tr.SourceRows, tr.SourceHash, err = tableSummary(ctx, src, srcTable); err != nil {
+		tr.Error = fmt.Sprintf("%s: %v", source.Label, err)
+		return tr
+	}
+	if tr.TargetRows, tr.TargetHash, err = tableSummary(ctx, dst, dstTable); err != nil {
+		tr.Error = fmt.Sprintf("%s: %v", target.Label, err)
+		return tr
+	}
+
+	tr.Match = tr.SourceRows == tr.TargetRows && tr.SourceHash == tr.TargetHash
+	if tr.Match {
+		return tr
+	}
+
+	tr.KeyColumns, err = primaryKey(ctx, src, source.schemaFor(t.schema), t.table)
+	if err != nil {
+		tr.Error = fmt.Sprintf("%s: %v", source.Label, err)
+		return tr
+	}
+	if len(tr.KeyColumns) == 0 {
+		tr.Error = "no primary key; rows cannot be matched"
+		return tr
+	}
+
+	srcRows, err := rowHashes(ctx, src, srcTable, tr.KeyColumns)
+	if err != nil {
+		tr.Error = fmt.Sprintf("%s: %v", source.Label, err)
+		return tr
+	}
+	dstRows, err := rowHashes(ctx, dst, dstTable, tr.KeyColumns)
+	if err != nil {
+		tr.Error = fmt.Sprintf("%s: %v", target.Label, err)
+		return tr
+	}
+
+	diffRows(&tr, srcRows, dstRows, maxRows)
+	return tr
+}
+
+// tableSummary returns the row count and a hash of the table's contents
+// that does not depend on row order: the sum of a hash of every row.
+func tableSummary(ctx context.Context, conn *pgx.Conn, table string) (int64, string, error) {
+	query := fmt.Sprintf(`SELECT count(*), coalesce(sum(('x' || substr(md5(t::text), 1, 15))::bit(60)::bigint), 0)::text FROM %s t`, table)
+
+	var count int64
+	var hash string
+	if err := conn.QueryRow(ctx, query).Scan(&count, &hash); err != nil {
+		return 0, "", err
+	}
+	return count, hash, nil
+}
+
+const primaryKeyQuery = `SELECT a.attname
+FROM pg_index i
+JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+WHERE i.indrelid = $1::regclass AND i.indisprimary
+ORDER BY array_position(i.indkey, a.attnum)`
+
+func primaryKey(ctx context.Context, conn *pgx.Conn, schema, table string) ([]string, error) {
+	rows, err := conn.Query(ctx, primaryKeyQuery, pgx.Identifier{schema, table}.Sanitize())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		keys = append(keys, name)
+	}
+	return keys, rows.Err()
+}
+
+// keyedRow is a row's key values and content hash.
+type keyedRow struct {
+	key  []string
+	hash string
+}
+
+// keySeparator joins key values into a map key. It cannot appear in
+// PostgreSQL text values.
+const keySeparator = "\x00"
+
+func rowHashes(ctx context.Context, conn *pgx.Conn, table string, keyColumns []string) (map[string]keyedRow, error) {
+	cols := make([]string, len(keyColumns))
+	for i, col := range keyColumns {
+		cols[i] = "t." + pgx.Identifier{col}.Sanitize() + "::text"
+	}
+	query := fmt.Sprintf("SELECT %s, md5(t::text) FROM %s t", strings.Join(cols, ", "), table)
+
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]keyedRow)
+	for rows.Next() {
+		values := make([]interface{}, len(keyColumns)+1)
+		key := make([]*string, len(keyColumns))
+		for i := range key {
+			values[i] = &key[i]
+		}
+		var hash string
+		values[len(keyColumns)] = &hash
+
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+
+		row := keyedRow{key: make([]string, len(key)), hash: hash}
+		for i, v := range key {
+			if v != nil {
+				row.key[i] = *v
+			}
+		}
+		result[strings.Join(row.key, keySeparator)] = row
+	}
+	return result, rows.Err()
+}
+
+// diffRows fills the row-level differences of tr, listing at most maxRows
+// keys of each kind in key order.
+func diffRows(tr *TableReport, source, target map[string]keyedRow, maxRows int) {
+	var missing, extra, differing []string
+	for k, row := range source {
+		other, ok := target[k]
+		switch {
+		case !ok:
+			missing = append(missing, k)
+		case other.hash != row.hash:
+			differing = append(differing, k)
+		}
+	}
+	for k := range target {
+		if _, ok := source[k]; !ok {
+			extra = append(extra, k)
+		}
+	}
+
+	tr.Missing, tr.Extra, tr.Differing = len(missing), len(extra), len(differing)
+	tr.MissingKeys = keyMaps(tr.KeyColumns, missing, source, maxRows)
+	tr.ExtraKeys = keyMaps(tr.KeyColumns, extra, target, maxRows)
+	tr.DifferingKeys = keyMaps(tr.KeyColumns, differing, source, maxRows)
+}
+
+func keyMaps(columns, keys []string, rows map[string]keyedRow, maxRows int) []map[string]string {
+	sort.Strings(keys)
+	if len(keys) > maxRows {
+		keys = keys[:maxRows]
+	}
+
+	result := make([]map[string]string, 0, len(keys))
+	for _, k := range keys {
+		row := rows[k]
+		m := make(map[string]string, len(columns))
+		for i, col := range columns {
+			m[col] = row.key[i]
+		}
+		result = append(result, m)
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package verify
+
+import (
+	"errors"
+	"testing"
+)
+
+func keyed(hash string, key ...string) keyedRow {
+	return keyedRow{key: key, hash: hash}
+}
+
+func TestDiffRows(t *testing.T) {
+	source := map[string]keyedRow{
+		"1": keyed("a", "1"),
+		"2": keyed("b", "2"),
+		"3": keyed("c", "3"),
+		"4": keyed("d", "4"),
+	}
+	target := map[string]keyedRow{
+		"1": keyed("a", "1"),
+		"2": keyed("changed", "2"),
+		"5": keyed("e", "5"),
+	}
+
+	tr := TableReport{Table: "orders", KeyColumns: []string{"id"}}
+	diffRows(&tr, source, target, 1)
+
+	if tr.Missing != 2 || tr.Extra != 1 || tr.Differing != 1 {
+		t.Errorf("Expected 2 missing, 1 extra and 1 differing, got %d, %d and %d", tr.Missing, tr.Extra, tr.Differing)
+	}
+	if len(tr.MissingKeys) != 1 || tr.MissingKeys[0]["id"] != "3" {
+		t.Errorf("Expected missing keys capped to the first key 3, got %v", tr.MissingKeys)
+	}
+	if len(tr.ExtraKeys) != 1 || tr.ExtraKeys[0]["id"] != "5" {
+		t.Errorf("Expected extra key 5, got %v", tr.ExtraKeys)
+	}
+	if len(tr.DifferingKeys) != 1 || tr.DifferingKeys[0]["id"] != "2" {
+		t.Errorf("Expected differing key 2, got %v", tr.DifferingKeys)
+	}
+}
+
+func TestDiffRowsCompositeKey(t *testing.T) {
+	source := map[string]keyedRow{
+		"1" + keySeparator + "x": keyed("a", "1", "x"),
+	}
+	tr := TableReport{KeyColumns: []string{"order_id", "sku"}}
+	diffRows(&tr, source, map[string]keyedRow{}, DefaultMaxRows)
+
+	if len(tr.MissingKeys) != 1 {
+		t.Fatalf("Expected 1 missing key, got %d", len(tr.MissingKeys))
+	}
+	if key := tr.MissingKeys[0]; key["order_id"] != "1" || key["sku"] != "x" {
+		t.Errorf("Expected key order_id=1 sku=x, got %v", key)
+	}
+}
+
+func TestSelected(t *testing.T) {
+	orders := tableName{schema: "public", table: "orders"}
+
+	if !selected([]string{"orders"}, orders) {
+		t.Error("Expected bare table name to select the table")
+	}
+	if !selected([]string{"public.orders"}, orders) {
+		t.Error("Expected qualified name to select the table")
+	}
+	if selected([]string{"billing.orders"}, orders) {
+		t.Error("Expected table in another schema not to be selected")
+	}
+}
+
+func TestSideSchemaFor(t *testing.T) {
+	side := Side{Schemas: map[string]string{"public": "ptr_cp_abc"}}
+	if got := side.schemaFor("public"); got != "ptr_cp_abc" {
+		t.Errorf("Expected public to map to ptr_cp_abc, got %s", got)
+	}
+	if got := side.schemaFor("billing"); got != "billing" {
+		t.Errorf("Expected unmapped schema to be kept, got %s", got)
+	}
+}
+
+func TestReportErr(t *testing.T) {
+	report := &Report{Tables: []TableReport{
+		{Schema: "public", Table: "customers", Match: true},
+		{Schema: "public", Table: "orders", Missing: 2},
+	}}
+
+	err := report.Err()
+	if !errors.Is(err, ErrMismatch) {
+		t.Fatalf("Expected ErrMismatch, got %v", err)
+	}
+	if len(report.Mismatched()) != 1 {
+		t.Errorf("Expected 1 mismatched table, got %d", len(report.Mismatched()))
+	}
+
+	report.Tables[1].Match = true
+	if err := report.Err(); err != nil {
+		t.Errorf("Expected no error when all tables match, got %v", err)
+	}
+}
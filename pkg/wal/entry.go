@@ -15,16 +15,89 @@ const (
 )
 
 type WALEntry struct {
-	ID           string                 `json:"id"`
-	Timestamp    time.Time              `json:"timestamp"`
-	LSN          string                 `json:"lsn"`
-	Operation    OperationType          `json:"operation"`
-	Schema       string                 `json:"schema"`
-	Table        string                 `json:"table"`
-	Data         map[string]interface{} `json:"data"`
-	OldData      map[string]interface{} `json:"old_data,omitempty"`
-	SQL          string                 `json:"sql,omitempty"`
-	CheckpointID string                 `json:"checkpoint_id,omitempty"`
+	ID          string                 `json:"id"`
+	Timestamp   time.Time              `json:"timestamp"`
+	LSN         string                 `json:"lsn"`
+	CommitLSN   string                 `json:"commit_lsn,omitempty"`
+	Seq         int                    `json:"seq,omitempty"`
+	TxID        uint32                 `json:"xid,omitempty"`
+	Operation   OperationType          `json:"operation"`
+	Schema      string                 `json:"schema"`
+	Table       string                 `json:"table"`
+	KeyColumns  []string               `json:"key_columns,omitempty"`
+	ColumnTypes map[string]string      `json:"column_types,omitempty"`
+	Data        map[string]interface{} `json:"data"`
+	OldData     map[string]interface{} `json:"old_data,omitempty"`
+	SQL         string                 `json:"sql,omitempty"`
+	// CommitTime is when the entry's transaction committed on the source.
+	// Entries captured by earlier versions have none.
+	CommitTime *time.Time `json:"commit_time,omitempty"`
+	// SessionID is the session that was recording when the entry was
+	// captured, and CheckpointID that session's head: the checkpoint the
+	// change was made after.
+	SessionID    string `json:"session_id,omitempty"`
+	CheckpointID string `json:"checkpoint_id,omitempty"`
+	// Origin names the bundle an imported entry came from. Entries captured
+	// here have none.
+	Origin string `json:"origin,omitempty"`
+}
+
+// Committed returns when the entry's transaction committed on the source,
+// or when the entry was captured for entries without a commit time.
+func (w *WALEntry) Committed() time.Time {
+	if w.CommitTime != nil {
+		return *w.CommitTime
+	}
+	return w.Timestamp
+}
+
+// MergeRows overlays the columns of next on prev. Columns that were not
+// captured in next (for example unchanged TOAST values) keep their
+// previous value.
+func MergeRows(prev, next map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(prev)+len(next))
+	for col, v := range prev {
+		merged[col] = v
+	}
+	for col, v := range next {
+		merged[col] = v
+	}
+	return merged
+}
+
+// OldKey returns the key column values identifying the row before the
+// change: taken from OldData when it carries the key (updates and deletes),
+// otherwise from Data. It returns nil when the key columns are unknown.
+func (w *WALEntry) OldKey() map[string]interface{} {
+	if key := w.keyFrom(w.OldData); key != nil {
+		return key
+	}
+	return w.keyFrom(w.Data)
+}
+
+// NewKey returns the key column values identifying the row after the
+// change. It returns nil for deletes and when the key columns are unknown.
+func (w *WALEntry) NewKey() map[string]interface{} {
+	if w.Operation == OpDelete {
+		return nil
+	}
+	return w.keyFrom(w.Data)
+}
+
+func (w *WALEntry) keyFrom(row map[string]interface{}) map[string]interface{} {
+	if len(w.KeyColumns) == 0 || row == nil {
+		return nil
+	}
+
+	key := make(map[string]interface{}, len(w.KeyColumns))
+	for _, col := range w.KeyColumns {
+		v, ok := row[col]
+		if !ok {
+			return nil
+		}
+		key[col] = v
+	}
+	return key
 }
 
 func (w *WALEntry) ToJSON() ([]byte, error) {
@@ -0,0 +1,166 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FollowPollInterval is how often Follow checks the log directory for new
+// data once it has caught up.
+var FollowPollInterval = 200 * time.Millisecond
+
+// Position identifies a point in the WAL log: a log file and a byte offset
+// within it. The zero Position refers to the start of the oldest log file.
+type Position struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+}
+
+// End returns the position just past the last complete entry in the log,
+// so that following from it yields only entries written afterwards.
+func (lr *LogReader) End() (Position, error) {
+	files, err := lr.Files()
+	if err != nil {
+		return Position{}, err
+	}
+	if len(files) == 0 {
+		return Position{}, nil
+	}
+
+	last := files[len(files)-1]
+	data, err := os.ReadFile(last)
+	if err != nil {
+		return Position{}, fmt.Errorf("failed to read log file: %w", err)
+	}
+
+	return Position{File: last, Offset: int64(bytes.LastIndexByte(data, '\n') + 1)}, nil
+}
+
+// Follow yields entries as they are appended to the log, starting at from.
+// When a newer log file appears (the writer rotated), Follow finishes the
+// current file and continues with the next one. Both channels are closed
+// when ctx is cancelled or a read error occurs; the error channel receives
+// the error, if any, before closing.
+func (lr *LogReader) Follow(ctx context.Context, from Position) (<-chan *WALEntry, <-chan error) {
+	entries := make(chan *WALEntry, 64)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(entries)
+		defer close(errs)
+
+		if err := lr.follow(ctx, from, entries); err != nil && ctx.Err() == nil {
+			errs <- err
+		}
+	}()
+
+	return entries, errs
+}
+
+func (lr *LogReader) follow(ctx context.Context, pos Position, out chan<- *WALEntry) error {
+	for {
+		files, err := lr.Files()
+		if err != nil {
+			return err
+		}
+
+		if pos.File == "" && len(files) > 0 {
+			pos = Position{File: files[0]}
+		}
+
+		progressed := false
+		if pos.File != "" {
+			n, err := lr.readFrom(ctx, pos, out)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			pos.Offset += n
+			progressed = n > 0
+
+			// Move on once a newer file exists and this one has been read
+			// to the end; the writer never appends to a rotated file.
+			if !progressed {
+				if next := nextFile(files, pos.File); next != "" {
+					pos = Position{File: next}
+					continue
+				}
+			}
+		}
+
+		if progressed {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(FollowPollInterval):
+		}
+	}
+}
+
+// readFrom sends every complete entry after pos and returns the number of
+// bytes consumed. A trailing line without a newline is left for the next
+// call, since the writer may still be in the middle of it.
+func (lr *LogReader) readFrom(ctx context.Context, pos Position, out chan<- *WALEntry) (int64, error) {
+	file, err := os.Open(pos.File)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Seek(pos.Offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek log file: %w", err)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read log file: %w", err)
+	}
+
+	var consumed int64
+	for {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		line := data[:idx]
+		data = data[idx+1:]
+		lineOffset := pos.Offset + consumed
+		consumed += int64(idx + 1)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := &WALEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to parse WAL entry at %s offset %d: %v\n", pos.File, lineOffset, err)
+			continue
+		}
+
+		select {
+		case out <- entry:
+		case <-ctx.Done():
+			return consumed, ctx.Err()
+		}
+	}
+
+	return consumed, nil
+}
+
+// nextFile returns the first file that sorts after current, or "" if
+// current is the newest.
+func nextFile(files []string, current string) string {
+	for _, f := range files {
+		if f > current {
+			return f
+		}
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package wal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	FollowPollInterval = 10 * time.Millisecond
+}
+
+func receiveEntry(t *testing.T, entries <-chan *WALEntry) *WALEntry {
+	t.Helper()
+	select {
+	case entry, ok := <-entries:
+		if !ok {
+			t.Fatal("Follow channel closed unexpectedly")
+		}
+		return entry
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for followed entry")
+	}
+	return nil
+}
+
+func TestLogReader_FollowAcrossRotation(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	first := filepath.Join(tmpDir, "wal_20240101_120000.log")
+	if err := WriteFile(first, []*WALEntry{{ID: "test-1", Operation: OpInsert}}); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := NewLogReader(tmpDir)
+	entries, errs := reader.Follow(ctx, Position{})
+
+	if entry := receiveEntry(t, entries); entry.ID != "test-1" {
+		t.Errorf("Expected first entry test-1, got %s", entry.ID)
+	}
+
+	// Append a partial line: it must not be yielded until it is complete.
+	file, err := os.OpenFile(first, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log file: %v", err)
+	}
+	file.WriteString(`{"id":"test-2",`)
+	time.Sleep(50 * time.Millisecond)
+	file.WriteString(`"operation":"UPDATE"}` + "\n")
+	file.Close()
+
+	if entry := receiveEntry(t, entries); entry.ID != "test-2" || entry.Operation != OpUpdate {
+		t.Errorf("Expected completed entry test-2, got %+v", entry)
+	}
+
+	second := filepath.Join(tmpDir, "wal_20240101_130000.log")
+	if err := WriteFile(second, []*WALEntry{{ID: "test-3", Operation: OpDelete}}); err != nil {
+		t.Fatalf("Failed to write rotated log file: %v", err)
+	}
+
+	if entry := receiveEntry(t, entries); entry.ID != "test-3" {
+		t.Errorf("Expected entry from rotated file test-3, got %s", entry.ID)
+	}
+
+	cancel()
+	if err := <-errs; err != nil {
+		t.Errorf("Expected no error after cancel, got %v", err)
+	}
+}
+
+func TestLogReader_FollowFromEnd(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writer, err := NewLogWriter(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to create log writer: %v", err)
+	}
+	defer writer.Close()
+
+	writer.WriteEntry(&WALEntry{ID: "old", Operation: OpInsert})
+
+	reader := NewLogReader(tmpDir)
+	end, err := reader.End()
+	if err != nil {
+		t.Fatalf("Failed to get end position: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entries, _ := reader.Follow(ctx, end)
+
+	writer.WriteEntry(&WALEntry{ID: "new", Operation: OpInsert})
+
+	if entry := receiveEntry(t, entries); entry.ID != "new" {
+		t.Errorf("Expected only entries written after End, got %s", entry.ID)
+	}
+}
@@ -98,11 +98,26 @@ func NewLogReader(logPath string) *LogReader {
 	}
 }
 
-func (lr *LogReader) ReadAll() ([]*WALEntry, error) {
+// Files returns the paths of all log files in the log directory, in the
+// order ReadAll reads them.
+func (lr *LogReader) Files() ([]string, error) {
 	files, err := filepath.Glob(filepath.Join(lr.logPath, "wal_*.log"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to list log files: %w", err)
 	}
+	return files, nil
+}
+
+// ReadFile reads the entries of a single log file.
+func (lr *LogReader) ReadFile(filename string) ([]*WALEntry, error) {
+	return lr.readFile(filename)
+}
+
+func (lr *LogReader) ReadAll() ([]*WALEntry, error) {
+	files, err := lr.Files()
+	if err != nil {
+		return nil, err
+	}
 
 	entries := make([]*WALEntry, 0)
 
@@ -151,3 +166,33 @@ func (lr *LogReader) readFile(filename string) ([]*WALEntry, error) {
 
 	return entries, nil
 }
+
+// WriteFile writes entries to filename in the log format, replacing any
+// existing file. It is used to produce rewritten copies of a log file.
+func WriteFile(filename string, entries []*WALEntry) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("failed to create log file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return fmt.Errorf("failed to marshal entry: %w", err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			return fmt.Errorf("failed to write entry: %w", err)
+		}
+		if err := writer.WriteByte('\n'); err != nil {
+			return fmt.Errorf("failed to write newline: %w", err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush log file: %w", err)
+	}
+
+	return file.Sync()
+}
@@ -0,0 +1,81 @@
+package wal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseLSN parses a PostgreSQL LSN in its textual X/Y form.
+func ParseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("invalid LSN %q", s)
+	}
+
+	upper, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+	lower, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN %q: %w", s, err)
+	}
+
+	return upper<<32 | lower, nil
+}
+
+// FormatLSN formats an LSN in the X/Y form PostgreSQL uses.
+func FormatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", uint32(lsn>>32), uint32(lsn))
+}
+
+// Anchor is where an entry sits in the change stream: the commit LSN of
+// its transaction and its sequence number within the transaction, from 1.
+// Transactions are streamed in commit order, so anchors increase through
+// the log whatever files it is split into.
+type Anchor struct {
+	LSN uint64
+	Seq int
+}
+
+// Compare returns -1, 0 or 1 as a is before, at or after other.
+func (a Anchor) Compare(other Anchor) int {
+	switch {
+	case a.LSN < other.LSN:
+		return -1
+	case a.LSN > other.LSN:
+		return 1
+	case a.Seq < other.Seq:
+		return -1
+	case a.Seq > other.Seq:
+		return 1
+	}
+	return 0
+}
+
+func (a Anchor) String() string {
+	if a.Seq == 0 {
+		return FormatLSN(a.LSN)
+	}
+	return fmt.Sprintf("%s#%d", FormatLSN(a.LSN), a.Seq)
+}
+
+// Anchor returns the entry's anchor. Entries written before commit
+// LSNs were captured fall back to the LSN of the change itself with no
+// sequence number.
+func (w *WALEntry) Anchor() (Anchor, error) {
+	lsn := w.CommitLSN
+	if lsn == "" {
+		lsn = w.LSN
+	}
+	if lsn == "" {
+		return Anchor{}, fmt.Errorf("entry %s has no LSN", w.ID)
+	}
+
+	parsed, err := ParseLSN(lsn)
+	if err != nil {
+		return Anchor{}, fmt.Errorf("entry %s: %w", w.ID, err)
+	}
+	return Anchor{LSN: parsed, Seq: w.Seq}, nil
+}
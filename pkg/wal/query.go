@@ -0,0 +1,590 @@
+package wal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter is a compiled filter expression over WAL entries.
+//
+// An expression compares entry fields with literals and combines the
+// comparisons with and, or, not and parentheses:
+//
+//	table = "orders" and data.status = "failed" and op in (UPDATE, DELETE)
+//	lsn >= 0/16B3748 and time < "2024-01-05T10:00:00Z"
+//
+// Fields are op (or operation), schema, table, lsn, time (or timestamp),
+// xid (or txid), id, data.<column> and old.<column>. Operators are =, !=,
+// <, <=, >, >=, in (...) and not in (...). Literals are quoted strings,
+// bare words, numbers and null. LSNs compare by position, times by instant
+// and column values numerically when both sides are numbers.
+type Filter struct {
+	expr string
+	root node
+}
+
+// ParseFilter compiles a filter expression. An empty expression matches
+// every entry.
+func ParseFilter(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{expr: expr}
+	if len(tokens) == 0 {
+		return f, nil
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.peek().text, p.peek().pos)
+	}
+
+	f.root = root
+	return f, nil
+}
+
+// Match reports whether entry satisfies the filter. A nil filter matches
+// every entry.
+func (f *Filter) Match(entry *WALEntry) bool {
+	if f == nil || f.root == nil {
+		return true
+	}
+	return f.root.eval(entry)
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// SearchResult is one page of entries matching a filter.
+type SearchResult struct {
+	Entries    []*WALEntry `json:"entries"`
+	Total      int         `json:"total_count"`
+	Matched    int         `json:"matched"`
+	Offset     int         `json:"offset"`
+	NextOffset int         `json:"next_offset,omitempty"`
+}
+
+// Search returns the entries matching filter, oldest first, skipping the
+// first offset matches and returning at most limit of them. NextOffset is
+// set when more matches remain.
+func (lr *LogReader) Search(filter *Filter, offset, limit int) (*SearchResult, error) {
+	entries, err := lr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return SearchEntries(entries, filter, offset, limit), nil
+}
+
+// SearchEntries is Search over an already loaded slice of entries.
+func SearchEntries(entries []*WALEntry, filter *Filter, offset, limit int) *SearchResult {
+	result := &SearchResult{
+		Entries: make([]*WALEntry, 0),
+		Total:   len(entries),
+		Offset:  offset,
+	}
+
+	for _, entry := range entries {
+		if !filter.Match(entry) {
+			continue
+		}
+		if result.Matched >= offset && len(result.Entries) < limit {
+			result.Entries = append(result.Entries, entry)
+		}
+		result.Matched++
+	}
+
+	if next := offset + len(result.Entries); next < result.Matched {
+		result.NextOffset = next
+	}
+
+	return result
+}
+
+type node interface {
+	eval(entry *WALEntry) bool
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(e *WALEntry) bool { return n.left.eval(e) && n.right.eval(e) }
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(e *WALEntry) bool { return n.left.eval(e) || n.right.eval(e) }
+
+type notNode struct{ inner node }
+
+func (n *notNode) eval(e *WALEntry) bool { return !n.inner.eval(e) }
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindOperation
+	kindLSN
+	kindTime
+	kindNumber
+	kindColumn
+)
+
+type field struct {
+	name   string
+	kind   fieldKind
+	column string
+	old    bool
+}
+
+func resolveField(name string) (field, error) {
+	lower := strings.ToLower(name)
+	switch {
+	case lower == "op" || lower == "operation":
+		return field{name: name, kind: kindOperation}, nil
+	case lower == "schema" || lower == "table" || lower == "id" || lower == "session" || lower == "checkpoint":
+		return field{name: lower, kind: kindString}, nil
+	case lower == "lsn":
+		return field{name: lower, kind: kindLSN}, nil
+	case lower == "time" || lower == "timestamp":
+		return field{name: name, kind: kindTime}, nil
+	case lower == "xid" || lower == "txid":
+		return field{name: name, kind: kindNumber}, nil
+	case strings.HasPrefix(lower, "data.") && len(name) > len("data."):
+		return field{name: name, kind: kindColumn, column: name[len("data."):]}, nil
+	case strings.HasPrefix(lower, "old.") && len(name) > len("old."):
+		return field{name: name, kind: kindColumn, column: name[len("old."):], old: true}, nil
+	}
+	return field{}, fmt.Errorf("unknown field %q", name)
+}
+
+// value is a literal or an entry field value, pre-parsed for its kind.
+type value struct {
+	text  string
+	null  bool
+	num   float64
+	isNum bool
+	lsn   uint64
+	time  time.Time
+}
+
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"}
+
+func parseLiteral(f field, tok token) (value, error) {
+	if tok.kind == tokWord && strings.EqualFold(tok.text, "null") {
+		return value{null: true}, nil
+	}
+
+	v := value{text: tok.text}
+	switch f.kind {
+	case kindOperation:
+		v.text = strings.ToUpper(tok.text)
+	case kindLSN:
+		lsn, err := ParseLSN(tok.text)
+		if err != nil {
+			return v, err
+		}
+		v.lsn = lsn
+	case kindTime:
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, tok.text); err == nil {
+				v.time = t
+				return v, nil
+			}
+		}
+		return v, fmt.Errorf("invalid time %q", tok.text)
+	case kindNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return v, fmt.Errorf("invalid number %q for %s", tok.text, f.name)
+		}
+		v.num, v.isNum = n, true
+	case kindColumn:
+		if n, err := strconv.ParseFloat(tok.text, 64); err == nil {
+			v.num, v.isNum = n, true
+		}
+	}
+	return v, nil
+}
+
+func (f field) extract(e *WALEntry) value {
+	switch f.kind {
+	case kindOperation:
+		return value{text: string(e.Operation)}
+	case kindLSN:
+		lsn, err := ParseLSN(e.LSN)
+		if err != nil {
+			return value{null: true}
+		}
+		return value{text: e.LSN, lsn: lsn}
+	case kindTime:
+		return value{time: e.Timestamp}
+	case kindNumber:
+		return value{num: float64(e.TxID), isNum: true}
+	case kindColumn:
+		row := e.Data
+		if f.old {
+			row = e.OldData
+		}
+		raw, ok := row[f.column]
+		if !ok || raw == nil {
+			return value{null: true}
+		}
+		v := value{text: fmt.Sprint(raw)}
+		switch n := raw.(type) {
+		case float64:
+			v.num, v.isNum = n, true
+		case int:
+			v.num, v.isNum = float64(n), true
+		default:
+			if parsed, err := strconv.ParseFloat(v.text, 64); err == nil {
+				v.num, v.isNum = parsed, true
+			}
+		}
+		return v
+	}
+
+	switch f.name {
+	case "schema":
+		return value{text: e.Schema}
+	case "table":
+		return value{text: e.Table}
+	case "session":
+		return value{text: e.SessionID}
+	case "checkpoint":
+		return value{text: e.CheckpointID}
+	default:
+		return value{text: e.ID}
+	}
+}
+
+// compare returns -1, 0 or 1, and false when the values are not ordered
+// (one of them is null).
+func compare(kind fieldKind, a, b value) (int, bool) {
+	if a.null || b.null {
+		return 0, false
+	}
+
+	switch {
+	case kind == kindLSN:
+		return cmpOrdered(a.lsn, b.lsn), true
+	case kind == kindTime:
+		return a.time.Compare(b.time), true
+	case a.isNum && b.isNum:
+		return cmpOrdered(a.num, b.num), true
+	}
+	return strings.Compare(a.text, b.text), true
+}
+
+func cmpOrdered[T uint64 | float64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type cmpNode struct {
+	field  field
+	op     string
+	values []value
+}
+
+func (n *cmpNode) eval(e *WALEntry) bool {
+	actual := n.field.extract(e)
+
+	switch n.op {
+	case "in", "not in":
+		found := false
+		for _, v := range n.values {
+			if equal(n.field.kind, actual, v) {
+				found = true
+				break
+			}
+		}
+		return found == (n.op == "in")
+	case "=":
+		return equal(n.field.kind, actual, n.values[0])
+	case "!=":
+		return !equal(n.field.kind, actual, n.values[0])
+	}
+
+	c, ok := compare(n.field.kind, actual, n.values[0])
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func equal(kind fieldKind, a, b value) bool {
+	if a.null || b.null {
+		return a.null && b.null
+	}
+	c, _ := compare(kind, a, b)
+	return c == 0
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_./:-+", r)
+}
+
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case r == '"' || r == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for i < len(runes) && runes[i] != r {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+				i++
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokString, b.String(), start})
+		case strings.ContainsRune("=!<>", r):
+			start := i
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+				i++
+			}
+			i++
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at position %d", start)
+			}
+			if op == "==" {
+				op = "="
+			}
+			tokens = append(tokens, token{tokOp, op, start})
+		case isWordRune(r):
+			start := i
+			for i < len(runes) && isWordRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokWord, string(runes[start:i]), start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) done() bool { return p.pos >= len(p.tokens) }
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: -1, pos: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() (token, error) {
+	if p.done() {
+		return token{}, fmt.Errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	p.pos++
+	return tok, nil
+}
+
+func (p *parser) keyword(word string) bool {
+	tok := p.peek()
+	if tok.kind == tokWord && strings.EqualFold(tok.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.keyword("not") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.peek().kind == tokLParen {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, err := p.next(); err != nil || tok.kind != tokRParen {
+			return nil, fmt.Errorf("expected ')' at position %d", tok.pos)
+		}
+		return inner, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if tok.kind != tokWord {
+		return nil, fmt.Errorf("expected field name at position %d, got %q", tok.pos, tok.text)
+	}
+	f, err := resolveField(tok.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.keyword("in") {
+		return p.parseList(f, "in")
+	}
+	if p.keyword("not") {
+		if !p.keyword("in") {
+			return nil, fmt.Errorf("expected 'in' after 'not' at position %d", p.peek().pos)
+		}
+		return p.parseList(f, "not in")
+	}
+
+	opTok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if opTok.kind != tokOp {
+		return nil, fmt.Errorf("expected operator after %s at position %d", f.name, opTok.pos)
+	}
+
+	v, err := p.parseValue(f)
+	if err != nil {
+		return nil, err
+	}
+	return &cmpNode{field: f, op: opTok.text, values: []value{v}}, nil
+}
+
+func (p *parser) parseList(f field, op string) (node, error) {
+	if tok, err := p.next(); err != nil || tok.kind != tokLParen {
+		return nil, fmt.Errorf("expected '(' after %s", op)
+	}
+
+	n := &cmpNode{field: f, op: op}
+	for {
+		v, err := p.parseValue(f)
+		if err != nil {
+			return nil, err
+		}
+		n.values = append(n.values, v)
+
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.kind == tokRParen {
+			return n, nil
+		}
+		if tok.kind != tokComma {
+			return nil, fmt.Errorf("expected ',' or ')' at position %d", tok.pos)
+		}
+	}
+}
+
+func (p *parser) parseValue(f field) (value, error) {
+	tok, err := p.next()
+	if err != nil {
+		return value{}, err
+	}
+	if tok.kind != tokWord && tok.kind != tokString {
+		return value{}, fmt.Errorf("expected value at position %d, got %q", tok.pos, tok.text)
+	}
+	return parseLiteral(f, tok)
+}
@@ -0,0 +1,135 @@
+package wal
+
+import (
+	"testing"
+	"time"
+)
+
+func queryEntries() []*WALEntry {
+	base := time.Date(2024, 1, 5, 10, 0, 0, 0, time.UTC)
+	return []*WALEntry{
+		{ID: "e1", Timestamp: base, LSN: "0/100", TxID: 7, Operation: OpInsert, Schema: "public", Table: "orders",
+			Data: map[string]interface{}{"id": "42", "status": "new", "amount": "9.50"}},
+		{ID: "e2", Timestamp: base.Add(time.Minute), LSN: "0/200", TxID: 8, Operation: OpUpdate, Schema: "public", Table: "orders", SessionID: "s1",
+			Data: map[string]interface{}{"id": "42", "status": "failed", "amount": "12"}, OldData: map[string]interface{}{"id": "42"}},
+		{ID: "e3", Timestamp: base.Add(2 * time.Minute), LSN: "0/1000", TxID: 9, Operation: OpDelete, Schema: "public", Table: "orders", SessionID: "s1", CheckpointID: "c1",
+			OldData: map[string]interface{}{"id": "42"}},
+		{ID: "e4", Timestamp: base.Add(3 * time.Minute), LSN: "1/0", TxID: 9, Operation: OpInsert, Schema: "billing", Table: "invoices",
+			Data: map[string]interface{}{"id": "1", "note": nil}},
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected []string
+	}{
+		{``, []string{"e1", "e2", "e3", "e4"}},
+		{`table = "orders" and data.status = "failed" and op in (UPDATE, DELETE)`, []string{"e2"}},
+		{`op in (update, delete)`, []string{"e2", "e3"}},
+		{`op not in (INSERT)`, []string{"e2", "e3"}},
+		{`data.id = 42 or old.id = 42`, []string{"e1", "e2", "e3"}},
+		{`data.amount > 10`, []string{"e2"}},
+		{`lsn >= 0/200 and lsn < 1/0`, []string{"e2", "e3"}},
+		{`time > "2024-01-05T10:01:30Z"`, []string{"e3", "e4"}},
+		{`xid = 9 and schema != public`, []string{"e4"}},
+		{`data.note = null and table = invoices`, []string{"e4"}},
+		{`not (table = orders) or id = 'e1'`, []string{"e1", "e4"}},
+		{`session = s1 and checkpoint != c1`, []string{"e2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			filter, err := ParseFilter(tt.expr)
+			if err != nil {
+				t.Fatalf("Failed to parse filter: %v", err)
+			}
+
+			var matched []string
+			for _, entry := range queryEntries() {
+				if filter.Match(entry) {
+					matched = append(matched, entry.ID)
+				}
+			}
+
+			if len(matched) != len(tt.expected) {
+				t.Fatalf("Expected %v, got %v", tt.expected, matched)
+			}
+			for i := range matched {
+				if matched[i] != tt.expected[i] {
+					t.Fatalf("Expected %v, got %v", tt.expected, matched)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilter_Errors(t *testing.T) {
+	tests := []string{
+		`table =`,
+		`color = red`,
+		`lsn > banana`,
+		`time < "yesterday"`,
+		`op in (INSERT`,
+		`table = "orders`,
+		`(table = orders`,
+		`table = orders extra`,
+	}
+
+	for _, expr := range tests {
+		if _, err := ParseFilter(expr); err == nil {
+			t.Errorf("Expected error for %q", expr)
+		}
+	}
+}
+
+func TestSearchEntries_Pagination(t *testing.T) {
+	filter, _ := ParseFilter(`table = orders`)
+
+	page := SearchEntries(queryEntries(), filter, 0, 2)
+	if page.Matched != 3 || len(page.Entries) != 2 || page.NextOffset != 2 {
+		t.Errorf("Unexpected first page: matched=%d returned=%d next=%d", page.Matched, len(page.Entries), page.NextOffset)
+	}
+
+	page = SearchEntries(queryEntries(), filter, page.NextOffset, 2)
+	if len(page.Entries) != 1 || page.Entries[0].ID != "e3" || page.NextOffset != 0 {
+		t.Errorf("Unexpected last page: %+v", page)
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	lsn, err := ParseLSN("16/B374D848")
+	if err != nil {
+		t.Fatalf("Failed to parse LSN: %v", err)
+	}
+	if FormatLSN(lsn) != "16/B374D848" {
+		t.Errorf("Expected round trip, got %s", FormatLSN(lsn))
+	}
+
+	if _, err := ParseLSN("16B374D848"); err == nil {
+		t.Error("Expected error for LSN without separator")
+	}
+}
+
+func TestWALEntry_Anchor(t *testing.T) {
+	entry := &WALEntry{ID: "e1", LSN: "0/8", CommitLSN: "0/10", Seq: 2}
+	anchor, err := entry.Anchor()
+	if err != nil {
+		t.Fatalf("Failed to get anchor: %v", err)
+	}
+	if anchor.String() != "0/10#2" {
+		t.Errorf("Expected 0/10#2, got %s", anchor)
+	}
+
+	legacy, err := (&WALEntry{ID: "e0", LSN: "0/20"}).Anchor()
+	if err != nil {
+		t.Fatalf("Failed to get anchor: %v", err)
+	}
+	if legacy.Compare(anchor) != 1 || anchor.Compare(legacy) != -1 {
+		t.Errorf("Expected %s after %s", legacy, anchor)
+	}
+
+	if _, err := (&WALEntry{ID: "e2"}).Anchor(); err == nil {
+		t.Error("Expected error for entry without LSN")
+	}
+}
@@ -0,0 +1,72 @@
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StatusFile is the file in the log directory where the listener records
+// how far it has captured the change stream.
+const StatusFile = "listener_status.json"
+
+// Status is how far the listener has captured the change stream.
+type Status struct {
+	// FlushedLSN is the position up to which every transaction has been
+	// written to the log.
+	FlushedLSN string    `json:"flushed_lsn"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// WriteStatus records status in the log directory. The file is replaced
+// atomically, since it is polled by other processes.
+func WriteStatus(logPath string, status *Status) error {
+	filename := filepath.Join(logPath, StatusFile)
+	tmp := filename + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create status file: %w", err)
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(status); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to encode status: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync status file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close status file: %w", err)
+	}
+
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("failed to replace status file: %w", err)
+	}
+	return nil
+}
+
+// ReadStatus returns the status recorded in the log directory. It returns
+// an error satisfying os.IsNotExist when no listener has recorded one.
+func ReadStatus(logPath string) (*Status, error) {
+	data, err := os.ReadFile(filepath.Join(logPath, StatusFile))
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{}
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, fmt.Errorf("failed to parse status file: %w", err)
+	}
+	return status, nil
+}
+
+// Flushed returns the flushed position.
+func (s *Status) Flushed() (uint64, error) {
+	return ParseLSN(s.FlushedLSN)
+}
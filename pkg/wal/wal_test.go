@@ -61,6 +61,32 @@ func TestFromJSON(t *testing.T) {
 	}
 }
 
+func TestWALEntry_Committed(t *testing.T) {
+	entry, err := FromJSON([]byte(`{"id": "e1", "timestamp": "2024-01-01T12:00:05Z", "commit_time": "2024-01-01T12:00:00Z"}`))
+	if err != nil {
+		t.Fatalf("Failed to parse JSON: %v", err)
+	}
+	if want := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC); !entry.Committed().Equal(want) {
+		t.Errorf("Expected the commit time %v, got %v", want, entry.Committed())
+	}
+
+	entry.CommitTime = nil
+	if !entry.Committed().Equal(entry.Timestamp) {
+		t.Errorf("Expected the capture time without a commit time, got %v", entry.Committed())
+	}
+}
+
+func TestMergeRows(t *testing.T) {
+	prev := map[string]interface{}{"id": "1", "note": "old", "blob": "toasted"}
+	merged := MergeRows(prev, map[string]interface{}{"id": "1", "note": nil})
+	if len(merged) != 3 || merged["note"] != nil || merged["blob"] != "toasted" {
+		t.Errorf("Expected note cleared and blob kept, got %v", merged)
+	}
+	if prev["note"] != "old" {
+		t.Errorf("Expected prev to be left unchanged, got %v", prev)
+	}
+}
+
 func TestLogWriter_WriteEntry(t *testing.T) {
 	tmpDir := t.TempDir()
 
@@ -236,3 +262,29 @@ func TestLogWriterConcurrentWrites(t *testing.T) {
 		t.Error("Expected log files to be created")
 	}
 }
+
+func TestStatus_RoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if _, err := ReadStatus(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("Expected not-exist error without a status file, got %v", err)
+	}
+
+	if err := WriteStatus(tmpDir, &Status{FlushedLSN: "0/1A0", UpdatedAt: time.Now()}); err != nil {
+		t.Fatalf("Failed to write status: %v", err)
+	}
+	status, err := ReadStatus(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read status: %v", err)
+	}
+	flushed, err := status.Flushed()
+	if err != nil || flushed != 0x1A0 {
+		t.Errorf("Expected flushed 0/1A0, got %d (%v)", flushed, err)
+	}
+
+	// The status file must not be read as a log file.
+	entries, err := NewLogReader(tmpDir).ReadAll()
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries, got %d (%v)", len(entries), err)
+	}
+}